@@ -0,0 +1,46 @@
+-- ----------------------------
+-- mall-search-go 自己使用的表，服务启动时不存在的表会自动创建
+-- ----------------------------
+
+-- ----------------------------
+-- Table structure for es_import_job
+-- ----------------------------
+CREATE TABLE IF NOT EXISTS `es_import_job` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `phase` varchar(16) NOT NULL COMMENT '任务阶段：PREPARING,INDEXING,VERIFYING,SWITCHING,SUCCEEDED,FAILED,CANCELLED,INTERRUPTED',
+  `processed` bigint(20) DEFAULT NULL COMMENT '已读取并提交给ES的商品数',
+  `total` bigint(20) DEFAULT NULL COMMENT '任务开始时可搜索的商品数',
+  `index` varchar(64) DEFAULT NULL COMMENT '写入的索引',
+  `indexed` bigint(20) DEFAULT NULL,
+  `failed` bigint(20) DEFAULT NULL,
+  `failures` text COMMENT '写入失败的商品及原因(JSON)',
+  `error` text,
+  `created_at` datetime(3) DEFAULT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  `finished_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_es_import_job_phase` (`phase`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='搜索全量导入任务';
+
+-- ----------------------------
+-- Table structure for es_cdc_checkpoint
+-- ----------------------------
+CREATE TABLE IF NOT EXISTS `es_cdc_checkpoint` (
+  `name` varchar(64) NOT NULL COMMENT '消费者名称，即 spring.application.name；<名称>:replay 是未持有同步锁的实例请求重放的位置',
+  `file` varchar(255) NOT NULL COMMENT 'binlog文件名',
+  `pos` int(10) unsigned NOT NULL COMMENT '下一个事件在binlog文件中的偏移',
+  `updated_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='binlog增量同步的检查点';
+
+-- ----------------------------
+-- Table structure for es_synonym_version
+-- ----------------------------
+CREATE TABLE IF NOT EXISTS `es_synonym_version` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT COMMENT '版本号，由服务在修改索引之前写入为上一个版本号加一，主键冲突表示并发修改，写入索引失败时删除',
+  `rules` text COMMENT '同义词规则(JSON)，Solr格式',
+  `stop_words` text COMMENT '停用词(JSON)',
+  `comment` varchar(255) DEFAULT NULL COMMENT '这个版本做了什么修改',
+  `created_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='搜索同义词和停用词的版本';
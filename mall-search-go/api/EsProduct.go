@@ -1,10 +1,14 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"mall-search-go/model"
 	"mall-search-go/service"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 type EsProductController struct {
@@ -19,33 +23,18 @@ func (ctrl *EsProductController) RegisterRoutes(router *gin.Engine) {
 
 	esProductGroup := router.Group("/esProduct")
 
-	esProductGroup.POST("/importAll", ctrl.ImportAllList)
 	esProductGroup.GET("/delete/:id", ctrl.Delete)
 	esProductGroup.POST("/delete/batch", ctrl.DeleteBatch)
 	esProductGroup.POST("/create/:id", ctrl.Create)
 	esProductGroup.GET("/search/simple", ctrl.SearchSimple)
 	esProductGroup.GET("/search", ctrl.Search)
+	esProductGroup.GET("/export", ctrl.Export)
 	esProductGroup.GET("/recommend/:id", ctrl.Recommend)
 	esProductGroup.GET("/search/relate", ctrl.SearchRelatedInfo)
-}
-
-// @Summary Import all products to Elasticsearch
-// @Description Import all products from the database to Elasticsearch
-// @Tags esProduct
-// @Accept  json
-// @Produce json
-// @Success 200 {object} map[string]interface{}
-// @Failure 400 {object} map[string]interface{}
-// @Failure 500 {object} map[string]interface{}
-// @Router /esProduct/importAll [post]
-func (ctrl *EsProductController) ImportAllList(c *gin.Context) {
-	count, err := ctrl.Service.ImportAll()
-	if err != nil {
-		res := Failed("Failed to import" + err.Error())
-		c.JSON(http.StatusBadRequest, res)
-		return
-	}
-	c.JSON(http.StatusOK, Success(count))
+	esProductGroup.GET("/suggest", ctrl.Suggest)
+	esProductGroup.GET("/mapping/drift", ctrl.MappingDrift)
+	esProductGroup.GET("/index/generations", ctrl.Generations)
+	esProductGroup.POST("/index/rollback", ctrl.Rollback)
 }
 
 // @Summary Delete a product in Elasticsearch by ID
@@ -108,7 +97,7 @@ func (ctrl *EsProductController) DeleteBatch(c *gin.Context) {
 // @Param  id   path   int64  true  "Database Product ID"
 // @Success 200 {object} map[string]interface{}
 // @Failure 400 {object} map[string]interface{}
-// @Failure 500 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
 // @Router /esProduct/create/{id} [post]
 func (ctrl *EsProductController) Create(c *gin.Context) {
 	idStr, _ := c.Params.Get("id")
@@ -121,29 +110,43 @@ func (ctrl *EsProductController) Create(c *gin.Context) {
 	product, err := ctrl.Service.Create(id)
 	if err != nil {
 		res := Failed("Failed to create product" + err.Error())
-		c.JSON(http.StatusBadRequest, res)
+		c.JSON(productErrorStatus(err), res)
 		return
 	}
 	c.JSON(http.StatusOK, Success(product))
 }
 
 // @Summary Simple search in Elasticsearch
-// @Description Search products by name, subtitle, or keywords
+// @Description Search products by name, subtitle, or keywords. With few or no results a corrected keyword is returned as Suggestion
+// @Description The keyword also matches the pinyin and pinyin initials of name, brand and category, e.g. xiaomi or hwsj
 // @Tags esProduct
 // @Accept  json
 // @Produce json
 // @Param  keyword   query   string  true  "Keyword for search"
-// @Param  pageNum   query   int     false "Page number"
+// @Param  pageNum   query   int     false "Page number, starting from 1"
 // @Param  pageSize  query   int     false "Number of items per page"
+// @Param  cursor    query   string  false "PageInfo.Cursor of the previous page of the same search, replaces pageNum and pageSize"
+// @Param  highlight query   bool    false "Return highlighted fragments of name, subTitle and keywords"
+// @Param  autoCorrect query bool    false "Return the results of the corrected keyword when it finds more products"
 // @Success 200 {object} map[string]interface{}
 // @Failure 400 {object} map[string]interface{}
 // @Failure 500 {object} map[string]interface{}
 // @Router /esProduct/search/simple [get]
 func (ctrl *EsProductController) SearchSimple(c *gin.Context) {
 	keyword := c.Query("keyword")
-	pageNum, _ := strconv.Atoi(c.Query("pageNum"))
-	pageSize, _ := strconv.Atoi(c.Query("pageSize"))
-	result, err := ctrl.Service.SearchByNameOrSubTitleOrKeywords(keyword, pageNum, pageSize)
+	pageNum, _ := strconv.Atoi(c.DefaultQuery("pageNum", "0"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "5"))
+	highlight, err := optionalBool(c, "highlight")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ValidateFailed(err.Error()))
+		return
+	}
+	autoCorrect, err := optionalBool(c, "autoCorrect")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ValidateFailed(err.Error()))
+		return
+	}
+	result, err := ctrl.Service.SearchByNameOrSubTitleOrKeywords(keyword, pageNum, pageSize, c.Query("cursor"), highlight, autoCorrect)
 	if err != nil {
 		res := Failed("Failed to search" + err.Error())
 		c.JSON(http.StatusBadRequest, res)
@@ -154,31 +157,40 @@ func (ctrl *EsProductController) SearchSimple(c *gin.Context) {
 }
 
 // @Summary Detailed search in Elasticsearch
-// @Description Search products by multiple criteria
+// @Description Search products by keyword and filter them by brand, category, price, status, promotion and stock
+// @Description The keyword must match name, subTitle or keywords. Pinyin (xiaomi) and pinyin initials (hwsj) only rank the results:
+// @Description a product matched by pinyin alone scores below the minimum score and is not returned. Use /esProduct/search/simple to search by pinyin
 // @Tags esProduct
 // @Accept  json
 // @Produce json
-// @Param  keyword              query   string  false "Keyword for search"
+// @Param  keyword              query   string  false "Keyword for search, matched against name, subTitle and keywords; pinyin alone does not match"
 // @Param  brandId              query   int64   false "Brand ID"
 // @Param  productCategoryId    query   int64   false "Product Category ID"
-// @Param  pageNum              query   int     false "Page number"
+// @Param  minPrice             query   number  false "Minimum price, inclusive"
+// @Param  maxPrice             query   number  false "Maximum price, inclusive"
+// @Param  newStatus            query   int     false "New product status (0 or 1)"
+// @Param  recommandStatus      query   int     false "Recommended product status (0 or 1)"
+// @Param  promotionType        query   int     false "Promotion type"
+// @Param  inStock              query   bool    false "Only products in stock"
+// @Param  attr                 query   []string false "Attribute filter <attrId>:<value1>,<value2>, repeatable" collectionFormat(multi)
+// @Param  facets               query   bool    false "Also return brand, category, attribute and price facets with counts"
+// @Param  highlight            query   bool    false "Return highlighted fragments of name, subTitle and keywords"
+// @Param  pageNum              query   int     false "Page number, starting from 1"
 // @Param  pageSize             query   int     false "Number of items per page"
+// @Param  cursor               query   string  false "PageInfo.Cursor of the previous page of the same search, replaces pageNum and pageSize"
 // @Param  sort                 query   int     false "Sort order"
 // @Success 200 {object} map[string]interface{}
 // @Failure 400 {object} map[string]interface{}
 // @Failure 500 {object} map[string]interface{}
 // @Router /esProduct/search [get]
 func (ctrl *EsProductController) Search(c *gin.Context) {
-	keyword := c.DefaultQuery("keyword", "")
-	brandIdStr := c.DefaultQuery("brandId", "0")
-	brandId, _ := strconv.ParseInt(brandIdStr, 10, 64)
-	productCategoryIdStr := c.DefaultQuery("productCategoryId", "0")
-	productCategoryId, _ := strconv.ParseInt(productCategoryIdStr, 10, 64)
-	pageNum, _ := strconv.Atoi(c.DefaultQuery("pageNum", "0"))
-	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "5"))
-	sort, _ := strconv.Atoi(c.DefaultQuery("sort", "0"))
+	criteria, err := searchCriteria(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ValidateFailed(err.Error()))
+		return
+	}
 
-	result, err := ctrl.Service.SearchByProductCategoryId(keyword, &brandId, &productCategoryId, pageNum, pageSize, sort)
+	result, err := ctrl.Service.SearchByCriteria(criteria)
 	if err != nil {
 		res := Failed("Failed to search" + err.Error())
 		c.JSON(http.StatusBadRequest, res)
@@ -188,17 +200,69 @@ func (ctrl *EsProductController) Search(c *gin.Context) {
 
 }
 
+// productErrorStatus 商品不存在时返回 404，其他错误与以前一样返回 400
+func productErrorStatus(err error) int {
+	if errors.Is(err, service.ErrProductNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// searchCriteria 从查询参数中读取搜索条件，不传的筛选条件不过滤
+func searchCriteria(c *gin.Context) (model.SearchCriteria, error) {
+	criteria := model.SearchCriteria{Keyword: c.Query("keyword")}
+	var err error
+	for _, p := range []struct {
+		name  string
+		value **int64
+	}{
+		{"brandId", &criteria.BrandId},
+		{"productCategoryId", &criteria.ProductCategoryId},
+		{"newStatus", &criteria.NewStatus},
+		{"recommandStatus", &criteria.RecommandStatus},
+		{"promotionType", &criteria.PromotionType},
+	} {
+		if *p.value, err = optionalInt64(c, p.name); err != nil {
+			return criteria, err
+		}
+	}
+	if criteria.MinPrice, err = optionalDecimal(c, "minPrice"); err != nil {
+		return criteria, err
+	}
+	if criteria.MaxPrice, err = optionalDecimal(c, "maxPrice"); err != nil {
+		return criteria, err
+	}
+	if criteria.InStock, err = optionalBool(c, "inStock"); err != nil {
+		return criteria, err
+	}
+	if criteria.Facets, err = optionalBool(c, "facets"); err != nil {
+		return criteria, err
+	}
+	if criteria.Highlight, err = optionalBool(c, "highlight"); err != nil {
+		return criteria, err
+	}
+	if criteria.Attrs, err = attrFilters(c.QueryArray("attr")); err != nil {
+		return criteria, err
+	}
+	criteria.PageNum, _ = strconv.Atoi(c.DefaultQuery("pageNum", "0"))
+	criteria.PageSize, _ = strconv.Atoi(c.DefaultQuery("pageSize", "5"))
+	criteria.Cursor = c.Query("cursor")
+	criteria.Sort, _ = strconv.Atoi(c.DefaultQuery("sort", "0"))
+	return criteria, criteria.Validate()
+}
+
 // @Summary Recommend products
 // @Description Recommend products based on a specific product ID
 // @Tags esProduct
 // @Accept  json
 // @Produce json
 // @Param  id       path   int64  true  "Product ID"
-// @Param  pageNum  query   int     false "Page number"
+// @Param  pageNum  query   int     false "Page number, starting from 1"
 // @Param  pageSize query   int     false "Number of items per page"
+// @Param  cursor   query   string  false "PageInfo.Cursor of the previous page of the same search, replaces pageNum and pageSize"
 // @Success 200 {object} map[string]interface{}
 // @Failure 400 {object} map[string]interface{}
-// @Failure 500 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
 // @Router /esProduct/recommend/{id} [get]
 func (ctrl *EsProductController) Recommend(c *gin.Context) {
 	idStr, _ := c.Params.Get("id")
@@ -209,10 +273,10 @@ func (ctrl *EsProductController) Recommend(c *gin.Context) {
 	}
 	pageNum, _ := strconv.Atoi(c.DefaultQuery("pageNum", "0"))
 	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "5"))
-	result, err := ctrl.Service.Recommend(id, pageNum, pageSize)
+	result, err := ctrl.Service.Recommend(id, pageNum, pageSize, c.Query("cursor"))
 	if err != nil {
 		res := Failed("Failed to Recommend" + err.Error())
-		c.JSON(http.StatusBadRequest, res)
+		c.JSON(productErrorStatus(err), res)
 		return
 	}
 	c.JSON(http.StatusOK, Success(result))
@@ -238,3 +302,155 @@ func (ctrl *EsProductController) SearchRelatedInfo(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, Success(result))
 }
+
+// @Summary Search-as-you-type suggestions
+// @Description Complete a prefix with product names, brands, categories and keywords, highest weight first
+// @Tags esProduct
+// @Produce json
+// @Param  prefix             query   string  true  "Text typed so far"
+// @Param  productCategoryId  query   int64   false "Only suggest products of this category"
+// @Param  size               query   int     false "Number of suggestions, at most search.suggest.size"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{}
+// @Router /esProduct/suggest [get]
+func (ctrl *EsProductController) Suggest(c *gin.Context) {
+	prefix := strings.TrimSpace(c.Query("prefix"))
+	categoryId, err := optionalInt64(c, "productCategoryId")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ValidateFailed(err.Error()))
+		return
+	}
+	size, _ := strconv.Atoi(c.Query("size"))
+	//还没有输入时没有可提示的内容，不查询ES
+	if prefix == "" {
+		c.JSON(http.StatusOK, Success([]model.Suggestion{}))
+		return
+	}
+	result, err := ctrl.Service.Suggest(prefix, categoryId, size)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Failed("Failed to suggest"+err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, Success(result))
+}
+
+// @Summary List index generations
+// @Description List the versioned indices behind the search alias, newest first
+// @Tags esProduct
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /esProduct/index/generations [get]
+func (ctrl *EsProductController) Generations(c *gin.Context) {
+	result, err := ctrl.Service.Generations(c.Request.Context())
+	if err != nil {
+		res := Failed("Failed to list generations" + err.Error())
+		c.JSON(http.StatusBadRequest, res)
+		return
+	}
+	c.JSON(http.StatusOK, Success(result))
+}
+
+// @Summary Roll back to the previous index generation
+// @Description Switch the search alias back to the generation before the active one
+// @Description The active synonyms are kept; use /esProduct/admin/synonyms/rollback/{version} to roll back synonyms
+// @Tags esProduct
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /esProduct/index/rollback [post]
+func (ctrl *EsProductController) Rollback(c *gin.Context) {
+	index, err := ctrl.Service.Rollback(c.Request.Context())
+	if err != nil {
+		res := Failed("Failed to roll back" + err.Error())
+		c.JSON(http.StatusBadRequest, res)
+		return
+	}
+	c.JSON(http.StatusOK, Success(index))
+}
+
+// @Summary Check index mapping drift
+// @Description List fields whose mapping in Elasticsearch differs from the managed index template
+// @Tags esProduct
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /esProduct/mapping/drift [get]
+func (ctrl *EsProductController) MappingDrift(c *gin.Context) {
+	result, err := ctrl.Service.MappingDrift(c.Request.Context())
+	if err != nil {
+		res := Failed("Failed to check mapping" + err.Error())
+		c.JSON(http.StatusBadRequest, res)
+		return
+	}
+	c.JSON(http.StatusOK, Success(result))
+}
+
+// optionalInt64 读取可选的整数查询参数，参数不存在或为空时返回 nil
+func optionalInt64(c *gin.Context, name string) (*int64, error) {
+	str := c.Query(name)
+	if str == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", name, str)
+	}
+	return &v, nil
+}
+
+// optionalDecimal 读取可选的金额参数，参数不存在或为空时返回 ""
+func optionalDecimal(c *gin.Context, name string) (model.Decimal, error) {
+	str := c.Query(name)
+	d, err := model.ParseDecimal(str)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q", name, str)
+	}
+	return d, nil
+}
+
+// attrFilters 解析 attr=<attrId>:<value1>,<value2> 参数，同一属性出现多次时合并它的值
+func attrFilters(params []string) ([]model.AttrFilter, error) {
+	var filters []model.AttrFilter
+	index := make(map[int64]int)
+	for _, param := range params {
+		idStr, valueList := param, ""
+		if i := strings.Index(param, ":"); i >= 0 {
+			idStr, valueList = param[:i], param[i+1:]
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attr %q, want <attrId>:<value1>,<value2>", param)
+		}
+		var values []string
+		for _, v := range strings.Split(valueList, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("attr %q has no values", param)
+		}
+		if i, ok := index[id]; ok {
+			filters[i].Values = append(filters[i].Values, values...)
+			continue
+		}
+		index[id] = len(filters)
+		filters = append(filters, model.AttrFilter{AttrId: id, Values: values})
+	}
+	return filters, nil
+}
+
+// optionalBool 读取可选的布尔参数，参数不存在或为空时返回 false
+func optionalBool(c *gin.Context, name string) (bool, error) {
+	str := c.Query(name)
+	if str == "" {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", name, str)
+	}
+	return v, nil
+}
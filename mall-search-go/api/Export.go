@@ -0,0 +1,172 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"mall-search-go/model"
+)
+
+// productWriter 把导出的商品逐条写入响应，Flush 在每批结束时把缓冲的内容写出
+type productWriter interface {
+	Write(p model.EsProduct) error
+	Flush() error
+}
+
+// exportFormat 是一种导出格式，newWriter 在写出第一批商品前调用，可以先写入表头
+type exportFormat struct {
+	contentType string
+	newWriter   func(w io.Writer) (productWriter, error)
+}
+
+var exportFormats = map[string]exportFormat{
+	"ndjson": {"application/x-ndjson", newNDJSONWriter},
+	"csv":    {"text/csv; charset=utf-8", newCSVWriter},
+}
+
+// ndjsonWriter 每行一个商品，字段与搜索接口返回的相同
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) (productWriter, error) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &ndjsonWriter{enc: enc}, nil
+}
+
+func (w *ndjsonWriter) Write(p model.EsProduct) error {
+	return w.enc.Encode(p)
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return nil
+}
+
+// csvColumns 是 CSV 的表头，属性值合并为一列 “属性名:值;属性名:值”
+var csvColumns = []string{
+	"id", "productSn", "name", "subTitle", "keywords", "brandId", "brandName", "productCategoryId", "productCategoryName",
+	"price", "sale", "stock", "newStatus", "recommandStatus", "promotionType", "sort", "pic", "attrValues",
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+// newCSVWriter 先写入 UTF-8 BOM 和表头，Excel 打开时中文才不会乱码
+func newCSVWriter(w io.Writer) (productWriter, error) {
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return nil, err
+	}
+	cw := &csvWriter{w: csv.NewWriter(w), record: make([]string, len(csvColumns))}
+	return cw, cw.w.Write(csvColumns)
+}
+
+func (w *csvWriter) Write(p model.EsProduct) error {
+	attrs := make([]string, len(p.AttrValueList))
+	for i, a := range p.AttrValueList {
+		attrs[i] = a.Name + ":" + a.Value
+	}
+	i64 := func(v int64) string { return strconv.FormatInt(v, 10) }
+	copy(w.record, []string{
+		i64(p.ID), p.ProductSn, p.Name, p.SubTitle, p.Keywords, i64(p.BrandId), p.BrandName, i64(p.ProductCategoryId), p.ProductCategoryName,
+		string(p.Price), i64(p.Sale), i64(p.Stock), i64(p.NewStatus), i64(p.RecommandStatus), i64(p.PromotionType), i64(p.Sort), p.Pic,
+		strings.Join(attrs, ";"),
+	})
+	return w.w.Write(w.record)
+}
+
+func (w *csvWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// @Summary Export search results
+// @Description Stream every product matching the search criteria as NDJSON or CSV without paging.
+// @Description The response is chunked; the X-Export-Count and X-Export-Status trailers tell whether it finished
+// @Tags esProduct
+// @Produce application/x-ndjson,text/csv
+// @Param  format               query   string  false "ndjson (default) or csv"
+// @Param  keyword              query   string  false "Keyword for search"
+// @Param  brandId              query   int64   false "Brand ID"
+// @Param  productCategoryId    query   int64   false "Product Category ID"
+// @Param  minPrice             query   number  false "Minimum price, inclusive"
+// @Param  maxPrice             query   number  false "Maximum price, inclusive"
+// @Param  newStatus            query   int     false "New product status (0 or 1)"
+// @Param  recommandStatus      query   int     false "Recommended product status (0 or 1)"
+// @Param  promotionType        query   int     false "Promotion type"
+// @Param  inStock              query   bool    false "Only products in stock"
+// @Param  attr                 query   []string false "Attribute filter <attrId>:<value1>,<value2>, repeatable" collectionFormat(multi)
+// @Param  sort                 query   int     false "Sort order"
+// @Success 200 {string} string
+// @Failure 400 {object} map[string]interface{}
+// @Router /esProduct/export [get]
+func (ctrl *EsProductController) Export(c *gin.Context) {
+	name := c.DefaultQuery("format", "ndjson")
+	format, ok := exportFormats[name]
+	if !ok {
+		c.JSON(http.StatusBadRequest, ValidateFailed("format must be ndjson or csv"))
+		return
+	}
+	criteria, err := searchCriteria(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ValidateFailed(err.Error()))
+		return
+	}
+
+	//第一批商品到达时才写响应头，在此之前失败还可以返回普通的错误响应；
+	//之后失败时状态码已经发出，只能通过 trailer 告诉客户端导出不完整
+	var writer productWriter
+	started, count := false, 0
+	start := func() (err error) {
+		started = true
+		c.Header("Content-Type", format.contentType)
+		c.Header("Content-Disposition", `attachment; filename="products.`+name+`"`)
+		c.Header("Trailer", "X-Export-Count, X-Export-Status")
+		c.Status(http.StatusOK)
+		writer, err = format.newWriter(c.Writer)
+		return err
+	}
+	err = ctrl.Service.Export(c.Request.Context(), criteria, func(products []model.EsProduct) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		for _, p := range products {
+			if err := writer.Write(p); err != nil {
+				return err
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		count += len(products)
+		c.Writer.Flush()
+		return nil
+	})
+	//没有匹配的商品时也返回表头
+	if err == nil && !started {
+		if err = start(); err == nil {
+			err = writer.Flush()
+		}
+	}
+	if !started {
+		c.JSON(http.StatusBadRequest, Failed("Failed to export"+err.Error()))
+		return
+	}
+	status := "complete"
+	if err != nil {
+		log.Printf("Export stopped after %d products: %s", count, err)
+		status = "failed"
+	}
+	c.Writer.Header().Set("X-Export-Count", strconv.Itoa(count))
+	c.Writer.Header().Set("X-Export-Status", status)
+}
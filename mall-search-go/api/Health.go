@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"mall-search-go/health"
+)
+
+// HealthController 提供与 Spring Boot actuator 兼容的健康检查端点，供 k8s 探针、网关和 mall-monitor 使用
+type HealthController struct {
+	Readiness map[string]health.Indicator
+
+	mu      sync.RWMutex
+	timeout time.Duration
+}
+
+func NewHealthController(readiness map[string]health.Indicator, timeout time.Duration) *HealthController {
+	return &HealthController{Readiness: readiness, timeout: timeout}
+}
+
+// SetTimeout 修改单个健康检查的超时时间，配置中心推送新配置时调用
+func (ctrl *HealthController) SetTimeout(timeout time.Duration) {
+	ctrl.mu.Lock()
+	defer ctrl.mu.Unlock()
+	ctrl.timeout = timeout
+}
+
+func (ctrl *HealthController) Timeout() time.Duration {
+	ctrl.mu.RLock()
+	defer ctrl.mu.RUnlock()
+	return ctrl.timeout
+}
+
+func (ctrl *HealthController) RegisterRoutes(router *gin.Engine) {
+
+	healthGroup := router.Group("/actuator/health")
+
+	healthGroup.GET("", ctrl.Health)
+	healthGroup.GET("/liveness", ctrl.Liveness)
+	healthGroup.GET("/readiness", ctrl.ReadinessCheck)
+}
+
+// @Summary Overall health
+// @Description Health of MySQL, Elasticsearch and the search index in Spring Boot actuator format
+// @Tags actuator
+// @Produce json
+// @Success 200 {object} health.Health
+// @Failure 503 {object} health.Health
+// @Router /actuator/health [get]
+func (ctrl *HealthController) Health(c *gin.Context) {
+	result := health.Check(c.Request.Context(), ctrl.Readiness, ctrl.Timeout())
+	result.Components["livenessState"] = health.Health{Status: health.StatusUp}
+	result.Components["readinessState"] = health.Health{Status: result.Status}
+	result.Components["ping"] = health.Health{Status: health.StatusUp}
+	result.Groups = []string{"liveness", "readiness"}
+	writeHealth(c, result)
+}
+
+// @Summary Liveness probe
+// @Description Reports UP while the process is able to serve HTTP, independent of MySQL and Elasticsearch
+// @Tags actuator
+// @Produce json
+// @Success 200 {object} health.Health
+// @Router /actuator/health/liveness [get]
+func (ctrl *HealthController) Liveness(c *gin.Context) {
+	writeHealth(c, health.Health{
+		Status: health.StatusUp,
+		Components: map[string]health.Health{
+			"livenessState": {Status: health.StatusUp},
+		},
+	})
+}
+
+// @Summary Readiness probe
+// @Description Reports UP only when MySQL, the Elasticsearch cluster and the search index are available
+// @Tags actuator
+// @Produce json
+// @Success 200 {object} health.Health
+// @Failure 503 {object} health.Health
+// @Router /actuator/health/readiness [get]
+func (ctrl *HealthController) ReadinessCheck(c *gin.Context) {
+	result := health.Check(c.Request.Context(), ctrl.Readiness, ctrl.Timeout())
+	result.Components["readinessState"] = health.Health{Status: result.Status}
+	writeHealth(c, result)
+}
+
+func writeHealth(c *gin.Context, result health.Health) {
+	status := http.StatusOK
+	if !result.Status.Available() {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, result)
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"mall-search-go/service"
+	"mall-search-go/store"
+)
+
+type ImportJobController struct {
+	Service service.ImportJobService
+}
+
+func NewImportJobController(service service.ImportJobService) *ImportJobController {
+	return &ImportJobController{Service: service}
+}
+
+func (ctrl *ImportJobController) RegisterRoutes(router *gin.Engine) {
+
+	esProductGroup := router.Group("/esProduct")
+
+	esProductGroup.POST("/importAll", ctrl.ImportAllList)
+	esProductGroup.GET("/jobs", ctrl.List)
+	esProductGroup.GET("/jobs/:id", ctrl.Get)
+	esProductGroup.DELETE("/jobs/:id", ctrl.Cancel)
+}
+
+// @Summary Import all products to Elasticsearch
+// @Description Start a background job that imports all products into a new index generation and switches the alias to it.
+// @Description Returns the job immediately; poll /esProduct/jobs/{id} for progress. Only one import can run at a time across all instances.
+// @Tags esProduct
+// @Produce json
+// @Success 200 {object} model.ImportJob
+// @Failure 409 {object} model.ImportJob
+// @Failure 500 {object} map[string]interface{}
+// @Router /esProduct/importAll [post]
+func (ctrl *ImportJobController) ImportAllList(c *gin.Context) {
+	job, err := ctrl.Service.Start()
+	if errors.Is(err, service.ErrImportRunning) {
+		res := FailedWithData(job, "Failed to import"+err.Error())
+		c.JSON(http.StatusConflict, res)
+		return
+	}
+	if err != nil {
+		res := Failed("Failed to import" + err.Error())
+		c.JSON(http.StatusInternalServerError, res)
+		return
+	}
+	c.JSON(http.StatusOK, Success(job))
+}
+
+// @Summary List import jobs
+// @Description List the most recent import jobs, newest first
+// @Tags esProduct
+// @Produce json
+// @Param  limit  query  int  false  "Number of jobs, default 20"
+// @Success 200 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{}
+// @Router /esProduct/jobs [get]
+func (ctrl *ImportJobController) List(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	jobs, err := ctrl.Service.List(limit)
+	if err != nil {
+		res := Failed("Failed to list jobs" + err.Error())
+		c.JSON(http.StatusInternalServerError, res)
+		return
+	}
+	c.JSON(http.StatusOK, Success(jobs))
+}
+
+// @Summary Get an import job
+// @Description Phase, progress and errors of an import job
+// @Tags esProduct
+// @Produce json
+// @Param  id  path  int64  true  "Job ID"
+// @Success 200 {object} model.ImportJob
+// @Failure 404 {object} map[string]interface{}
+// @Router /esProduct/jobs/{id} [get]
+func (ctrl *ImportJobController) Get(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Failed("Invalid ID"))
+		return
+	}
+	job, err := ctrl.Service.Get(id)
+	if err != nil {
+		c.JSON(jobErrorStatus(err), Failed("Failed to get job"+err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, Success(job))
+}
+
+// @Summary Cancel an import job
+// @Description Cancel the running import job; the new index generation is deleted and the alias is left unchanged
+// @Tags esProduct
+// @Produce json
+// @Param  id  path  int64  true  "Job ID"
+// @Success 200 {object} model.ImportJob
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} model.ImportJob
+// @Router /esProduct/jobs/{id} [delete]
+func (ctrl *ImportJobController) Cancel(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Failed("Invalid ID"))
+		return
+	}
+	job, err := ctrl.Service.Cancel(id)
+	if err != nil {
+		c.JSON(jobErrorStatus(err), FailedWithData(job, "Failed to cancel job"+err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, Success(job))
+}
+
+func jobErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrJobFinished):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"mall-search-go/model"
+	"mall-search-go/repository"
+	"mall-search-go/service"
+	"mall-search-go/store"
+)
+
+type SynonymController struct {
+	Service service.SynonymService
+}
+
+func NewSynonymController(service service.SynonymService) *SynonymController {
+	return &SynonymController{Service: service}
+}
+
+func (ctrl *SynonymController) RegisterRoutes(router *gin.Engine) {
+
+	synonymGroup := router.Group("/esProduct/admin/synonyms")
+
+	synonymGroup.GET("", ctrl.Current)
+	synonymGroup.POST("", ctrl.AddRule)
+	synonymGroup.PUT("/:id", ctrl.UpdateRule)
+	synonymGroup.DELETE("/:id", ctrl.DeleteRule)
+	synonymGroup.POST("/stopwords", ctrl.AddStopWord)
+	synonymGroup.DELETE("/stopwords/:word", ctrl.DeleteStopWord)
+	synonymGroup.GET("/versions", ctrl.Versions)
+	synonymGroup.POST("/rollback/:version", ctrl.Rollback)
+}
+
+// synonymRuleParam 是添加和修改同义词规则的请求体
+type synonymRuleParam struct {
+	Rule string `json:"rule"`
+}
+
+type stopWordParam struct {
+	Word string `json:"word"`
+}
+
+// @Summary Current synonyms and stop words
+// @Description The latest version of the synonym rules and stop words, which is the one applied to the index
+// @Tags synonyms
+// @Produce json
+// @Success 200 {object} model.SynonymVersion
+// @Failure 500 {object} map[string]interface{}
+// @Router /esProduct/admin/synonyms [get]
+func (ctrl *SynonymController) Current(c *gin.Context) {
+	version, err := ctrl.Service.Current()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Failed("Failed to get synonyms"+err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, Success(version))
+}
+
+// @Summary Add a synonym rule
+// @Description Add a rule in Solr format, "a, b, c" for equivalent words or "a, b => c" to replace words, and apply it to the index
+// @Description Every change rebuilds the index, so it returns 409 while a full import or another change is running on any instance
+// @Tags synonyms
+// @Accept  json
+// @Produce json
+// @Param  rule  body  synonymRuleParam  true  "Synonym rule"
+// @Success 200 {object} model.SynonymVersion
+// @Failure 400 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /esProduct/admin/synonyms [post]
+func (ctrl *SynonymController) AddRule(c *gin.Context) {
+	var param synonymRuleParam
+	if err := c.ShouldBindJSON(&param); err != nil {
+		c.JSON(http.StatusBadRequest, ValidateFailed(err.Error()))
+		return
+	}
+	version, err := ctrl.Service.AddRule(c.Request.Context(), param.Rule)
+	ctrl.respond(c, version, err, "Failed to add synonym rule")
+}
+
+// @Summary Update a synonym rule
+// @Tags synonyms
+// @Accept  json
+// @Produce json
+// @Param  id    path  int64             true  "Rule ID"
+// @Param  rule  body  synonymRuleParam  true  "Synonym rule"
+// @Success 200 {object} model.SynonymVersion
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /esProduct/admin/synonyms/{id} [put]
+func (ctrl *SynonymController) UpdateRule(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ValidateFailed("Invalid ID"))
+		return
+	}
+	var param synonymRuleParam
+	if err := c.ShouldBindJSON(&param); err != nil {
+		c.JSON(http.StatusBadRequest, ValidateFailed(err.Error()))
+		return
+	}
+	version, err := ctrl.Service.UpdateRule(c.Request.Context(), id, param.Rule)
+	ctrl.respond(c, version, err, "Failed to update synonym rule")
+}
+
+// @Summary Delete a synonym rule
+// @Tags synonyms
+// @Produce json
+// @Param  id  path  int64  true  "Rule ID"
+// @Success 200 {object} model.SynonymVersion
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /esProduct/admin/synonyms/{id} [delete]
+func (ctrl *SynonymController) DeleteRule(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ValidateFailed("Invalid ID"))
+		return
+	}
+	version, err := ctrl.Service.DeleteRule(c.Request.Context(), id)
+	ctrl.respond(c, version, err, "Failed to delete synonym rule")
+}
+
+// @Summary Add a stop word
+// @Description Stop words are removed from search keywords after synonyms are expanded
+// @Tags synonyms
+// @Accept  json
+// @Produce json
+// @Param  word  body  stopWordParam  true  "Stop word"
+// @Success 200 {object} model.SynonymVersion
+// @Failure 400 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /esProduct/admin/synonyms/stopwords [post]
+func (ctrl *SynonymController) AddStopWord(c *gin.Context) {
+	var param stopWordParam
+	if err := c.ShouldBindJSON(&param); err != nil {
+		c.JSON(http.StatusBadRequest, ValidateFailed(err.Error()))
+		return
+	}
+	version, err := ctrl.Service.AddStopWord(c.Request.Context(), param.Word)
+	ctrl.respond(c, version, err, "Failed to add stop word")
+}
+
+// @Summary Delete a stop word
+// @Tags synonyms
+// @Produce json
+// @Param  word  path  string  true  "Stop word"
+// @Success 200 {object} model.SynonymVersion
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /esProduct/admin/synonyms/stopwords/{word} [delete]
+func (ctrl *SynonymController) DeleteStopWord(c *gin.Context) {
+	version, err := ctrl.Service.DeleteStopWord(c.Request.Context(), c.Param("word"))
+	ctrl.respond(c, version, err, "Failed to delete stop word")
+}
+
+// @Summary List synonym versions
+// @Description List the most recent versions of the synonym rules and stop words, newest first
+// @Tags synonyms
+// @Produce json
+// @Param  limit  query  int  false  "Number of versions, default 20"
+// @Success 200 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{}
+// @Router /esProduct/admin/synonyms/versions [get]
+func (ctrl *SynonymController) Versions(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	versions, err := ctrl.Service.Versions(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Failed("Failed to list synonym versions"+err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, Success(versions))
+}
+
+// @Summary Roll back synonyms
+// @Description Apply the rules and stop words of an earlier version; the rollback is saved as a new version
+// @Tags synonyms
+// @Produce json
+// @Param  version  path  int64  true  "Version to roll back to"
+// @Success 200 {object} model.SynonymVersion
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /esProduct/admin/synonyms/rollback/{version} [post]
+func (ctrl *SynonymController) Rollback(c *gin.Context) {
+	version, err := strconv.ParseInt(c.Param("version"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ValidateFailed("Invalid version"))
+		return
+	}
+	result, err := ctrl.Service.Rollback(c.Request.Context(), version)
+	ctrl.respond(c, result, err, "Failed to roll back synonyms")
+}
+
+// isBadRequest 判断 ES 是否因为规则无法解析而拒绝了修改
+func isBadRequest(err error) bool {
+	var esErr *repository.ElasticsearchError
+	return errors.As(err, &esErr) && esErr.Status == http.StatusBadRequest
+}
+
+// respond 返回修改后的版本，失败时按错误类型返回 400、404、409 或 500
+func (ctrl *SynonymController) respond(c *gin.Context, version model.SynonymVersion, err error, message string) {
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, Success(version))
+	case errors.Is(err, model.ErrInvalidSynonym), isBadRequest(err):
+		c.JSON(http.StatusBadRequest, ValidateFailed(err.Error()))
+	case errors.Is(err, service.ErrSynonymRuleNotFound), errors.Is(err, store.ErrSynonymVersionNotFound):
+		c.JSON(http.StatusNotFound, Failed(message+err.Error()))
+	case errors.Is(err, service.ErrSynonymConflict), errors.Is(err, service.ErrSynonymBusy):
+		c.JSON(http.StatusConflict, Failed(message+err.Error()))
+	default:
+		c.JSON(http.StatusInternalServerError, Failed(message+err.Error()))
+	}
+}
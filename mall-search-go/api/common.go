@@ -47,6 +47,14 @@ func Failed(message string) *CommonResult {
 	}
 }
 
+func FailedWithData(data interface{}, message string) *CommonResult {
+	return &CommonResult{
+		Code:    resultCode.FAILED,
+		Message: message,
+		Data:    data,
+	}
+}
+
 func ValidateFailed(message string) *CommonResult {
 	return &CommonResult{
 		Code:    resultCode.VALIDATE_FAILED,
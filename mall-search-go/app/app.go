@@ -0,0 +1,437 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/gin-gonic/gin"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"mall-search-go/api"
+	"mall-search-go/cdc"
+	"mall-search-go/config"
+	"mall-search-go/health"
+	"mall-search-go/nacos"
+	"mall-search-go/repository"
+	"mall-search-go/service"
+	"mall-search-go/store"
+)
+
+// App 持有服务运行所需的全部组件，所有依赖都在 New/Assemble 中显式构造，
+// 不再依赖包级 init() 的副作用
+type App struct {
+	Config     *config.Config
+	DB         *gorm.DB
+	ES         *elasticsearch.Client
+	Dao        store.EsproductDao
+	Repository repository.EsProductRepository
+	Jobs       store.ImportJobDao
+	Synonyms   store.SynonymDao
+	Service    service.EsProductService
+	ImportJobs service.ImportJobService
+	Synonym    service.SynonymService
+	Controller *api.EsProductController
+	JobControl *api.ImportJobController
+	SynControl *api.SynonymController
+	Health     *api.HealthController
+	Router     *gin.Engine
+	// CDC 在 search.cdc.enabled 为 true 时从 binlog 增量同步商品，否则为 nil
+	CDC *cdc.Syncer
+	// Registry 在配置了 spring.cloud.nacos.discovery.server-addr 时把实例注册到 Nacos，否则为 nil
+	Registry *nacos.Registry
+	// Remote 是 LoadConfig 返回的 Nacos 远程配置，不为 nil 时 Run 会监听变更并调用 Reload
+	Remote *RemoteConfig
+
+	//保护 Config，配置中心推送新配置时会替换它
+	mu sync.Mutex
+
+	//ES客户端使用的连接池，停机时关闭空闲连接
+	esTransport *http.Transport
+	//停止 binlog 同步，cdcDone 在同步结束（并保存了检查点）后关闭
+	stopCDC context.CancelFunc
+	cdcDone chan struct{}
+	//停止 Nacos 心跳和配置监听
+	stopNacos context.CancelFunc
+}
+
+// Components 是 Assemble 需要的存储层组件，测试中可以换成假实现
+type Components struct {
+	Dao        store.EsproductDao
+	Repository repository.EsProductRepository
+	Jobs       store.ImportJobDao
+	Synonyms   store.SynonymDao
+	// ImportLock 保证所有实例中同一时间只有一个全量导入或同义词修改，为 nil 时只在实例内保证
+	ImportLock store.DbLock
+	// Changes 是增量同步的进度，全量导入和修改同义词切换别名后从这里重放，没有开启增量同步时为 nil
+	Changes service.ChangeLog
+	// Readiness 是就绪探针要检查的依赖，key 是 actuator 返回中的组件名
+	Readiness map[string]health.Indicator
+}
+
+// New 按配置连接 MySQL 和 ES（失败时按退避策略重试），并组装出完整的 App
+func New(ctx context.Context, cfg *config.Config) (*App, error) {
+	db, err := OpenDB(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	es, err := OpenES(ctx, cfg, transport)
+	if err != nil {
+		closeDB(db)
+		return nil, err
+	}
+
+	repo := repository.NewEsProductRepository(es, cfg.Search)
+	if err := prepareIndex(ctx, repo); err != nil {
+		closeDB(db)
+		return nil, err
+	}
+
+	importLock := store.NewDbLock(db, cfg.Spring.Application.Name+":import")
+	jobs, err := prepareJobs(ctx, db, importLock)
+	if err != nil {
+		closeDB(db)
+		return nil, err
+	}
+
+	components := Components{
+		Dao:        store.NewEsProductDao(db),
+		Repository: repo,
+		Jobs:       jobs,
+		Synonyms:   store.NewSynonymDao(db),
+		ImportLock: importLock,
+		Readiness: map[string]health.Indicator{
+			"db":            health.DB(db),
+			"elasticsearch": health.Elasticsearch(es),
+			"index":         health.Index(es, cfg.Search.Index),
+		},
+	}
+	var syncer *cdc.Syncer
+	if cfg.Search.CDC.Enabled {
+		if syncer, err = newSyncer(cfg, db, components.Dao, repo); err != nil {
+			closeDB(db)
+			return nil, err
+		}
+		components.Changes = syncer
+	}
+	a := Assemble(cfg, components)
+	a.DB = db
+	a.ES = es
+	a.esTransport = transport
+	a.CDC = syncer
+	if cfg.Spring.Cloud.Nacos.Discovery.NacosEnabled() {
+		if a.Registry, err = newRegistry(cfg); err != nil {
+			closeDB(db)
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// newSyncer 创建从 binlog 增量同步商品的 Syncer，复制连接使用 spring.datasource 的地址和库名
+func newSyncer(cfg *config.Config, db *gorm.DB, dao store.EsproductDao, repo repository.EsProductRepository) (*cdc.Syncer, error) {
+	dsn, err := cfg.Spring.Datasource.DSN()
+	if err != nil {
+		return nil, err
+	}
+	mysqlCfg, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	cdcCfg := cfg.Search.CDC
+	binlog := cdc.BinlogConfig{
+		Addr:      mysqlCfg.Addr,
+		User:      firstNonEmpty(cdcCfg.Username, mysqlCfg.User),
+		Password:  firstNonEmpty(cdcCfg.Password, mysqlCfg.Passwd),
+		Schema:    mysqlCfg.DBName,
+		Tables:    cdc.Tables,
+		ServerID:  uint32(cdcCfg.ServerID),
+		Heartbeat: cdcCfg.HeartbeatPeriod,
+	}
+	//所有实例中只有拿到锁的一个连接复制，其余实例每个心跳周期尝试一次
+	lock := store.NewDbLock(db, cfg.Spring.Application.Name+":cdc")
+	return cdc.NewSyncer(cdc.NewBinlogStream(binlog, sqlDB), dao, repo, store.NewCdcCheckpointDao(db), lock, cdc.SyncerConfig{
+		Name:               cfg.Spring.Application.Name,
+		CheckpointInterval: cdcCfg.CheckpointInterval,
+		InitialBackoff:     cfg.Search.Startup.InitialBackoff,
+		MaxBackoff:         cfg.Search.Startup.MaxBackoff,
+		LockInterval:       cdcCfg.HeartbeatPeriod,
+	}), nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Assemble 用给定的存储层组件构造 service、controller 和路由，不做任何网络连接
+func Assemble(cfg *config.Config, components Components) *App {
+	a := &App{
+		Config:     cfg,
+		Dao:        components.Dao,
+		Repository: components.Repository,
+		Jobs:       components.Jobs,
+		Synonyms:   components.Synonyms,
+	}
+	a.Service = service.NewEsProductServiceImpl(a.Dao, a.Repository, components.Changes, cfg.Search)
+	a.ImportJobs = service.NewImportJobServiceImpl(a.Service, a.Jobs, components.ImportLock)
+	a.Synonym = service.NewSynonymServiceImpl(a.Synonyms, a.Service, a.Repository, components.Changes, components.ImportLock)
+	a.Controller = api.NewEsProductController(a.Service)
+	a.JobControl = api.NewImportJobController(a.ImportJobs)
+	a.SynControl = api.NewSynonymController(a.Synonym)
+	a.Health = api.NewHealthController(components.Readiness, cfg.Management.Health.Elasticsearch.ResponseTimeout)
+
+	a.Router = gin.Default()
+	a.Controller.RegisterRoutes(a.Router)
+	a.JobControl.RegisterRoutes(a.Router)
+	a.SynControl.RegisterRoutes(a.Router)
+	a.Health.RegisterRoutes(a.Router)
+	a.Router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	return a
+}
+
+// Run 在配置的端口上启动 HTTP 服务并注册到 Nacos，直到 ctx 结束（通常是收到 SIGTERM/SIGINT）后优雅停机：
+// 先从 Nacos 注销让网关不再转发新请求，再停止接收新请求并等待进行中的搜索和索引写入，
+// 然后等待剩余的写入落盘，最后关闭 ES 和 MySQL 连接。每个阶段最多等待 spring.lifecycle.timeout-per-shutdown-phase
+func (a *App) Run(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(a.currentConfig().Server.Port),
+		Handler: a.Router,
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		a.Close(context.Background())
+		return err
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+	log.Printf("Listening on %s", srv.Addr)
+
+	if a.CDC != nil {
+		var cdcCtx context.Context
+		cdcCtx, a.stopCDC = context.WithCancel(ctx)
+		a.cdcDone = make(chan struct{})
+		go func() {
+			defer close(a.cdcDone)
+			if err := a.CDC.Run(cdcCtx); err != nil {
+				log.Printf("Binlog sync failed: %s", err)
+			}
+		}()
+	}
+
+	//端口已经在监听，这时注册的实例可以立即接收网关转发的请求
+	var nacosCtx context.Context
+	nacosCtx, a.stopNacos = context.WithCancel(ctx)
+	if a.Registry != nil {
+		go a.Registry.Run(nacosCtx)
+	}
+	if a.Remote != nil {
+		go a.Remote.Watch(nacosCtx, a.Reload)
+	}
+
+	select {
+	case err := <-serveErr:
+		a.Close(context.Background())
+		return err
+	case <-ctx.Done():
+	}
+
+	timeout := a.currentConfig().Spring.Lifecycle.TimeoutPerShutdownPhase
+	a.deregister(timeout)
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", timeout)
+	httpCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(httpCtx); err != nil {
+		log.Printf("Error draining in-flight requests: %s", err)
+		srv.Close()
+	}
+
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), timeout)
+	defer cancelClose()
+	return a.Close(closeCtx)
+}
+
+// deregister 停止心跳并从 Nacos 注销实例，失败时 Nacos 会在心跳超时后自动摘除它
+func (a *App) deregister(timeout time.Duration) {
+	if a.stopNacos != nil {
+		a.stopNacos()
+	}
+	if a.Registry == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := a.Registry.Deregister(ctx); err != nil {
+		log.Printf("Error deregistering %s from Nacos: %s", a.Registry.Instance(), err)
+		return
+	}
+	log.Printf("Deregistered %s from Nacos", a.Registry.Instance())
+}
+
+// Close 等待 binlog 同步保存检查点，中断正在运行的导入任务并等待尚未完成的索引写入，然后释放 ES 和 MySQL 连接，返回遇到的第一个错误
+func (a *App) Close(ctx context.Context) error {
+	var firstErr error
+	if a.stopNacos != nil {
+		a.stopNacos()
+	}
+	if a.cdcDone != nil {
+		a.stopCDC()
+		select {
+		case <-a.cdcDone:
+		case <-ctx.Done():
+			log.Printf("Binlog sync did not stop in time: %s", ctx.Err())
+		}
+	}
+	if a.ImportJobs != nil {
+		if err := a.ImportJobs.Shutdown(ctx); err != nil {
+			log.Printf("Error interrupting import job: %s", err)
+			firstErr = err
+		}
+	}
+	if a.Repository != nil {
+		if err := a.Repository.Close(ctx); err != nil {
+			log.Printf("Error flushing Elasticsearch writes: %s", err)
+			firstErr = err
+		}
+	}
+	if a.esTransport != nil {
+		a.esTransport.CloseIdleConnections()
+	}
+	if a.DB != nil {
+		if err := closeDB(a.DB); err != nil {
+			log.Printf("Error closing MySQL connection: %s", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func closeDB(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// prepareIndex 确保索引模板和索引存在，并把与模板不一致的字段打印出来
+func prepareIndex(ctx context.Context, repo repository.EsProductRepository) error {
+	if err := repo.EnsureIndex(ctx); err != nil {
+		return fmt.Errorf("prepare index: %w", err)
+	}
+	drifts, err := repo.MappingDrift(ctx)
+	if err != nil {
+		return fmt.Errorf("check index mapping: %w", err)
+	}
+	for _, d := range drifts {
+		log.Printf("Mapping drift in %s: field %s expected %q, got %q", d.Index, d.Field, d.Expected, d.Actual)
+	}
+	return nil
+}
+
+// prepareJobs 确保 Go 版自己的表存在，并把上次停机时没有结束的导入任务标记为 INTERRUPTED
+func prepareJobs(ctx context.Context, db *gorm.DB, lock store.DbLock) (store.ImportJobDao, error) {
+	if err := store.Migrate(db); err != nil {
+		return nil, fmt.Errorf("prepare mall-search tables: %w", err)
+	}
+	jobs := store.NewImportJobDao(db)
+	if err := recoverJobs(ctx, jobs, lock); err != nil {
+		return nil, fmt.Errorf("recover import jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// recoverJobs 在没有实例持有导入锁时把没有结束的任务标记为 INTERRUPTED。
+// 锁被其他实例持有时它的任务还在运行，留给它自己结束
+func recoverJobs(ctx context.Context, jobs store.ImportJobDao, lock store.DbLock) error {
+	ok, err := lock.TryLock(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Printf("Another instance is running an import, leaving its job alone")
+		return nil
+	}
+	defer lock.Unlock()
+	interrupted, err := jobs.InterruptUnfinished()
+	if err != nil {
+		return err
+	}
+	if interrupted > 0 {
+		log.Printf("Marked %d unfinished import jobs as interrupted", interrupted)
+	}
+	return nil
+}
+
+// OpenDB 连接 MySQL，gorm 在 Open 时会 ping 一次数据库
+func OpenDB(ctx context.Context, cfg *config.Config) (*gorm.DB, error) {
+	dsn, err := cfg.Spring.Datasource.DSN()
+	if err != nil {
+		return nil, err
+	}
+
+	var db *gorm.DB
+	err = retry(ctx, cfg.Search.Startup, "MySQL", func() error {
+		db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect to MySQL: %w", err)
+	}
+	return db, nil
+}
+
+// OpenES 基于给定的连接池创建 ES 客户端并确认集群可以访问
+func OpenES(ctx context.Context, cfg *config.Config, transport http.RoundTripper) (*elasticsearch.Client, error) {
+	esCfg := cfg.Spring.Elasticsearch
+	es, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: esCfg.Addresses(),
+		Username:  esCfg.Username,
+		Password:  esCfg.Password,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create Elasticsearch client: %w", err)
+	}
+
+	err = retry(ctx, cfg.Search.Startup, "Elasticsearch", func() error {
+		res, err := es.Info(es.Info.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.IsError() {
+			return fmt.Errorf("unexpected response: %s", res.Status())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect to Elasticsearch %v: %w", esCfg.Addresses(), err)
+	}
+	log.Printf("Connected to Elasticsearch %v", esCfg.Addresses())
+	return es, nil
+}
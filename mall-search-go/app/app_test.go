@@ -0,0 +1,1187 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"mall-search-go/cdc"
+	"mall-search-go/config"
+	"mall-search-go/model"
+	"mall-search-go/nacos"
+	"mall-search-go/repository"
+	"mall-search-go/service"
+	"mall-search-go/store"
+)
+
+type fakeDao struct {
+	products []model.EsProduct
+	attrs    []model.ProductAttribute
+	// block 不为空时 IterateProducts 会等到它被关闭或 ctx 被取消
+	block chan struct{}
+	// published 是 IterateProducts 读不到、但 CountProducts 会统计的商品数，模拟导入期间上架的商品
+	published int
+}
+
+func (d *fakeDao) IterateProducts(ctx context.Context, batchSize int, fn func([]model.EsProduct) error) error {
+	if d.block != nil {
+		select {
+		case <-d.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for start := 0; start < len(d.products); start += batchSize {
+		end := start + batchSize
+		if end > len(d.products) {
+			end = len(d.products)
+		}
+		if err := fn(d.products[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *fakeDao) CountProducts() (int, error) {
+	return len(d.products) + d.published, nil
+}
+
+func (d *fakeDao) GetProducts(ctx context.Context, ids []int64) ([]model.EsProduct, error) {
+	var products []model.EsProduct
+	for _, id := range ids {
+		found, _ := d.GetAllProductList(&id)
+		products = append(products, found...)
+	}
+	return products, nil
+}
+
+func (d *fakeDao) GetFilterableAttributes(ctx context.Context) ([]model.ProductAttribute, error) {
+	return d.attrs, nil
+}
+
+func (d *fakeDao) GetAllProductList(id *int64) ([]model.EsProduct, error) {
+	if id == nil {
+		return d.products, nil
+	}
+	for _, p := range d.products {
+		if p.ID == *id {
+			return []model.EsProduct{p}, nil
+		}
+	}
+	return nil, nil
+}
+
+type fakeJobDao struct {
+	mu   sync.Mutex
+	jobs []model.ImportJob
+}
+
+func (d *fakeJobDao) Create(job *model.ImportJob) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job.ID = int64(len(d.jobs) + 1)
+	job.CreatedAt = time.Now()
+	d.jobs = append(d.jobs, *job)
+	return nil
+}
+
+func (d *fakeJobDao) Save(job *model.ImportJob) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.jobs[job.ID-1] = *job
+	return nil
+}
+
+func (d *fakeJobDao) Get(id int64) (model.ImportJob, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if id < 1 || int(id) > len(d.jobs) {
+		return model.ImportJob{}, store.ErrJobNotFound
+	}
+	return d.jobs[id-1], nil
+}
+
+func (d *fakeJobDao) List(limit int) ([]model.ImportJob, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var jobs []model.ImportJob
+	for i := len(d.jobs) - 1; i >= 0 && len(jobs) < limit; i-- {
+		jobs = append(jobs, d.jobs[i])
+	}
+	return jobs, nil
+}
+
+func (d *fakeJobDao) Unfinished() (model.ImportJob, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := len(d.jobs) - 1; i >= 0; i-- {
+		if !d.jobs[i].Finished() {
+			return d.jobs[i], nil
+		}
+	}
+	return model.ImportJob{}, store.ErrJobNotFound
+}
+
+func (d *fakeJobDao) InterruptUnfinished() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var interrupted int64
+	for i := range d.jobs {
+		if !d.jobs[i].Finished() {
+			d.jobs[i].Phase = model.JobInterrupted
+			interrupted++
+		}
+	}
+	return interrupted, nil
+}
+
+// lockTable 模拟 MySQL 的命名锁，同一个 lockTable 上的 fakeLock 互斥，就像连接同一个库的多个实例
+type lockTable struct {
+	mu    sync.Mutex
+	owner *fakeLock
+}
+
+type fakeLock struct {
+	table *lockTable
+}
+
+func (l *fakeLock) TryLock(ctx context.Context) (bool, error) {
+	l.table.mu.Lock()
+	defer l.table.mu.Unlock()
+	if l.table.owner != nil {
+		return false, nil
+	}
+	l.table.owner = l
+	return true, nil
+}
+
+func (l *fakeLock) Held(ctx context.Context) (bool, error) {
+	l.table.mu.Lock()
+	defer l.table.mu.Unlock()
+	return l.table.owner == l, nil
+}
+
+func (l *fakeLock) Unlock() error {
+	l.table.mu.Lock()
+	defer l.table.mu.Unlock()
+	if l.table.owner == l {
+		l.table.owner = nil
+	}
+	return nil
+}
+
+type fakeSynonymDao struct {
+	versions []model.SynonymVersion
+	// beforeCreate 在写入之前调用，用来模拟另一个实例在这期间保存了版本
+	beforeCreate func()
+}
+
+func (d *fakeSynonymDao) Latest() (model.SynonymVersion, error) {
+	if len(d.versions) == 0 {
+		return model.SynonymVersion{}, nil
+	}
+	return d.versions[len(d.versions)-1], nil
+}
+
+func (d *fakeSynonymDao) Get(id int64) (model.SynonymVersion, error) {
+	if id < 1 || int(id) > len(d.versions) {
+		return model.SynonymVersion{}, store.ErrSynonymVersionNotFound
+	}
+	return d.versions[id-1], nil
+}
+
+func (d *fakeSynonymDao) List(limit int) ([]model.SynonymVersion, error) {
+	var versions []model.SynonymVersion
+	for i := len(d.versions) - 1; i >= 0 && len(versions) < limit; i-- {
+		versions = append(versions, d.versions[i])
+	}
+	return versions, nil
+}
+
+func (d *fakeSynonymDao) Create(v *model.SynonymVersion) error {
+	if d.beforeCreate != nil {
+		d.beforeCreate()
+	}
+	//与数据库一样，版本号是主键
+	if v.ID <= int64(len(d.versions)) {
+		return store.ErrSynonymVersionExists
+	}
+	v.CreatedAt = time.Now()
+	d.versions = append(d.versions, *v)
+	return nil
+}
+
+func (d *fakeSynonymDao) Delete(id int64) error {
+	//只有最新的版本会被删除
+	if id == int64(len(d.versions)) {
+		d.versions = d.versions[:id-1]
+	}
+	return nil
+}
+
+type fakeRepository struct {
+	indices map[string]map[int64]model.EsProduct
+	alias   string
+	seq     int
+	// rejected 中的商品在批量写入时会失败
+	rejected map[int64]string
+	// synonyms 和 stopWords 是最后一次 ApplySynonyms 写入的内容，rejectRule 中的规则会被拒绝
+	synonyms   []string
+	stopWords  []string
+	rejectRule string
+	// filters 是每一代索引中的同义词和停用词
+	filters map[string]string
+}
+
+func newFakeRepository() *fakeRepository {
+	return &fakeRepository{indices: make(map[string]map[int64]model.EsProduct), filters: make(map[string]string)}
+}
+
+func (r *fakeRepository) live() map[int64]model.EsProduct {
+	return r.indices[r.alias]
+}
+
+func (r *fakeRepository) SaveAll(products []model.EsProduct) (int, error) {
+	for _, p := range products {
+		r.live()[p.ID] = p
+	}
+	return len(products), nil
+}
+
+type fakeBulkWriter struct {
+	repo   *fakeRepository
+	report model.ImportReport
+}
+
+func (r *fakeRepository) NewBulkWriter(index string) (repository.BulkWriter, error) {
+	return &fakeBulkWriter{repo: r, report: model.ImportReport{Index: index}}, nil
+}
+
+func (w *fakeBulkWriter) Add(ctx context.Context, product model.EsProduct) error {
+	if reason, ok := w.repo.rejected[product.ID]; ok {
+		w.report.Failed++
+		w.report.Failures = append(w.report.Failures, model.ImportFailure{ProductID: product.ID, Reason: reason})
+		return nil
+	}
+	w.repo.indices[w.report.Index][product.ID] = product
+	w.report.Indexed++
+	return nil
+}
+
+func (w *fakeBulkWriter) Close(ctx context.Context) (model.ImportReport, error) {
+	return w.report, nil
+}
+
+func (r *fakeRepository) Save(product *model.EsProduct) (*model.EsProduct, error) {
+	r.live()[product.ID] = *product
+	return product, nil
+}
+
+func (r *fakeRepository) Delete(id int64) error {
+	delete(r.live(), id)
+	return nil
+}
+
+func (r *fakeRepository) DeletaBatch(ids []int64) error {
+	for _, id := range ids {
+		delete(r.live(), id)
+	}
+	return nil
+}
+
+func (r *fakeRepository) Search(keyword string, pageNum, pageSize int, cursor string, highlight bool) (model.Page, error) {
+	var page model.Page
+	for _, p := range r.live() {
+		if p.Name == keyword {
+			page.Content = append(page.Content, p)
+		}
+	}
+	page.PageInfo.TotalElements = len(page.Content)
+	return page, nil
+}
+
+func (r *fakeRepository) CreateGeneration(ctx context.Context) (string, error) {
+	r.seq++
+	name := fmt.Sprintf("pms_v%017d", r.seq)
+	r.indices[name] = make(map[int64]model.EsProduct)
+	r.filters[name] = r.filters[r.alias]
+	return name, nil
+}
+
+func (r *fakeRepository) CountDocuments(ctx context.Context, index string) (int, error) {
+	return len(r.indices[index]), nil
+}
+
+func (r *fakeRepository) SwapAlias(ctx context.Context, index string) error {
+	r.alias = index
+	return nil
+}
+
+func (r *fakeRepository) Generations(ctx context.Context) ([]model.IndexGeneration, error) {
+	var generations []model.IndexGeneration
+	for name, docs := range r.indices {
+		generations = append(generations, model.IndexGeneration{Name: name, DocsCount: len(docs), Active: name == r.alias})
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i].Name > generations[j].Name })
+	return generations, nil
+}
+
+func (r *fakeRepository) DeleteIndex(ctx context.Context, index string) error {
+	delete(r.indices, index)
+	return nil
+}
+
+func (r *fakeRepository) SearchByCriteria(criteria model.SearchCriteria) (model.Page, error) {
+	return model.Page{}, errors.New("not implemented")
+}
+
+func (r *fakeRepository) Recommend(id int64, product model.EsProduct, pageNum int, pageSize int, cursor string) (model.Page, error) {
+	return model.Page{}, errors.New("not implemented")
+}
+
+func (r *fakeRepository) Export(ctx context.Context, criteria model.SearchCriteria, fn func([]model.EsProduct) error) error {
+	return errors.New("not implemented")
+}
+
+func (r *fakeRepository) SearchRelated(keyword string, attrIds []int64) (model.EsProductRelatedInfo, error) {
+	return model.EsProductRelatedInfo{}, errors.New("not implemented")
+}
+
+func (r *fakeRepository) Correct(keyword string) (string, error) {
+	return "", nil
+}
+
+func (r *fakeRepository) Suggest(ctx context.Context, prefix string, categoryId *int64, size int) ([]model.Suggestion, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *fakeRepository) ApplySynonyms(ctx context.Context, synonyms, stopWords []string) error {
+	for _, rule := range synonyms {
+		if rule == r.rejectRule {
+			return &repository.ElasticsearchError{Status: http.StatusBadRequest, Reason: "failed to build synonyms"}
+		}
+	}
+	r.synonyms, r.stopWords = synonyms, stopWords
+	//与真实实现一样新建一代并复制线上的文档
+	index, _ := r.CreateGeneration(ctx)
+	for id, p := range r.live() {
+		r.indices[index][id] = p
+	}
+	r.filters[index] = fmt.Sprint(synonyms, stopWords)
+	r.alias = index
+	return nil
+}
+
+func (r *fakeRepository) CopySynonyms(ctx context.Context, index string) error {
+	r.filters[index] = r.filters[r.alias]
+	return nil
+}
+
+func (r *fakeRepository) EnsureIndex(ctx context.Context) error {
+	return nil
+}
+
+func (r *fakeRepository) MappingDrift(ctx context.Context) ([]model.MappingDrift, error) {
+	return nil, nil
+}
+
+func (r *fakeRepository) Close(ctx context.Context) error {
+	return nil
+}
+
+func TestAssembleWithFakes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dao := &fakeDao{products: []model.EsProduct{
+		{ID: 26, Name: "华为 HUAWEI P20"},
+		{ID: 27, Name: "小米8"},
+	}}
+	repo := newFakeRepository()
+	a := Assemble(config.Default(), Components{Dao: dao, Repository: repo, Jobs: &fakeJobDao{}})
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/esProduct/importAll", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("importAll: status %d, body %s", w.Code, w.Body)
+	}
+	job := waitForJob(t, a, decodeJob(t, w).ID)
+	if job.Phase != model.JobSucceeded || job.Total != 2 || job.Processed != 2 || job.Indexed != 2 {
+		t.Fatalf("import job finished as %+v", job)
+	}
+	if len(repo.live()) != 2 {
+		t.Fatalf("importAll indexed %d products, want 2", len(repo.live()))
+	}
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/esProduct/search/simple?keyword=小米8&pageNum=0&pageSize=5", nil))
+	var res struct {
+		Code int        `json:"code"`
+		Data model.Page `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != 200 || len(res.Data.Content) != 1 || res.Data.Content[0].ID != 27 {
+		t.Fatalf("search/simple returned %s", w.Body)
+	}
+}
+
+func TestImportAllSwapsAliasAndKeepsGenerations(t *testing.T) {
+	dao := &fakeDao{products: []model.EsProduct{{ID: 26}, {ID: 27}}}
+	repo := newFakeRepository()
+	cfg := config.Default()
+	cfg.Search.Reindex.Retain = 1
+	a := Assemble(cfg, Components{Dao: dao, Repository: repo, Jobs: &fakeJobDao{}})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := a.Service.ImportAll(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	generations, _ := repo.Generations(ctx)
+	if len(generations) != 2 || !generations[0].Active {
+		t.Fatalf("generations after 3 imports with retain=1: %+v", generations)
+	}
+
+	previous, err := a.Service.Rollback(ctx)
+	if err != nil || previous != generations[1].Name || repo.alias != previous {
+		t.Fatalf("rollback switched to %q (%v), want %q", previous, err, generations[1].Name)
+	}
+	if _, err := a.Service.Rollback(ctx); err == nil {
+		t.Fatal("rollback past the oldest generation should fail")
+	}
+
+	//有商品写入失败时返回失败的商品ID和原因，并且不切换别名
+	before := repo.alias
+	repo.rejected = map[int64]string{27: "mapper_parsing_exception: failed to parse field [price]"}
+	report, err := a.Service.ImportAll(ctx, nil)
+	if err == nil || report.Indexed != 1 || report.Failed != 1 || report.Failures[0].ProductID != 27 {
+		t.Fatalf("import with a rejected product returned %+v, %v", report, err)
+	}
+	if repo.alias != before {
+		t.Fatalf("alias moved to %s after a failed import", repo.alias)
+	}
+	repo.rejected = nil
+
+	//导入期间上架的商品不影响校验，由增量同步重放补上
+	dao.published = 3
+	if _, err := a.Service.ImportAll(ctx, nil); err != nil {
+		t.Fatalf("import with products published meanwhile: %v", err)
+	}
+	dao.published = 0
+	before = repo.alias
+
+	//读到的商品数与索引的文档数不一致时不切换别名
+	dao.products = append(dao.products, model.EsProduct{ID: 26})
+	if _, err := a.Service.ImportAll(ctx, nil); err == nil {
+		t.Fatal("import with a document count mismatch should fail")
+	}
+	if repo.alias != before {
+		t.Fatalf("alias moved to %s after a failed import", repo.alias)
+	}
+}
+
+// fakeChangeLog 记录全量导入和修改同义词时什么时候读取和回退增量同步的位置
+type fakeChangeLog struct {
+	repo   *fakeRepository
+	pos    model.BinlogPosition
+	events []string
+}
+
+func (c *fakeChangeLog) Mark() model.BinlogPosition {
+	c.events = append(c.events, fmt.Sprintf("mark %s, %d generations", c.pos, len(c.repo.indices)))
+	return c.pos
+}
+
+func (c *fakeChangeLog) Replay(from model.BinlogPosition) {
+	c.events = append(c.events, fmt.Sprintf("replay %s, alias %s", from, c.repo.alias))
+}
+
+func TestImportAllReplaysChangesAfterSwap(t *testing.T) {
+	repo := newFakeRepository()
+	changes := &fakeChangeLog{repo: repo, pos: model.BinlogPosition{File: "mysql-bin.000003", Pos: 2411}}
+	dao := &fakeDao{products: []model.EsProduct{{ID: 26}, {ID: 27}}}
+	a := Assemble(config.Default(), Components{Dao: dao, Repository: repo, Jobs: &fakeJobDao{}, Changes: changes})
+	before := len(repo.indices)
+
+	report, err := a.Service.ImportAll(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//在创建新一代索引之前记下位置，切换别名之后重放
+	want := []string{
+		fmt.Sprintf("mark mysql-bin.000003:2411, %d generations", before),
+		"replay mysql-bin.000003:2411, alias " + report.Index,
+	}
+	if !reflect.DeepEqual(changes.events, want) {
+		t.Fatalf("change log calls:\n got %q\nwant %q", changes.events, want)
+	}
+
+	//导入失败时别名没有变化，不需要重放
+	changes.events = nil
+	dao.products = append(dao.products, model.EsProduct{ID: 26})
+	if _, err := a.Service.ImportAll(context.Background(), nil); err == nil {
+		t.Fatal("import with a document count mismatch should fail")
+	}
+	if len(changes.events) != 1 {
+		t.Fatalf("change log calls after a failed import: %q", changes.events)
+	}
+}
+
+func TestImportJobsRunOneAtATimeAndCancel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dao := &fakeDao{products: []model.EsProduct{{ID: 26}, {ID: 27}}, block: make(chan struct{})}
+	repo := newFakeRepository()
+	jobs := &fakeJobDao{}
+	a := Assemble(config.Default(), Components{Dao: dao, Repository: repo, Jobs: jobs})
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/esProduct/importAll", nil))
+	first := decodeJob(t, w)
+	if w.Code != http.StatusOK || first.Phase != model.JobPreparing {
+		t.Fatalf("importAll: status %d, body %s", w.Code, w.Body)
+	}
+
+	//第一个任务还在运行时不能再开始第二个
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/esProduct/importAll", nil))
+	if w.Code != http.StatusConflict || decodeJob(t, w).ID != first.ID {
+		t.Fatalf("second importAll: status %d, body %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/esProduct/jobs/%d", first.ID), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("cancel: status %d, body %s", w.Code, w.Body)
+	}
+	job := waitForJob(t, a, first.ID)
+	if job.Phase != model.JobCancelled || job.Error == "" || job.FinishedAt == nil {
+		t.Fatalf("cancelled job finished as %+v", job)
+	}
+	if repo.alias != "" || len(repo.indices) != 0 {
+		t.Fatalf("cancelled import left alias %q and indices %v", repo.alias, repo.indices)
+	}
+	if saved, _ := jobs.Get(first.ID); saved.Phase != model.JobCancelled {
+		t.Fatalf("job history has phase %s, want CANCELLED", saved.Phase)
+	}
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/esProduct/jobs/%d", first.ID), nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("cancelling a finished job: status %d, body %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/esProduct/jobs/99", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown job: status %d, body %s", w.Code, w.Body)
+	}
+
+	//取消后可以开始新的任务，停机时运行中的任务被标记为 INTERRUPTED
+	second, err := a.ImportJobs.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ImportJobs.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := jobs.Get(second.ID); job.Phase != model.JobInterrupted {
+		t.Fatalf("job running during shutdown finished as %+v", job)
+	}
+
+	close(dao.block)
+	third, err := a.ImportJobs.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job := waitForJob(t, a, third.ID); job.Phase != model.JobSucceeded {
+		t.Fatalf("import job finished as %+v", job)
+	}
+	history, _ := a.ImportJobs.List(10)
+	if len(history) != 3 || history[0].ID != third.ID {
+		t.Fatalf("job history: %+v", history)
+	}
+}
+
+// 两个实例共用导入锁和任务表：一个实例在导入时另一个实例不能开始，启动时也不会把它的任务标记为中断；
+// 锁空闲时没有结束的任务属于已经退出的实例，下一次导入开始时标记为 INTERRUPTED
+func TestImportJobsRunOneAtATimeAcrossInstances(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dao := &fakeDao{products: []model.EsProduct{{ID: 26}, {ID: 27}}, block: make(chan struct{})}
+	repo := newFakeRepository()
+	jobs := &fakeJobDao{}
+	locks := &lockTable{}
+	first := Assemble(config.Default(), Components{Dao: dao, Repository: repo, Jobs: jobs, ImportLock: &fakeLock{table: locks}})
+	second := Assemble(config.Default(), Components{Dao: dao, Repository: repo, Jobs: jobs, ImportLock: &fakeLock{table: locks}})
+
+	running, err := first.ImportJobs.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	second.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/esProduct/importAll", nil))
+	if w.Code != http.StatusConflict || decodeJob(t, w).ID != running.ID {
+		t.Fatalf("importAll on the other instance: status %d, body %s", w.Code, w.Body)
+	}
+	//另一个实例重启
+	if err := recoverJobs(context.Background(), jobs, &fakeLock{table: locks}); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := jobs.Get(running.ID); job.Finished() {
+		t.Fatalf("restarting instance marked a running job as %s", job.Phase)
+	}
+
+	close(dao.block)
+	if job := waitForJob(t, first, running.ID); job.Phase != model.JobSucceeded {
+		t.Fatalf("import job finished as %+v", job)
+	}
+
+	//运行任务的实例崩溃，锁随连接释放，任务停在 INDEXING
+	orphan := model.ImportJob{Phase: model.JobIndexing}
+	jobs.Create(&orphan)
+	next, err := second.ImportJobs.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := jobs.Get(orphan.ID); job.Phase != model.JobInterrupted {
+		t.Fatalf("orphaned job is %s, want INTERRUPTED", job.Phase)
+	}
+	if job := waitForJob(t, second, next.ID); job.Phase != model.JobSucceeded {
+		t.Fatalf("import job on the other instance finished as %+v", job)
+	}
+	if ok, _ := (&fakeLock{table: locks}).TryLock(context.Background()); !ok {
+		t.Fatal("import lock was not released")
+	}
+}
+
+func decodeJob(t *testing.T, w *httptest.ResponseRecorder) model.ImportJob {
+	t.Helper()
+	var res struct {
+		Data model.ImportJob `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Data
+}
+
+func waitForJob(t *testing.T, a *App, id int64) model.ImportJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/esProduct/jobs/%d", id), nil))
+		if job := decodeJob(t, w); job.Finished() {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("import job %d did not finish", id)
+	return model.ImportJob{}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	cfg := config.StartupConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	calls := 0
+	err := retry(context.Background(), cfg, "test", func() error {
+		calls++
+		return errors.New("connection refused")
+	})
+	if err == nil || calls != 3 {
+		t.Fatalf("retry returned %v after %d calls, want an error after 3 calls", err, calls)
+	}
+
+	calls = 0
+	err = retry(context.Background(), cfg, "test", func() error {
+		calls++
+		if calls < 2 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("retry returned %v after %d calls, want success after 2 calls", err, calls)
+	}
+}
+
+// 修改同义词会重建索引，复制期间写入旧索引的变更要在切换后重放，ES 拒绝的规则不重放
+func TestSynonymChangeReplaysChanges(t *testing.T) {
+	repo := newFakeRepository()
+	repo.rejectRule = "的, 地"
+	changes := &fakeChangeLog{repo: repo, pos: model.BinlogPosition{File: "mysql-bin.000003", Pos: 2411}}
+	synonyms := &fakeSynonymDao{}
+	a := Assemble(config.Default(), Components{Dao: &fakeDao{}, Repository: repo, Jobs: &fakeJobDao{}, Synonyms: synonyms, Changes: changes})
+
+	if _, err := a.Synonym.AddRule(context.Background(), "手机, 移动电话"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Synonym.AddRule(context.Background(), "的, 地"); err == nil || len(synonyms.versions) != 1 {
+		t.Fatalf("rejected rule was saved: %v, %d versions", err, len(synonyms.versions))
+	}
+	want := []string{
+		"mark mysql-bin.000003:2411, 0 generations",
+		"replay mysql-bin.000003:2411, alias pms_v00000000000000001",
+		"mark mysql-bin.000003:2411, 1 generations",
+	}
+	if !reflect.DeepEqual(changes.events, want) {
+		t.Fatalf("change log calls:\n got %q\nwant %q", changes.events, want)
+	}
+}
+
+// 修改同义词替换的一代与导入替换的一样按 retain 保留；回滚只撤销导入，回滚到的一代使用线上的同义词
+func TestSynonymChangesKeepGenerationsForRollback(t *testing.T) {
+	repo := newFakeRepository()
+	cfg := config.Default()
+	cfg.Search.Reindex.Retain = 1
+	a := Assemble(cfg, Components{Dao: &fakeDao{products: []model.EsProduct{{ID: 26}}}, Repository: repo, Jobs: &fakeJobDao{}, Synonyms: &fakeSynonymDao{}})
+	ctx := context.Background()
+
+	if _, err := a.Service.ImportAll(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []string{"手机, 移动电话", "iphone => 苹果手机"} {
+		if _, err := a.Synonym.AddRule(ctx, rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	generations, _ := repo.Generations(ctx)
+	if len(generations) != 2 || !generations[0].Active || generations[1].DocsCount != 1 {
+		t.Fatalf("generations after an import and 2 synonym changes with retain=1: %+v", generations)
+	}
+	active := repo.filters[repo.alias]
+	if active != "[手机, 移动电话 iphone => 苹果手机] []" || repo.filters[generations[1].Name] == active {
+		t.Fatalf("filters %v", repo.filters)
+	}
+
+	previous, err := a.Service.Rollback(ctx)
+	if err != nil || previous != generations[1].Name {
+		t.Fatalf("rollback switched to %q (%v)", previous, err)
+	}
+	if got := repo.filters[repo.alias]; got != active {
+		t.Fatalf("rolled back generation uses synonyms %q, want the active %q", got, active)
+	}
+}
+
+// 两个实例基于同一个版本修改时，后保存的返回 409，并且不会重建索引
+func TestSynonymConflictBetweenInstances(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	repo := newFakeRepository()
+	dao := &fakeSynonymDao{}
+	a := Assemble(config.Default(), Components{Dao: &fakeDao{}, Repository: repo, Jobs: &fakeJobDao{}, Synonyms: dao})
+	dao.beforeCreate = func() {
+		dao.beforeCreate = nil
+		other := model.SynonymVersion{ID: 1, Rules: []model.SynonymRule{{ID: 1, Rule: "手机, 移动电话"}}, Comment: "add rule 1: 手机, 移动电话"}
+		if err := dao.Create(&other); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/esProduct/admin/synonyms", strings.NewReader(`{"rule":"iphone => 苹果手机"}`)))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	if len(dao.versions) != 1 || fmt.Sprint(dao.versions[0].Synonyms()) != "[手机, 移动电话]" {
+		t.Fatalf("saved versions %+v", dao.versions)
+	}
+	if repo.synonyms != nil || len(repo.indices) != 0 {
+		t.Fatalf("index rebuilt with %q for a conflicting change", repo.synonyms)
+	}
+
+	//基于最新版本重试可以成功
+	v, err := a.Synonym.AddRule(context.Background(), "iphone => 苹果手机")
+	if err != nil || v.ID != 2 || len(v.Rules) != 2 {
+		t.Fatalf("retry: %+v, %v", v, err)
+	}
+}
+
+// 修改同义词和全量导入都会新建一代索引并切换别名，任何实例在导入时都不能修改同义词，反之亦然
+func TestSynonymChangesWaitForImports(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dao := &fakeDao{products: []model.EsProduct{{ID: 26}}, block: make(chan struct{})}
+	repo := newFakeRepository()
+	jobs := &fakeJobDao{}
+	synonyms := &fakeSynonymDao{}
+	locks := &lockTable{}
+	first := Assemble(config.Default(), Components{Dao: dao, Repository: repo, Jobs: jobs, Synonyms: synonyms, ImportLock: &fakeLock{table: locks}})
+	second := Assemble(config.Default(), Components{Dao: dao, Repository: repo, Jobs: jobs, Synonyms: synonyms, ImportLock: &fakeLock{table: locks}})
+
+	job, err := first.ImportJobs.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []*App{first, second} {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/esProduct/admin/synonyms", strings.NewReader(`{"rule":"手机, 移动电话"}`)))
+		if w.Code != http.StatusConflict {
+			t.Fatalf("synonym change during an import: status %d, body %s", w.Code, w.Body)
+		}
+	}
+	if len(synonyms.versions) != 0 || repo.synonyms != nil {
+		t.Fatalf("synonyms changed during an import: versions %+v, index %q", synonyms.versions, repo.synonyms)
+	}
+
+	close(dao.block)
+	waitForJob(t, first, job.ID)
+	if _, err := second.Synonym.AddRule(context.Background(), "手机, 移动电话"); err != nil {
+		t.Fatal(err)
+	}
+
+	//同义词修改持有锁时不能开始导入
+	locked := &fakeLock{table: locks}
+	locked.TryLock(context.Background())
+	if _, err := first.Synonym.AddRule(context.Background(), "iphone => 苹果手机"); !errors.Is(err, service.ErrSynonymBusy) {
+		t.Fatalf("AddRule error = %v, want ErrSynonymBusy", err)
+	}
+	if _, err := second.ImportJobs.Start(); !errors.Is(err, service.ErrImportRunning) || !strings.Contains(err.Error(), "synonym change") {
+		t.Fatalf("Start error = %v, want ErrImportRunning for a synonym change", err)
+	}
+}
+
+func TestSynonymAdminAppliesEachVersion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	repo := newFakeRepository()
+	repo.rejectRule = "的, 地"
+	dao := &fakeSynonymDao{}
+	a := Assemble(config.Default(), Components{Dao: &fakeDao{}, Repository: repo, Jobs: &fakeJobDao{}, Synonyms: dao})
+
+	call := func(method, path, body string) (int, model.SynonymVersion) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(method, "/esProduct/admin/synonyms"+path, strings.NewReader(body)))
+		var res struct {
+			Data model.SynonymVersion `json:"data"`
+		}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, res.Data
+	}
+
+	if code, v := call(http.MethodPost, "", `{"rule":" 手机 ,移动电话,,  "}`); code != http.StatusOK || v.ID != 1 || v.Synonyms()[0] != "手机, 移动电话" {
+		t.Fatalf("add rule: %d %+v", code, v)
+	}
+	if code, v := call(http.MethodPost, "", `{"rule":"iphone => 苹果手机"}`); code != http.StatusOK || v.ID != 2 || len(v.Rules) != 2 {
+		t.Fatalf("add second rule: %d %+v", code, v)
+	}
+	if fmt.Sprint(repo.synonyms) != "[手机, 移动电话 iphone => 苹果手机]" {
+		t.Fatalf("applied synonyms %q", repo.synonyms)
+	}
+
+	//格式错误和 ES 拒绝的规则都返回 400，也不会保存新版本
+	for _, rule := range []string{`{"rule":"手机"}`, `{"rule":"a => b => c"}`, `{"rule":"的, 地"}`} {
+		if code, _ := call(http.MethodPost, "", rule); code != http.StatusBadRequest {
+			t.Errorf("add %s: status %d, want 400", rule, code)
+		}
+	}
+	if len(dao.versions) != 2 {
+		t.Fatalf("rejected rules saved %d versions, want 2", len(dao.versions))
+	}
+
+	if code, v := call(http.MethodPut, "/1", `{"rule":"手机, 移动电话, 智能手机"}`); code != http.StatusOK || v.Rules[0].Rule != "手机, 移动电话, 智能手机" {
+		t.Fatalf("update rule: %d %+v", code, v)
+	}
+	if code, _ := call(http.MethodPut, "/9", `{"rule":"a, b"}`); code != http.StatusNotFound {
+		t.Fatalf("update missing rule: status %d, want 404", code)
+	}
+	if code, v := call(http.MethodPost, "/stopwords", `{"word":" 的 "}`); code != http.StatusOK || fmt.Sprint(v.StopWords) != "[的]" {
+		t.Fatalf("add stop word: %d %+v", code, v)
+	}
+	if code, _ := call(http.MethodPost, "/stopwords", `{"word":"的"}`); code != http.StatusBadRequest {
+		t.Fatalf("add duplicate stop word: status %d, want 400", code)
+	}
+	if code, v := call(http.MethodDelete, "/2", ""); code != http.StatusOK || v.ID != 5 || len(v.Rules) != 1 {
+		t.Fatalf("delete rule: %d %+v", code, v)
+	}
+	if code, v := call(http.MethodDelete, "/stopwords/的", ""); code != http.StatusOK || len(v.StopWords) != 0 {
+		t.Fatalf("delete stop word: %d %+v", code, v)
+	}
+
+	//回滚保存为新版本，内容与旧版本相同
+	code, v := call(http.MethodPost, "/rollback/2", "")
+	if code != http.StatusOK || v.ID != 7 || fmt.Sprint(v.Synonyms()) != "[手机, 移动电话 iphone => 苹果手机]" {
+		t.Fatalf("rollback: %d %+v", code, v)
+	}
+	if fmt.Sprint(repo.synonyms) != "[手机, 移动电话 iphone => 苹果手机]" || len(repo.stopWords) != 0 {
+		t.Fatalf("rollback applied %q %q", repo.synonyms, repo.stopWords)
+	}
+	if code, _ := call(http.MethodPost, "/rollback/99", ""); code != http.StatusNotFound {
+		t.Fatalf("rollback to a missing version: status %d, want 404", code)
+	}
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/esProduct/admin/synonyms/versions?limit=3", nil))
+	var res struct {
+		Data []model.SynonymVersion `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data) != 3 || res.Data[0].ID != 7 || res.Data[0].Comment != "roll back to version 2" {
+		t.Fatalf("versions returned %s", w.Body)
+	}
+}
+
+// 不存在、已删除或未上架的商品 GetAllProductList 返回空列表，以前取 product[0] 时 panic
+func TestMissingProductReturnsNotFound(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dao := &fakeDao{products: []model.EsProduct{{ID: 26, Name: "华为 HUAWEI P20"}}}
+	repo := newFakeRepository()
+	a := Assemble(config.Default(), Components{Dao: dao, Repository: repo, Jobs: &fakeJobDao{}})
+	for _, req := range []struct{ method, target string }{
+		{http.MethodPost, "/esProduct/create/999"},
+		{http.MethodGet, "/esProduct/recommend/999"},
+	} {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(req.method, req.target, nil))
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "product not found") {
+			t.Errorf("%s %s returned %d %s, want 404", req.method, req.target, w.Code, w.Body)
+		}
+	}
+	if len(repo.live()) != 0 {
+		t.Fatalf("create/999 indexed %d products", len(repo.live()))
+	}
+}
+
+// shutdownLog 按发生的顺序记录停机过程中的事件
+type shutdownLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *shutdownLog) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+// index 返回事件第一次出现的位置，没有发生时返回 -1
+func (l *shutdownLog) index(event string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, e := range l.events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordingJobDao 在任务结束并保存时记录事件
+type recordingJobDao struct {
+	*fakeJobDao
+	log *shutdownLog
+}
+
+func (d *recordingJobDao) Save(job *model.ImportJob) error {
+	if job.Finished() {
+		d.log.add("import job " + string(job.Phase))
+	}
+	return d.fakeJobDao.Save(job)
+}
+
+// idleStream 是一直没有新事件的 binlog，Next 在 ctx 结束时返回
+type idleStream struct{}
+
+func (idleStream) Open(ctx context.Context, pos model.BinlogPosition) (cdc.Source, error) {
+	return idleStream{}, nil
+}
+
+func (idleStream) Current(ctx context.Context) (model.BinlogPosition, error) {
+	return model.BinlogPosition{File: "mysql-bin.000003", Pos: 2411}, nil
+}
+
+func (idleStream) Next(ctx context.Context) (cdc.Event, error) {
+	<-ctx.Done()
+	return cdc.Event{}, ctx.Err()
+}
+
+func (idleStream) Close() error {
+	return nil
+}
+
+// recordingCheckpoints 在 binlog 同步停止前保存检查点时记录事件
+type recordingCheckpoints struct {
+	log *shutdownLog
+}
+
+func (c *recordingCheckpoints) Load(name string) (*model.BinlogPosition, error) {
+	return nil, nil
+}
+
+func (c *recordingCheckpoints) Save(name string, pos model.BinlogPosition) error {
+	c.log.add("binlog checkpoint saved")
+	return nil
+}
+
+func (c *recordingCheckpoints) Rewind(name string, pos model.BinlogPosition) error {
+	return nil
+}
+
+func (c *recordingCheckpoints) Take(name string) (*model.BinlogPosition, error) {
+	return nil, nil
+}
+
+// closingConnector 不会真正连接数据库，只记录连接池被关闭，sql.DB.Close 会调用它的 Close
+type closingConnector struct {
+	log *shutdownLog
+}
+
+func (c closingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return nil, errors.New("no database in tests")
+}
+
+func (c closingConnector) Driver() driver.Driver {
+	return nil
+}
+
+func (c closingConnector) Close() error {
+	c.log.add("database closed")
+	return nil
+}
+
+// 收到 SIGTERM 后先从 Nacos 注销（这时仍然接收请求），再等待进行中的请求完成；
+// binlog 同步和导入任务要在关闭数据库之前停下来，它们停止时还要写检查点和任务状态
+func TestRunShutsDownGracefully(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	events := &shutdownLog{}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	base := fmt.Sprintf("http://127.0.0.1:%d", port)
+
+	registered := make(chan struct{})
+	var registerOnce sync.Once
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/nacos/v1/ns/instance" && r.Method == http.MethodPost:
+			registerOnce.Do(func() { close(registered) })
+		case r.URL.Path == "/nacos/v1/ns/instance" && r.Method == http.MethodDelete:
+			//注销时服务还没有停止接收请求，网关在刷新服务列表之前转发过来的请求仍然能处理
+			resp, err := http.Get(base + "/fast")
+			if err != nil {
+				events.add("deregistered after the server stopped accepting requests")
+			} else {
+				resp.Body.Close()
+				events.add("deregistered")
+			}
+		case r.URL.Path == "/nacos/v1/ns/instance/beat":
+			fmt.Fprint(w, `{"clientBeatInterval":5000,"code":10200}`)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer registry.Close()
+	client, err := nacos.NewClient(nacos.ClientConfig{ServerAddr: registry.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Server.Port = port
+	cfg.Spring.Lifecycle.TimeoutPerShutdownPhase = 5 * time.Second
+	dao := &fakeDao{products: []model.EsProduct{{ID: 26}}, block: make(chan struct{})}
+	repo := newFakeRepository()
+	a := Assemble(cfg, Components{Dao: dao, Repository: repo, Jobs: &recordingJobDao{fakeJobDao: &fakeJobDao{}, log: events}})
+	a.Registry = nacos.NewRegistry(client, nacos.Instance{Service: "mall-search", Group: "DEFAULT_GROUP", IP: "127.0.0.1", Port: port, Weight: 1}, time.Second)
+	a.CDC = cdc.NewSyncer(idleStream{}, dao, repo, &recordingCheckpoints{log: events}, nil, cdc.SyncerConfig{
+		Name: "mall-search", CheckpointInterval: time.Second, InitialBackoff: time.Second, MaxBackoff: time.Second,
+	})
+	a.DB, err = gorm.Open(mysql.New(mysql.Config{Conn: sql.OpenDB(closingConnector{log: events}), SkipInitializeWithVersion: true}), &gorm.Config{DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	a.Router.GET("/fast", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	a.Router.GET("/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		events.add("slow request finished")
+		c.String(http.StatusOK, "done")
+	})
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+	select {
+	case <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("instance was not registered with Nacos")
+	}
+	//导入任务一直运行到停机时被中断
+	if _, err := a.ImportJobs.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+		slow <- err
+	}()
+	<-started
+	stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for events.index("deregistered") < 0 && events.index("deregistered after the server stopped accepting requests") < 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("instance was not deregistered from Nacos")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+
+	if err := <-slow; err != nil {
+		t.Fatalf("in-flight request was not drained: %s", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return")
+	}
+
+	for _, order := range [][2]string{
+		{"deregistered", "slow request finished"},
+		{"binlog checkpoint saved", "database closed"},
+		{"import job " + string(model.JobInterrupted), "database closed"},
+	} {
+		first, second := events.index(order[0]), events.index(order[1])
+		if first < 0 || second < 0 || first > second {
+			t.Errorf("want %q before %q, events %q", order[0], order[1], events.events)
+		}
+	}
+}
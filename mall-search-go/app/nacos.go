@@ -0,0 +1,219 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"mall-search-go/config"
+	"mall-search-go/nacos"
+)
+
+// RemoteConfig 是从 Nacos 配置中心读取的配置，变更时用启动时的 Loader 按相同的顺序重新构建整个配置
+type RemoteConfig struct {
+	loader  *config.Loader
+	watcher *nacos.Watcher
+	refresh bool
+}
+
+// LoadConfig 加载本地配置，开启了 Nacos 配置中心时再读取远程配置并重新构建。
+// 与 Spring Cloud Alibaba 的默认行为一致，Nacos 不可用时只打印错误并使用本地配置启动，之后通过长轮询补上。
+// 返回的 RemoteConfig 在未开启配置中心时为 nil
+func LoadConfig(ctx context.Context, loader *config.Loader) (*config.Config, *RemoteConfig, error) {
+	cfg, err := loader.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	nacosCfg := cfg.Spring.Cloud.Nacos.Config
+	if !nacosCfg.NacosEnabled() {
+		return cfg, nil, nil
+	}
+
+	client, err := nacos.NewClient(nacos.ClientConfig{
+		ServerAddr: nacosCfg.ServerAddr,
+		Namespace:  nacosCfg.Namespace,
+		Username:   nacosCfg.Username,
+		Password:   nacosCfg.Password,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("spring.cloud.nacos.config: %w", err)
+	}
+	var keys []nacos.ConfigKey
+	for _, dataID := range cfg.DataIDs() {
+		keys = append(keys, nacos.ConfigKey{DataID: dataID, Group: nacosCfg.Group})
+	}
+	remote := &RemoteConfig{
+		loader:  loader,
+		watcher: nacos.NewWatcher(client, keys, nacosCfg.LongPollTimeout),
+		refresh: nacosCfg.RefreshEnabled,
+	}
+
+	contents, err := remote.watcher.Load(ctx)
+	if err != nil {
+		log.Printf("Error loading config from Nacos %s, starting with local config: %s", nacosCfg.ServerAddr, err)
+		return cfg, remote, nil
+	}
+	if cfg, err = remote.build(contents); err != nil {
+		return nil, nil, fmt.Errorf("config from Nacos: %w", err)
+	}
+	log.Printf("Loaded %v from Nacos %s", cfg.DataIDs(), nacosCfg.ServerAddr)
+	return cfg, remote, nil
+}
+
+func (r *RemoteConfig) build(contents []string) (*config.Config, error) {
+	remote := make([][]byte, len(contents))
+	for i, content := range contents {
+		remote[i] = []byte(content)
+	}
+	return r.loader.Load(remote...)
+}
+
+// Watch 长轮询配置变更直到 ctx 结束，把校验通过的新配置交给 apply，校验失败时保持原配置
+func (r *RemoteConfig) Watch(ctx context.Context, apply func(*config.Config)) {
+	if !r.refresh {
+		return
+	}
+	r.watcher.Watch(ctx, func(contents []string) {
+		cfg, err := r.build(contents)
+		if err != nil {
+			log.Printf("Ignoring config from Nacos: %s", err)
+			return
+		}
+		apply(cfg)
+	})
+}
+
+// configurable 是可以在运行中替换 search.* 配置的组件
+type configurable interface {
+	UpdateConfig(config.SearchConfig)
+}
+
+// Reload 应用配置中心推送的新配置，以下各项立即生效：
+// spring.lifecycle（停机超时）、management（健康检查超时）、search.bulk、search.reindex、
+// search.facets、search.highlight、search.suggest、search.spelling 和 search.paging。
+// 其余变更（端口、数据源、ES 地址、索引名、启动导入、binlog 同步和 Nacos 本身）需要重启，只打印提示
+func (a *App) Reload(cfg *config.Config) {
+	a.mu.Lock()
+	old := a.Config
+	for _, key := range restartRequired(old, cfg) {
+		log.Printf("%s changed in Nacos, restart %s to apply it", key, old.Spring.Application.Name)
+	}
+	next := *old
+	next.Spring.Lifecycle = cfg.Spring.Lifecycle
+	next.Management = cfg.Management
+	next.Search.Bulk = cfg.Search.Bulk
+	next.Search.Reindex = cfg.Search.Reindex
+	next.Search.Facets = cfg.Search.Facets
+	next.Search.Highlight = cfg.Search.Highlight
+	next.Search.Suggest = cfg.Search.Suggest
+	next.Search.Spelling = cfg.Search.Spelling
+	next.Search.Paging = cfg.Search.Paging
+	a.Config = &next
+	a.mu.Unlock()
+
+	for _, c := range []interface{}{a.Service, a.Repository} {
+		if c, ok := c.(configurable); ok {
+			c.UpdateConfig(next.Search)
+		}
+	}
+	a.Health.SetTimeout(next.Management.Health.Elasticsearch.ResponseTimeout)
+	log.Printf("Applied config from Nacos")
+}
+
+// currentConfig 返回最新的配置，Reload 可能在其他 goroutine 中替换 a.Config
+func (a *App) currentConfig() *config.Config {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.Config
+}
+
+// restartRequired 返回只在启动时读取、运行中修改不会生效的配置项
+func restartRequired(old, cfg *config.Config) []string {
+	sections := []struct {
+		key      string
+		old, new interface{}
+	}{
+		{"server", old.Server, cfg.Server},
+		{"spring.application", old.Spring.Application, cfg.Spring.Application},
+		{"spring.datasource", old.Spring.Datasource, cfg.Spring.Datasource},
+		{"spring.elasticsearch", old.Spring.Elasticsearch, cfg.Spring.Elasticsearch},
+		{"spring.cloud.nacos", old.Spring.Cloud, cfg.Spring.Cloud},
+		{"search.index", old.Search.Index, cfg.Search.Index},
+		{"search.startup", old.Search.Startup, cfg.Search.Startup},
+		{"search.cdc", old.Search.CDC, cfg.Search.CDC},
+	}
+	var keys []string
+	for _, s := range sections {
+		if !reflect.DeepEqual(s.old, s.new) {
+			keys = append(keys, s.key)
+		}
+	}
+	return keys
+}
+
+// newRegistry 按 spring.cloud.nacos.discovery 创建注册 mall-search 实例的 Registry，
+// 元数据中带上 actuator 的地址，供 mall-monitor（Spring Boot Admin）和网关检查健康状态
+func newRegistry(cfg *config.Config) (*nacos.Registry, error) {
+	discovery := cfg.Spring.Cloud.Nacos.Discovery
+	client, err := nacos.NewClient(nacos.ClientConfig{
+		ServerAddr: discovery.ServerAddr,
+		Namespace:  discovery.Namespace,
+		Username:   discovery.Username,
+		Password:   discovery.Password,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("spring.cloud.nacos.discovery: %w", err)
+	}
+	ip := discovery.IP
+	if ip == "" {
+		if ip, err = localIP(discovery.ServerAddr); err != nil {
+			return nil, fmt.Errorf("detect the address to register with Nacos, set spring.cloud.nacos.discovery.ip: %w", err)
+		}
+	}
+	port := discovery.Port
+	if port == 0 {
+		port = cfg.Server.Port
+	}
+	return nacos.NewRegistry(client, nacos.Instance{
+		Service: cfg.Spring.Application.Name,
+		Group:   discovery.Group,
+		Cluster: discovery.ClusterName,
+		IP:      ip,
+		Port:    port,
+		Weight:  discovery.Weight,
+		Metadata: map[string]string{
+			"preserved.register.source": "GO",
+			"profile":                   cfg.Profile,
+			"management.context-path":   "/actuator",
+			"health.path":               "health",
+			"health.liveness.path":      "/actuator/health/liveness",
+			"health.readiness.path":     "/actuator/health/readiness",
+		},
+	}, discovery.HeartbeatInterval), nil
+}
+
+// localIP 返回连接第一个 Nacos 地址时使用的本机地址，UDP 的 Dial 不会真正发送数据
+func localIP(serverAddr string) (string, error) {
+	addr := strings.TrimSpace(strings.Split(serverAddr, ",")[0])
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "8848")
+	}
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mall-search-go/config"
+)
+
+// configCenter 是只实现了读取和长轮询的 Nacos 配置中心
+type configCenter struct {
+	mu      sync.Mutex
+	configs map[string]string
+}
+
+func (c *configCenter) publish(dataID, content string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.configs[dataID] = content
+}
+
+func (c *configCenter) changed(listening string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var changed strings.Builder
+	for _, line := range strings.Split(listening, "\x01") {
+		words := strings.Split(line, "\x02")
+		if len(words) < 3 {
+			continue
+		}
+		sum := ""
+		if content := c.configs[words[0]]; content != "" {
+			digest := md5.Sum([]byte(content))
+			sum = hex.EncodeToString(digest[:])
+		}
+		if sum != words[2] {
+			changed.WriteString(words[0] + "\x02" + words[1] + "\x01")
+		}
+	}
+	return changed.String()
+}
+
+func (c *configCenter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/nacos/v1/cs/configs":
+		c.mu.Lock()
+		content, ok := c.configs[r.URL.Query().Get("dataId")]
+		c.mu.Unlock()
+		if !ok || r.URL.Query().Get("group") != "DEFAULT_GROUP" {
+			http.Error(w, "config data not exist", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, content)
+	case "/nacos/v1/cs/configs/listener":
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) && r.Context().Err() == nil {
+			if changed := c.changed(r.FormValue("Listening-Configs")); changed != "" {
+				fmt.Fprint(w, url.QueryEscape(changed))
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestLoadConfigFromNacosAndReload(t *testing.T) {
+	center := &configCenter{configs: map[string]string{
+		"mall-search.yaml":     "search:\n  bulk:\n    batch-size: 200\n    workers: 8\n",
+		"mall-search-dev.yaml": "management:\n  health:\n    elasticsearch:\n      response-timeout: 2s\n",
+	}}
+	server := httptest.NewServer(center)
+	defer server.Close()
+
+	dir := t.TempDir()
+	local := fmt.Sprintf("spring:\n  cloud:\n    nacos:\n      config:\n        server-addr: %s\n        long-poll-timeout: 10s\n", server.URL)
+	if err := ioutil.WriteFile(filepath.Join(dir, "mall-search.yaml"), []byte(local), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loader, err := config.NewLoader([]string{"-profile=dev", "-config-dir=" + dir, "-search.bulk.workers=3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, remote, err := LoadConfig(context.Background(), loader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 远程配置覆盖本地文件，命令行参数覆盖远程配置
+	if cfg.Search.Bulk.BatchSize != 200 || cfg.Search.Bulk.Workers != 3 || cfg.Management.Health.Elasticsearch.ResponseTimeout != 2*time.Second {
+		t.Fatalf("bulk = %+v, health timeout = %s", cfg.Search.Bulk, cfg.Management.Health.Elasticsearch.ResponseTimeout)
+	}
+
+	a := Assemble(cfg, Components{Dao: &fakeDao{}, Repository: newFakeRepository(), Jobs: &fakeJobDao{}})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		remote.Watch(ctx, a.Reload)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	//校验失败的配置被忽略
+	center.publish("mall-search.yaml", "search:\n  bulk:\n    batch-size: 0\n")
+	time.Sleep(100 * time.Millisecond)
+	if got := a.currentConfig().Search.Bulk.BatchSize; got != 200 {
+		t.Fatalf("invalid config was applied, batch-size = %d", got)
+	}
+
+	center.publish("mall-search.yaml", "search:\n  bulk:\n    batch-size: 300\n")
+	center.publish("mall-search-dev.yaml", "server:\n  port: 9090\nmanagement:\n  health:\n    elasticsearch:\n      response-timeout: 3s\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Health.Timeout() != 3*time.Second || a.currentConfig().Search.Bulk.BatchSize != 300 {
+		if time.Now().After(deadline) {
+			t.Fatalf("config was not reloaded: %+v, health timeout %s", a.currentConfig().Search.Bulk, a.Health.Timeout())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// server.port 需要重启才能生效，运行中的配置保持不变
+	if got := a.currentConfig(); got.Server.Port != 8081 || got.Search.Bulk.Workers != 3 {
+		t.Fatalf("port = %d, workers = %d", got.Server.Port, got.Search.Bulk.Workers)
+	}
+}
+
+func TestLoadConfigWithoutNacos(t *testing.T) {
+	loader, err := config.NewLoader([]string{"-config-dir=" + t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, remote, err := LoadConfig(context.Background(), loader)
+	if err != nil || remote != nil {
+		t.Fatalf("remote = %v, err = %v", remote, err)
+	}
+	if cfg.Spring.Cloud.Nacos.Discovery.NacosEnabled() {
+		t.Fatal("discovery enabled without a server address")
+	}
+}
@@ -0,0 +1,35 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"mall-search-go/config"
+)
+
+// retry 调用 fn 直到成功、达到最大次数或 ctx 结束，每次失败后的等待时间翻倍，不超过 MaxBackoff
+func retry(ctx context.Context, cfg config.StartupConfig, name string, fn func() error) error {
+	backoff := cfg.InitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt >= cfg.MaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		log.Printf("%s is not available (attempt %d/%d): %s, retrying in %s", name, attempt, cfg.MaxAttempts, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > cfg.MaxBackoff {
+			backoff = cfg.MaxBackoff
+		}
+	}
+}
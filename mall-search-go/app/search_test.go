@@ -0,0 +1,554 @@
+package app
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/gin-gonic/gin"
+	"mall-search-go/config"
+	"mall-search-go/model"
+	"mall-search-go/repository"
+)
+
+// searchES 是只实现 _search 和 PIT 的假 ES，记录收到的查询并返回 response，response 为空时返回一个固定的命中
+type searchES struct {
+	mu       sync.Mutex
+	queries  []map[string]interface{}
+	response string
+	// delay 模拟响应慢的 ES
+	delay time.Duration
+	// reply 不为 nil 时按查询返回响应，优先于 response
+	reply func(q map[string]interface{}) string
+}
+
+func (s *searchES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	//导出在 PIT 上搜索，路径中没有索引
+	switch r.URL.Path {
+	case "/pms/_search", "/_search":
+	case "/pms/_pit":
+		fmt.Fprint(w, `{"id":"pit-1"}`)
+		return
+	case "/_pit":
+		fmt.Fprint(w, `{"succeeded":true,"num_freed":1}`)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var q map[string]interface{}
+	if err := json.Unmarshal(body, &q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	response, delay := s.response, s.delay
+	if s.reply != nil {
+		response = s.reply(q)
+	}
+	s.mu.Unlock()
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+		return
+	}
+	if response != "" {
+		fmt.Fprint(w, response)
+		return
+	}
+	fmt.Fprint(w, `{"took":1,"hits":{"total":{"value":1,"relation":"eq"},"hits":[{"_id":"26","_score":17,"_source":{"id":26,"brandId":3,"name":"华为 HUAWEI P20","price":3788}}]}}`)
+}
+
+func (s *searchES) last() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queries) == 0 {
+		return nil
+	}
+	return s.queries[len(s.queries)-1]
+}
+
+// lastSearch 返回最后一个搜索商品的查询，跳过命中少时追加的拼写纠正
+func (s *searchES) lastSearch() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.queries) - 1; i >= 0; i-- {
+		if _, ok := s.queries[i]["suggest"]; !ok {
+			return s.queries[i]
+		}
+	}
+	return nil
+}
+
+func newSearchApp(t *testing.T, attrs ...model.ProductAttribute) (*App, *searchES) {
+	gin.SetMode(gin.TestMode)
+	es := &searchES{}
+	server := httptest.NewServer(es)
+	t.Cleanup(server.Close)
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	repo := repository.NewEsProductRepository(client, cfg.Search)
+	return Assemble(cfg, Components{Dao: &fakeDao{attrs: attrs}, Repository: repo, Jobs: &fakeJobDao{}}), es
+}
+
+// jsonPath 按 key 或下标依次取出嵌套的值，取不到时返回 nil
+func jsonPath(v interface{}, path ...interface{}) interface{} {
+	for _, p := range path {
+		switch key := p.(type) {
+		case string:
+			m, _ := v.(map[string]interface{})
+			v = m[key]
+		case int:
+			a, _ := v.([]interface{})
+			if key >= len(a) {
+				return nil
+			}
+			v = a[key]
+		}
+	}
+	return v
+}
+
+func TestSearchCombinesKeywordScoringWithFilters(t *testing.T) {
+	a, es := newSearchApp(t)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	//以前不传品牌和分类时按 brandId=0、productCategoryId=0 过滤，并且丢掉了关键词打分
+	w := get("/esProduct/search?keyword=手机&pageNum=1&pageSize=5")
+	var res struct {
+		Code int        `json:"code"`
+		Data model.Page `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Code != 200 || len(res.Data.Content) != 1 || res.Data.Content[0].ID != 26 {
+		t.Fatalf("search returned %d %s", w.Code, w.Body)
+	}
+	q := es.last()
+	if jsonPath(q, "query", "bool") != nil {
+		t.Fatalf("keyword-only search is filtered: %v", q["query"])
+	}
+	fs := jsonPath(q, "query", "function_score")
+	if jsonPath(fs, "min_score") != 2.0 || jsonPath(fs, "score_mode") != "sum" {
+		t.Fatalf("function_score = %v", fs)
+	}
+	for i, want := range []struct {
+		field  string
+		weight float64
+	}{{"name", 10}, {"subTitle", 5}, {"keywords", 2}} {
+		if jsonPath(fs, "functions", i, "filter", "match", want.field) != "手机" || jsonPath(fs, "functions", i, "weight") != want.weight {
+			t.Fatalf("function %d = %v", i, jsonPath(fs, "functions", i))
+		}
+	}
+
+	get("/esProduct/search?keyword=手机&brandId=3&sort=3")
+	q = es.last()
+	filters := jsonPath(q, "query", "bool", "filter").([]interface{})
+	if len(filters) != 1 || jsonPath(filters[0], "term", "brandId") != 3.0 {
+		t.Fatalf("filters = %v", filters)
+	}
+	if jsonPath(q, "query", "bool", "must", 0, "function_score", "min_score") != 2.0 {
+		t.Fatalf("filtered search lost keyword scoring: %v", q["query"])
+	}
+	if jsonPath(q, "sort", 0, "price", "order") != "asc" || jsonPath(q, "sort", 1, "_score", "order") != "desc" {
+		t.Fatalf("sort = %v", q["sort"])
+	}
+
+	get("/esProduct/search?productCategoryId=19")
+	q = es.last()
+	if jsonPath(q, "query", "bool", "must", 0, "match_all") == nil || jsonPath(q, "query", "bool", "filter", 0, "term", "productCategoryId") != 19.0 {
+		t.Fatalf("category search = %v", q["query"])
+	}
+
+	before := len(es.queries)
+	if w := get("/esProduct/search?brandId=abc"); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid brandId: status %d", w.Code)
+	}
+	if len(es.queries) != before {
+		t.Fatal("invalid brandId reached Elasticsearch")
+	}
+}
+
+func TestSearchFiltersByPriceStatusPromotionAndStock(t *testing.T) {
+	a, es := newSearchApp(t)
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/esProduct/search?minPrice=1999.00&maxPrice=4999&newStatus=1&recommandStatus=0&promotionType=3&inStock=true&pageNum=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	filters, _ := jsonPath(es.last(), "query", "bool", "filter").([]interface{})
+	want := []string{
+		`{"term":{"newStatus":1}}`,
+		`{"term":{"recommandStatus":0}}`,
+		`{"term":{"promotionType":3}}`,
+		`{"range":{"price":{"gte":1999,"lte":4999}}}`,
+		`{"range":{"stock":{"gt":0}}}`,
+	}
+	if len(filters) != len(want) {
+		t.Fatalf("filters = %v", filters)
+	}
+	for i, f := range filters {
+		if got, _ := json.Marshal(f); string(got) != want[i] {
+			t.Errorf("filter %d = %s, want %s", i, got, want[i])
+		}
+	}
+
+	for _, target := range []string{
+		"/esProduct/search?minPrice=abc",
+		"/esProduct/search?maxPrice=NaN",
+		"/esProduct/search?maxPrice=Inf",
+		"/esProduct/search?minPrice=0x1p3",
+		"/esProduct/search?minPrice=1_000",
+		"/esProduct/search?minPrice=1e999",
+		"/esProduct/search?minPrice=500&maxPrice=100",
+		"/esProduct/search?inStock=maybe",
+		"/esProduct/search?newStatus=1.5",
+	} {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", target, w.Code)
+		}
+	}
+}
+
+func TestSearchFiltersByAttributes(t *testing.T) {
+	a, es := newSearchApp(t)
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/esProduct/search?keyword=手机&attr=43:5.8&attr=44:黑色,金色&attr=44:白色", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	// 不同属性之间是“且”，同一属性的多个值是“或”，重复出现的属性合并
+	filters, _ := jsonPath(es.last(), "query", "bool", "filter").([]interface{})
+	want := []string{
+		`{"nested":{"path":"attrValueList","query":{"bool":{"filter":[{"term":{"attrValueList.productAttributeId":43}},{"terms":{"attrValueList.value":["5.8"]}}]}},"score_mode":"none"}}`,
+		`{"nested":{"path":"attrValueList","query":{"bool":{"filter":[{"term":{"attrValueList.productAttributeId":44}},{"terms":{"attrValueList.value":["黑色","金色","白色"]}}]}},"score_mode":"none"}}`,
+	}
+	if len(filters) != len(want) {
+		t.Fatalf("filters = %v", filters)
+	}
+	for i, f := range filters {
+		if got, _ := json.Marshal(f); string(got) != want[i] {
+			t.Errorf("filter %d = %s, want %s", i, got, want[i])
+		}
+	}
+
+	for _, attr := range []string{"43", "43:", "x:5.8", ":黑色", "43:,"} {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/esProduct/search?attr="+attr, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("attr=%s: status %d", attr, w.Code)
+		}
+	}
+}
+
+func TestSearchRelatedReturnsFilterableAttributes(t *testing.T) {
+	a, es := newSearchApp(t,
+		model.ProductAttribute{ID: 43, Name: "屏幕尺寸", Type: 1, SearchType: 1},
+		model.ProductAttribute{ID: 44, Name: "颜色", Type: 1, SearchType: 1, FilterType: 1},
+	)
+	//以前这个结构的响应会在类型断言时 panic
+	es.response = `{"hits":{"total":{"value":2},"hits":[]},"aggregations":{
+"brandNames":{"buckets":[{"key":"华为","doc_count":1},{"key":"小米","doc_count":1}]},
+"productCategoryNames":{"buckets":[{"key":"手机通讯","doc_count":2}]},
+"allAttrValues":{"doc_count":9,"productAttrs":{"doc_count":4,"attrIds":{"buckets":[
+{"key":44,"doc_count":2,"attrValues":{"buckets":[{"key":"黑色","doc_count":1},{"key":"金色","doc_count":1}]},"attrNames":{"buckets":[{"key":"颜色","doc_count":2}]}},
+{"key":43,"doc_count":2,"attrValues":{"buckets":[{"key":"5.8","doc_count":1},{"key":"6.1","doc_count":1}]},"attrNames":{"buckets":[{"key":"屏幕尺寸","doc_count":2}]}},
+{"key":45,"doc_count":1,"attrValues":{"buckets":[{"key":"其他","doc_count":1}]},"attrNames":{"buckets":[{"key":"不再检索的属性","doc_count":1}]}}]}}}}}`
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/esProduct/search/relate?keyword=手机", nil))
+	var res struct {
+		Code int                        `json:"code"`
+		Data model.EsProductRelatedInfo `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Code != 200 {
+		t.Fatalf("search/relate returned %d %s", w.Code, w.Body)
+	}
+	info := res.Data
+	if len(info.BrandNames) != 2 || len(info.ProductCategoryNames) != 1 || len(info.ProductAttrs) != 2 {
+		t.Fatalf("info = %+v", info)
+	}
+	if attr := info.ProductAttrs[0]; attr.AttrId != 44 || attr.AttrName != "颜色" || attr.FilterType != 1 || len(attr.AttrValues) != 2 {
+		t.Fatalf("attr = %+v", attr)
+	}
+
+	//只聚合需要检索的参数
+	q := es.last()
+	filter := jsonPath(q, "aggs", "allAttrValues", "aggs", "productAttrs", "filter", "bool", "filter")
+	if jsonPath(filter, 0, "term", "attrValueList.type") != 1.0 || fmt.Sprint(jsonPath(filter, 1, "terms", "attrValueList.productAttributeId")) != "[43 44]" {
+		t.Fatalf("attribute filter = %v", filter)
+	}
+}
+
+func TestSearchReturnsHighlights(t *testing.T) {
+	a, es := newSearchApp(t)
+	es.response = `{"hits":{"total":{"value":1},"hits":[{"_id":"26","_score":17,"_source":{"id":26,"name":"华为 HUAWEI P20","subTitle":"AI智慧全面屏 6GB +64GB"},
+"highlight":{"name":["<em>华为</em> HUAWEI P20"]}}]}}`
+	for _, target := range []string{
+		"/esProduct/search?keyword=华为&highlight=true",
+		"/esProduct/search/simple?keyword=华为&pageNum=1&pageSize=5&highlight=true",
+	} {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		var res struct {
+			Data model.Page `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s returned %d %s", target, w.Code, w.Body)
+		}
+		//高亮单独返回，商品的字段不变
+		if res.Data.Content[0].Name != "华为 HUAWEI P20" || fmt.Sprint(res.Data.Highlights[26]["name"]) != "[<em>华为</em> HUAWEI P20]" {
+			t.Fatalf("%s: content %+v, highlights %v", target, res.Data.Content[0], res.Data.Highlights)
+		}
+		h := jsonPath(es.lastSearch(), "highlight")
+		if jsonPath(h, "pre_tags", 0) != "<em>" || jsonPath(h, "fields", "subTitle") == nil || jsonPath(h, "highlight_query", "multi_match", "query") != "华为" {
+			t.Fatalf("%s: highlight = %v", target, h)
+		}
+	}
+
+	es.mu.Lock()
+	es.response = ""
+	es.mu.Unlock()
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/esProduct/search?keyword=华为", nil))
+	if jsonPath(es.last(), "highlight") != nil || bytes.Contains(w.Body.Bytes(), []byte("Highlights")) {
+		t.Fatalf("highlighted without highlight=true: %s", w.Body)
+	}
+}
+
+func TestSuggestCompletesPrefixWithinCategory(t *testing.T) {
+	a, es := newSearchApp(t)
+	es.response = `{"took":1,"hits":{"total":{"value":0,"relation":"eq"},"hits":[]},"suggest":{"products":[{"text":"华为","offset":0,"length":2,"options":[
+{"text":"华为","_id":"26","_score":40,"_source":{"id":26,"name":"华为 HUAWEI P20 ","brandName":"华为","productCategoryName":"手机通讯"}},
+{"text":"华为 HUAWEI P20","_id":"26","_score":20,"_source":{"id":26,"name":"华为 HUAWEI P20 ","brandName":"华为","productCategoryName":"手机通讯"}},
+{"text":"华为手机","_id":"27","_score":10,"_source":{"id":27,"name":"HUAWEI Mate 20","brandName":"华为","productCategoryName":"手机通讯"}}]}]}}`
+	get := func(target string) (int, []model.Suggestion) {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		var res struct {
+			Data []model.Suggestion `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res.Data
+	}
+
+	code, suggestions := get("/esProduct/suggest?prefix=华为&productCategoryId=19&size=50")
+	want := []model.Suggestion{
+		{Text: "华为", Type: model.SuggestionBrand},
+		{Text: "华为 HUAWEI P20", Type: model.SuggestionProduct, ProductId: 26},
+		{Text: "华为手机", Type: model.SuggestionKeyword},
+	}
+	if code != http.StatusOK || fmt.Sprint(suggestions) != fmt.Sprint(want) {
+		t.Fatalf("suggest returned %d %+v", code, suggestions)
+	}
+	completion := jsonPath(es.last(), "suggest", "products", "completion")
+	//size 不能超过 search.suggest.size
+	if jsonPath(completion, "contexts", "category", 0) != "19" || jsonPath(completion, "size") != float64(10) || jsonPath(es.last(), "size") != float64(0) {
+		t.Fatalf("suggest query = %v", es.last())
+	}
+
+	//没有输入时不查询 ES
+	last := es.last()
+	if code, suggestions := get("/esProduct/suggest?prefix=%20"); code != http.StatusOK || suggestions == nil || fmt.Sprint(es.last()) != fmt.Sprint(last) {
+		t.Fatalf("empty prefix returned %d %v", code, suggestions)
+	}
+	if code, _ := get("/esProduct/suggest?prefix=华为&productCategoryId=phone"); code != http.StatusBadRequest {
+		t.Fatalf("invalid productCategoryId returned %d", code)
+	}
+
+	//ES 在 search.suggest.timeout 内没有返回时返回空的提示，而不是错误
+	cfg := *a.Config
+	cfg.Search.Suggest.Timeout = 20 * time.Millisecond
+	a.Reload(&cfg)
+	es.mu.Lock()
+	es.delay = time.Second
+	es.mu.Unlock()
+	start := time.Now()
+	code, suggestions = get("/esProduct/suggest?prefix=华为")
+	if code != http.StatusOK || suggestions == nil || len(suggestions) != 0 {
+		t.Fatalf("slow suggest returned %d %v", code, suggestions)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("slow suggest took %s", elapsed)
+	}
+}
+
+func TestSearchSuggestsCorrectedKeyword(t *testing.T) {
+	a, es := newSearchApp(t)
+	es.reply = func(q map[string]interface{}) string {
+		if text := jsonPath(q, "suggest", "spelling", "text"); text != nil {
+			if text == "华伟手机" {
+				return `{"hits":{"total":{"value":0},"hits":[]},"suggest":{"spelling":[{"text":"华伟手机","options":[{"text":"华为手机","score":0.02}]}]}}`
+			}
+			return `{"hits":{"total":{"value":0},"hits":[]},"suggest":{"spelling":[{"text":"` + text.(string) + `","options":[]}]}}`
+		}
+		if jsonPath(q, "query", "bool", "should", 0, "match", "name") == "华为手机" {
+			return `{"hits":{"total":{"value":1},"hits":[{"_id":"26","_source":{"id":26,"name":"华为 HUAWEI P20"}}]}}`
+		}
+		return `{"hits":{"total":{"value":0},"hits":[]}}`
+	}
+	search := func(target string) model.Page {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		var res struct {
+			Data model.Page `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s returned %d %s", target, w.Code, w.Body)
+		}
+		return res.Data
+	}
+
+	//默认只提示纠正后的搜索词，结果仍然是原搜索词的
+	page := search("/esProduct/search/simple?keyword=华伟手机&pageNum=1&pageSize=5")
+	if page.Suggestion != "华为手机" || page.Corrected || len(page.Content) != 0 {
+		t.Fatalf("page = %+v", page)
+	}
+	phrase := jsonPath(es.last(), "suggest", "spelling", "phrase")
+	if jsonPath(phrase, "direct_generator", 1, "field") != "keywords" || jsonPath(phrase, "collate", "query", "source") == nil {
+		t.Fatalf("spelling query = %v", es.last())
+	}
+
+	page = search("/esProduct/search/simple?keyword=华伟手机&pageNum=1&pageSize=5&autoCorrect=true")
+	if page.Suggestion != "华为手机" || !page.Corrected || len(page.Content) != 1 || page.Content[0].ID != 26 {
+		t.Fatalf("corrected page = %+v", page)
+	}
+
+	//没有更好的写法时不提示
+	if page := search("/esProduct/search/simple?keyword=小米&pageNum=1&pageSize=5&autoCorrect=true"); page.Suggestion != "" || page.Corrected {
+		t.Fatalf("page = %+v", page)
+	}
+
+	//结果足够多时不纠正
+	es.mu.Lock()
+	es.reply = nil
+	es.response = `{"hits":{"total":{"value":3},"hits":[]}}`
+	es.queries = nil
+	es.mu.Unlock()
+	search("/esProduct/search/simple?keyword=华为&pageNum=1&pageSize=5")
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if len(es.queries) != 1 {
+		t.Fatalf("sent %d queries for a keyword with enough results", len(es.queries))
+	}
+}
+
+// 页码 0 按第一页处理，超出前 10000 条的页码和无效的游标返回 400
+func TestSearchPaging(t *testing.T) {
+	a, es := newSearchApp(t)
+	for _, target := range []string{
+		"/esProduct/search/simple?keyword=华为&pageNum=0&pageSize=5",
+		"/esProduct/search?keyword=华为",
+	} {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		var res struct {
+			Data model.Page `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s returned %d %s", target, w.Code, w.Body)
+		}
+		if from := jsonPath(es.lastSearch(), "from"); from != float64(0) || res.Data.PageInfo.Number != 1 {
+			t.Errorf("%s: from %v, page %+v", target, from, res.Data.PageInfo)
+		}
+	}
+
+	for _, target := range []string{
+		"/esProduct/search/simple?keyword=华为&pageNum=2001&pageSize=5",
+		"/esProduct/search?keyword=华为&cursor=not-a-cursor",
+	} {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s returned %d, want 400", target, w.Code)
+		}
+	}
+}
+
+func TestExportStreamsAllMatchingProducts(t *testing.T) {
+	a, es := newSearchApp(t)
+	//第一批是满的 500 条，第二批从最后一条之后继续
+	es.reply = func(q map[string]interface{}) string {
+		first, n := 1, 500
+		if q["search_after"] != nil {
+			first, n = 501, 2
+		}
+		hits := make([]string, n)
+		for i := range hits {
+			id := first + i
+			hits[i] = fmt.Sprintf(`{"_id":"%d","_source":{"id":%d,"brandId":3,"brandName":"华为","name":"华为 P%d","price":"3788.00",`+
+				`"attrValueList":[{"productAttributeId":44,"name":"颜色","value":"黑色","type":0}]},"sort":[1.0,%d]}`, id, id, id, id)
+		}
+		return `{"pit_id":"pit-1","hits":{"hits":[` + strings.Join(hits, ",") + `]}}`
+	}
+	export := func(target string) *http.Response {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w.Result()
+	}
+
+	res := export("/esProduct/export?brandId=3")
+	body, _ := ioutil.ReadAll(res.Body)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/x-ndjson" || len(lines) != 502 {
+		t.Fatalf("ndjson export: %d %s, %d lines", res.StatusCode, res.Header.Get("Content-Type"), len(lines))
+	}
+	var last model.EsProduct
+	if err := json.Unmarshal([]byte(lines[501]), &last); err != nil || last.ID != 502 || last.AttrValueList[0].Value != "黑色" {
+		t.Fatalf("last line %s", lines[501])
+	}
+	if res.Trailer.Get("X-Export-Count") != "502" || res.Trailer.Get("X-Export-Status") != "complete" {
+		t.Fatalf("trailers %v", res.Trailer)
+	}
+	q := es.last()
+	if jsonPath(q, "pit", "id") != "pit-1" || jsonPath(q, "search_after", 1) != float64(500) || q["track_total_hits"] != false {
+		t.Fatalf("export query %v", q)
+	}
+	if jsonPath(q, "query", "bool", "filter", 0, "term", "brandId") != float64(3) {
+		t.Fatalf("export ignored the criteria: %v", q)
+	}
+
+	res = export("/esProduct/export?format=csv&brandId=3")
+	body, _ = ioutil.ReadAll(res.Body)
+	if !bytes.HasPrefix(body, []byte("\ufeff")) {
+		t.Fatalf("csv export has no BOM")
+	}
+	records, err := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(body, []byte("\ufeff")))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 503 || records[0][0] != "id" || strings.Join(records[1], "|") != "1||华为 P1|||3|华为|0||3788.00|0|0|0|0|0|0||颜色:黑色" {
+		t.Fatalf("csv export: %d records, %q, %q", len(records), records[0], records[1])
+	}
+
+	if res := export("/esProduct/export?format=xml"); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("format=xml returned %d", res.StatusCode)
+	}
+	//还没有写出任何内容时失败返回普通的错误响应
+	es.mu.Lock()
+	es.reply = func(map[string]interface{}) string { return `not json` }
+	es.mu.Unlock()
+	if res := export("/esProduct/export"); res.StatusCode != http.StatusBadRequest || res.Header.Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Fatalf("failed export returned %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,351 @@
+package cdc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	perrors "github.com/pingcap/errors"
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-log/log"
+	"mall-search-go/model"
+)
+
+// BinlogConfig 是以复制客户端身份连接 MySQL 所需的参数。
+// MySQL 需要开启 binlog_format=ROW（5.7 之后的默认值），binlog_row_image 为 FULL 时可以直接从行镜像判断上下架状态
+type BinlogConfig struct {
+	Addr     string
+	User     string
+	Password string
+	// Schema 和 Tables 决定哪些表的行事件会被返回，其余的只用于推进位置
+	Schema string
+	Tables []string
+	// ServerID 在同一个 MySQL 的所有复制客户端（包括从库）中必须唯一
+	ServerID uint32
+	// Heartbeat 是服务器在没有新事件时发送心跳的间隔，超过 3 个间隔读不到数据就认为连接已断开
+	Heartbeat time.Duration
+}
+
+// BinlogStream 打开 MySQL 的 binlog 流，复制协议由 go-mysql 的 BinlogSyncer 实现。
+// binlog_row_metadata=FULL 时行事件自带列名，否则从 information_schema 中读取
+type BinlogStream struct {
+	config BinlogConfig
+	db     *sql.DB
+	// lookup 返回表的列名，默认查询 information_schema
+	lookup func(ctx context.Context, table string) ([]string, error)
+
+	mu      sync.Mutex
+	columns map[string][]string
+}
+
+func NewBinlogStream(cfg BinlogConfig, db *sql.DB) *BinlogStream {
+	s := &BinlogStream{config: cfg, db: db, columns: make(map[string][]string)}
+	s.lookup = s.queryColumns
+	return s
+}
+
+// Current 返回 SHOW MASTER STATUS 中的当前位置，MySQL 8.4 之后改名为 SHOW BINARY LOG STATUS
+func (s *BinlogStream) Current(ctx context.Context) (model.BinlogPosition, error) {
+	var pos model.BinlogPosition
+	var err error
+	for _, query := range []string{"SHOW MASTER STATUS", "SHOW BINARY LOG STATUS"} {
+		if pos, err = s.queryPosition(ctx, query); err == nil {
+			return pos, nil
+		}
+	}
+	return pos, err
+}
+
+func (s *BinlogStream) queryPosition(ctx context.Context, query string) (model.BinlogPosition, error) {
+	var pos model.BinlogPosition
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return pos, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return pos, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return pos, err
+		}
+		return pos, errors.New("binary logging is not enabled on the MySQL server")
+	}
+	values := make([]interface{}, len(columns))
+	values[0], values[1] = &pos.File, &pos.Pos
+	for i := 2; i < len(values); i++ {
+		values[i] = new(sql.RawBytes)
+	}
+	return pos, rows.Scan(values...)
+}
+
+// columnNames 返回表的列名，按定义顺序排列。refresh 为 true 时忽略缓存，表结构变更后使用
+func (s *BinlogStream) columnNames(ctx context.Context, table string, refresh bool) ([]string, error) {
+	s.mu.Lock()
+	names, ok := s.columns[table]
+	s.mu.Unlock()
+	if ok && !refresh {
+		return names, nil
+	}
+
+	names, err := s.lookup(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.columns[table] = names
+	s.mu.Unlock()
+	return names, nil
+}
+
+func (s *BinlogStream) queryColumns(ctx context.Context, table string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION",
+		s.config.Schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, strings.ToLower(name))
+	}
+	return names, rows.Err()
+}
+
+// Open 连接 MySQL 并从 pos 开始接收 binlog 事件。连接断开后 Next 返回错误，由 Syncer 从最后提交的位置重连
+func (s *BinlogStream) Open(ctx context.Context, pos model.BinlogPosition) (Source, error) {
+	host, port, err := net.SplitHostPort(s.config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MySQL port in %q: %w", s.config.Addr, err)
+	}
+	syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+		ServerID:        s.config.ServerID,
+		Flavor:          mysql.MySQLFlavor,
+		Host:            host,
+		Port:            uint16(portNum),
+		User:            s.config.User,
+		Password:        s.config.Password,
+		HeartbeatPeriod: s.config.Heartbeat,
+		ReadTimeout:     3 * s.config.Heartbeat,
+		//价格等 DECIMAL 列保留精确的十进制值
+		UseDecimal: true,
+		//重连和退避由 Syncer 负责
+		DisableRetrySync: true,
+		Logger:           syncerLogger,
+	})
+	streamer, err := syncer.StartSync(mysql.Position{Name: pos.File, Pos: pos.Pos})
+	if err != nil {
+		syncer.Close()
+		//go-mysql 用 pingcap/errors 附加调用栈，这里取出原始错误，调用方可以用 errors.As 判断 *mysql.MyError
+		return nil, fmt.Errorf("MySQL replication: %w", perrors.Cause(err))
+	}
+	src := &BinlogSource{
+		syncer:   syncer,
+		streamer: streamer,
+		stream:   s,
+		pos:      pos,
+		watched:  make(map[string]bool),
+	}
+	for _, table := range s.config.Tables {
+		src.watched[table] = true
+	}
+	return src, nil
+}
+
+// syncerLogger 只输出 go-mysql 的警告和错误，连接和位置的变化由 Syncer 记录
+var syncerLogger = func() *log.Logger {
+	handler, _ := log.NewStreamHandler(os.Stderr)
+	logger := log.NewDefault(handler)
+	logger.SetLevel(log.LevelWarn)
+	return logger
+}()
+
+// BinlogSource 是一个复制连接上的事件流
+type BinlogSource struct {
+	syncer   *replication.BinlogSyncer
+	streamer *replication.BinlogStreamer
+	stream   *BinlogStream
+	pos      model.BinlogPosition
+	watched  map[string]bool
+	// schemaChanged 在 DDL 之后置为 true，下一次解析行事件时重新读取列名
+	schemaChanged bool
+
+	closeOnce sync.Once
+}
+
+func (s *BinlogSource) Close() error {
+	s.closeOnce.Do(s.syncer.Close)
+	return nil
+}
+
+func (s *BinlogSource) Next(ctx context.Context) (Event, error) {
+	for {
+		ev, err := s.streamer.GetEvent(ctx)
+		if err != nil {
+			return Event{}, err
+		}
+		event, ok, err := s.handle(ctx, ev)
+		if err != nil {
+			return Event{}, fmt.Errorf("binlog event at %s: %w", s.pos, err)
+		}
+		if ok {
+			return event, nil
+		}
+	}
+}
+
+// handle 处理一个 binlog 事件，ok 为 true 时返回给调用方
+func (s *BinlogSource) handle(ctx context.Context, ev *replication.BinlogEvent) (event Event, ok bool, err error) {
+	switch e := ev.Event.(type) {
+	case *replication.RotateEvent:
+		s.pos = model.BinlogPosition{File: string(e.NextLogName), Pos: uint32(e.Position)}
+		return event, false, nil
+	case *replication.RowsEvent:
+		s.advance(ev.Header)
+		schema, table := string(e.Table.Schema), string(e.Table.Table)
+		if schema != s.stream.config.Schema || !s.watched[table] {
+			return event, false, nil
+		}
+		names, err := s.columnNames(ctx, e)
+		if err != nil {
+			return event, false, err
+		}
+		action := rowsAction(ev.Header.EventType)
+		rows, err := rowChanges(action, e.Rows, names)
+		if err != nil {
+			return event, false, err
+		}
+		return Event{Position: s.pos, Schema: schema, Table: table, Action: action, Rows: rows}, true, nil
+	case *replication.XIDEvent:
+		s.advance(ev.Header)
+		return Event{Position: s.pos, Commit: true}, true, nil
+	case *replication.QueryEvent:
+		s.advance(ev.Header)
+		query := strings.TrimSpace(string(e.Query))
+		switch {
+		case strings.EqualFold(query, "BEGIN"):
+		case strings.EqualFold(query, "COMMIT"):
+			//非事务表的提交
+			return Event{Position: s.pos, Commit: true}, true, nil
+		default:
+			s.schemaChanged = true
+		}
+		return event, false, nil
+	}
+	if ev.Header.EventType != replication.HEARTBEAT_EVENT {
+		s.advance(ev.Header)
+	}
+	return event, false, nil
+}
+
+// columnNames 优先使用行事件自带的列名，没有时按表名读取，列数对不上说明表结构变了，重新读取
+func (s *BinlogSource) columnNames(ctx context.Context, e *replication.RowsEvent) ([]string, error) {
+	if names := e.Table.ColumnNameString(); len(names) == int(e.ColumnCount) {
+		for i := range names {
+			names[i] = strings.ToLower(names[i])
+		}
+		return names, nil
+	}
+	table := string(e.Table.Table)
+	names, err := s.stream.columnNames(ctx, table, s.schemaChanged)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) != int(e.ColumnCount) {
+		if names, err = s.stream.columnNames(ctx, table, true); err != nil {
+			return nil, err
+		}
+	}
+	s.schemaChanged = false
+	return names, nil
+}
+
+// advance 把位置移到事件之后，伪造的事件（例如 dump 开始时的 ROTATE）log_pos 为 0
+func (s *BinlogSource) advance(header *replication.EventHeader) {
+	if header.LogPos != 0 {
+		s.pos.Pos = header.LogPos
+	}
+}
+
+func rowsAction(t replication.EventType) string {
+	switch t {
+	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		return ActionInsert
+	case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		return ActionUpdate
+	}
+	return ActionDelete
+}
+
+// rowChanges 把 go-mysql 解码出的行按列名转换为 RowChange，update 事件的行是前后镜像交替排列的
+func rowChanges(action string, values [][]interface{}, names []string) ([]RowChange, error) {
+	var changes []RowChange
+	for i := 0; i < len(values); i++ {
+		row, err := namedRow(values[i], names)
+		if err != nil {
+			return nil, err
+		}
+		switch action {
+		case ActionInsert:
+			changes = append(changes, RowChange{After: row})
+		case ActionDelete:
+			changes = append(changes, RowChange{Before: row})
+		case ActionUpdate:
+			if i+1 == len(values) {
+				return nil, errors.New("update rows event without an after image")
+			}
+			i++
+			after, err := namedRow(values[i], names)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, RowChange{Before: row, After: after})
+		}
+	}
+	return changes, nil
+}
+
+// namedRow 按列名组成 Row，整数统一为 int64，DECIMAL 为十进制字符串，与录制的事件一致
+func namedRow(values []interface{}, names []string) (Row, error) {
+	if len(values) != len(names) {
+		return nil, fmt.Errorf("row has %d columns but the table has %d", len(values), len(names))
+	}
+	row := make(Row, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case int8:
+			row[names[i]] = int64(v)
+		case int16:
+			row[names[i]] = int64(v)
+		case int32:
+			row[names[i]] = int64(v)
+		case decimal.Decimal:
+			row[names[i]] = v.String()
+		case []byte:
+			row[names[i]] = string(v)
+		default:
+			row[names[i]] = v
+		}
+	}
+	return row, nil
+}
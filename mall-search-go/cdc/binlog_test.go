@@ -0,0 +1,338 @@
+package cdc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/server"
+	"mall-search-go/model"
+)
+
+// fakeMaster 用 go-mysql 的 server 包模拟 MySQL 主库：完成握手，对 SET 语句返回 OK，
+// 收到 COM_BINLOG_DUMP 后推送 events，然后像真的主库一样等待新事件，直到 close 断开连接
+type fakeMaster struct {
+	server.EmptyReplicationHandler
+	listener net.Listener
+	password string
+	events   [][]byte
+	// checksumOff 在客户端要求不带校验和时为 true
+	checksumOff bool
+	// dump 是客户端请求的起始位置
+	dump      chan model.BinlogPosition
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeMaster(t *testing.T, password string, events [][]byte) *fakeMaster {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMaster{listener: l, password: password, events: events, dump: make(chan model.BinlogPosition, 1), closed: make(chan struct{})}
+	go m.serve()
+	return m
+}
+
+func (m *fakeMaster) close() {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		m.listener.Close()
+	})
+}
+
+// serve 接受所有连接，BinlogSyncer 关闭时会另开一个连接 KILL 复制连接
+func (m *fakeMaster) serve() {
+	for {
+		nc, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer nc.Close()
+			c, err := server.NewConn(nc, "canal", m.password, m)
+			if err != nil {
+				return
+			}
+			for c.HandleCommand() == nil {
+			}
+		}()
+	}
+}
+
+func (m *fakeMaster) HandleQuery(query string) (*mysql.Result, error) {
+	switch {
+	case strings.HasPrefix(query, "SHOW GLOBAL VARIABLES LIKE 'BINLOG_CHECKSUM'"):
+		rs, err := mysql.BuildSimpleTextResultset([]string{"Variable_name", "Value"}, [][]interface{}{{"binlog_checksum", "CRC32"}})
+		return &mysql.Result{Resultset: rs}, err
+	case query == "SET @master_binlog_checksum='NONE'":
+		m.checksumOff = true
+	}
+	return &mysql.Result{}, nil
+}
+
+func (m *fakeMaster) HandleRegisterSlave(data []byte) error {
+	return nil
+}
+
+func (m *fakeMaster) HandleBinlogDump(pos mysql.Position) (*replication.BinlogStreamer, error) {
+	if !m.checksumOff {
+		return nil, errors.New("the fake master only sends events without checksums")
+	}
+	m.dump <- model.BinlogPosition{File: pos.Name, Pos: pos.Pos}
+	s := replication.NewBinlogStreamer()
+	for _, event := range m.events {
+		s.AddEventToStreamer(&replication.BinlogEvent{RawData: event})
+	}
+	go func() {
+		<-m.closed
+		s.AddErrorToStreamer(io.EOF)
+	}()
+	return s, nil
+}
+
+// encoder 按小端序拼接事件内容
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint8(v uint8)   { e.buf = append(e.buf, v) }
+func (e *encoder) uint16(v uint16) { e.buf = append(e.buf, le(uint64(v), 2)...) }
+func (e *encoder) uint32(v uint32) { e.buf = append(e.buf, le(uint64(v), 4)...) }
+func (e *encoder) bytes(b []byte)  { e.buf = append(e.buf, b...) }
+func (e *encoder) cstring(s string) {
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+func le(v uint64, n int) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b[:n]
+}
+
+// binlogEvent 构造一个不带校验和的事件
+func binlogEvent(eventType replication.EventType, logPos uint32, body []byte) []byte {
+	var e encoder
+	e.uint32(uint32(time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC).Unix()))
+	e.uint8(byte(eventType))
+	e.uint32(1)
+	e.uint32(uint32(replication.EventHeaderSize + len(body)))
+	e.uint32(logPos)
+	e.uint16(0)
+	e.bytes(body)
+	return e.buf
+}
+
+func rotateBody(file string, pos uint64) []byte {
+	return append(le(pos, 8), file...)
+}
+
+// formatDescriptionBody 的校验和算法为 OFF，FORMAT_DESCRIPTION 本身总是带着 4 字节的校验和位置
+func formatDescriptionBody() []byte {
+	var e encoder
+	e.uint16(4)
+	version := make([]byte, 50)
+	copy(version, "8.0.35")
+	e.bytes(version)
+	e.uint32(0)
+	e.uint8(replication.EventHeaderSize)
+	e.bytes(make([]byte, 40))
+	e.uint8(byte(replication.BINLOG_CHECKSUM_ALG_OFF))
+	e.uint32(0)
+	return e.buf
+}
+
+func queryBody(schema, query string) []byte {
+	var e encoder
+	e.uint32(1)
+	e.uint32(0)
+	e.uint8(uint8(len(schema)))
+	e.uint16(0)
+	e.uint16(0)
+	e.cstring(schema)
+	e.bytes([]byte(query))
+	return e.buf
+}
+
+// pms_product 的一部分列：id bigint, name varchar(200), price decimal(10,2),
+// delete_status int, publish_status int, promotion_start_time datetime
+var productColumns = []string{"id", "name", "price", "delete_status", "publish_status", "promotion_start_time"}
+
+func tableMapBody(tableID uint64, schema, table string) []byte {
+	var e encoder
+	e.bytes(le(tableID, 6))
+	e.uint16(1)
+	e.uint8(uint8(len(schema)))
+	e.cstring(schema)
+	e.uint8(uint8(len(table)))
+	e.cstring(table)
+	e.uint8(6)
+	e.bytes([]byte{mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_NEWDECIMAL,
+		mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_DATETIME2})
+	meta := []byte{200, 0, 10, 2, 0}
+	e.uint8(uint8(len(meta)))
+	e.bytes(meta)
+	e.uint8(0x3e)
+	return e.buf
+}
+
+type productRow struct {
+	id        int64
+	name      string
+	price     []byte
+	deleted   int32
+	published int32
+	// promotion 为零值时写入 NULL
+	promotion time.Time
+}
+
+func (r productRow) encode(e *encoder) {
+	var nulls byte
+	if r.promotion.IsZero() {
+		nulls = 0x20
+	}
+	e.uint8(nulls)
+	e.bytes(le(uint64(r.id), 8))
+	e.uint8(uint8(len(r.name)))
+	e.bytes([]byte(r.name))
+	e.bytes(r.price)
+	e.uint32(uint32(r.deleted))
+	e.uint32(uint32(r.published))
+	if !r.promotion.IsZero() {
+		t := r.promotion
+		ym := int64(t.Year()*13 + int(t.Month()))
+		ymd := ym<<5 | int64(t.Day())
+		hms := int64(t.Hour()<<12 | t.Minute()<<6 | t.Second())
+		v := uint64(ymd<<17|hms) + 0x8000000000
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		e.bytes(b[3:])
+	}
+}
+
+func rowsBody(eventType replication.EventType, tableID uint64, rows ...productRow) []byte {
+	var e encoder
+	e.bytes(le(tableID, 6))
+	e.uint16(0)
+	e.uint16(2)
+	e.uint8(6)
+	e.uint8(0x3f)
+	if eventType == replication.UPDATE_ROWS_EVENTv2 {
+		e.uint8(0x3f)
+	}
+	for _, r := range rows {
+		r.encode(&e)
+	}
+	return e.buf
+}
+
+func TestBinlogSourceDecodesRowEvents(t *testing.T) {
+	promotion := time.Date(2018, 8, 31, 10, 20, 30, 0, time.UTC)
+	events := [][]byte{
+		binlogEvent(replication.ROTATE_EVENT, 0, rotateBody("mysql-bin.000003", 4)),
+		binlogEvent(replication.FORMAT_DESCRIPTION_EVENT, 0, formatDescriptionBody()),
+		binlogEvent(replication.QUERY_EVENT, 300, queryBody("mall", "BEGIN")),
+		binlogEvent(replication.TABLE_MAP_EVENT, 380, tableMapBody(42, "mall", "pms_product")),
+		binlogEvent(replication.UPDATE_ROWS_EVENTv2, 520, rowsBody(replication.UPDATE_ROWS_EVENTv2, 42,
+			// 3788.00 -> 3599.50，同时下架
+			productRow{id: 26, name: "华为 HUAWEI P20", price: []byte{0x80, 0x00, 0x0e, 0xcc, 0x00}, published: 1},
+			productRow{id: 26, name: "华为 HUAWEI P20", price: []byte{0x80, 0x00, 0x0e, 0x0f, 0x32}, published: 0, promotion: promotion},
+		)),
+		binlogEvent(replication.XID_EVENT, 551, make([]byte, 8)),
+		//别的库里同名的表和不关心的表都要跳过，但位置要前进
+		binlogEvent(replication.TABLE_MAP_EVENT, 630, tableMapBody(43, "other", "pms_product")),
+		binlogEvent(replication.WRITE_ROWS_EVENTv2, 700, rowsBody(replication.WRITE_ROWS_EVENTv2, 43,
+			productRow{id: 1, name: "x", price: []byte{0x7f, 0xff, 0xff, 0xff, 0x9b}})),
+		binlogEvent(replication.XID_EVENT, 731, make([]byte, 8)),
+	}
+	master := newFakeMaster(t, "123456", events)
+	defer master.close()
+
+	stream := &BinlogStream{
+		config: BinlogConfig{
+			Addr: master.listener.Addr().String(), User: "canal", Password: "123456",
+			Schema: "mall", Tables: Tables, ServerID: 1001,
+		},
+		lookup: func(ctx context.Context, table string) ([]string, error) {
+			return productColumns, nil
+		},
+		columns: make(map[string][]string),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	src, err := stream.Open(ctx, model.BinlogPosition{File: "mysql-bin.000003", Pos: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	event, err := src.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := <-master.dump; pos.File != "mysql-bin.000003" || pos.Pos != 4 {
+		t.Fatalf("dump requested from %s", pos)
+	}
+	if event.Table != "pms_product" || event.Action != ActionUpdate || len(event.Rows) != 1 || event.Position.Pos != 520 {
+		t.Fatalf("update event = %+v", event)
+	}
+	before, after := event.Rows[0].Before, event.Rows[0].After
+	if before["price"] != "3788" || after["price"] != "3599.5" || after["name"] != "华为 HUAWEI P20" {
+		t.Fatalf("decoded rows before=%v after=%v", before, after)
+	}
+	if id, _ := after.Int("id"); id != 26 || searchable(after) || !searchable(before) {
+		t.Fatalf("decoded status columns before=%v after=%v", before, after)
+	}
+	if before["promotion_start_time"] != nil || after["promotion_start_time"] != "2018-08-31 10:20:30" {
+		t.Fatalf("decoded datetime before=%v after=%v", before["promotion_start_time"], after["promotion_start_time"])
+	}
+
+	commit, err := src.Next(ctx)
+	if err != nil || !commit.Commit || commit.Position != (model.BinlogPosition{File: "mysql-bin.000003", Pos: 551}) {
+		t.Fatalf("commit event = %+v, %v", commit, err)
+	}
+	commit, err = src.Next(ctx)
+	if err != nil || !commit.Commit || commit.Position.Pos != 731 {
+		t.Fatalf("rows of unwatched tables were not skipped: %+v, %v", commit, err)
+	}
+	master.close()
+	if _, err := src.Next(ctx); err == nil || ctx.Err() != nil {
+		t.Fatalf("expected a connection error after the master went away, got %v", err)
+	}
+}
+
+func TestBinlogSourceRejectsWrongPassword(t *testing.T) {
+	master := newFakeMaster(t, "123456", nil)
+	defer master.close()
+	stream := NewBinlogStream(BinlogConfig{Addr: master.listener.Addr().String(), User: "canal", Password: "wrong", ServerID: 1001}, nil)
+	_, err := stream.Open(context.Background(), model.BinlogPosition{File: "mysql-bin.000001", Pos: 4})
+	var mysqlErr *mysql.MyError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Code != mysql.ER_ACCESS_DENIED_ERROR {
+		t.Fatalf("Open with a wrong password returned %#v", err)
+	}
+}
+
+func TestNamedRowNormalizesValues(t *testing.T) {
+	row, err := namedRow([]interface{}{int32(26), int8(1), []byte("华为"), nil}, []string{"id", "publish_status", "name", "promotion_start_time"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row["id"] != int64(26) || row["publish_status"] != int64(1) || row["name"] != "华为" || row["promotion_start_time"] != nil {
+		t.Fatalf("namedRow = %#v", row)
+	}
+	if _, err := namedRow([]interface{}{int64(1)}, productColumns); err == nil {
+		t.Fatal("a row with fewer values than columns should be rejected")
+	}
+	if action := rowsAction(replication.DELETE_ROWS_EVENTv1); action != ActionDelete {
+		t.Fatalf("rowsAction(DELETE_ROWS_EVENTv1) = %s", action)
+	}
+}
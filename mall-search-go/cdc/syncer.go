@@ -0,0 +1,462 @@
+package cdc
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"mall-search-go/model"
+)
+
+// 需要同步的表，pms_product 的行镜像可以直接判断删除和上下架状态，
+// 另外两个表的变更只说明某个商品需要重新从数据库读取
+const (
+	productTable        = "pms_product"
+	attributeValueTable = "pms_product_attribute_value"
+	skuStockTable       = "pms_sku_stock"
+)
+
+// Tables 是 Syncer 关心的表
+var Tables = []string{productTable, attributeValueTable, skuStockTable}
+
+// Products 读取可以被搜索的商品，store.EsproductDao 满足这个接口
+type Products interface {
+	GetProducts(ctx context.Context, ids []int64) ([]model.EsProduct, error)
+}
+
+// Index 是同步的目标，repository.EsProductRepository 满足这个接口
+type Index interface {
+	SaveAll([]model.EsProduct) (int, error)
+	DeletaBatch([]int64) error
+}
+
+// Checkpoints 保存同步进度，store.CdcCheckpointDao 满足这个接口。
+// 没有在同步的实例通过 Rewind/Take 把 Replay 的请求交给正在同步的实例
+type Checkpoints interface {
+	Load(name string) (*model.BinlogPosition, error)
+	Save(name string, pos model.BinlogPosition) error
+	Rewind(name string, pos model.BinlogPosition) error
+	Take(name string) (*model.BinlogPosition, error)
+}
+
+// Lock 保证多个服务实例中同一时间只有一个在消费 binlog，store.DbLock 满足这个接口
+type Lock interface {
+	TryLock(ctx context.Context) (bool, error)
+	Held(ctx context.Context) (bool, error)
+	Unlock() error
+}
+
+type SyncerConfig struct {
+	// Name 是检查点的名称，同一个数据库上的多个服务实例应使用相同的名称
+	Name string
+	// CheckpointInterval 是保存检查点的最小间隔，重启后最多重放这段时间内的事务，写入 ES 是幂等的
+	CheckpointInterval time.Duration
+	// InitialBackoff/MaxBackoff 是断线重连的退避间隔
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// LockInterval 是没有拿到锁时重试、拿到锁后确认锁仍然有效并领取其他实例的重放请求的间隔
+	LockInterval time.Duration
+}
+
+// Syncer 消费行事件，每个事务提交时把涉及的商品写入或删除，然后推进检查点
+type Syncer struct {
+	stream      Stream
+	products    Products
+	index       Index
+	checkpoints Checkpoints
+	lock        Lock
+	config      SyncerConfig
+
+	// pos 是最后一个已经写入 ES 的事务之后的位置，只在 Run 中修改，其他 goroutine 读取时要持有 mu
+	pos     model.BinlogPosition
+	savedAt time.Time
+	saved   model.BinlogPosition
+
+	mu sync.Mutex
+	// replay 是 Replay 要求回退到的位置，interrupt 中断正在进行的 consume
+	replay    *model.BinlogPosition
+	interrupt context.CancelFunc
+	// leading 表示这个实例拿到了锁并且已经从检查点恢复了 pos
+	leading bool
+}
+
+// NewSyncer 创建 Syncer，lock 为 nil 时不和其他实例协调，只应该用于单个实例
+func NewSyncer(stream Stream, products Products, index Index, checkpoints Checkpoints, lock Lock, cfg SyncerConfig) *Syncer {
+	return &Syncer{stream: stream, products: products, index: index, checkpoints: checkpoints, lock: lock, config: cfg}
+}
+
+// Run 从检查点（没有时从当前位置）开始同步，出错时按退避间隔重连并从最后提交的位置继续，直到 ctx 结束。
+// 有锁时只有拿到锁的实例消费 binlog，所有实例共用同一个检查点和 server-id；其余实例每隔 LockInterval 尝试一次，
+// 锁失效（例如连接断开）后停止消费重新等待。返回前会保存最新的检查点
+func (s *Syncer) Run(ctx context.Context) error {
+	if s.lock == nil {
+		return s.sync(ctx)
+	}
+	for {
+		if !s.acquire(ctx) {
+			return nil
+		}
+		leaderCtx, cancel := context.WithCancel(ctx)
+		watched := make(chan struct{})
+		go func() {
+			defer close(watched)
+			s.watchLock(leaderCtx, cancel)
+		}()
+		err := s.sync(leaderCtx)
+		cancel()
+		<-watched
+		s.resign()
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+		log.Printf("Lost the binlog sync lock, standing by")
+	}
+}
+
+// acquire 每隔 LockInterval 尝试获取锁，拿到锁时返回 true，ctx 结束时返回 false
+func (s *Syncer) acquire(ctx context.Context) bool {
+	waiting := false
+	for {
+		ok, err := s.lock.TryLock(ctx)
+		switch {
+		case ok:
+			log.Printf("Acquired the binlog sync lock")
+			return true
+		case err != nil:
+			log.Printf("Error acquiring the binlog sync lock: %s", err)
+		case !waiting:
+			log.Printf("Another instance is syncing the binlog, standing by")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(s.config.LockInterval):
+		}
+	}
+}
+
+// watchLock 每隔 LockInterval 确认锁仍然有效并领取其他实例的重放请求，锁失效时调用 cancel 停止消费
+func (s *Syncer) watchLock(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(s.config.LockInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		held, err := s.lock.Held(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil || !held {
+			log.Printf("Binlog sync lock is no longer held (%v), stopping", err)
+			cancel()
+			return
+		}
+		s.takeReplay()
+	}
+}
+
+// resign 释放锁，还没有处理的重放请求交给下一个拿到锁的实例
+func (s *Syncer) resign() {
+	s.mu.Lock()
+	pending := s.replay
+	s.replay = nil
+	s.leading = false
+	s.mu.Unlock()
+	if pending != nil {
+		s.requestReplay(*pending)
+	}
+	if err := s.lock.Unlock(); err != nil {
+		log.Printf("Error releasing the binlog sync lock: %s", err)
+	}
+}
+
+// replayName 是其他实例写入重放请求的检查点名称
+func (s *Syncer) replayName() string {
+	return s.config.Name + ":replay"
+}
+
+// requestReplay 把重放请求写入检查点表，多个请求只保留最早的位置
+func (s *Syncer) requestReplay(from model.BinlogPosition) {
+	if err := s.checkpoints.Rewind(s.replayName(), from); err != nil {
+		log.Printf("Error requesting binlog replay from %s: %s", from, err)
+	}
+}
+
+// takeReplay 领取其他实例写入的重放请求
+func (s *Syncer) takeReplay() {
+	from, err := s.checkpoints.Take(s.replayName())
+	if err != nil {
+		log.Printf("Error taking binlog replay requests: %s", err)
+		return
+	}
+	if from != nil {
+		s.Replay(*from)
+	}
+}
+
+// sync 在这个实例上消费 binlog，直到 ctx 结束
+func (s *Syncer) sync(ctx context.Context) error {
+	if err := s.resume(ctx); err != nil {
+		return err
+	}
+	defer s.checkpoint(true)
+	s.mu.Lock()
+	s.leading = true
+	s.mu.Unlock()
+	if s.lock != nil {
+		//没有实例在同步时写入的请求
+		s.takeReplay()
+	}
+
+	backoff := s.config.InitialBackoff
+	for {
+		before := s.pos
+		err := s.consume(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if s.rewind() {
+			backoff = s.config.InitialBackoff
+			continue
+		}
+		if s.pos != before {
+			backoff = s.config.InitialBackoff
+		}
+		log.Printf("Binlog sync stopped at %s: %s, reconnecting in %s", s.pos, err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > s.config.MaxBackoff {
+			backoff = s.config.MaxBackoff
+		}
+	}
+}
+
+func (s *Syncer) resume(ctx context.Context) error {
+	saved, err := s.checkpoints.Load(s.config.Name)
+	if err != nil {
+		return err
+	}
+	if saved != nil {
+		s.mu.Lock()
+		s.pos = *saved
+		s.mu.Unlock()
+		s.saved = *saved
+		log.Printf("Resuming binlog sync from checkpoint %s", s.pos)
+		return nil
+	}
+	current, err := s.stream.Current(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.pos = current
+	s.mu.Unlock()
+	log.Printf("No binlog checkpoint, starting from the current position %s", s.pos)
+	return nil
+}
+
+// Mark 返回已经写入 ES 的位置，在这之前提交的变更都已经可以从数据库读到。
+// 全量导入开始读取数据库之前调用，切换别名后用 Replay 重新同步之后的变更。Run 还没有开始时返回空位置。
+// 同步在其他实例上进行时返回它保存的检查点，最多落后 CheckpointInterval，从更早的位置重放没有副作用
+func (s *Syncer) Mark() model.BinlogPosition {
+	s.mu.Lock()
+	pos, local := s.pos, s.lock == nil || s.leading
+	s.mu.Unlock()
+	if local {
+		return pos
+	}
+	saved, err := s.checkpoints.Load(s.config.Name)
+	if err != nil {
+		log.Printf("Error loading binlog checkpoint: %s", err)
+		return model.BinlogPosition{}
+	}
+	if saved == nil {
+		return model.BinlogPosition{}
+	}
+	return *saved
+}
+
+// Replay 让 Run 从 from 重新同步。全量导入期间的变更写入的是别名指向的旧索引，
+// 切换到新一代之后需要重放；重新读取商品并写入是幂等的，重复的事务没有副作用。from 为空时什么都不做。
+// 同步在其他实例上进行时把请求写入检查点表，由那个实例在 LockInterval 内领取
+func (s *Syncer) Replay(from model.BinlogPosition) {
+	if from.File == "" {
+		return
+	}
+	s.mu.Lock()
+	if s.lock != nil && !s.leading {
+		s.mu.Unlock()
+		s.requestReplay(from)
+		return
+	}
+	defer s.mu.Unlock()
+	if s.replay == nil || from.Before(*s.replay) {
+		s.replay = &from
+	}
+	//即使 pos 还没有越过 from 也要中断：正在写入的事务可能在别名切换之前就发出了请求
+	if s.interrupt != nil {
+		s.interrupt()
+	}
+}
+
+// rewind 处理 Replay 的请求，把 pos 和检查点回退到要求的位置，没有请求时返回 false
+func (s *Syncer) rewind() bool {
+	s.mu.Lock()
+	from := s.replay
+	s.replay = nil
+	if from != nil && from.Before(s.pos) {
+		s.pos = *from
+	}
+	s.mu.Unlock()
+	if from == nil {
+		return false
+	}
+	log.Printf("Replaying binlog from %s", s.pos)
+	//回退的检查点立即保存，重启后也会重放
+	s.checkpoint(true)
+	return true
+}
+
+func (s *Syncer) consume(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	s.interrupt = cancel
+	//Run 处理之前到达的 Replay 请求
+	if s.replay != nil {
+		cancel()
+	}
+	s.mu.Unlock()
+
+	source, err := s.stream.Open(ctx, s.pos)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	pending := make(map[int64]bool)
+	for {
+		event, err := source.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if !event.Commit {
+			collect(event, pending)
+			continue
+		}
+		if err := s.apply(ctx, pending); err != nil {
+			return err
+		}
+		pending = make(map[int64]bool)
+		s.mu.Lock()
+		s.pos = event.Position
+		s.mu.Unlock()
+		s.checkpoint(false)
+	}
+}
+
+// collect 把事件涉及的商品记到 pending 中：true 表示需要从数据库重新读取，false 表示直接删除
+func collect(event Event, pending map[int64]bool) {
+	for _, change := range event.Rows {
+		switch event.Table {
+		case productTable:
+			row := change.After
+			if event.Action == ActionDelete {
+				row = change.Before
+			}
+			id, ok := row.Int("id")
+			if !ok {
+				continue
+			}
+			pending[id] = event.Action != ActionDelete && searchable(row)
+		case attributeValueTable, skuStockTable:
+			for _, row := range []Row{change.Before, change.After} {
+				//不覆盖同一事务中 pms_product 行镜像已经做出的判断
+				if id, ok := row.Int("product_id"); ok {
+					if _, seen := pending[id]; !seen {
+						pending[id] = true
+					}
+				}
+			}
+		}
+	}
+}
+
+// searchable 按行镜像判断商品是否可以被搜索，镜像中没有状态列（binlog_row_image=MINIMAL）时交给数据库判断
+func searchable(row Row) bool {
+	if deleted, ok := row.Int("delete_status"); ok && deleted != 0 {
+		return false
+	}
+	if published, ok := row.Int("publish_status"); ok && published != 1 {
+		return false
+	}
+	return true
+}
+
+// apply 重新读取需要更新的商品并写入 ES，数据库中查不到的（已删除或已下架）和确定要删除的从 ES 中删除
+func (s *Syncer) apply(ctx context.Context, pending map[int64]bool) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	var reload, deletes []int64
+	for id, load := range pending {
+		if load {
+			reload = append(reload, id)
+		} else {
+			deletes = append(deletes, id)
+		}
+	}
+	sort.Slice(reload, func(i, j int) bool { return reload[i] < reload[j] })
+
+	products, err := s.products.GetProducts(ctx, reload)
+	if err != nil {
+		return err
+	}
+	found := make(map[int64]bool, len(products))
+	for _, p := range products {
+		found[p.ID] = true
+	}
+	for _, id := range reload {
+		if !found[id] {
+			deletes = append(deletes, id)
+		}
+	}
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i] < deletes[j] })
+
+	if len(products) > 0 {
+		if _, err := s.index.SaveAll(products); err != nil {
+			return err
+		}
+	}
+	if len(deletes) > 0 {
+		if err := s.index.DeletaBatch(deletes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpoint 保存当前位置，force 为 false 时距离上次保存不足 CheckpointInterval 则跳过
+func (s *Syncer) checkpoint(force bool) {
+	if s.pos == s.saved || s.pos.File == "" {
+		return
+	}
+	if !force && time.Since(s.savedAt) < s.config.CheckpointInterval {
+		return
+	}
+	if err := s.checkpoints.Save(s.config.Name, s.pos); err != nil {
+		log.Printf("Error saving binlog checkpoint %s: %s", s.pos, err)
+		return
+	}
+	s.saved = s.pos
+	s.savedAt = time.Now()
+}
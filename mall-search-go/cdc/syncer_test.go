@@ -0,0 +1,485 @@
+package cdc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"mall-search-go/model"
+)
+
+// replayStream 回放 testdata 中录制的事件，Open 从 pos 之后的事件开始。
+// 事件放完之后的下一次 Open 会取消 ctx，让 Syncer.Run 返回
+type replayStream struct {
+	file    string
+	current model.BinlogPosition
+	cancel  context.CancelFunc
+	opened  []model.BinlogPosition
+}
+
+func (s *replayStream) Current(ctx context.Context) (model.BinlogPosition, error) {
+	return s.current, nil
+}
+
+func (s *replayStream) Open(ctx context.Context, pos model.BinlogPosition) (Source, error) {
+	s.opened = append(s.opened, pos)
+	if len(s.opened) > 1 {
+		s.cancel()
+		return nil, ctx.Err()
+	}
+	f, err := os.Open(s.file)
+	if err != nil {
+		return nil, err
+	}
+	return &afterSource{Source: NewReplaySource(f), pos: pos}, nil
+}
+
+// afterSource 跳过 pos 及之前的事件，模拟从检查点开始 dump
+type afterSource struct {
+	Source
+	pos model.BinlogPosition
+}
+
+func (s *afterSource) Next(ctx context.Context) (Event, error) {
+	for {
+		event, err := s.Source.Next(ctx)
+		if err != nil {
+			return event, err
+		}
+		p := event.Position
+		if p.File > s.pos.File || (p.File == s.pos.File && p.Pos > s.pos.Pos) {
+			return event, nil
+		}
+	}
+}
+
+type fakeProducts map[int64]model.EsProduct
+
+func (db fakeProducts) GetProducts(ctx context.Context, ids []int64) ([]model.EsProduct, error) {
+	var products []model.EsProduct
+	for _, id := range ids {
+		if p, ok := db[id]; ok {
+			products = append(products, p)
+		}
+	}
+	return products, nil
+}
+
+type fakeIndex struct {
+	ops []string
+	// fail 不为空时第一次写入返回这个错误
+	fail error
+}
+
+func (idx *fakeIndex) SaveAll(products []model.EsProduct) (int, error) {
+	if err := idx.fail; err != nil {
+		idx.fail = nil
+		return 0, err
+	}
+	for _, p := range products {
+		idx.ops = append(idx.ops, fmt.Sprintf("save %d %s", p.ID, p.Name))
+	}
+	return len(products), nil
+}
+
+func (idx *fakeIndex) DeletaBatch(ids []int64) error {
+	for _, id := range ids {
+		idx.ops = append(idx.ops, fmt.Sprintf("delete %d", id))
+	}
+	return nil
+}
+
+type fakeCheckpoints struct {
+	mu    sync.Mutex
+	saved map[string]model.BinlogPosition
+}
+
+func (c *fakeCheckpoints) Load(name string) (*model.BinlogPosition, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pos, ok := c.saved[name]; ok {
+		return &pos, nil
+	}
+	return nil, nil
+}
+
+func (c *fakeCheckpoints) Save(name string, pos model.BinlogPosition) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.saved[name] = pos
+	return nil
+}
+
+func (c *fakeCheckpoints) Rewind(name string, pos model.BinlogPosition) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if saved, ok := c.saved[name]; !ok || pos.Before(saved) {
+		c.saved[name] = pos
+	}
+	return nil
+}
+
+func (c *fakeCheckpoints) Take(name string) (*model.BinlogPosition, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pos, ok := c.saved[name]
+	if !ok {
+		return nil, nil
+	}
+	delete(c.saved, name)
+	return &pos, nil
+}
+
+func runRecorded(t *testing.T, checkpoints *fakeCheckpoints, index *fakeIndex) *replayStream {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream := &replayStream{
+		file:    "testdata/binlog_events.jsonl",
+		current: model.BinlogPosition{File: "mysql-bin.000003", Pos: 4},
+		cancel:  cancel,
+	}
+	// 数据库中 28 已经下架，其余需要重新读取的商品都可以搜索
+	products := fakeProducts{
+		26: {ID: 26, Name: "华为 HUAWEI P20"},
+		31: {ID: 31, Name: "HLA海澜之家蓝灰花纹圆领针织布短袖T恤"},
+		32: {ID: 32, Name: "HLA海澜之家短袖T恤男基础款"},
+	}
+	syncer := NewSyncer(stream, products, index, checkpoints, nil, SyncerConfig{
+		Name:           "mall-search",
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	})
+	if err := syncer.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		t.Fatal("syncer did not stop")
+	}
+	return stream
+}
+
+func TestSyncerReplaysRecordedBinlog(t *testing.T) {
+	checkpoints := &fakeCheckpoints{saved: map[string]model.BinlogPosition{}}
+	index := &fakeIndex{}
+	runRecorded(t, checkpoints, index)
+
+	want := []string{
+		"save 26 华为 HUAWEI P20", // 改价
+		"delete 27",             // 下架，直接按行镜像删除
+		"save 26 华为 HUAWEI P20", // 新增属性值
+		"delete 28",             // sku 库存变化，但数据库中已经不可搜索
+		"delete 29",             // delete_status 置为 1
+		"delete 30",             // 物理删除，同一事务中的属性值变更不会让它被重新写入
+		"save 31 HLA海澜之家蓝灰花纹圆领针织布短袖T恤", // 重新上架
+	}
+	if !reflect.DeepEqual(index.ops, want) {
+		t.Fatalf("index operations:\n got %q\nwant %q", index.ops, want)
+	}
+	// 最后一个事务没有提交，检查点停在它之前
+	if pos := checkpoints.saved["mall-search"]; pos != (model.BinlogPosition{File: "mysql-bin.000004", Pos: 1011}) {
+		t.Fatalf("checkpoint = %s", pos)
+	}
+}
+
+func TestSyncerResumesFromCheckpointAndRetries(t *testing.T) {
+	checkpoints := &fakeCheckpoints{saved: map[string]model.BinlogPosition{
+		"mall-search": {File: "mysql-bin.000003", Pos: 2411},
+	}}
+	index := &fakeIndex{fail: errors.New("es_rejected_execution_exception")}
+	stream := runRecorded(t, checkpoints, index)
+
+	if stream.opened[0] != (model.BinlogPosition{File: "mysql-bin.000003", Pos: 2411}) {
+		t.Fatalf("stream opened at %v", stream.opened)
+	}
+	// 29 和 30 只需要删除，31 的写入失败后 Run 从最后提交的位置重连，
+	// 这里的 replayStream 在第二次 Open 时结束测试
+	if want := []string{"delete 29", "delete 30"}; !reflect.DeepEqual(index.ops, want) {
+		t.Fatalf("index operations = %q, want %q", index.ops, want)
+	}
+	committed := model.BinlogPosition{File: "mysql-bin.000004", Pos: 641}
+	if pos := checkpoints.saved["mall-search"]; pos != committed {
+		t.Fatalf("checkpoint = %s, want %s", pos, committed)
+	}
+	if len(stream.opened) != 2 || stream.opened[1] != committed {
+		t.Fatalf("reconnected at %v, want %s", stream.opened, committed)
+	}
+}
+
+// liveStream 模拟一个持续写入的 binlog，Open 先返回 pos 之后已有的事件，然后等待新的事件
+type liveStream struct {
+	mu     sync.Mutex
+	events []Event
+	added  chan struct{}
+	opened []model.BinlogPosition
+}
+
+func (s *liveStream) Current(ctx context.Context) (model.BinlogPosition, error) {
+	return model.BinlogPosition{File: "mysql-bin.000001", Pos: 4}, nil
+}
+
+func (s *liveStream) Open(ctx context.Context, pos model.BinlogPosition) (Source, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opened = append(s.opened, pos)
+	next := 0
+	for next < len(s.events) && !pos.Before(s.events[next].Position) {
+		next++
+	}
+	return &liveSource{stream: s, next: next}, nil
+}
+
+// commit 追加一个更新商品 id 的事务
+func (s *liveStream) commit(id int64, pos uint32) {
+	s.mu.Lock()
+	update := Event{
+		Position: model.BinlogPosition{File: "mysql-bin.000001", Pos: pos - 1},
+		Table:    productTable,
+		Action:   ActionUpdate,
+		Rows:     []RowChange{{After: Row{"id": id, "publish_status": int64(1)}}},
+	}
+	s.events = append(s.events, update, Event{Position: model.BinlogPosition{File: "mysql-bin.000001", Pos: pos}, Commit: true})
+	s.mu.Unlock()
+	s.added <- struct{}{}
+}
+
+type liveSource struct {
+	stream *liveStream
+	next   int
+}
+
+func (s *liveSource) Next(ctx context.Context) (Event, error) {
+	for {
+		s.stream.mu.Lock()
+		if s.next < len(s.stream.events) {
+			event := s.stream.events[s.next]
+			s.next++
+			s.stream.mu.Unlock()
+			return event, nil
+		}
+		s.stream.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		case <-s.stream.added:
+		}
+	}
+}
+
+func (s *liveSource) Close() error {
+	return nil
+}
+
+// aliasIndex 记录每次写入时别名指向的索引，swap 模拟全量导入切换别名
+type aliasIndex struct {
+	mu      sync.Mutex
+	current string
+	ops     []string
+	written chan struct{}
+}
+
+func (idx *aliasIndex) SaveAll(products []model.EsProduct) (int, error) {
+	idx.mu.Lock()
+	for _, p := range products {
+		idx.ops = append(idx.ops, fmt.Sprintf("%s save %d", idx.current, p.ID))
+	}
+	idx.mu.Unlock()
+	idx.written <- struct{}{}
+	return len(products), nil
+}
+
+func (idx *aliasIndex) DeletaBatch(ids []int64) error {
+	return errors.New("unexpected delete")
+}
+
+func (idx *aliasIndex) swap(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.current = name
+}
+
+func (idx *aliasIndex) wait(t *testing.T, want ...string) {
+	t.Helper()
+	select {
+	case <-idx.written:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !reflect.DeepEqual(idx.ops, want) {
+		t.Fatalf("index operations:\n got %q\nwant %q", idx.ops, want)
+	}
+}
+
+// 全量导入期间提交的事务写入的是旧索引，切换别名后从导入开始时记下的位置重放，新一代索引也会包含它
+func TestSyncerReplaysChangesMadeDuringImport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &liveStream{added: make(chan struct{}, 10)}
+	index := &aliasIndex{current: "pms_v1", written: make(chan struct{}, 10)}
+	checkpoints := &fakeCheckpoints{saved: map[string]model.BinlogPosition{}}
+	products := fakeProducts{26: {ID: 26}, 27: {ID: 27}}
+	syncer := NewSyncer(stream, products, index, checkpoints, nil, SyncerConfig{
+		Name:           "mall-search",
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	})
+	done := make(chan error)
+	go func() { done <- syncer.Run(ctx) }()
+
+	stream.commit(26, 100)
+	index.wait(t, "pms_v1 save 26")
+
+	//导入开始，之后提交的 27 只写入了旧索引
+	mark := syncer.Mark()
+	if mark != (model.BinlogPosition{File: "mysql-bin.000001", Pos: 100}) {
+		t.Fatalf("mark = %s", mark)
+	}
+	stream.commit(27, 200)
+	index.wait(t, "pms_v1 save 26", "pms_v1 save 27")
+
+	index.swap("pms_v2")
+	syncer.Replay(mark)
+	index.wait(t, "pms_v1 save 26", "pms_v1 save 27", "pms_v2 save 27")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if len(stream.opened) != 2 || stream.opened[1] != mark {
+		t.Fatalf("stream opened at %v, want a reopen at %s", stream.opened, mark)
+	}
+	if pos := checkpoints.saved["mall-search"]; pos != (model.BinlogPosition{File: "mysql-bin.000001", Pos: 200}) {
+		t.Fatalf("checkpoint = %s", pos)
+	}
+}
+
+// lockTable 模拟 MySQL 的命名锁，同一个 lockTable 上的 fakeLock 互斥
+type lockTable struct {
+	mu    sync.Mutex
+	owner *fakeLock
+}
+
+// drop 模拟持有锁的连接断开，MySQL 释放了锁
+func (t *lockTable) drop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.owner = nil
+}
+
+type fakeLock struct {
+	table *lockTable
+}
+
+func (l *fakeLock) TryLock(ctx context.Context) (bool, error) {
+	l.table.mu.Lock()
+	defer l.table.mu.Unlock()
+	if l.table.owner != nil {
+		return false, nil
+	}
+	l.table.owner = l
+	return true, nil
+}
+
+func (l *fakeLock) Held(ctx context.Context) (bool, error) {
+	l.table.mu.Lock()
+	defer l.table.mu.Unlock()
+	return l.table.owner == l, nil
+}
+
+func (l *fakeLock) Unlock() error {
+	l.table.mu.Lock()
+	defer l.table.mu.Unlock()
+	if l.table.owner == l {
+		l.table.owner = nil
+	}
+	return nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 多个实例共用一个检查点和 server-id，只有拿到锁的实例消费 binlog。
+// 在其他实例上开始的导入从检查点表拿到位置并请求重放，锁失效后重新拿到锁的实例从检查点接手
+func TestSyncerRunsOnOneInstance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &liveStream{added: make(chan struct{}, 10)}
+	index := &aliasIndex{current: "pms_v1", written: make(chan struct{}, 10)}
+	checkpoints := &fakeCheckpoints{saved: map[string]model.BinlogPosition{}}
+	products := fakeProducts{26: {ID: 26}, 27: {ID: 27}}
+	locks := &lockTable{}
+	cfg := SyncerConfig{
+		Name:           "mall-search",
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		LockInterval:   5 * time.Millisecond,
+	}
+	done := make(chan error, 2)
+	leader := NewSyncer(stream, products, index, checkpoints, &fakeLock{table: locks}, cfg)
+	go func() { done <- leader.Run(ctx) }()
+	stream.commit(26, 100)
+	index.wait(t, "pms_v1 save 26")
+
+	follower := NewSyncer(stream, products, index, checkpoints, &fakeLock{table: locks}, cfg)
+	go func() { done <- follower.Run(ctx) }()
+	at := func(pos uint32) model.BinlogPosition { return model.BinlogPosition{File: "mysql-bin.000001", Pos: pos} }
+	waitFor(t, "the checkpoint", func() bool {
+		saved, _ := checkpoints.Load("mall-search")
+		return saved != nil && *saved == at(100)
+	})
+
+	//导入在 follower 上进行
+	mark := follower.Mark()
+	if mark != at(100) {
+		t.Fatalf("mark = %s", mark)
+	}
+	stream.commit(27, 200)
+	index.wait(t, "pms_v1 save 26", "pms_v1 save 27")
+	index.swap("pms_v2")
+	follower.Replay(mark)
+	index.wait(t, "pms_v1 save 26", "pms_v1 save 27", "pms_v2 save 27")
+
+	//锁失效后两个实例都可能拿到锁，无论哪个拿到都从检查点继续，并且只有它在消费
+	locks.drop()
+	leading := func(s *Syncer) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.leading
+	}
+	waitFor(t, "another instance to take over", func() bool {
+		stream.mu.Lock()
+		opened := len(stream.opened)
+		stream.mu.Unlock()
+		return opened == 3 && leading(leader) != leading(follower)
+	})
+	stream.commit(26, 300)
+	index.wait(t, "pms_v1 save 26", "pms_v1 save 27", "pms_v2 save 27", "pms_v2 save 26")
+
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []model.BinlogPosition{at(4), at(100), at(200)}; !reflect.DeepEqual(stream.opened, want) {
+		t.Fatalf("stream opened at %v, want %v", stream.opened, want)
+	}
+	if _, ok := checkpoints.saved["mall-search:replay"]; ok {
+		t.Fatal("replay request was not taken")
+	}
+}
@@ -1,5 +1,500 @@
 package config
 
-const (
-	Dsn = "root:root@tcp(mysql:3306)/mall?charset=utf8mb4&parseTime=True&loc=Local"
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/yaml.v3"
 )
+
+// Config 是 mall-search-go 的运行时配置。
+// yaml 的层级与 config/search/mall-search-{dev,prod}.yaml 中 Spring 的写法保持一致，
+// 这样同一份配置文件既能给 Java 版 mall-search 用，也能给 Go 版用。
+type Config struct {
+	// Profile 是当前激活的环境（dev/prod），由命令行或环境变量决定，不从文件读取
+	Profile    string           `yaml:"-"`
+	Server     ServerConfig     `yaml:"server"`
+	Spring     SpringConfig     `yaml:"spring"`
+	Management ManagementConfig `yaml:"management"`
+	Search     SearchConfig     `yaml:"search"`
+}
+
+type ServerConfig struct {
+	Port int `yaml:"port"`
+}
+
+type SpringConfig struct {
+	Application   ApplicationConfig   `yaml:"application"`
+	Lifecycle     LifecycleConfig     `yaml:"lifecycle"`
+	Datasource    DatasourceConfig    `yaml:"datasource"`
+	Elasticsearch ElasticsearchConfig `yaml:"elasticsearch"`
+	Cloud         CloudConfig         `yaml:"cloud"`
+}
+
+type ApplicationConfig struct {
+	Name string `yaml:"name"`
+}
+
+// LifecycleConfig 对应 Spring 的 spring.lifecycle.timeout-per-shutdown-phase，
+// 是优雅停机时等待进行中的请求和索引写入完成的最长时间
+type LifecycleConfig struct {
+	TimeoutPerShutdownPhase time.Duration `yaml:"timeout-per-shutdown-phase"`
+}
+
+// DatasourceConfig 兼容 Spring 的 jdbc url，也可以直接写 go-sql-driver 的 DSN
+type DatasourceConfig struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type ElasticsearchConfig struct {
+	URIs     StringList `yaml:"uris"`
+	Username string     `yaml:"username"`
+	Password string     `yaml:"password"`
+}
+
+// CloudConfig 对应 Java 服务 bootstrap-{dev,prod}.yml 中的 spring.cloud.nacos.*
+type CloudConfig struct {
+	Nacos NacosConfig `yaml:"nacos"`
+}
+
+type NacosConfig struct {
+	Discovery NacosDiscoveryConfig `yaml:"discovery"`
+	Config    NacosConfigConfig    `yaml:"config"`
+}
+
+// NacosDiscoveryConfig 控制向 Nacos 注册服务实例，网关通过 lb://mall-search 发现它。
+// IP 为空时使用连接 Nacos 的本机地址，Port 为 0 时使用 server.port
+type NacosDiscoveryConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	ServerAddr        string        `yaml:"server-addr"`
+	Namespace         string        `yaml:"namespace"`
+	Group             string        `yaml:"group"`
+	ClusterName       string        `yaml:"cluster-name"`
+	IP                string        `yaml:"ip"`
+	Port              int           `yaml:"port"`
+	Weight            float64       `yaml:"weight"`
+	Username          string        `yaml:"username"`
+	Password          string        `yaml:"password"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat-interval"`
+}
+
+// NacosConfigConfig 控制从 Nacos 配置中心读取 <spring.application.name>[-<profile>].<file-extension>，
+// 它们覆盖本地文件，但仍会被环境变量和命令行参数覆盖。RefreshEnabled 为 true 时长轮询变更并热加载
+type NacosConfigConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	ServerAddr      string        `yaml:"server-addr"`
+	Namespace       string        `yaml:"namespace"`
+	Group           string        `yaml:"group"`
+	FileExtension   string        `yaml:"file-extension"`
+	Username        string        `yaml:"username"`
+	Password        string        `yaml:"password"`
+	RefreshEnabled  bool          `yaml:"refresh-enabled"`
+	LongPollTimeout time.Duration `yaml:"long-poll-timeout"`
+}
+
+// ManagementConfig 对应 Spring 的 management.* 配置，只保留 Go 版用到的部分
+type ManagementConfig struct {
+	Health HealthConfig `yaml:"health"`
+}
+
+type HealthConfig struct {
+	Elasticsearch HealthTimeoutConfig `yaml:"elasticsearch"`
+}
+
+// HealthTimeoutConfig 中的 ResponseTimeout 是单个健康检查最多等待的时间
+type HealthTimeoutConfig struct {
+	ResponseTimeout time.Duration `yaml:"response-timeout"`
+}
+
+// SearchConfig 是 Go 版 mall-search 独有的配置
+type SearchConfig struct {
+	Index     string          `yaml:"index"`
+	Startup   StartupConfig   `yaml:"startup"`
+	Reindex   ReindexConfig   `yaml:"reindex"`
+	Bulk      BulkConfig      `yaml:"bulk"`
+	CDC       CDCConfig       `yaml:"cdc"`
+	Facets    FacetsConfig    `yaml:"facets"`
+	Highlight HighlightConfig `yaml:"highlight"`
+	Suggest   SuggestConfig   `yaml:"suggest"`
+	Spelling  SpellingConfig  `yaml:"spelling"`
+	Paging    PagingConfig    `yaml:"paging"`
+}
+
+// PagingConfig 控制搜索结果的分页：按页码分页只能访问前 MaxResultWindow 条结果，需要与索引的
+// index.max_result_window 一致，更深的结果通过游标访问；KeepAlive 是游标背后的 PIT 在两次翻页之间保留的时间
+type PagingConfig struct {
+	MaxResultWindow int           `yaml:"max-result-window"`
+	KeepAlive       time.Duration `yaml:"keep-alive"`
+}
+
+// SpellingConfig 控制简单搜索的拼写纠正：命中数少于 MinHits 时按商品名称和关键词纠正搜索词，
+// MaxErrors 是最多修正的词数
+type SpellingConfig struct {
+	MinHits   int     `yaml:"min-hits"`
+	MaxErrors float64 `yaml:"max-errors"`
+}
+
+// SuggestConfig 控制输入提示：Size 是默认也是最多返回的提示数，
+// Timeout 是一次提示最多等待 ES 的时间，超时时返回空的提示，不影响用户继续输入
+type SuggestConfig struct {
+	Size    int           `yaml:"size"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// HighlightConfig 是搜索结果高亮时包裹匹配词的标签
+type HighlightConfig struct {
+	PreTag  string `yaml:"pre-tag"`
+	PostTag string `yaml:"post-tag"`
+}
+
+// FacetsConfig 控制搜索结果的分面统计：Size 是品牌、分类、属性以及每个属性的取值最多返回的个数，
+// PriceRanges 是价格区间的分界点，[1000, 3000] 得到 1000 以下、1000 到 3000、3000 以上三个区间
+type FacetsConfig struct {
+	Size        int       `yaml:"size"`
+	PriceRanges []float64 `yaml:"price-ranges"`
+}
+
+// CDCConfig 控制从 MySQL binlog 增量同步商品的消费者。
+// 复制账号需要 REPLICATION SLAVE 和 REPLICATION CLIENT 权限，不填时使用 spring.datasource 的账号；
+// 多个实例通过 MySQL 命名锁选出一个消费 binlog，其余实例每个 HeartbeatPeriod 尝试接手一次，
+// 所以所有实例使用同一个 ServerID 和检查点；ServerID 只需要和其他复制客户端（包括从库）不同，
+// 锁失效时旧实例的复制连接还会被使用同一 ServerID 的新连接顶掉。
+// 第一次启动（没有检查点）时从当前 binlog 位置开始，之前的数据需要先做一次全量导入
+type CDCConfig struct {
+	Enabled            bool          `yaml:"enabled"`
+	ServerID           int           `yaml:"server-id"`
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password"`
+	CheckpointInterval time.Duration `yaml:"checkpoint-interval"`
+	HeartbeatPeriod    time.Duration `yaml:"heartbeat-period"`
+}
+
+// BulkConfig 控制全量导入：BatchSize 是每次从 MySQL 读取的商品数，
+// Workers/FlushBytes/FlushInterval 是 BulkIndexer 的并发数和刷新阈值
+type BulkConfig struct {
+	BatchSize           int           `yaml:"batch-size"`
+	Workers             int           `yaml:"workers"`
+	FlushBytes          int           `yaml:"flush-bytes"`
+	FlushInterval       time.Duration `yaml:"flush-interval"`
+	MaxReportedFailures int           `yaml:"max-reported-failures"`
+}
+
+// ReindexConfig 控制全量导入时的多代索引，Retain 是切换别名后保留的旧索引代数，用于回滚
+type ReindexConfig struct {
+	Retain int `yaml:"retain"`
+}
+
+// StartupConfig 控制启动时连接 MySQL 和 ES 的重试策略，间隔按指数增长直到 MaxBackoff
+type StartupConfig struct {
+	MaxAttempts    int           `yaml:"max-attempts"`
+	InitialBackoff time.Duration `yaml:"initial-backoff"`
+	MaxBackoff     time.Duration `yaml:"max-backoff"`
+}
+
+// StringList 既可以写成 yaml 列表，也可以写成 Spring 风格的逗号分隔字符串
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		*l = splitList(value.Value)
+		return nil
+	case yaml.SequenceNode:
+		var items []string
+		if err := value.Decode(&items); err != nil {
+			return err
+		}
+		*l = items
+		return nil
+	}
+	return fmt.Errorf("line %d: expected a string or a list of strings", value.Line)
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Default 返回内置的默认配置，文件、环境变量和命令行参数依次覆盖在它之上
+func Default() *Config {
+	return &Config{
+		Profile: "dev",
+		Server: ServerConfig{
+			Port: 8081,
+		},
+		Spring: SpringConfig{
+			Application: ApplicationConfig{Name: "mall-search"},
+			Lifecycle:   LifecycleConfig{TimeoutPerShutdownPhase: 30 * time.Second},
+			Datasource: DatasourceConfig{
+				URL:      "jdbc:mysql://localhost:3306/mall?useUnicode=true&characterEncoding=utf-8&serverTimezone=Asia/Shanghai&useSSL=false",
+				Username: "root",
+				Password: "root",
+			},
+			Elasticsearch: ElasticsearchConfig{
+				URIs: StringList{"localhost:9200"},
+			},
+			Cloud: CloudConfig{
+				Nacos: NacosConfig{
+					Discovery: NacosDiscoveryConfig{
+						Enabled:           true,
+						Group:             "DEFAULT_GROUP",
+						ClusterName:       "DEFAULT",
+						Weight:            1,
+						HeartbeatInterval: 5 * time.Second,
+					},
+					Config: NacosConfigConfig{
+						Enabled:         true,
+						Group:           "DEFAULT_GROUP",
+						FileExtension:   "yaml",
+						RefreshEnabled:  true,
+						LongPollTimeout: 30 * time.Second,
+					},
+				},
+			},
+		},
+		Management: ManagementConfig{
+			Health: HealthConfig{
+				Elasticsearch: HealthTimeoutConfig{ResponseTimeout: time.Second},
+			},
+		},
+		Search: SearchConfig{
+			Index: "pms",
+			Startup: StartupConfig{
+				MaxAttempts:    5,
+				InitialBackoff: time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Reindex: ReindexConfig{
+				Retain: 2,
+			},
+			Bulk: BulkConfig{
+				BatchSize:           500,
+				Workers:             2,
+				FlushBytes:          5 << 20,
+				FlushInterval:       30 * time.Second,
+				MaxReportedFailures: 100,
+			},
+			CDC: CDCConfig{
+				Enabled:            false,
+				ServerID:           1001,
+				CheckpointInterval: time.Second,
+				HeartbeatPeriod:    10 * time.Second,
+			},
+			Facets: FacetsConfig{
+				Size:        20,
+				PriceRanges: []float64{500, 1000, 2000, 3000, 5000},
+			},
+			Highlight: HighlightConfig{
+				PreTag:  "<em>",
+				PostTag: "</em>",
+			},
+			Suggest: SuggestConfig{
+				Size:    10,
+				Timeout: 200 * time.Millisecond,
+			},
+			Spelling: SpellingConfig{
+				MinHits:   3,
+				MaxErrors: 2,
+			},
+			Paging: PagingConfig{
+				MaxResultWindow: 10000,
+				KeepAlive:       time.Minute,
+			},
+		},
+	}
+}
+
+// DSN 把 Spring 的 jdbc url 转换为 go-sql-driver 使用的 DSN，
+// 不是以 jdbc:mysql:// 开头的 url 按原生 DSN 原样返回
+func (d DatasourceConfig) DSN() (string, error) {
+	const prefix = "jdbc:mysql://"
+	if !strings.HasPrefix(d.URL, prefix) {
+		if _, err := mysql.ParseDSN(d.URL); err != nil {
+			return "", err
+		}
+		return d.URL, nil
+	}
+
+	u, err := url.Parse("mysql://" + strings.TrimPrefix(d.URL, prefix))
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("missing host in %q", d.URL)
+	}
+
+	cfg := mysql.NewConfig()
+	cfg.User = d.Username
+	cfg.Passwd = d.Password
+	cfg.Net = "tcp"
+	cfg.Addr = u.Host
+	cfg.DBName = strings.TrimPrefix(u.Path, "/")
+	cfg.ParseTime = true
+	cfg.Params = map[string]string{"charset": "utf8mb4"}
+
+	query := u.Query()
+	if tz := query.Get("serverTimezone"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return "", fmt.Errorf("serverTimezone: %s", err)
+		}
+		cfg.Loc = loc
+	}
+	if query.Get("useSSL") == "true" {
+		cfg.TLSConfig = "true"
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// Addresses 返回带协议前缀的 ES 地址，Spring 里常见的 "localhost:9200" 会补全为 http://localhost:9200
+func (e ElasticsearchConfig) Addresses() []string {
+	addresses := make([]string, 0, len(e.URIs))
+	for _, uri := range e.URIs {
+		if !strings.Contains(uri, "://") {
+			uri = "http://" + uri
+		}
+		addresses = append(addresses, uri)
+	}
+	return addresses
+}
+
+// NacosEnabled 在开启且配置了 server-addr 时返回 true，本地开发不启动 Nacos 时只需不配置地址
+func (d NacosDiscoveryConfig) NacosEnabled() bool {
+	return d.Enabled && d.ServerAddr != ""
+}
+
+func (c NacosConfigConfig) NacosEnabled() bool {
+	return c.Enabled && c.ServerAddr != ""
+}
+
+// DataIDs 返回要从 Nacos 读取的配置，与 Spring Cloud Alibaba 的顺序一致，后面的覆盖前面的
+func (c *Config) DataIDs() []string {
+	name := c.Spring.Application.Name
+	ext := c.Spring.Cloud.Nacos.Config.FileExtension
+	return []string{name + "." + ext, name + "-" + c.Profile + "." + ext}
+}
+
+// ValidationError 汇总了配置中的所有错误，启动时一次性报出来
+type ValidationError []string
+
+func (v ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(v, "\n  - ")
+}
+
+var indexNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// Validate 校验配置，返回 ValidationError 或 nil
+func (c *Config) Validate() error {
+	var errs ValidationError
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("server.port must be between 1 and 65535, got %d", c.Server.Port))
+	}
+
+	if c.Spring.Lifecycle.TimeoutPerShutdownPhase <= 0 {
+		errs = append(errs, "spring.lifecycle.timeout-per-shutdown-phase must be positive")
+	}
+
+	if c.Spring.Datasource.URL == "" {
+		errs = append(errs, "spring.datasource.url is required")
+	} else if _, err := c.Spring.Datasource.DSN(); err != nil {
+		errs = append(errs, fmt.Sprintf("spring.datasource.url is not a valid MySQL url: %s", err))
+	}
+
+	if len(c.Spring.Elasticsearch.URIs) == 0 {
+		errs = append(errs, "spring.elasticsearch.uris must contain at least one address")
+	}
+	for _, address := range c.Spring.Elasticsearch.Addresses() {
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Sprintf("spring.elasticsearch.uris contains an invalid address %q", address))
+		}
+	}
+
+	discovery := c.Spring.Cloud.Nacos.Discovery
+	if discovery.Port < 0 || discovery.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("spring.cloud.nacos.discovery.port must be between 0 and 65535, got %d", discovery.Port))
+	}
+	if discovery.Weight <= 0 || discovery.HeartbeatInterval <= 0 {
+		errs = append(errs, "spring.cloud.nacos.discovery.weight and heartbeat-interval must be positive")
+	}
+	nacosConfig := c.Spring.Cloud.Nacos.Config
+	if nacosConfig.FileExtension != "yaml" && nacosConfig.FileExtension != "yml" {
+		errs = append(errs, fmt.Sprintf("spring.cloud.nacos.config.file-extension must be yaml or yml, got %q", nacosConfig.FileExtension))
+	}
+	if nacosConfig.LongPollTimeout < 10*time.Second {
+		errs = append(errs, "spring.cloud.nacos.config.long-poll-timeout must be at least 10s")
+	}
+
+	if c.Management.Health.Elasticsearch.ResponseTimeout <= 0 {
+		errs = append(errs, "management.health.elasticsearch.response-timeout must be positive")
+	}
+
+	if !indexNamePattern.MatchString(c.Search.Index) {
+		errs = append(errs, fmt.Sprintf("search.index %q is not a valid Elasticsearch index name", c.Search.Index))
+	}
+
+	startup := c.Search.Startup
+	if startup.MaxAttempts < 1 {
+		errs = append(errs, fmt.Sprintf("search.startup.max-attempts must be at least 1, got %d", startup.MaxAttempts))
+	}
+	if startup.InitialBackoff <= 0 || startup.MaxBackoff < startup.InitialBackoff {
+		errs = append(errs, "search.startup.initial-backoff must be positive and not greater than search.startup.max-backoff")
+	}
+
+	if c.Search.Reindex.Retain < 0 {
+		errs = append(errs, fmt.Sprintf("search.reindex.retain must not be negative, got %d", c.Search.Reindex.Retain))
+	}
+
+	bulk := c.Search.Bulk
+	if bulk.BatchSize < 1 || bulk.Workers < 1 || bulk.FlushBytes < 1 || bulk.FlushInterval <= 0 || bulk.MaxReportedFailures < 1 {
+		errs = append(errs, "search.bulk.batch-size, workers, flush-bytes, flush-interval and max-reported-failures must all be positive")
+	}
+
+	cdc := c.Search.CDC
+	if cdc.Enabled && (cdc.ServerID < 1 || cdc.CheckpointInterval <= 0 || cdc.HeartbeatPeriod <= 0) {
+		errs = append(errs, "search.cdc.server-id, checkpoint-interval and heartbeat-period must all be positive when search.cdc.enabled is true")
+	}
+
+	facets := c.Search.Facets
+	if facets.Size < 1 {
+		errs = append(errs, fmt.Sprintf("search.facets.size must be at least 1, got %d", facets.Size))
+	}
+	for i, bound := range facets.PriceRanges {
+		if bound <= 0 || (i > 0 && bound <= facets.PriceRanges[i-1]) {
+			errs = append(errs, "search.facets.price-ranges must be positive and in ascending order")
+			break
+		}
+	}
+
+	if c.Search.Highlight.PreTag == "" || c.Search.Highlight.PostTag == "" {
+		errs = append(errs, "search.highlight.pre-tag and post-tag must not be empty")
+	}
+
+	if c.Search.Suggest.Size < 1 || c.Search.Suggest.Timeout <= 0 {
+		errs = append(errs, "search.suggest.size and timeout must both be positive")
+	}
+	if c.Search.Spelling.MinHits < 0 || c.Search.Spelling.MaxErrors <= 0 {
+		errs = append(errs, "search.spelling.min-hits must not be negative and max-errors must be positive")
+	}
+	//PIT 的 keep_alive 最小单位是秒
+	if c.Search.Paging.MaxResultWindow < 1 || c.Search.Paging.KeepAlive < time.Second {
+		errs = append(errs, "search.paging.max-result-window must be positive and keep-alive at least 1s")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
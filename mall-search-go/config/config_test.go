@@ -0,0 +1,81 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 所有错误一次性报出来，每一条都指明配置项
+func TestValidateReportsEveryError(t *testing.T) {
+	cfg := Default()
+	cfg.Server.Port = 70000
+	cfg.Spring.Datasource.URL = "jdbc:mysql://"
+	cfg.Spring.Elasticsearch.URIs = StringList{"ftp://es:9200"}
+	cfg.Spring.Cloud.Nacos.Config.FileExtension = "properties"
+	cfg.Search.Index = "PMS"
+	cfg.Search.Reindex.Retain = -1
+	cfg.Search.Bulk.Workers = 0
+	cfg.Search.CDC.Enabled, cfg.Search.CDC.ServerID = true, 0
+	cfg.Search.Facets.PriceRanges = []float64{1000, 500}
+	cfg.Search.Paging.KeepAlive = 500 * time.Millisecond
+
+	err := cfg.Validate()
+	var errs ValidationError
+	if !errors.As(err, &errs) {
+		t.Fatalf("Validate() = %v, want a ValidationError", err)
+	}
+	want := []string{
+		"server.port must be between 1 and 65535, got 70000",
+		`spring.elasticsearch.uris contains an invalid address "ftp://es:9200"`,
+		`spring.cloud.nacos.config.file-extension must be yaml or yml, got "properties"`,
+		`search.index "PMS" is not a valid Elasticsearch index name`,
+		"search.reindex.retain must not be negative, got -1",
+		"search.bulk.batch-size, workers, flush-bytes, flush-interval and max-reported-failures must all be positive",
+		"search.cdc.server-id, checkpoint-interval and heartbeat-period must all be positive when search.cdc.enabled is true",
+		"search.facets.price-ranges must be positive and in ascending order",
+		"search.paging.max-result-window must be positive and keep-alive at least 1s",
+	}
+	message := err.Error()
+	if !strings.HasPrefix(message, "invalid configuration:\n  - ") {
+		t.Errorf("message %q", message)
+	}
+	for _, w := range want {
+		if !strings.Contains(message, w) {
+			t.Errorf("missing %q in:\n%s", w, message)
+		}
+	}
+	if !strings.Contains(message, "spring.datasource.url") {
+		t.Errorf("invalid datasource url not reported:\n%s", message)
+	}
+}
+
+// Load 在所有层合并之后才校验，错误的值不管来自哪一层都会被拒绝
+func TestLoadValidates(t *testing.T) {
+	dir := writeConfigDir(t, map[string]string{"mall-search.yaml": "search:\n  reindex:\n    retain: -3\n"})
+	_, err := Load([]string{"-config-dir", dir})
+	if err == nil || !strings.Contains(err.Error(), "search.reindex.retain must not be negative, got -3") {
+		t.Fatalf("Load() = %v", err)
+	}
+	if _, err := Load([]string{"-config-dir", dir, "-search.reindex.retain=1"}); err != nil {
+		t.Fatalf("flag should fix the value from the file: %v", err)
+	}
+}
+
+func TestDatasourceDSN(t *testing.T) {
+	d := DatasourceConfig{URL: "jdbc:mysql://db:3306/mall?useUnicode=true&serverTimezone=Asia/Shanghai", Username: "root", Password: "secret"}
+	dsn, err := d.DSN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dsn, "root:secret@tcp(db:3306)/mall") {
+		t.Fatalf("dsn = %s", dsn)
+	}
+}
@@ -0,0 +1,250 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 配置按以下顺序逐层覆盖：
+//  1. Default() 中的内置默认值
+//  2. <config-dir>/mall-search.yaml
+//  3. <config-dir>/mall-search-<profile>.yaml
+//  4. Nacos 配置中心中的 mall-search.yaml 和 mall-search-<profile>.yaml（见 Loader.Load 的 remote 参数）
+//  5. 环境变量，既支持 k8s 清单中的 spring.datasource.url 写法，也支持 SPRING_DATASOURCE_URL
+//  6. 命令行参数，例如 -spring.datasource.url=... -server.port=8082
+const (
+	fileBaseName     = "mall-search"
+	defaultConfigDir = "conf"
+)
+
+// Loader 记住启动时的命令行参数，远程配置变更后可以按相同的顺序重新构建配置
+type Loader struct {
+	profile string
+	dir     string
+	// flags 是命令行中出现过的配置覆盖，key 是点分路径
+	flags map[string]string
+}
+
+// NewLoader 解析命令行参数，不读取任何配置文件
+func NewLoader(args []string) (*Loader, error) {
+	fs := flag.NewFlagSet(fileBaseName, flag.ContinueOnError)
+	profile := fs.String("profile", "", "active profile, e.g. dev or prod (env: SPRING_PROFILES_ACTIVE)")
+	configDir := fs.String("config-dir", "", "directory containing mall-search[-<profile>].yaml (env: CONFIG_DIR)")
+	overrides := make(map[string]*string)
+	for _, path := range leafPaths(reflect.TypeOf(Config{}), "") {
+		overrides[path] = fs.String(path, "", "override "+path)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	l := &Loader{
+		profile: firstNonEmpty(*profile, lookupEnv("spring.profiles.active"), Default().Profile),
+		dir:     firstNonEmpty(*configDir, os.Getenv("CONFIG_DIR"), defaultConfigDir),
+		flags:   make(map[string]string),
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if value, ok := overrides[f.Name]; ok {
+			l.flags[f.Name] = *value
+		}
+	})
+	return l, nil
+}
+
+// Load 解析命令行参数并按层加载本地配置，最后做一次校验
+func Load(args []string) (*Config, error) {
+	l, err := NewLoader(args)
+	if err != nil {
+		return nil, err
+	}
+	return l.Load()
+}
+
+// Load 按层构建配置并校验，remote 是从配置中心读取的 yaml，按顺序覆盖在本地文件之上
+func (l *Loader) Load(remote ...[]byte) (*Config, error) {
+	cfg := Default()
+	cfg.Profile = l.profile
+
+	for _, name := range []string{fileBaseName + ".yaml", fileBaseName + "-" + cfg.Profile + ".yaml"} {
+		if err := mergeFile(cfg, filepath.Join(l.dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	for _, data := range remote {
+		if err := Merge(cfg, data); err != nil {
+			return nil, err
+		}
+	}
+
+	root := reflect.ValueOf(cfg).Elem()
+	for _, path := range leafPaths(root.Type(), "") {
+		if value, ok := lookupEnvOk(path); ok {
+			if err := setPath(root, path, value); err != nil {
+				return nil, fmt.Errorf("environment variable for %s: %s", path, err)
+			}
+		}
+	}
+	for _, path := range leafPaths(root.Type(), "") {
+		if value, ok := l.flags[path]; ok {
+			if err := setPath(root, path, value); err != nil {
+				return nil, fmt.Errorf("flag -%s: %s", path, err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// mergeFile 把 yaml 文件覆盖到 cfg 上，文件不存在时直接跳过
+func mergeFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return Merge(cfg, data)
+}
+
+// Merge 把一段 yaml 覆盖到 cfg 上，未出现的字段保持原值
+func Merge(cfg *Config, data []byte) error {
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("parse config: %s", err)
+	}
+	return nil
+}
+
+// leafPaths 返回所有可覆盖字段的点分路径，例如 spring.datasource.url
+func leafPaths(t reflect.Type, prefix string) []string {
+	var paths []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := yamlName(field)
+		if name == "" {
+			continue
+		}
+		path := prefix + name
+		if field.Type.Kind() == reflect.Struct {
+			paths = append(paths, leafPaths(field.Type, path+".")...)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func yamlName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// setPath 按点分路径找到字段，并把字符串形式的值转换后写入
+func setPath(v reflect.Value, path string, value string) error {
+	for _, name := range strings.Split(path, ".") {
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			if yamlName(v.Type().Field(i)) == name {
+				v = v.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown key %q", path)
+		}
+	}
+	return setValue(v, value)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setValue(v reflect.Value, value string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		items := splitList(value)
+		list := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			list.Index(i).SetString(item)
+		}
+		v.Set(list)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Float64:
+		items := splitList(value)
+		list := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			f, err := strconv.ParseFloat(item, 64)
+			if err != nil {
+				return err
+			}
+			list.Index(i).SetFloat(f)
+		}
+		v.Set(list)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// lookupEnvOk 依次查找 spring.datasource.url 和 SPRING_DATASOURCE_URL 两种写法
+func lookupEnvOk(path string) (string, bool) {
+	if value, ok := os.LookupEnv(path); ok {
+		return value, true
+	}
+	relaxed := strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(path))
+	return os.LookupEnv(relaxed)
+}
+
+func lookupEnv(path string) string {
+	value, _ := lookupEnvOk(path)
+	return value
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigDir 在临时目录中写入配置文件，返回目录
+func writeConfigDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// 每一层只覆盖它出现的字段：默认值 < mall-search.yaml < mall-search-<profile>.yaml < 配置中心 < 环境变量 < 命令行参数
+func TestLoadLayersInOrder(t *testing.T) {
+	dir := writeConfigDir(t, map[string]string{
+		"mall-search.yaml": `
+server:
+  port: 9000
+search:
+  index: base
+  reindex:
+    retain: 5
+  bulk:
+    workers: 3
+  suggest:
+    size: 4
+`,
+		"mall-search-prod.yaml": `
+search:
+  index: prod
+  bulk:
+    workers: 4
+  suggest:
+    size: 6
+`,
+	})
+	remote := []byte("search:\n  bulk:\n    workers: 5\n  suggest:\n    size: 7\n")
+	t.Setenv("SEARCH_SUGGEST_SIZE", "8")
+	t.Setenv("server.port", "9001")
+
+	l, err := NewLoader([]string{"-config-dir", dir, "-profile", "prod", "-server.port=9002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := l.Load(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		key       string
+		got, want interface{}
+	}{
+		{"profile", cfg.Profile, "prod"},
+		{"search.reindex.retain from mall-search.yaml", cfg.Search.Reindex.Retain, 5},
+		{"search.index from mall-search-prod.yaml", cfg.Search.Index, "prod"},
+		{"search.bulk.workers from the config center", cfg.Search.Bulk.Workers, 5},
+		{"search.suggest.size from SEARCH_SUGGEST_SIZE", cfg.Search.Suggest.Size, 8},
+		{"server.port from the flag", cfg.Server.Port, 9002},
+		{"search.bulk.batch-size from the defaults", cfg.Search.Bulk.BatchSize, 500},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %v, want %v", c.key, c.got, c.want)
+		}
+	}
+}
+
+func TestProfileFromEnvironment(t *testing.T) {
+	dir := writeConfigDir(t, map[string]string{"mall-search-test.yaml": "search:\n  index: from-test\n"})
+	t.Setenv("SPRING_PROFILES_ACTIVE", "test")
+	cfg, err := Load([]string{"-config-dir", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Profile != "test" || cfg.Search.Index != "from-test" {
+		t.Fatalf("profile %q, index %q", cfg.Profile, cfg.Search.Index)
+	}
+}
+
+// 所有出现在 leafPaths 中的字段都要能从环境变量和命令行参数覆盖
+func TestEveryKeyCanBeOverridden(t *testing.T) {
+	root := reflect.ValueOf(Default()).Elem()
+	for _, path := range leafPaths(root.Type(), "") {
+		//时间间隔需要单位，其余类型都接受 1
+		if err := setPath(root, path, "1"); err != nil {
+			if err := setPath(root, path, "1s"); err != nil {
+				t.Errorf("%s: %s", path, err)
+			}
+		}
+	}
+}
+
+func TestOverrideLists(t *testing.T) {
+	t.Setenv("SPRING_ELASTICSEARCH_URIS", "es1:9200, es2:9200")
+	dir := t.TempDir()
+	cfg, err := Load([]string{"-config-dir", dir, "-search.facets.price-ranges=100, 250.5,1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Search.Facets.PriceRanges, []float64{100, 250.5, 1000}) {
+		t.Errorf("price ranges = %v", cfg.Search.Facets.PriceRanges)
+	}
+	if !reflect.DeepEqual(cfg.Spring.Elasticsearch.URIs, StringList{"es1:9200", "es2:9200"}) {
+		t.Errorf("uris = %v", cfg.Spring.Elasticsearch.URIs)
+	}
+}
+
+// 覆盖的值无法转换时报出来源和字段
+func TestOverrideErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load([]string{"-config-dir", dir, "-search.facets.price-ranges=100,abc"}); err == nil || !strings.Contains(err.Error(), "flag -search.facets.price-ranges") {
+		t.Errorf("bad flag: %v", err)
+	}
+
+	t.Setenv("SEARCH_SUGGEST_TIMEOUT", "soon")
+	if _, err := Load([]string{"-config-dir", dir}); err == nil || !strings.Contains(err.Error(), "environment variable for search.suggest.timeout") {
+		t.Errorf("bad environment variable: %v", err)
+	}
+
+	bad := writeConfigDir(t, map[string]string{"mall-search.yaml": "server: [8081\n"})
+	if _, err := Load([]string{"-config-dir", bad}); err == nil || !strings.Contains(err.Error(), "parse config") {
+		t.Errorf("bad yaml: %v", err)
+	}
+}
+
+func TestMergeKeepsMissingFields(t *testing.T) {
+	cfg := Default()
+	if err := Merge(cfg, []byte("search:\n  suggest:\n    timeout: 1s\n")); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Search.Suggest.Timeout != time.Second || cfg.Search.Suggest.Size != Default().Search.Suggest.Size {
+		t.Fatalf("suggest = %+v", cfg.Search.Suggest)
+	}
+}
+
+// conf/mall-search.yaml 是完整的示例配置，每一节都要写出来，值与内置默认值一致
+func TestSampleConfigMatchesDefaults(t *testing.T) {
+	cfg := Default()
+	if err := mergeFile(cfg, filepath.Join("..", "conf", "mall-search.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("conf/mall-search.yaml differs from Default():\n%+v\n%+v", cfg.Search, Default().Search)
+	}
+	data, err := os.ReadFile(filepath.Join("..", "conf", "mall-search.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{"startup", "reindex", "bulk", "cdc", "facets", "highlight", "suggest", "spelling", "paging"} {
+		if !strings.Contains(string(data), "\n  "+section+":") {
+			t.Errorf("conf/mall-search.yaml has no search.%s section", section)
+		}
+	}
+}
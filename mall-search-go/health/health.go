@@ -0,0 +1,106 @@
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status 与 Spring Boot actuator 的健康状态一致
+type Status string
+
+const (
+	StatusUp           Status = "UP"
+	StatusDown         Status = "DOWN"
+	StatusOutOfService Status = "OUT_OF_SERVICE"
+	StatusUnknown      Status = "UNKNOWN"
+)
+
+// 状态聚合的优先级，与 Spring 的 SimpleStatusAggregator 相同：DOWN > OUT_OF_SERVICE > UP > UNKNOWN
+var statusOrder = map[Status]int{
+	StatusDown:         0,
+	StatusOutOfService: 1,
+	StatusUp:           2,
+	StatusUnknown:      3,
+}
+
+// Health 对应 actuator /actuator/health 返回的 JSON 结构
+type Health struct {
+	Status     Status                 `json:"status"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	Components map[string]Health      `json:"components,omitempty"`
+	Groups     []string               `json:"groups,omitempty"`
+}
+
+func Up(details map[string]interface{}) Health {
+	return Health{Status: StatusUp, Details: details}
+}
+
+func Down(err error) Health {
+	return Health{Status: StatusDown, Details: map[string]interface{}{"error": err.Error()}}
+}
+
+// Available 表示该状态下实例可以对外提供服务，DOWN 和 OUT_OF_SERVICE 对应 HTTP 503
+func (s Status) Available() bool {
+	return s == StatusUp || s == StatusUnknown
+}
+
+// Indicator 检查一个依赖组件的健康状况
+type Indicator interface {
+	Health(ctx context.Context) Health
+}
+
+// IndicatorFunc 让普通函数可以作为 Indicator 使用
+type IndicatorFunc func(ctx context.Context) Health
+
+func (f IndicatorFunc) Health(ctx context.Context) Health {
+	return f(ctx)
+}
+
+// Check 并发执行所有 indicator，每个最多等待 timeout，然后按优先级聚合出总体状态
+func Check(ctx context.Context, indicators map[string]Indicator, timeout time.Duration) Health {
+	result := Health{Status: StatusUp, Components: make(map[string]Health, len(indicators))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, indicator := range indicators {
+		wg.Add(1)
+		go func(name string, indicator Indicator) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			h := indicator.Health(checkCtx)
+			mu.Lock()
+			result.Components[name] = h
+			mu.Unlock()
+		}(name, indicator)
+	}
+	wg.Wait()
+
+	statuses := make([]Status, 0, len(result.Components))
+	for _, h := range result.Components {
+		statuses = append(statuses, h.Status)
+	}
+	result.Status = Aggregate(statuses)
+	return result
+}
+
+// Aggregate 返回优先级最高的状态，没有任何状态时为 UP
+func Aggregate(statuses []Status) Status {
+	if len(statuses) == 0 {
+		return StatusUp
+	}
+	sorted := append([]Status(nil), statuses...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return rank(sorted[i]) < rank(sorted[j])
+	})
+	return sorted[0]
+}
+
+func rank(s Status) int {
+	if r, ok := statusOrder[s]; ok {
+		return r
+	}
+	return len(statusOrder)
+}
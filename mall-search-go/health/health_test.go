@@ -0,0 +1,86 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+func TestCheckAggregatesWorstStatus(t *testing.T) {
+	indicators := map[string]Indicator{
+		"db": IndicatorFunc(func(ctx context.Context) Health { return Up(nil) }),
+		"elasticsearch": IndicatorFunc(func(ctx context.Context) Health {
+			return Health{Status: StatusOutOfService}
+		}),
+		"slow": IndicatorFunc(func(ctx context.Context) Health {
+			<-ctx.Done()
+			return Down(ctx.Err())
+		}),
+	}
+
+	result := Check(context.Background(), indicators, 10*time.Millisecond)
+	if result.Status != StatusDown {
+		t.Fatalf("status = %s, want DOWN", result.Status)
+	}
+	if result.Components["slow"].Details["error"] != context.DeadlineExceeded.Error() {
+		t.Fatalf("slow indicator was not cut off by the timeout: %+v", result.Components["slow"])
+	}
+	if result.Status.Available() {
+		t.Fatal("DOWN must not be reported as available")
+	}
+
+	delete(indicators, "slow")
+	if status := Check(context.Background(), indicators, time.Second).Status; status != StatusOutOfService {
+		t.Fatalf("status = %s, want OUT_OF_SERVICE", status)
+	}
+	if status := Aggregate(nil); status != StatusUp {
+		t.Fatalf("empty aggregate = %s, want UP", status)
+	}
+}
+
+func TestElasticsearchIndicators(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		switch {
+		case r.URL.Path == "/_cluster/health":
+			w.Write([]byte(`{"cluster_name":"mall","status":"red","number_of_nodes":1}`))
+		case r.Method == http.MethodHead && r.URL.Path == "/pms":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodHead && r.URL.Path == "/_alias/pms":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := Elasticsearch(client).Health(context.Background())
+	if cluster.Status != StatusOutOfService || cluster.Details["cluster_name"] != "mall" {
+		t.Fatalf("red cluster reported as %+v", cluster)
+	}
+
+	index := Index(client, "pms").Health(context.Background())
+	if index.Status != StatusUp || index.Details["alias"] != true {
+		t.Fatalf("existing alias reported as %+v", index)
+	}
+
+	missing := Index(client, "missing").Health(context.Background())
+	if missing.Status != StatusDown {
+		t.Fatalf("missing index reported as %+v", missing)
+	}
+
+	down := Down(errors.New("connection refused"))
+	if down.Details["error"] != "connection refused" {
+		t.Fatalf("Down details = %+v", down.Details)
+	}
+}
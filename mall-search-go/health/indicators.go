@@ -0,0 +1,82 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"gorm.io/gorm"
+)
+
+// DB 检查 MySQL 连接，details 与 Spring 的 DataSourceHealthIndicator 保持一致
+func DB(db *gorm.DB) Indicator {
+	return IndicatorFunc(func(ctx context.Context) Health {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return Down(err)
+		}
+		if err := sqlDB.PingContext(ctx); err != nil {
+			return Down(err)
+		}
+		return Up(map[string]interface{}{
+			"database":        "MySQL",
+			"validationQuery": "isValid()",
+		})
+	})
+}
+
+// Elasticsearch 检查集群健康，red 视为 OUT_OF_SERVICE，与 Spring 的 ElasticsearchRestClientHealthIndicator 一致
+func Elasticsearch(client *elasticsearch.Client) Indicator {
+	return IndicatorFunc(func(ctx context.Context) Health {
+		res, err := client.Cluster.Health(client.Cluster.Health.WithContext(ctx))
+		if err != nil {
+			return Down(err)
+		}
+		defer res.Body.Close()
+		if res.IsError() {
+			return Down(fmt.Errorf("cluster health returned %s", res.Status()))
+		}
+
+		var details map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&details); err != nil {
+			return Down(err)
+		}
+		if details["status"] == "red" {
+			return Health{Status: StatusOutOfService, Details: details}
+		}
+		return Up(details)
+	})
+}
+
+// Index 检查搜索使用的索引或别名是否存在，不存在时实例不应接收搜索流量
+func Index(client *elasticsearch.Client, index string) Indicator {
+	return IndicatorFunc(func(ctx context.Context) Health {
+		res, err := client.Indices.Exists([]string{index}, client.Indices.Exists.WithContext(ctx))
+		if err != nil {
+			return Down(err)
+		}
+		res.Body.Close()
+		switch res.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			return Health{Status: StatusDown, Details: map[string]interface{}{
+				"index": index,
+				"error": "index or alias does not exist",
+			}}
+		default:
+			return Down(fmt.Errorf("index check returned %s", res.Status()))
+		}
+
+		aliasRes, err := client.Indices.ExistsAlias([]string{index}, client.Indices.ExistsAlias.WithContext(ctx))
+		if err != nil {
+			return Down(err)
+		}
+		aliasRes.Body.Close()
+		return Up(map[string]interface{}{
+			"index": index,
+			"alias": aliasRes.StatusCode == http.StatusOK,
+		})
+	})
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
-	"github.com/gin-gonic/gin"
-	swaggerFiles "github.com/swaggo/files"
-	"mall-search-go/service"
-
-	ginSwagger "github.com/swaggo/gin-swagger"
-	"mall-search-go/api"
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"mall-search-go/app"
+	"mall-search-go/config"
 )
 
 // @title           Swagger Example API
@@ -30,16 +32,26 @@ import (
 // @externalDocs.url          https://swagger.io/resources/open-api/
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	serviceImpl := service.NewEsProductServiceImpl()
-	server := api.NewEsProductController(serviceImpl)
-	r := gin.Default()
-	server.RegisterRoutes(r)
-
-	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
-	err := r.Run(":8081")
+	loader, err := config.NewLoader(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+	cfg, remote, err := app.LoadConfig(ctx, loader)
 	if err != nil {
-		panic(err)
+		log.Fatalf("Error loading config: %s", err)
 	}
+	log.Printf("Starting %s with profile %s", cfg.Spring.Application.Name, cfg.Profile)
 
+	application, err := app.New(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Startup failed: %s", err)
+	}
+	application.Remote = remote
+	if err := application.Run(ctx); err != nil {
+		log.Fatalf("Server stopped: %s", err)
+	}
+	log.Printf("Server stopped")
 }
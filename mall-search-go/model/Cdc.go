@@ -0,0 +1,34 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// BinlogPosition is a position in the MySQL binlog; Pos is the offset where the next event starts.
+type BinlogPosition struct {
+	File string `json:"file"`
+	Pos  uint32 `json:"pos"`
+}
+
+func (p BinlogPosition) String() string {
+	return fmt.Sprintf("%s:%d", p.File, p.Pos)
+}
+
+// Before reports whether p comes earlier in the binlog than q.
+func (p BinlogPosition) Before(q BinlogPosition) bool {
+	return p.File < q.File || (p.File == q.File && p.Pos < q.Pos)
+}
+
+// CdcCheckpoint is how far a binlog consumer has synchronised the index, persisted in es_cdc_checkpoint.
+// Rows named "<name>:replay" hold the earliest position other instances asked the consumer to replay from.
+type CdcCheckpoint struct {
+	Name      string `gorm:"primaryKey;size:64"`
+	File      string `gorm:"size:255;not null"`
+	Pos       uint32 `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+func (CdcCheckpoint) TableName() string {
+	return "es_cdc_checkpoint"
+}
@@ -0,0 +1,36 @@
+package model
+
+// Facets 是搜索结果的分面统计。每个维度的 Count 只应用其他维度的筛选条件，
+// 选中一个品牌之后品牌分面仍然列出其他品牌，用户可以直接切换或多选
+type Facets struct {
+	Brands     []FacetBucket `json:"brands"`
+	Categories []FacetBucket `json:"categories"`
+	Attrs      []AttrFacet   `json:"attrs"`
+	Prices     []PriceFacet  `json:"prices"`
+}
+
+// FacetBucket 是一个品牌或分类及其商品数
+type FacetBucket struct {
+	Id    int64  `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// AttrFacet 是一个可筛选的属性及其取值的商品数
+type AttrFacet struct {
+	AttrId   int64        `json:"attrId"`
+	AttrName string       `json:"attrName"`
+	Values   []FacetValue `json:"values"`
+}
+
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// PriceFacet 是价格区间 [From, To) 内的商品数，From 或 To 为空表示没有下界或上界
+type PriceFacet struct {
+	From  Decimal `json:"from,omitempty"`
+	To    Decimal `json:"to,omitempty"`
+	Count int     `json:"count"`
+}
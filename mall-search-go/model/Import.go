@@ -0,0 +1,16 @@
+package model
+
+// ImportReport summarises a bulk import into one index.
+type ImportReport struct {
+	Index   string `json:"index"`
+	Indexed int    `json:"indexed"`
+	Failed  int    `json:"failed"`
+	// Failures lists the failed products, capped at search.bulk.max-reported-failures
+	Failures []ImportFailure `json:"failures"`
+}
+
+// ImportFailure is one product that Elasticsearch rejected, with the reason it gave.
+type ImportFailure struct {
+	ProductID int64  `json:"productId"`
+	Reason    string `json:"reason"`
+}
@@ -0,0 +1,56 @@
+package model
+
+import "time"
+
+// Phases of an import job. PREPARING, INDEXING, VERIFYING and SWITCHING mean the job is still running,
+// the others are final.
+const (
+	JobPreparing   = "PREPARING"
+	JobIndexing    = "INDEXING"
+	JobVerifying   = "VERIFYING"
+	JobSwitching   = "SWITCHING"
+	JobSucceeded   = "SUCCEEDED"
+	JobFailed      = "FAILED"
+	JobCancelled   = "CANCELLED"
+	JobInterrupted = "INTERRUPTED"
+)
+
+// ImportJob is one asynchronous full import, persisted in es_import_job so the history survives restarts.
+type ImportJob struct {
+	ID    int64  `json:"id" gorm:"primaryKey;autoIncrement"`
+	Phase string `json:"phase" gorm:"size:16;not null;index"`
+	// Processed is the number of products read from the database and handed to Elasticsearch so far,
+	// Total is the number of searchable products when the job started
+	Processed int             `json:"processed"`
+	Total     int             `json:"total"`
+	Index     string          `json:"index" gorm:"size:64"`
+	Indexed   int             `json:"indexed"`
+	Failed    int             `json:"failed"`
+	Failures  []ImportFailure `json:"failures" gorm:"type:text;serializer:json"`
+	Error     string          `json:"error" gorm:"type:text"`
+
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+}
+
+func (ImportJob) TableName() string {
+	return "es_import_job"
+}
+
+// Finished reports whether the job has reached a final phase.
+func (j ImportJob) Finished() bool {
+	switch j.Phase {
+	case JobSucceeded, JobFailed, JobCancelled, JobInterrupted:
+		return true
+	}
+	return false
+}
+
+// ImportProgress is reported by a running import each time it changes phase or finishes a batch.
+type ImportProgress struct {
+	Phase     string
+	Index     string
+	Processed int
+	Total     int
+}
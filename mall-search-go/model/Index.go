@@ -0,0 +1,25 @@
+package model
+
+import "errors"
+
+// ErrGenerationExists means the name chosen for a new index generation is already taken,
+// which only happens when another import created a generation at the same millisecond.
+var ErrGenerationExists = errors.New("index generation already exists, another import is running")
+
+// MappingDrift describes one field whose mapping in Elasticsearch differs from the managed index template.
+// Expected is empty for fields that only exist in the index (usually added by dynamic mapping),
+// Actual is empty for fields that are missing from the index.
+type MappingDrift struct {
+	Index    string `json:"index"`
+	Field    string `json:"field"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// IndexGeneration is one versioned physical index (pms_v<timestamp in milliseconds>) behind the pms alias.
+type IndexGeneration struct {
+	Name      string `json:"name"`
+	DocsCount int    `json:"docsCount"`
+	CreatedAt string `json:"createdAt"`
+	Active    bool   `json:"active"`
+}
@@ -1,45 +1,72 @@
 package model
 
+import "errors"
+
+var (
+	// ErrInvalidCursor 表示游标不是之前的搜索结果返回的
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrCursorExpired 表示游标背后的 PIT 已经过期，需要从第一页重新搜索
+	ErrCursorExpired = errors.New("cursor expired")
+	// ErrPageTooDeep 表示按页码分页超出了 ES 允许访问的前 max_result_window 条结果
+	ErrPageTooDeep = errors.New("page is too deep, use the cursor of the previous page")
+)
+
 type Page struct {
 	Content  []EsProduct
 	PageInfo PageInfo
+	// Facets 只在请求分面时返回
+	Facets *Facets `json:",omitempty"`
+	// Highlights 只在请求高亮时返回，key 是商品id，值是每个字段的高亮片段，Content 中的字段保持原样
+	Highlights map[int64]map[string][]string `json:",omitempty"`
+	// Suggestion 是搜索词没有或只有很少结果时纠正后的搜索词
+	Suggestion string `json:",omitempty"`
+	// Corrected 为 true 时 Content 是按 Suggestion 而不是原搜索词搜索的结果
+	Corrected bool `json:",omitempty"`
 }
 
+// PageInfo 中的 Number 从 1 开始，小于 1 的页码按第一页处理。
+// 还有下一页时返回 Cursor，把它作为 cursor 参数传回就得到下一页，不受 10000 条的限制；
+// 游标和页码可以互换，前几页也可以继续按 Number 加一翻页
 type PageInfo struct {
 	TotalPages    int
 	TotalElements int
 	Number        int
 	Size          int
+	Cursor        string `json:",omitempty"`
 }
 
+// EsProduct 是搜索用的商品，json 字段名与 Java 版 com.macro.mall.search.domain.EsProduct 一致，
+// 写入 pms 索引时通过 EncodeProduct/DecodeProduct 转换，接口返回的字段也与 Java 版相同
 type EsProduct struct {
-	ID                  int64 `gorm:"primaryKey"`
-	ProductSn           string
-	BrandId             int64
-	BrandName           string
-	ProductCategoryId   int64
-	ProductCategoryName string
-	Pic                 string
-	Name                string
-	SubTitle            string
-	Price               float64
-	Sale                int64
-	NewStatus           int64
-	RecommendStatus     int64
-	Stock               int64
-	PromotionType       int64
-	Keywords            string
-	Sort                int64
-	AttrValueList       []EsProductAttributeValue `gorm:"foreignKey:ProductID"`
+	ID                  int64                     `json:"id" gorm:"primaryKey"`
+	ProductSn           string                    `json:"productSn"`
+	BrandId             int64                     `json:"brandId"`
+	BrandName           string                    `json:"brandName"`
+	ProductCategoryId   int64                     `json:"productCategoryId"`
+	ProductCategoryName string                    `json:"productCategoryName"`
+	Pic                 string                    `json:"pic"`
+	Name                string                    `json:"name"`
+	SubTitle            string                    `json:"subTitle"`
+	Keywords            string                    `json:"keywords"`
+	Price               Decimal                   `json:"price"`
+	Sale                int64                     `json:"sale"`
+	NewStatus           int64                     `json:"newStatus"`
+	RecommandStatus     int64                     `json:"recommandStatus"`
+	Stock               int64                     `json:"stock"`
+	PromotionType       int64                     `json:"promotionType"`
+	Sort                int64                     `json:"sort"`
+	AttrValueList       []EsProductAttributeValue `json:"attrValueList" gorm:"foreignKey:ProductID"`
 }
 
+// EsProductAttributeValue 对应 Java 版 EsProductAttributeValue，Type 为 0 表示规格，1 表示参数
 type EsProductAttributeValue struct {
-	ID                 int64 `gorm:"primaryKey"`
-	Value              string
-	ProductAttributeID int64
-	Type               string
-	Name               string
-	ProductID          int64
+	ID                 int64  `json:"id" gorm:"primaryKey"`
+	ProductAttributeID int64  `json:"productAttributeId"`
+	Value              string `json:"value"`
+	Type               int64  `json:"type"`
+	Name               string `json:"name"`
+	// ProductID 只用于从数据库关联商品，不写入索引
+	ProductID int64 `json:"-"`
 }
 
 // EsProductRelatedInfo represents the product-related information for search results.
@@ -54,4 +81,6 @@ type ProductAttr struct {
 	AttrId     int64    `json:"attrId"`
 	AttrName   string   `json:"attrName"`
 	AttrValues []string `json:"attrValues"`
+	// FilterType 是 pms_product_attribute.filter_type，0 表示普通，1 表示颜色
+	FilterType int64 `json:"filterType"`
 }
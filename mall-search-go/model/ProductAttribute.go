@@ -0,0 +1,13 @@
+package model
+
+// ProductAttribute 是 pms_product_attribute 中搜索用到的字段
+type ProductAttribute struct {
+	ID   int64  `gorm:"column:id;primaryKey"`
+	Name string `gorm:"column:name"`
+	// Type 0 表示规格，1 表示参数
+	Type int64 `gorm:"column:type"`
+	// SearchType 0 表示不需要检索，1 表示关键字检索，2 表示范围检索
+	SearchType int64 `gorm:"column:search_type"`
+	// FilterType 是筛选时的展示样式，0 表示普通，1 表示颜色
+	FilterType int64 `gorm:"column:filter_type"`
+}
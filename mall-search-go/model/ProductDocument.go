@@ -0,0 +1,216 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ProductSchemaVersion 是 pms 索引中商品文档的结构版本，记录在索引 mapping 的 _meta.documentSchema 中。
+// 版本 1 就是 Java 版 EsProduct 经 Spring Data Elasticsearch 写入的结构，Java 版创建的索引没有 _meta，按版本 1 处理。
+// 增删字段或改变字段类型时加一，并同步修改 repository/mapping/pms.json。
+// 版本 2 增加了输入提示用的 suggest 字段，Java 版读取时忽略它
+const ProductSchemaVersion = 2
+
+// productJavaClass 是 Spring Data Elasticsearch 写入 _source 的类型提示，
+// Go 版写入的文档也带上它，两边写入的文档完全相同
+const productJavaClass = "com.macro.mall.search.domain.EsProduct"
+
+// SuggestContextCategory 是 suggest 字段中按商品分类过滤的 context，值是分类id
+const SuggestContextCategory = "category"
+
+// 输入提示的权重，同样匹配前缀时品牌排在分类前面，分类排在商品名称前面
+const (
+	suggestWeightBrand    = 40
+	suggestWeightCategory = 30
+	suggestWeightName     = 20
+	suggestWeightKeyword  = 10
+)
+
+// productDocument 是商品在索引中的 _source
+type productDocument struct {
+	Class string `json:"_class,omitempty"`
+	EsProduct
+	Suggest []completionInput `json:"suggest,omitempty"`
+}
+
+// completionInput 是 completion 类型字段的一组输入，同一组输入共用权重和 context
+type completionInput struct {
+	Input    []string            `json:"input"`
+	Weight   int                 `json:"weight"`
+	Contexts map[string][]string `json:"contexts"`
+}
+
+// EncodeProduct 把商品编码为索引中的 _source，同时从名称、品牌、分类和关键词生成输入提示
+func EncodeProduct(p EsProduct) ([]byte, error) {
+	return json.Marshal(productDocument{Class: productJavaClass, EsProduct: p, Suggest: suggestInputs(p)})
+}
+
+func suggestInputs(p EsProduct) []completionInput {
+	contexts := map[string][]string{SuggestContextCategory: {strconv.FormatInt(p.ProductCategoryId, 10)}}
+	var inputs []completionInput
+	add := func(weight int, input ...string) {
+		var texts []string
+		for _, text := range input {
+			if text = strings.TrimSpace(text); text != "" {
+				texts = append(texts, text)
+			}
+		}
+		if len(texts) > 0 {
+			inputs = append(inputs, completionInput{Input: texts, Weight: weight, Contexts: contexts})
+		}
+	}
+	add(suggestWeightBrand, p.BrandName)
+	add(suggestWeightCategory, p.ProductCategoryName)
+	add(suggestWeightName, p.Name)
+	add(suggestWeightKeyword, SplitKeywords(p.Keywords)...)
+	return inputs
+}
+
+// SplitKeywords 把后台填写的关键词按空白和中英文逗号、顿号、分号拆开
+func SplitKeywords(keywords string) []string {
+	return strings.FieldsFunc(keywords, func(r rune) bool {
+		switch r {
+		case ',', '，', '、', ';', '；':
+			return true
+		}
+		return unicode.IsSpace(r)
+	})
+}
+
+// DecodeProduct 解码 Go 版或 Java 版写入的 _source，价格既可以是数字也可以是字符串
+func DecodeProduct(source []byte) (EsProduct, error) {
+	var doc productDocument
+	if err := json.Unmarshal(source, &doc); err != nil {
+		return EsProduct{}, fmt.Errorf("decode product document: %w", err)
+	}
+	return doc.EsProduct, nil
+}
+
+// Decimal 保存 MySQL DECIMAL/Java BigDecimal 的十进制文本，不经过 float64，避免 5999.00 变成 5998.999…。
+// 编码为 JSON 数字；解码时同时接受数字（Spring Data 把 BigDecimal 转为 double 写入）和字符串
+// （其他客户端或手工写入的 "5999.00"）。空值编码为 null
+type Decimal string
+
+// decimalPattern 是允许的十进制文本：可选负号、整数部分、可选的小数部分和可选的指数。
+// 不用 strconv.ParseFloat 校验，它还接受 NaN、Inf、0x1p3 和 1_000，这些写进文档或查询都会出错。
+// 指数是必须接受的：Jackson 把不小于 1e7 的 double 写成 1.0E7，Java 版写入的价格可能是这种形式
+var decimalPattern = regexp.MustCompile(`^(-?)(\d+)(?:\.(\d+))?(?:[eE]([+-]?\d+))?$`)
+
+// maxDecimalExponent 限制指数的大小，避免 1e999999 展开成很长的字符串
+const maxDecimalExponent = 64
+
+// normalizeDecimal 校验十进制文本，并把指数形式展开为普通的小数，例如 1.0E7 → 10000000，1.5e-3 → 0.0015
+func normalizeDecimal(text string) (string, bool) {
+	m := decimalPattern.FindStringSubmatch(text)
+	if m == nil {
+		return "", false
+	}
+	if m[4] == "" {
+		return text, true
+	}
+	exp, err := strconv.Atoi(m[4])
+	if err != nil || exp > maxDecimalExponent || exp < -maxDecimalExponent {
+		return "", false
+	}
+	sign, digits, point := m[1], m[2]+m[3], len(m[2])+exp
+	var intPart, fracPart string
+	switch {
+	case point <= 0:
+		intPart, fracPart = "0", strings.Repeat("0", -point)+digits
+	case point >= len(digits):
+		intPart = digits + strings.Repeat("0", point-len(digits))
+	default:
+		intPart, fracPart = digits[:point], digits[point:]
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	if intPart == "" {
+		intPart = "0"
+	}
+	if fracPart == "" {
+		return sign + intPart, true
+	}
+	return sign + intPart + "." + fracPart, true
+}
+
+// ParseDecimal 校验十进制文本并展开指数，空字符串返回空值
+func ParseDecimal(text string) (Decimal, error) {
+	if text == "" {
+		return "", nil
+	}
+	normalized, ok := normalizeDecimal(text)
+	if !ok {
+		return "", fmt.Errorf("invalid decimal %q", text)
+	}
+	return Decimal(normalized), nil
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	if d == "" {
+		return []byte("null"), nil
+	}
+	normalized, ok := normalizeDecimal(string(d))
+	if !ok {
+		return nil, fmt.Errorf("invalid decimal %q", string(d))
+	}
+	return []byte(normalized), nil
+}
+
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	switch {
+	case text == "null":
+		*d = ""
+		return nil
+	case len(text) > 0 && text[0] == '"':
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		if text == "" {
+			*d = ""
+			return nil
+		}
+	}
+	normalized, ok := normalizeDecimal(text)
+	if !ok {
+		return fmt.Errorf("invalid decimal %s", data)
+	}
+	*d = Decimal(normalized)
+	return nil
+}
+
+// Scan 实现 sql.Scanner，MySQL 驱动把 DECIMAL 列返回为 []byte
+func (d *Decimal) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = ""
+	case []byte:
+		*d = Decimal(v)
+	case string:
+		*d = Decimal(v)
+	case float64:
+		*d = Decimal(strconv.FormatFloat(v, 'f', -1, 64))
+	case int64:
+		*d = Decimal(strconv.FormatInt(v, 10))
+	default:
+		return fmt.Errorf("cannot scan %T into Decimal", src)
+	}
+	return nil
+}
+
+func (d Decimal) Value() (driver.Value, error) {
+	if d == "" {
+		return nil, nil
+	}
+	return string(d), nil
+}
+
+// Float64 返回近似的浮点值，空值为 0，用于排序和范围查询之类不要求精确的场景
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(string(d), 64)
+	return f
+}
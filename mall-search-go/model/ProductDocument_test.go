@@ -0,0 +1,129 @@
+package model
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeJavaDocument(t *testing.T) {
+	source, err := ioutil.ReadFile("testdata/java_product.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := DecodeProduct(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != 26 || p.BrandId != 3 || p.ProductCategoryName != "手机通讯" || p.RecommandStatus != 1 || p.Price != "3788.0" {
+		t.Fatalf("decoded %+v", p)
+	}
+	if len(p.AttrValueList) != 3 || p.AttrValueList[2] != (EsProductAttributeValue{ID: 185, ProductAttributeID: 26, Value: "中国大陆", Type: 1, Name: "商品产地"}) {
+		t.Fatalf("attrValueList = %+v", p.AttrValueList)
+	}
+
+	// Go 版重新写入之后 Java 版读到的字段不变
+	encoded, err := EncodeProduct(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got map[string]interface{}
+	json.Unmarshal(source, &want)
+	json.Unmarshal(encoded, &got)
+	//suggest 只用于输入提示，Java 版忽略它
+	delete(got, "suggest")
+	// Java 版不写 null 属性，Go 版总是写出空字符串
+	for _, attr := range want["attrValueList"].([]interface{}) {
+		if attr := attr.(map[string]interface{}); attr["value"] == nil {
+			attr["value"] = ""
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("re-encoded document differs:\n got %s\nwant %s", encoded, source)
+	}
+}
+
+func TestSuggestInputs(t *testing.T) {
+	inputs := suggestInputs(EsProduct{
+		ProductCategoryId: 19, ProductCategoryName: "手机通讯", BrandName: "华为",
+		Name: "华为 HUAWEI P20 ", Keywords: "华为手机，全面屏、P20 拍照;",
+	})
+	want := []completionInput{
+		{Input: []string{"华为"}, Weight: suggestWeightBrand},
+		{Input: []string{"手机通讯"}, Weight: suggestWeightCategory},
+		{Input: []string{"华为 HUAWEI P20"}, Weight: suggestWeightName},
+		{Input: []string{"华为手机", "全面屏", "P20", "拍照"}, Weight: suggestWeightKeyword},
+	}
+	for i := range want {
+		want[i].Contexts = map[string][]string{SuggestContextCategory: {"19"}}
+	}
+	if !reflect.DeepEqual(inputs, want) {
+		t.Fatalf("suggest inputs = %+v", inputs)
+	}
+
+	//没有品牌和关键词的商品只提示名称和分类
+	if inputs := suggestInputs(EsProduct{Name: "P20", ProductCategoryName: "手机"}); len(inputs) != 2 {
+		t.Fatalf("suggest inputs = %+v", inputs)
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		want Decimal
+	}{
+		{`{"price": 5999.00}`, "5999.00"},
+		{`{"price": "3788.00"}`, "3788.00"},
+		{`{"price": 0.1}`, "0.1"},
+		//Jackson 把不小于 1e7 的 double 写成指数形式
+		{`{"price": 1.0E7}`, "10000000"},
+		{`{"price": 1.23456789E8}`, "123456789"},
+		{`{"price": "2.5e-3"}`, "0.0025"},
+		{`{"price": -1.5E1}`, "-15"},
+		{`{"price": 0.5E+1}`, "5"},
+		{`{"price": 12.345E1}`, "123.45"},
+		{`{"price": null}`, ""},
+		{`{"price": ""}`, ""},
+		{`{}`, ""},
+	} {
+		p, err := DecodeProduct([]byte(tc.json))
+		if err != nil || p.Price != tc.want {
+			t.Errorf("%s: price = %q, %v, want %q", tc.json, p.Price, err, tc.want)
+		}
+	}
+	//ParseFloat 能解析但不是十进制文本的值都要拒绝
+	for _, price := range []string{`"abc"`, `"NaN"`, `"Inf"`, `"-Infinity"`, `"0x1p3"`, `"1_000"`, `1e`, `"1e999"`, `"1."`, `".5"`, `"+1"`} {
+		if _, err := DecodeProduct([]byte(`{"price": ` + price + `}`)); err == nil {
+			t.Errorf("decoded an invalid price %s", price)
+		}
+	}
+	if d, err := ParseDecimal("-0.50"); err != nil || d != "-0.50" {
+		t.Errorf("ParseDecimal = %q, %v", d, err)
+	}
+	if _, err := ParseDecimal("NaN"); err == nil {
+		t.Error("parsed NaN")
+	}
+
+	//MySQL 驱动把 DECIMAL(10,2) 返回为 []byte，原样写入，不经过 float64
+	var d Decimal
+	if err := d.Scan([]byte("2699.00")); err != nil || d != "2699.00" || d.Float64() != 2699 {
+		t.Fatalf("Scan = %q, %v", d, err)
+	}
+	data, err := json.Marshal(EsProduct{Price: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Price json.RawMessage `json:"price"`
+	}
+	json.Unmarshal(data, &doc)
+	if string(doc.Price) != "2699.00" {
+		t.Fatalf("encoded price = %s", doc.Price)
+	}
+	for _, d := range []Decimal{"12,5", "NaN", "Inf", "0x1p3", "1_000"} {
+		if _, err := json.Marshal(EsProduct{Price: d}); err == nil {
+			t.Errorf("encoded an invalid decimal %q", d)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package model
+
+import "fmt"
+
+// SearchCriteria 是 /esProduct/search 的查询条件。指针字段和空的价格为 nil/"" 时不按它过滤，
+// 新增筛选条件时在这里加字段，不再给 Service 和 Repository 的方法加参数
+type SearchCriteria struct {
+	Keyword           string
+	BrandId           *int64
+	ProductCategoryId *int64
+	// MinPrice 和 MaxPrice 都包含边界
+	MinPrice        Decimal
+	MaxPrice        Decimal
+	NewStatus       *int64
+	RecommandStatus *int64
+	PromotionType   *int64
+	// InStock 为 true 时只返回有库存的商品
+	InStock bool
+	// Attrs 按属性筛选，不同属性之间是“且”，同一属性的多个值之间是“或”
+	Attrs []AttrFilter
+	// Facets 为 true 时同时返回品牌、分类、属性和价格区间的分面统计
+	Facets bool
+	// Highlight 为 true 时返回名称、副标题和关键词中匹配词的高亮片段
+	Highlight bool
+
+	PageNum  int
+	PageSize int
+	// Cursor 不为空时忽略 PageNum 和 PageSize，返回游标对应的那一页
+	Cursor string
+	// Sort 1: 按id降序，2: 按销量降序，3: 按价格升序，4: 按价格降序，其他: 按相关度
+	Sort int
+}
+
+// AttrFilter 要求商品的 attrValueList 中有 productAttributeId 为 AttrId、value 为 Values 之一的属性值
+type AttrFilter struct {
+	AttrId int64
+	Values []string
+}
+
+// Validate 检查价格区间
+func (c SearchCriteria) Validate() error {
+	if c.MinPrice != "" && c.MaxPrice != "" && c.MinPrice.Float64() > c.MaxPrice.Float64() {
+		return fmt.Errorf("minPrice %s is greater than maxPrice %s", c.MinPrice, c.MaxPrice)
+	}
+	if c.MinPrice.Float64() < 0 || c.MaxPrice.Float64() < 0 {
+		return fmt.Errorf("price must not be negative")
+	}
+	return nil
+}
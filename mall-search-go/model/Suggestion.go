@@ -0,0 +1,33 @@
+package model
+
+import "strings"
+
+// 输入提示的类型
+const (
+	SuggestionProduct  = "product"
+	SuggestionBrand    = "brand"
+	SuggestionCategory = "category"
+	SuggestionKeyword  = "keyword"
+)
+
+// Suggestion 是一条输入提示，按权重从高到低返回，相同的文本只返回一次
+type Suggestion struct {
+	Text string `json:"text"`
+	// Type 是 product、brand、category 或 keyword
+	Type string `json:"type"`
+	// ProductId 只在 Type 为 product 时返回，前端可以直接跳转到商品详情
+	ProductId int64 `json:"productId,omitempty"`
+}
+
+// NewSuggestion 按提示文本来自商品的哪个字段确定它的类型，写入时输入去掉了首尾空白
+func NewSuggestion(text string, p EsProduct) Suggestion {
+	switch text {
+	case strings.TrimSpace(p.BrandName):
+		return Suggestion{Text: text, Type: SuggestionBrand}
+	case strings.TrimSpace(p.ProductCategoryName):
+		return Suggestion{Text: text, Type: SuggestionCategory}
+	case strings.TrimSpace(p.Name):
+		return Suggestion{Text: text, Type: SuggestionProduct, ProductId: p.ID}
+	}
+	return Suggestion{Text: text, Type: SuggestionKeyword}
+}
@@ -0,0 +1,90 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSynonym 表示同义词规则或停用词的格式不正确
+var ErrInvalidSynonym = errors.New("invalid synonym rule")
+
+// SynonymRule 是一条 Solr 格式的同义词规则：“手机, 移动电话” 表示互为同义词，
+// “iphone, 苹果手机 => 苹果手机” 表示把左边的词替换为右边的词
+type SynonymRule struct {
+	ID   int64  `json:"id"`
+	Rule string `json:"rule"`
+}
+
+// SynonymVersion 是同义词和停用词的一个完整版本，保存在 es_synonym_version 中。
+// 每次修改都写入一个新版本，回滚也是把旧版本的内容复制为新版本，历史不会被改写
+type SynonymVersion struct {
+	ID        int64         `json:"version" gorm:"primaryKey;autoIncrement"`
+	Rules     []SynonymRule `json:"rules" gorm:"type:text;serializer:json"`
+	StopWords []string      `json:"stopWords" gorm:"type:text;serializer:json"`
+	// Comment 说明这个版本做了什么修改
+	Comment   string    `json:"comment" gorm:"size:255"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (SynonymVersion) TableName() string {
+	return "es_synonym_version"
+}
+
+// Synonyms 返回写入 synonym_graph 过滤器的规则
+func (v SynonymVersion) Synonyms() []string {
+	rules := make([]string, len(v.Rules))
+	for i, r := range v.Rules {
+		rules[i] = r.Rule
+	}
+	return rules
+}
+
+// NextRuleID 返回新规则的id，比已有的规则都大
+func (v SynonymVersion) NextRuleID() int64 {
+	var max int64
+	for _, r := range v.Rules {
+		if r.ID > max {
+			max = r.ID
+		}
+	}
+	return max + 1
+}
+
+// NormalizeSynonymRule 去掉规则中多余的空白并检查格式：用逗号分隔的词至少两个（或者有 =>），
+// => 最多一个，两边都不能为空
+func NormalizeSynonymRule(rule string) (string, error) {
+	sides := strings.Split(rule, "=>")
+	if len(sides) > 2 {
+		return "", fmt.Errorf("%w %q: more than one =>", ErrInvalidSynonym, rule)
+	}
+	normalized := make([]string, len(sides))
+	words := 0
+	for i, side := range sides {
+		var terms []string
+		for _, term := range strings.Split(side, ",") {
+			if term = strings.Join(strings.Fields(term), " "); term != "" {
+				terms = append(terms, term)
+			}
+		}
+		if len(terms) == 0 {
+			return "", fmt.Errorf("%w %q: empty side", ErrInvalidSynonym, rule)
+		}
+		words += len(terms)
+		normalized[i] = strings.Join(terms, ", ")
+	}
+	if len(sides) == 1 && words < 2 {
+		return "", fmt.Errorf("%w %q: a rule needs at least two words", ErrInvalidSynonym, rule)
+	}
+	return strings.Join(normalized, " => "), nil
+}
+
+// NormalizeStopWord 去掉停用词两边的空白，停用词不能为空也不能包含逗号
+func NormalizeStopWord(word string) (string, error) {
+	word = strings.TrimSpace(word)
+	if word == "" || strings.ContainsAny(word, ",=") {
+		return "", fmt.Errorf("%w: stop word %q", ErrInvalidSynonym, word)
+	}
+	return word, nil
+}
@@ -0,0 +1,217 @@
+// Package nacos 是 Nacos Open API（v1 HTTP 接口）的最小客户端，只实现 mall-search 用到的
+// 服务注册、心跳、注销以及配置读取和长轮询监听，Nacos 1.x 和 2.x 的服务端都支持这些接口
+package nacos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// contextPath 是 Nacos 服务端默认的 server.servlet.contextPath
+const contextPath = "/nacos"
+
+// ClientConfig 是连接 Nacos 所需的参数，ServerAddr 与 Spring 的 server-addr 写法相同，
+// 可以带协议前缀，多个地址用逗号分隔
+type ClientConfig struct {
+	ServerAddr string
+	Namespace  string
+	Username   string
+	Password   string
+	// HTTPClient 为空时使用 10s 超时的默认客户端，长轮询请求会单独延长超时
+	HTTPClient *http.Client
+}
+
+// Error 是 Nacos 返回的非 2xx 响应
+type Error struct {
+	Status int
+	Body   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("nacos: %d %s", e.Status, strings.TrimSpace(e.Body))
+}
+
+// Client 按顺序使用配置的服务端地址，一个地址不可用时换下一个
+type Client struct {
+	servers   []string
+	namespace string
+	username  string
+	password  string
+	http      *http.Client
+
+	mu          sync.Mutex
+	next        int
+	token       string
+	tokenExpiry time.Time
+}
+
+func NewClient(cfg ClientConfig) (*Client, error) {
+	c := &Client{namespace: cfg.Namespace, username: cfg.Username, password: cfg.Password, http: cfg.HTTPClient}
+	if c.http == nil {
+		c.http = &http.Client{Timeout: 10 * time.Second}
+	}
+	for _, addr := range strings.Split(cfg.ServerAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid Nacos server address %q", addr)
+		}
+		c.servers = append(c.servers, strings.TrimSuffix(addr, "/"))
+	}
+	if len(c.servers) == 0 {
+		return nil, errors.New("no Nacos server address configured")
+	}
+	return c, nil
+}
+
+// Namespace 是请求使用的命名空间 ID，空字符串表示 public
+func (c *Client) Namespace() string {
+	return c.namespace
+}
+
+// request 描述一次 Open API 调用，form 为空时参数放在查询字符串中
+type request struct {
+	method  string
+	path    string
+	params  url.Values
+	form    url.Values
+	header  http.Header
+	timeout time.Duration
+}
+
+// do 依次尝试各个服务端，网络错误和 5xx 换下一个地址，其余错误直接返回
+func (c *Client) do(ctx context.Context, req request) ([]byte, error) {
+	c.mu.Lock()
+	start := c.next
+	c.mu.Unlock()
+
+	var lastErr error
+	for i := 0; i < len(c.servers); i++ {
+		n := (start + i) % len(c.servers)
+		body, err := c.doServer(ctx, c.servers[n], req)
+		if err == nil {
+			c.mu.Lock()
+			c.next = n
+			c.mu.Unlock()
+			return body, nil
+		}
+		lastErr = err
+		var apiErr *Error
+		if ctx.Err() != nil || (errors.As(err, &apiErr) && apiErr.Status < 500) {
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *Client) doServer(ctx context.Context, server string, req request) ([]byte, error) {
+	params := url.Values{}
+	for k, v := range req.params {
+		params[k] = v
+	}
+	if c.username != "" {
+		token, err := c.accessToken(ctx, server)
+		if err != nil {
+			return nil, err
+		}
+		params.Set("accessToken", token)
+	}
+
+	var body *strings.Reader
+	if req.form != nil {
+		body = strings.NewReader(req.form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	u := server + contextPath + req.path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.header {
+		httpReq.Header[k] = v
+	}
+	if req.form != nil {
+		httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	client := c.http
+	if req.timeout > 0 && client.Timeout > 0 && client.Timeout < req.timeout {
+		copied := *client
+		copied.Timeout = req.timeout
+		client = &copied
+	}
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		if res.StatusCode == http.StatusForbidden && c.username != "" {
+			//token 可能已经在服务端失效，下一次请求重新登录
+			c.mu.Lock()
+			c.token = ""
+			c.mu.Unlock()
+		}
+		return nil, &Error{Status: res.StatusCode, Body: string(data)}
+	}
+	return data, nil
+}
+
+// accessToken 在开启鉴权时登录并缓存 token，在过期前 10% 的时间内刷新
+func (c *Client) accessToken(ctx context.Context, server string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	form := url.Values{"username": {c.username}, "password": {c.password}}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, server+contextPath+"/v1/auth/login", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := c.http.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode/100 != 2 {
+		return "", fmt.Errorf("nacos login: %w", &Error{Status: res.StatusCode, Body: string(data)})
+	}
+	var login struct {
+		AccessToken string `json:"accessToken"`
+		TokenTTL    int64  `json:"tokenTtl"`
+	}
+	if err := json.Unmarshal(data, &login); err != nil {
+		return "", fmt.Errorf("nacos login: %w", err)
+	}
+	c.token = login.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(login.TokenTTL) * time.Second * 9 / 10)
+	return c.token, nil
+}
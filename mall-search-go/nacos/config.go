@@ -0,0 +1,173 @@
+package nacos
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listening-Configs 中的分隔符，与 Nacos 客户端的 Constants.WORD_SEPARATOR/LINE_SEPARATOR 相同
+const (
+	wordSeparator = "\x02"
+	lineSeparator = "\x01"
+)
+
+// ConfigKey 标识配置中心中的一份配置
+type ConfigKey struct {
+	DataID string
+	Group  string
+}
+
+func (k ConfigKey) String() string {
+	return k.Group + "/" + k.DataID
+}
+
+// GetConfig 读取一份配置，配置不存在时返回空字符串和 false
+func (c *Client) GetConfig(ctx context.Context, key ConfigKey) (string, bool, error) {
+	params := url.Values{"dataId": {key.DataID}, "group": {key.Group}}
+	if c.namespace != "" {
+		params.Set("tenant", c.namespace)
+	}
+	data, err := c.do(ctx, request{method: http.MethodGet, path: "/v1/cs/configs", params: params})
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), true, nil
+}
+
+// ListenConfig 长轮询配置变更：contents 是客户端当前持有的内容，服务端在 timeout 内发现内容的 MD5 不一致时
+// 立即返回变更的配置，否则在 timeout 后返回空列表
+func (c *Client) ListenConfig(ctx context.Context, contents map[ConfigKey]string, timeout time.Duration) ([]ConfigKey, error) {
+	var listening strings.Builder
+	for key, content := range contents {
+		listening.WriteString(key.DataID + wordSeparator + key.Group + wordSeparator + contentMD5(content))
+		if c.namespace != "" {
+			listening.WriteString(wordSeparator + c.namespace)
+		}
+		listening.WriteString(lineSeparator)
+	}
+	header := http.Header{"Long-Pulling-Timeout": {strconv.FormatInt(timeout.Milliseconds(), 10)}}
+	data, err := c.do(ctx, request{
+		method:  http.MethodPost,
+		path:    "/v1/cs/configs/listener",
+		form:    url.Values{"Listening-Configs": {listening.String()}},
+		header:  header,
+		timeout: timeout + timeout/2,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//返回的是 url 编码之后的 dataId^2group[^2tenant]^1 列表
+	changed, err := url.QueryUnescape(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	var keys []ConfigKey
+	for _, line := range strings.Split(changed, lineSeparator) {
+		words := strings.Split(line, wordSeparator)
+		if len(words) >= 2 {
+			keys = append(keys, ConfigKey{DataID: words[0], Group: words[1]})
+		}
+	}
+	return keys, nil
+}
+
+// contentMD5 是 Nacos 用来比较配置内容的摘要，不存在的配置对应空字符串
+func contentMD5(content string) string {
+	if content == "" {
+		return ""
+	}
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Watcher 持有一组配置的最新内容，并在其中任何一份变化时通知调用方
+type Watcher struct {
+	client  *Client
+	keys    []ConfigKey
+	timeout time.Duration
+	// retryInterval 是长轮询出错后的等待时间
+	retryInterval time.Duration
+
+	contents map[ConfigKey]string
+}
+
+func NewWatcher(client *Client, keys []ConfigKey, timeout time.Duration) *Watcher {
+	w := &Watcher{client: client, keys: keys, timeout: timeout, retryInterval: 2 * time.Second, contents: make(map[ConfigKey]string)}
+	for _, key := range keys {
+		w.contents[key] = ""
+	}
+	return w
+}
+
+// Load 读取所有配置，返回的内容与 keys 的顺序一致，不存在的配置为空字符串
+func (w *Watcher) Load(ctx context.Context) ([]string, error) {
+	for _, key := range w.keys {
+		content, _, err := w.client.GetConfig(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		w.contents[key] = content
+	}
+	return w.ordered(), nil
+}
+
+func (w *Watcher) ordered() []string {
+	contents := make([]string, len(w.keys))
+	for i, key := range w.keys {
+		contents[i] = w.contents[key]
+	}
+	return contents
+}
+
+// Watch 长轮询配置变更直到 ctx 结束，每次有配置变化时用全部配置的最新内容调用 onChange。
+// 启动时 Load 失败也可以直接调用，第一次长轮询会把所有存在的配置当作变更
+func (w *Watcher) Watch(ctx context.Context, onChange func(contents []string)) {
+	for {
+		changed, err := w.client.ListenConfig(ctx, w.contents, w.timeout)
+		if err == nil && len(changed) > 0 {
+			err = w.reload(ctx, changed)
+			if err == nil {
+				onChange(w.ordered())
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Error watching Nacos config: %s, retrying in %s", err, w.retryInterval)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.retryInterval):
+			}
+		}
+	}
+}
+
+func (w *Watcher) reload(ctx context.Context, changed []ConfigKey) error {
+	for _, key := range changed {
+		if _, ok := w.contents[key]; !ok {
+			continue
+		}
+		content, _, err := w.client.GetConfig(ctx, key)
+		if err != nil {
+			return err
+		}
+		log.Printf("Nacos config %s changed", key)
+		w.contents[key] = content
+	}
+	return nil
+}
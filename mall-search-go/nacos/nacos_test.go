@@ -0,0 +1,310 @@
+package nacos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubServer 实现测试用到的 Nacos Open API，开启鉴权时要求 accessToken
+type stubServer struct {
+	*httptest.Server
+	auth bool
+
+	mu        sync.Mutex
+	instances map[string]url.Values
+	beats     int
+	// forget 为 true 时下一次心跳返回 20404，模拟 Nacos 重启后丢失了实例
+	forget     bool
+	registered int
+	configs    map[string]string
+	changed    chan struct{}
+}
+
+func newStubServer(t *testing.T, auth bool) *stubServer {
+	s := &stubServer{auth: auth, instances: make(map[string]url.Values), configs: make(map[string]string), changed: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nacos/v1/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("username") != "nacos" || r.FormValue("password") != "nacos" {
+			http.Error(w, "unknown user!", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"accessToken":"token-1","tokenTtl":18000,"globalAdmin":true}`)
+	})
+	mux.HandleFunc("/nacos/v1/ns/instance", s.instance)
+	mux.HandleFunc("/nacos/v1/ns/instance/beat", s.beat)
+	mux.HandleFunc("/nacos/v1/cs/configs", s.config)
+	mux.HandleFunc("/nacos/v1/cs/configs/listener", s.listen)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.auth && !strings.HasSuffix(r.URL.Path, "/login") && r.URL.Query().Get("accessToken") != "token-1" {
+			http.Error(w, "user not found!", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func instanceKey(v url.Values) string {
+	return v.Get("namespaceId") + "/" + v.Get("groupName") + "@@" + v.Get("serviceName") + "/" + v.Get("ip") + ":" + v.Get("port")
+}
+
+func (s *stubServer) instance(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPost:
+		s.instances[instanceKey(r.Form)] = r.Form
+		s.registered++
+	case http.MethodDelete:
+		delete(s.instances, instanceKey(r.Form))
+	}
+	fmt.Fprint(w, "ok")
+}
+
+func (s *stubServer) beat(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.beats++
+	key := instanceKey(r.URL.Query())
+	if s.forget {
+		s.forget = false
+		delete(s.instances, key)
+	}
+	if _, ok := s.instances[key]; !ok {
+		fmt.Fprint(w, `{"clientBeatInterval":5000,"code":20404}`)
+		return
+	}
+	fmt.Fprint(w, `{"clientBeatInterval":10,"code":10200,"lightBeatEnabled":true}`)
+}
+
+func (s *stubServer) config(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.mu.Lock()
+	content, ok := s.configs[q.Get("tenant")+"/"+q.Get("group")+"/"+q.Get("dataId")]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "config data not exist", http.StatusNotFound)
+		return
+	}
+	fmt.Fprint(w, content)
+}
+
+func (s *stubServer) publish(tenant, group, dataID, content string) {
+	s.mu.Lock()
+	s.configs[tenant+"/"+group+"/"+dataID] = content
+	changed := s.changed
+	s.changed = make(chan struct{})
+	s.mu.Unlock()
+	close(changed)
+}
+
+// listen 按 Nacos 的长轮询语义：有 MD5 不一致的配置时立即返回，否则等到有发布或超时
+func (s *stubServer) listen(w http.ResponseWriter, r *http.Request) {
+	timeout, _ := time.ParseDuration(r.Header.Get("Long-Pulling-Timeout") + "ms")
+	listening := r.FormValue("Listening-Configs")
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		var result strings.Builder
+		for _, line := range strings.Split(listening, lineSeparator) {
+			words := strings.Split(line, wordSeparator)
+			if len(words) < 3 {
+				continue
+			}
+			tenant := ""
+			if len(words) > 3 {
+				tenant = words[3]
+			}
+			if contentMD5(s.configs[tenant+"/"+words[1]+"/"+words[0]]) != words[2] {
+				result.WriteString(words[0] + wordSeparator + words[1] + wordSeparator + tenant + lineSeparator)
+			}
+		}
+		s.mu.Unlock()
+		if result.Len() > 0 {
+			fmt.Fprint(w, url.QueryEscape(result.String()))
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *stubServer) snapshot() (instances map[string]url.Values, registered, beats int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	instances = make(map[string]url.Values, len(s.instances))
+	for k, v := range s.instances {
+		instances[k] = v
+	}
+	return instances, s.registered, s.beats
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRegistryRegistersBeatsAndDeregisters(t *testing.T) {
+	server := newStubServer(t, true)
+	client, err := NewClient(ClientConfig{ServerAddr: strings.TrimPrefix(server.URL, "http://"), Namespace: "mall", Username: "nacos", Password: "nacos"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewRegistry(client, Instance{
+		Service:  "mall-search",
+		Group:    "DEFAULT_GROUP",
+		Cluster:  "DEFAULT",
+		IP:       "10.0.0.8",
+		Port:     8081,
+		Weight:   1,
+		Metadata: map[string]string{"management.context-path": "/actuator"},
+	}, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		registry.Run(ctx)
+	}()
+
+	const key = "mall/DEFAULT_GROUP@@mall-search/10.0.0.8:8081"
+	waitFor(t, "heartbeats", func() bool {
+		_, _, beats := server.snapshot()
+		return beats >= 3
+	})
+	instances, _, _ := server.snapshot()
+	form, ok := instances[key]
+	if !ok {
+		t.Fatalf("instance not registered: %v", instances)
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal([]byte(form.Get("metadata")), &metadata); err != nil || metadata["management.context-path"] != "/actuator" {
+		t.Fatalf("metadata = %q (%v)", form.Get("metadata"), err)
+	}
+	if form.Get("ephemeral") != "true" || form.Get("clusterName") != "DEFAULT" || form.Get("weight") != "1" {
+		t.Fatalf("registration form = %v", form)
+	}
+
+	//Nacos 丢失实例之后下一次心跳会触发重新注册
+	server.mu.Lock()
+	server.forget = true
+	server.mu.Unlock()
+	waitFor(t, "registering again", func() bool {
+		instances, registered, _ := server.snapshot()
+		_, ok := instances[key]
+		return registered == 2 && ok
+	})
+
+	cancel()
+	<-done
+	if err := registry.Deregister(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if instances, _, _ := server.snapshot(); len(instances) != 0 {
+		t.Fatalf("instances after deregister: %v", instances)
+	}
+}
+
+func TestRegistryKeepsRetryingWhileNacosIsDown(t *testing.T) {
+	server := newStubServer(t, true)
+	// 密码错误时登录失败，Run 不退出而是在下一个周期重试
+	client, _ := NewClient(ClientConfig{ServerAddr: server.URL, Username: "nacos", Password: "wrong"})
+	registry := NewRegistry(client, Instance{Service: "mall-search", Group: "DEFAULT_GROUP", IP: "10.0.0.8", Port: 8081, Weight: 1}, time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	registry.Run(ctx)
+	if _, registered, _ := server.snapshot(); registered != 0 {
+		t.Fatalf("registered %d times with a wrong password", registered)
+	}
+}
+
+func TestClientFailsOverToNextServer(t *testing.T) {
+	server := newStubServer(t, false)
+	server.publish("", "DEFAULT_GROUP", "mall-search.yaml", "server:\n  port: 8081\n")
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "server is DOWN now", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	client, err := NewClient(ClientConfig{ServerAddr: down.URL + "," + server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, ok, err := client.GetConfig(context.Background(), ConfigKey{DataID: "mall-search.yaml", Group: "DEFAULT_GROUP"})
+	if err != nil || !ok || content != "server:\n  port: 8081\n" {
+		t.Fatalf("GetConfig = %q, %v, %v", content, ok, err)
+	}
+	if _, ok, err := client.GetConfig(context.Background(), ConfigKey{DataID: "missing.yaml", Group: "DEFAULT_GROUP"}); ok || err != nil {
+		t.Fatalf("missing config: ok = %v, err = %v", ok, err)
+	}
+}
+
+func TestWatcherReloadsChangedConfig(t *testing.T) {
+	server := newStubServer(t, false)
+	server.publish("mall", "DEFAULT_GROUP", "mall-search.yaml", "search:\n  bulk:\n    workers: 2\n")
+	client, _ := NewClient(ClientConfig{ServerAddr: server.URL, Namespace: "mall"})
+
+	keys := []ConfigKey{
+		{DataID: "mall-search.yaml", Group: "DEFAULT_GROUP"},
+		{DataID: "mall-search-dev.yaml", Group: "DEFAULT_GROUP"},
+	}
+	watcher := NewWatcher(client, keys, time.Second)
+	contents, err := watcher.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents[0] != "search:\n  bulk:\n    workers: 2\n" || contents[1] != "" {
+		t.Fatalf("loaded %q", contents)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan []string, 4)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watcher.Watch(ctx, func(contents []string) { updates <- contents })
+	}()
+
+	server.publish("mall", "DEFAULT_GROUP", "mall-search-dev.yaml", "search:\n  bulk:\n    workers: 4\n")
+	select {
+	case contents := <-updates:
+		if contents[0] != "search:\n  bulk:\n    workers: 2\n" || contents[1] != "search:\n  bulk:\n    workers: 4\n" {
+			t.Fatalf("update = %q", contents)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update after publishing a config")
+	}
+
+	//其他命名空间的同名配置不影响监听的配置
+	server.publish("", "DEFAULT_GROUP", "mall-search-dev.yaml", "server:\n  port: 9000\n")
+	select {
+	case contents := <-updates:
+		t.Fatalf("unexpected update %q", contents)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	<-done
+}
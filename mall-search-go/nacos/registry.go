@@ -0,0 +1,150 @@
+package nacos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// codeResourceNotFound 是心跳响应中实例不存在的返回码，通常是 Nacos 重启或实例因心跳超时被摘除，需要重新注册
+const codeResourceNotFound = 20404
+
+// Instance 是注册到 Nacos 的临时实例，停止心跳后 Nacos 会自动把它摘除
+type Instance struct {
+	Service  string
+	Group    string
+	Cluster  string
+	IP       string
+	Port     int
+	Weight   float64
+	Metadata map[string]string
+}
+
+func (i Instance) String() string {
+	return fmt.Sprintf("%s@%s %s:%d", i.Service, i.Group, i.IP, i.Port)
+}
+
+// Registry 注册一个实例并定期发送心跳
+type Registry struct {
+	client   *Client
+	instance Instance
+	interval time.Duration
+}
+
+func NewRegistry(client *Client, instance Instance, interval time.Duration) *Registry {
+	return &Registry{client: client, instance: instance, interval: interval}
+}
+
+func (r *Registry) Instance() Instance {
+	return r.instance
+}
+
+func (r *Registry) params() url.Values {
+	i := r.instance
+	return url.Values{
+		"serviceName": {i.Service},
+		"groupName":   {i.Group},
+		"clusterName": {i.Cluster},
+		"namespaceId": {r.client.Namespace()},
+		"ip":          {i.IP},
+		"port":        {strconv.Itoa(i.Port)},
+		"ephemeral":   {"true"},
+	}
+}
+
+// Register 注册实例，Nacos 对同一个 ip:port 的重复注册按更新处理
+func (r *Registry) Register(ctx context.Context) error {
+	metadata, err := json.Marshal(r.instance.Metadata)
+	if err != nil {
+		return err
+	}
+	form := r.params()
+	form.Set("weight", strconv.FormatFloat(r.instance.Weight, 'f', -1, 64))
+	form.Set("healthy", "true")
+	form.Set("enabled", "true")
+	form.Set("metadata", string(metadata))
+	_, err = r.client.do(ctx, request{method: http.MethodPost, path: "/v1/ns/instance", form: form})
+	return err
+}
+
+// Deregister 注销实例，网关在下一次刷新服务列表后不再把请求路由过来
+func (r *Registry) Deregister(ctx context.Context) error {
+	_, err := r.client.do(ctx, request{method: http.MethodDelete, path: "/v1/ns/instance", params: r.params()})
+	return err
+}
+
+// beat 发送一次心跳，返回服务端要求的下一次心跳间隔（没有要求时为 0）以及实例是否需要重新注册
+func (r *Registry) beat(ctx context.Context) (time.Duration, bool, error) {
+	i := r.instance
+	beat, err := json.Marshal(map[string]interface{}{
+		"serviceName": i.Group + "@@" + i.Service,
+		"cluster":     i.Cluster,
+		"ip":          i.IP,
+		"port":        i.Port,
+		"weight":      i.Weight,
+		"metadata":    i.Metadata,
+		"scheduled":   true,
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	params := r.params()
+	params.Set("beat", string(beat))
+	data, err := r.client.do(ctx, request{method: http.MethodPut, path: "/v1/ns/instance/beat", params: params})
+	if err != nil {
+		return 0, false, err
+	}
+	var res struct {
+		ClientBeatInterval int64 `json:"clientBeatInterval"`
+		Code               int   `json:"code"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return 0, false, fmt.Errorf("decode heartbeat response: %w", err)
+	}
+	return time.Duration(res.ClientBeatInterval) * time.Millisecond, res.Code == codeResourceNotFound, nil
+}
+
+// Run 注册实例并持续发送心跳直到 ctx 结束。注册失败或 Nacos 报告实例不存在时会在下一个心跳周期重新注册，
+// 所以 Nacos 暂时不可用不会影响服务启动。Run 不会注销实例，停机时由调用方先调用 Deregister
+func (r *Registry) Run(ctx context.Context) {
+	interval := r.interval
+	registered := false
+	for {
+		if !registered {
+			if err := r.Register(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Error registering %s with Nacos: %s", r.instance, err)
+			} else {
+				registered = true
+				log.Printf("Registered %s with Nacos", r.instance)
+			}
+		} else {
+			next, missing, err := r.beat(ctx)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				log.Printf("Error sending Nacos heartbeat for %s: %s", r.instance, err)
+			case missing:
+				log.Printf("Nacos no longer knows %s, registering again", r.instance)
+				registered = false
+				continue
+			case next > 0:
+				interval = next
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
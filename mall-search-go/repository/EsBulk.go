@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"mall-search-go/model"
+)
+
+// BulkWriter 把商品流式写入一个索引。Add 在内部队列满时会阻塞，
+// 所以调用方可以边从数据库分页读取边写入，内存占用不随商品总数增长
+type BulkWriter interface {
+	Add(ctx context.Context, product model.EsProduct) error
+	// Close 刷新剩余的缓冲并等待所有批次完成，返回成功和失败的统计
+	Close(ctx context.Context) (model.ImportReport, error)
+}
+
+type bulkWriter struct {
+	indexer     esutil.BulkIndexer
+	maxFailures int
+	done        func()
+
+	mu     sync.Mutex
+	report model.ImportReport
+}
+
+// NewBulkWriter 创建写入 index 的 BulkWriter，在 Close 之前 repository 的 Close 会等待它
+func (repo *esProductRepositoryImpl) NewBulkWriter(index string) (BulkWriter, error) {
+	return repo.newBulkWriter(index, "")
+}
+
+func (repo *esProductRepositoryImpl) newBulkWriter(index string, refresh string) (*bulkWriter, error) {
+	repo.mu.RLock()
+	cfg := repo.bulk
+	repo.mu.RUnlock()
+	w := &bulkWriter{
+		maxFailures: cfg.MaxReportedFailures,
+		report:      model.ImportReport{Index: index, Failures: []model.ImportFailure{}},
+	}
+	indexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:        repo.client,
+		Index:         index,
+		NumWorkers:    cfg.Workers,
+		FlushBytes:    cfg.FlushBytes,
+		FlushInterval: cfg.FlushInterval,
+		Refresh:       refresh,
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.indexer = indexer
+
+	repo.writes.Add(1)
+	var once sync.Once
+	w.done = func() { once.Do(repo.writes.Done) }
+	return w, nil
+}
+
+func (w *bulkWriter) Add(ctx context.Context, product model.EsProduct) error {
+	data, err := model.EncodeProduct(product)
+	if err != nil {
+		return err
+	}
+	id := product.ID
+	return w.indexer.Add(ctx, esutil.BulkIndexerItem{
+		Action:     "index",
+		DocumentID: strconv.FormatInt(id, 10),
+		Body:       bytes.NewReader(data),
+		OnSuccess: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
+			w.mu.Lock()
+			w.report.Indexed++
+			w.mu.Unlock()
+		},
+		OnFailure: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+			reason := fmt.Sprintf("%s: %s", res.Error.Type, res.Error.Reason)
+			if err != nil {
+				reason = err.Error()
+			}
+			w.fail(id, reason)
+		},
+	})
+}
+
+func (w *bulkWriter) fail(id int64, reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.report.Failed++
+	if len(w.report.Failures) < w.maxFailures {
+		w.report.Failures = append(w.report.Failures, model.ImportFailure{ProductID: id, Reason: reason})
+	}
+}
+
+func (w *bulkWriter) Close(ctx context.Context) (model.ImportReport, error) {
+	defer w.done()
+	err := w.indexer.Close(ctx)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.report, err
+}
+
+// saveAll 同步写入一批商品并立即刷新，任何一条失败都会返回错误
+func (repo *esProductRepositoryImpl) saveAll(index string, products []model.EsProduct) (int, error) {
+	ctx := context.Background()
+	w, err := repo.newBulkWriter(index, "true")
+	if err != nil {
+		return 0, err
+	}
+	for _, product := range products {
+		if err := w.Add(ctx, product); err != nil {
+			w.Close(ctx)
+			return 0, err
+		}
+	}
+	report, err := w.Close(ctx)
+	if err != nil {
+		return report.Indexed, err
+	}
+	if report.Failed > 0 {
+		return report.Indexed, fmt.Errorf("Error indexing %d of %d products, first failure: product %d: %s",
+			report.Failed, len(products), report.Failures[0].ProductID, report.Failures[0].Reason)
+	}
+	return report.Indexed, nil
+}
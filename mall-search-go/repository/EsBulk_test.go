@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"mall-search-go/config"
+	"mall-search-go/model"
+)
+
+// newBulkES 在 newStubES 上只实现 _bulk，id 在 rejected 中的文档返回 400
+func newBulkES(t *testing.T, rejected map[string]bool) *esProductRepositoryImpl {
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var items []string
+		hasErrors := false
+		scanner := bufio.NewScanner(strings.NewReader(body))
+		scanner.Buffer(make([]byte, 1<<20), 1<<20)
+		for scanner.Scan() {
+			var meta map[string]struct {
+				ID string `json:"_id"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil {
+				t.Errorf("bad bulk meta line: %s", scanner.Text())
+				return
+			}
+			id := meta["index"].ID
+			scanner.Scan() // 文档本身
+			if rejected[id] {
+				hasErrors = true
+				items = append(items, fmt.Sprintf(`{"index":{"_id":%q,"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [price]"}}}`, id))
+			} else {
+				items = append(items, fmt.Sprintf(`{"index":{"_id":%q,"status":201,"result":"created"}}`, id))
+			}
+		}
+		fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, hasErrors, strings.Join(items, ","))
+	})
+	cfg := config.Default().Search
+	cfg.Bulk.FlushBytes = 256 // 让测试中的少量文档也会分成多个批次
+	cfg.Bulk.MaxReportedFailures = 1
+	repo.UpdateConfig(cfg)
+	return repo
+}
+
+func TestBulkWriterReportsPerDocumentFailures(t *testing.T) {
+	repo := newBulkES(t, map[string]bool{"3": true, "7": true})
+	ctx := context.Background()
+
+	writer, err := repo.NewBulkWriter("pms_v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(1); id <= 10; id++ {
+		if err := writer.Add(ctx, model.EsProduct{ID: id, Name: "商品"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := writer.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Indexed != 8 || report.Failed != 2 {
+		t.Fatalf("report = %+v, want 8 indexed and 2 failed", report)
+	}
+	if len(report.Failures) != 1 || !strings.Contains(report.Failures[0].Reason, "mapper_parsing_exception") {
+		t.Fatalf("failures = %+v, want one capped failure with the ES reason", report.Failures)
+	}
+
+	//Close 之后 repository 不再有未完成的写入
+	if err := repo.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.SaveAll([]model.EsProduct{{ID: 3}}); err == nil {
+		t.Fatal("SaveAll must report per-item failures")
+	}
+}
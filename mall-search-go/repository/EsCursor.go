@@ -0,0 +1,201 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"mall-search-go/model"
+	"mall-search-go/repository/query"
+)
+
+// 按页码分页用 from/size，只能访问前 max_result_window 条结果，而且翻页之间索引的变化会让结果重复或遗漏。
+// 游标分页在 PIT 上用 search_after 从上一页最后一条命中的排序值之后继续，每一页看到的是同一时刻的索引。
+// 每一页都返回下一页的游标：按页码分页返回的游标只记录页码，第一次使用时才打开 PIT，
+// 浅的几页不会为每次搜索都打开一个 PIT；游标分页的结果也返回页码，前几页可以再换回按页码翻页
+
+// pageCursor 是 PageInfo.Cursor 解码后的内容，对调用方是不透明的字符串
+type pageCursor struct {
+	// PIT 为空表示游标来自按页码分页的结果，这时 After 也为空
+	PIT string `json:"pit,omitempty"`
+	// After 是上一页最后一条命中的排序值，包含 ES 在 PIT 上自动追加的 _shard_doc，原样传回
+	After []json.RawMessage `json:"after,omitempty"`
+	Page  int               `json:"page"`
+	Size  int               `json:"size"`
+	// Query 是生成游标的那次搜索的摘要（见 queryDigest），游标只能继续同一个搜索
+	Query string `json:"q"`
+}
+
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("%w: %s", model.ErrInvalidCursor, err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("%w: %s", model.ErrInvalidCursor, err)
+	}
+	if c.Page < 1 || c.Size < 1 || (c.PIT == "") != (len(c.After) == 0) {
+		return c, fmt.Errorf("%w: %q", model.ErrInvalidCursor, s)
+	}
+	return c, nil
+}
+
+// queryDigest 返回决定命中及其顺序的部分（query、post_filter 和 sort）的摘要。
+// 分页参数、高亮和聚合不影响结果，翻页时可以改变，不计入摘要
+func queryDigest(search *query.Search) string {
+	body := search.Source()
+	data, _ := json.Marshal(map[string]interface{}{
+		"query":       body["query"],
+		"post_filter": body["post_filter"],
+		"sort":        body["sort"],
+	})
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// apply 在 PIT 上取游标对应的那一页：游标来自按页码分页时按偏移，否则从 After 之后继续
+func (c pageCursor) apply(search *query.Search, pit, keepAlive string) *query.Search {
+	if len(c.After) == 0 {
+		search.From(pageOffset(c.Page, c.Size))
+	} else {
+		after := make([]interface{}, len(c.After))
+		for i, v := range c.After {
+			after[i] = v
+		}
+		search.From(0).SearchAfter(after...)
+	}
+	return search.Size(c.Size).PointInTime(pit, keepAlive)
+}
+
+// keepAliveParam 把保留时间转换为 ES 的时间单位，不足一秒的部分舍去
+func keepAliveParam(d time.Duration) string {
+	return fmt.Sprintf("%ds", int64(d/time.Second))
+}
+
+// hasNext 判断这一页之后是否还有结果，没有统计精确总数时只要这一页是满的就认为还有
+func (r *searchResponse) hasNext(info model.PageInfo) bool {
+	if info.Size < 1 || len(r.Hits.Hits) < info.Size {
+		return false
+	}
+	return r.Hits.Total.Relation == "gte" || info.Number*info.Size < r.Hits.Total.Value
+}
+
+// searchPage 执行一页搜索并返回下一页的游标。cursor 为空时按 search 中已经设置的 from/size 分页，
+// 否则用游标中的页码和每页条数，search 中的 from/size 被覆盖。
+// digest 是这个搜索的 queryDigest，写入返回的游标；传入的游标不是由摘要相同的搜索返回的时返回 ErrInvalidCursor
+func (repo *esProductRepositoryImpl) searchPage(ctx context.Context, search *query.Search, digest string, pageNum, pageSize int, cursor string) (searchResponse, model.Page, error) {
+	repo.mu.RLock()
+	paging := repo.paging
+	repo.mu.RUnlock()
+
+	if cursor == "" {
+		if pageOffset(pageNum, pageSize)+pageSize > paging.MaxResultWindow {
+			return searchResponse{}, model.Page{}, fmt.Errorf("%w: page %d of size %d is beyond the first %d results",
+				model.ErrPageTooDeep, pageNum, pageSize, paging.MaxResultWindow)
+		}
+		res, err := repo.search(ctx, search)
+		if err != nil {
+			return res, model.Page{}, err
+		}
+		page := res.page(pageNum, pageSize)
+		if res.hasNext(page.PageInfo) {
+			page.PageInfo.Cursor = pageCursor{Page: page.PageInfo.Number + 1, Size: pageSize, Query: digest}.encode()
+		}
+		return res, page, nil
+	}
+
+	c, err := decodeCursor(cursor)
+	if err != nil {
+		return searchResponse{}, model.Page{}, err
+	}
+	//换了关键词或筛选条件后继续用旧的游标，会在旧结果的位置上返回新搜索的结果
+	if c.Query != digest {
+		return searchResponse{}, model.Page{}, fmt.Errorf("%w: it was returned by a different search", model.ErrInvalidCursor)
+	}
+	keepAlive := keepAliveParam(paging.KeepAlive)
+	pit := c.PIT
+	if pit == "" {
+		//从按页码分页转为游标时，在新打开的 PIT 上按偏移取这一页，之后的页用 search_after
+		if pageOffset(c.Page, c.Size)+c.Size > paging.MaxResultWindow {
+			return searchResponse{}, model.Page{}, fmt.Errorf("%w: page %d of size %d is beyond the first %d results",
+				model.ErrPageTooDeep, c.Page, c.Size, paging.MaxResultWindow)
+		}
+		if pit, err = repo.openPointInTime(ctx, keepAlive); err != nil {
+			return searchResponse{}, model.Page{}, err
+		}
+	}
+	c.apply(search, pit, keepAlive)
+
+	//在 PIT 上搜索时不能在路径中指定索引
+	res, err := repo.search(ctx, search, repo.client.Search.WithIndex())
+	if err != nil {
+		if c.PIT == "" {
+			repo.closePointInTime(pit)
+		}
+		var esErr *ElasticsearchError
+		if errors.As(err, &esErr) && esErr.Status == http.StatusNotFound {
+			return res, model.Page{}, fmt.Errorf("%w: %s", model.ErrCursorExpired, err)
+		}
+		return res, model.Page{}, err
+	}
+	//每次搜索返回的 PIT id 可能变化，下一页使用最新的
+	if res.PitID != "" {
+		pit = res.PitID
+	}
+	page := res.page(c.Page, c.Size)
+	if res.hasNext(page.PageInfo) {
+		last := res.Hits.Hits[len(res.Hits.Hits)-1]
+		page.PageInfo.Cursor = pageCursor{PIT: pit, After: last.Sort, Page: c.Page + 1, Size: c.Size, Query: digest}.encode()
+	} else {
+		//最后一页立即释放 PIT，中途放弃的游标在 keep_alive 之后由 ES 释放
+		repo.closePointInTime(pit)
+	}
+	return res, page, nil
+}
+
+// openPointInTime 在索引（别名指向的当前一代）上打开一个 PIT
+func (repo *esProductRepositoryImpl) openPointInTime(ctx context.Context, keepAlive string) (string, error) {
+	res, err := esapi.OpenPointInTimeRequest{Index: []string{repo.index}, KeepAlive: keepAlive}.Do(ctx, repo.client)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := decodeResponse(res, &out); err != nil {
+		return "", fmt.Errorf("Error opening point in time on %s: %w", repo.index, err)
+	}
+	return out.ID, nil
+}
+
+// closePointInTime 释放 PIT，失败时只记录日志，PIT 过期后 ES 也会释放它
+func (repo *esProductRepositoryImpl) closePointInTime(id string) {
+	body, _ := json.Marshal(map[string]string{"id": id})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := esapi.ClosePointInTimeRequest{Body: bytes.NewReader(body)}.Do(ctx, repo.client)
+	if err == nil {
+		defer res.Body.Close()
+		if res.IsError() && res.StatusCode != http.StatusNotFound {
+			err = responseError(res)
+		}
+	}
+	if err != nil {
+		log.Printf("Error closing point in time: %s", err)
+	}
+}
@@ -0,0 +1,177 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"mall-search-go/model"
+)
+
+// cursorHits 返回 ids 对应的命中，排序值是 [价格, _shard_doc]
+func cursorHits(total int, pit string, ids ...int) string {
+	hits := make([]string, len(ids))
+	for i, id := range ids {
+		hits[i] = fmt.Sprintf(`{"_id":"%d","_source":{"id":%d},"sort":[%d.5,%d]}`, id, id, id*100, 4294967296+id)
+	}
+	pitID := ""
+	if pit != "" {
+		pitID = fmt.Sprintf(`"pit_id":%q,`, pit)
+	}
+	return fmt.Sprintf(`{%s"hits":{"total":{"value":%d,"relation":"eq"},"hits":[%s]}}`, pitID, total, strings.Join(hits, ","))
+}
+
+// 按页码取第一页，再用游标翻到最后一页：第一次使用游标时打开 PIT 并按偏移取页，之后用 search_after，最后一页释放 PIT
+func TestCursorContinuesFromOffsetPage(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		bodies   []string
+	)
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		bodies = append(bodies, body)
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/pms/_pit":
+			if r.URL.Query().Get("keep_alive") != "60s" {
+				t.Errorf("keep_alive = %q", r.URL.Query().Get("keep_alive"))
+			}
+			fmt.Fprint(w, `{"id":"pit-1"}`)
+		case r.URL.Path == "/_pit":
+			fmt.Fprint(w, `{"succeeded":true,"num_freed":1}`)
+		case strings.Contains(body, `"search_after"`):
+			fmt.Fprint(w, cursorHits(5, "pit-2", 5))
+		case strings.Contains(body, `"pit"`):
+			fmt.Fprint(w, cursorHits(5, "pit-1", 3, 4))
+		default:
+			fmt.Fprint(w, cursorHits(5, "", 1, 2))
+		}
+	})
+
+	page, err := repo.SearchByCriteria(model.SearchCriteria{Keyword: "手机", PageNum: 0, PageSize: 2, Sort: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.PageInfo.Number != 1 || page.PageInfo.TotalPages != 3 || page.PageInfo.Cursor == "" || !strings.Contains(bodies[0], `"from":0`) {
+		t.Fatalf("page 0: %+v, query %s", page.PageInfo, bodies[0])
+	}
+
+	var ids []int64
+	for cursor := page.PageInfo.Cursor; cursor != ""; cursor = page.PageInfo.Cursor {
+		if page, err = repo.SearchByCriteria(model.SearchCriteria{Keyword: "手机", PageSize: 100, Cursor: cursor, Sort: 3}); err != nil {
+			t.Fatal(err)
+		}
+		if page.PageInfo.Size != 2 {
+			t.Fatalf("cursor page size %d, want the size of the first page", page.PageInfo.Size)
+		}
+		for _, p := range page.Content {
+			ids = append(ids, p.ID)
+		}
+	}
+	if fmt.Sprint(ids) != "[3 4 5]" || page.PageInfo.Number != 3 {
+		t.Fatalf("cursor pages returned %v, last page %+v", ids, page.PageInfo)
+	}
+
+	want := "[POST /pms/_search POST /pms/_pit POST /_search POST /_search DELETE /_pit]"
+	if got := fmt.Sprint(requests); got != want {
+		t.Fatalf("requests = %s, want %s", got, want)
+	}
+	if !strings.Contains(bodies[2], `"from":2`) || !strings.Contains(bodies[2], `"pit":{"id":"pit-1","keep_alive":"60s"}`) {
+		t.Errorf("first cursor page query %s", bodies[2])
+	}
+	//排序值原样传回，_shard_doc 超过 2^53 也不会丢失精度
+	if !strings.Contains(bodies[3], `"search_after":[400.5,4294967300]`) || !strings.Contains(bodies[3], `"id":"pit-1"`) {
+		t.Errorf("search_after query %s", bodies[3])
+	}
+	if bodies[4] != `{"id":"pit-2"}` {
+		t.Errorf("closed %s, want the latest pit id", bodies[4])
+	}
+}
+
+func TestPageOutsideResultWindow(t *testing.T) {
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	})
+	if _, err := repo.Search("手机", 2001, 5, "", false); !errors.Is(err, model.ErrPageTooDeep) {
+		t.Errorf("page 2001: err = %v, want ErrPageTooDeep", err)
+	}
+	for _, cursor := range []string{"not a cursor", pageCursor{Page: 0, Size: 5}.encode(), pageCursor{PIT: "pit-1", Page: 2, Size: 5}.encode()} {
+		if _, err := repo.Search("手机", 1, 5, cursor, false); !errors.Is(err, model.ErrInvalidCursor) {
+			t.Errorf("cursor %q: err = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
+
+// 游标只能继续返回它的那个搜索，换了关键词、筛选条件或排序都要拒绝；每页条数和高亮可以改变
+func TestCursorBelongsToItsQuery(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		searches int
+	)
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		switch r.URL.Path {
+		case "/pms/_pit":
+			fmt.Fprint(w, `{"id":"pit-1"}`)
+		case "/_pit":
+			fmt.Fprint(w, `{"succeeded":true,"num_freed":1}`)
+		default:
+			mu.Lock()
+			searches++
+			mu.Unlock()
+			fmt.Fprint(w, cursorHits(10, "pit-1", 1, 2))
+		}
+	})
+
+	first := model.SearchCriteria{Keyword: "手机", BrandId: int64Ptr(3), PageNum: 1, PageSize: 2, Sort: 3}
+	page, err := repo.SearchByCriteria(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor := page.PageInfo.Cursor
+
+	next := first
+	next.Cursor, next.PageSize, next.Highlight = cursor, 5, true
+	if _, err := repo.SearchByCriteria(next); err != nil {
+		t.Fatalf("same search with another page size: %v", err)
+	}
+
+	other := func(change func(*model.SearchCriteria)) model.SearchCriteria {
+		c := first
+		c.Cursor = cursor
+		change(&c)
+		return c
+	}
+	for name, criteria := range map[string]model.SearchCriteria{
+		"keyword": other(func(c *model.SearchCriteria) { c.Keyword = "华为" }),
+		"filter":  other(func(c *model.SearchCriteria) { c.BrandId = int64Ptr(6) }),
+		"sort":    other(func(c *model.SearchCriteria) { c.Sort = 4 }),
+	} {
+		if _, err := repo.SearchByCriteria(criteria); !errors.Is(err, model.ErrInvalidCursor) {
+			t.Errorf("%s changed: err = %v, want ErrInvalidCursor", name, err)
+		}
+	}
+	if _, err := repo.Search("手机", 1, 2, cursor, false); !errors.Is(err, model.ErrInvalidCursor) {
+		t.Errorf("criteria cursor used by keyword search: err = %v, want ErrInvalidCursor", err)
+	}
+	if searches != 2 {
+		t.Errorf("%d searches sent to ES, rejected cursors must not reach it", searches)
+	}
+}
+
+func TestExpiredCursor(t *testing.T) {
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"type":"search_context_missing_exception","reason":"No search context found for id [1]"},"status":404}`)
+	})
+	cursor := pageCursor{PIT: "pit-1", After: []json.RawMessage{json.RawMessage("1.5"), json.RawMessage("4294967297")}, Page: 2, Size: 5,
+		Query: queryDigest(searchQuery("手机", 1, 5))}.encode()
+	if _, err := repo.Search("手机", 1, 5, cursor, false); !errors.Is(err, model.ErrCursorExpired) {
+		t.Fatalf("err = %v, want ErrCursorExpired", err)
+	}
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"mall-search-go/model"
+)
+
+// exportBatchSize 是导出时每次从 ES 取的商品数，内存中最多同时有这么多商品
+const exportBatchSize = 500
+
+// Export 在一个 PIT 上用 search_after 依次取出 criteria 匹配的所有商品，每批调用一次 fn，
+// 结果是打开 PIT 那一刻的索引，不受导出期间的写入影响。fn 返回错误或 ctx 被取消时停止，结束时释放 PIT
+func (repo *esProductRepositoryImpl) Export(ctx context.Context, criteria model.SearchCriteria, fn func([]model.EsProduct) error) error {
+	criteria.Facets, criteria.Highlight = false, false
+	repo.mu.RLock()
+	keepAlive := keepAliveParam(repo.paging.KeepAlive)
+	search := criteriaQuery(criteria, repo.facets)
+	repo.mu.RUnlock()
+	//导出不需要总数
+	search.TrackTotalHits(false)
+
+	pit, err := repo.openPointInTime(ctx, keepAlive)
+	if err != nil {
+		return err
+	}
+	defer func() { repo.closePointInTime(pit) }()
+
+	cursor := pageCursor{Page: 1, Size: exportBatchSize}
+	for {
+		res, err := repo.search(ctx, cursor.apply(search, pit, keepAlive), repo.client.Search.WithIndex())
+		if err != nil {
+			return fmt.Errorf("Error exporting products: %w", err)
+		}
+		if res.PitID != "" {
+			pit = res.PitID
+		}
+		hits := res.Hits.Hits
+		if len(hits) == 0 {
+			return nil
+		}
+		if err := fn(res.products()); err != nil {
+			return err
+		}
+		if len(hits) < exportBatchSize {
+			return nil
+		}
+		cursor.After = hits[len(hits)-1].Sort
+	}
+}
@@ -0,0 +1,146 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"mall-search-go/model"
+)
+
+// namedTermsAggregation 是按 id 分桶、names 子聚合取名称的 terms 聚合
+type namedTermsAggregation struct {
+	IDs struct {
+		Buckets []struct {
+			Key      int64            `json:"key"`
+			DocCount int              `json:"doc_count"`
+			Names    termsAggregation `json:"names"`
+		} `json:"buckets"`
+	} `json:"ids"`
+}
+
+func (a namedTermsAggregation) buckets() []model.FacetBucket {
+	buckets := make([]model.FacetBucket, 0, len(a.IDs.Buckets))
+	for _, b := range a.IDs.Buckets {
+		bucket := model.FacetBucket{Id: b.Key, Count: b.DocCount}
+		if names := b.Names.keys(); len(names) > 0 {
+			bucket.Name = names[0]
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+// attrFacetAggregation 是 facetAggregations 中属性的聚合，取值的商品数来自 reverse_nested
+type attrFacetAggregation struct {
+	Values struct {
+		Attrs struct {
+			IDs struct {
+				Buckets []struct {
+					Key    int64            `json:"key"`
+					Names  termsAggregation `json:"names"`
+					Values struct {
+						Buckets []struct {
+							termsBucket
+							Products struct {
+								DocCount int `json:"doc_count"`
+							} `json:"products"`
+						} `json:"buckets"`
+					} `json:"values"`
+				} `json:"buckets"`
+			} `json:"ids"`
+		} `json:"attrs"`
+	} `json:"values"`
+}
+
+func (a attrFacetAggregation) attrs() []model.AttrFacet {
+	attrs := make([]model.AttrFacet, 0, len(a.Values.Attrs.IDs.Buckets))
+	for _, b := range a.Values.Attrs.IDs.Buckets {
+		attr := model.AttrFacet{AttrId: b.Key, Values: make([]model.FacetValue, 0, len(b.Values.Buckets))}
+		if names := b.Names.keys(); len(names) > 0 {
+			attr.AttrName = names[0]
+		}
+		for _, v := range b.Values.Buckets {
+			attr.Values = append(attr.Values, model.FacetValue{Value: v.KeyString(), Count: v.Products.DocCount})
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+type priceFacetAggregation struct {
+	Ranges struct {
+		Buckets []struct {
+			From     *float64 `json:"from"`
+			To       *float64 `json:"to"`
+			DocCount int      `json:"doc_count"`
+		} `json:"buckets"`
+	} `json:"ranges"`
+}
+
+func (a priceFacetAggregation) prices() []model.PriceFacet {
+	prices := make([]model.PriceFacet, 0, len(a.Ranges.Buckets))
+	for _, b := range a.Ranges.Buckets {
+		price := model.PriceFacet{Count: b.DocCount}
+		if b.From != nil {
+			price.From = model.Decimal(strconv.FormatFloat(*b.From, 'f', -1, 64))
+		}
+		if b.To != nil {
+			price.To = model.Decimal(strconv.FormatFloat(*b.To, 'f', -1, 64))
+		}
+		prices = append(prices, price)
+	}
+	return prices
+}
+
+// convertFacets 解析 facetAggregations 的结果，已选属性的取值用它单独的聚合替换
+func convertFacets(aggregations json.RawMessage, criteria model.SearchCriteria) (*model.Facets, error) {
+	if len(aggregations) == 0 {
+		return nil, errors.New("Error parsing facets: response has no aggregations")
+	}
+	var aggs map[string]json.RawMessage
+	if err := json.Unmarshal(aggregations, &aggs); err != nil {
+		return nil, fmt.Errorf("Error parsing facets: %w", err)
+	}
+	decode := func(name string, v interface{}) error {
+		if err := json.Unmarshal(aggs[name], v); err != nil {
+			return fmt.Errorf("Error parsing facet %s: %w", name, err)
+		}
+		return nil
+	}
+
+	var brands, categories namedTermsAggregation
+	var prices priceFacetAggregation
+	var attrs attrFacetAggregation
+	for name, v := range map[string]interface{}{"brands": &brands, "categories": &categories, "prices": &prices, "attrs": &attrs} {
+		if err := decode(name, v); err != nil {
+			return nil, err
+		}
+	}
+	facets := &model.Facets{
+		Brands:     brands.buckets(),
+		Categories: categories.buckets(),
+		Attrs:      attrs.attrs(),
+		Prices:     prices.prices(),
+	}
+
+	for _, selected := range criteria.Attrs {
+		var own attrFacetAggregation
+		if err := decode(attrFacet(selected.AttrId), &own); err != nil {
+			return nil, err
+		}
+		for _, attr := range own.attrs() {
+			replaced := false
+			for i := range facets.Attrs {
+				if facets.Attrs[i].AttrId == attr.AttrId {
+					facets.Attrs[i], replaced = attr, true
+				}
+			}
+			if !replaced {
+				facets.Attrs = append(facets.Attrs, attr)
+			}
+		}
+	}
+	return facets, nil
+}
@@ -0,0 +1,259 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"mall-search-go/model"
+)
+
+// 全量导入不再直接写入线上索引，而是写入新的一代索引 pms_v<毫秒时间戳>，
+// 校验文档数后通过别名 pms 原子切换，旧的几代索引保留下来用于回滚。
+
+// generationPattern 匹配所有代的索引名
+func (repo *esProductRepositoryImpl) generationPattern() string {
+	return repo.index + "_v*"
+}
+
+// generationName 返回 t 时刻创建的一代索引名，时间戳精确到毫秒。
+// 早期的索引名只到秒，同一秒内开始的两次导入（多个实例同时触发）会得到同一个名字
+func (repo *esProductRepositoryImpl) generationName(t time.Time) string {
+	return repo.index + "_v" + strings.Replace(t.Format("20060102150405.000"), ".", "", 1)
+}
+
+// CreateGeneration 按索引模板创建新一代索引，返回索引名。同义词和停用词不在模板中，从当前这一代复制。
+// 索引名已经存在时返回 model.ErrGenerationExists，ES 没有安装 ik 或 pinyin 插件时返回 *MissingPluginError
+func (repo *esProductRepositoryImpl) CreateGeneration(ctx context.Context) (string, error) {
+	filters, err := repo.activeSynonymFilters(ctx)
+	if err != nil {
+		return "", err
+	}
+	return repo.createGeneration(ctx, filters)
+}
+
+// createGeneration 按索引模板和指定的同义词、停用词过滤器创建新一代索引，filters 为 nil 时使用模板中的空过滤器
+func (repo *esProductRepositoryImpl) createGeneration(ctx context.Context, filters map[string]interface{}) (string, error) {
+	name := repo.generationName(time.Now())
+	req := esapi.IndicesCreateRequest{Index: name}
+	if filters != nil {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"settings": synonymSettings(filters)}); err != nil {
+			return "", err
+		}
+		req.Body = &buf
+	}
+	res, err := req.Do(ctx, repo.client)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		err := responseError(res)
+		var esErr *ElasticsearchError
+		if errors.As(err, &esErr) && esErr.Type == "resource_already_exists_exception" {
+			return "", fmt.Errorf("%w: %s", model.ErrGenerationExists, name)
+		}
+		return "", fmt.Errorf("Error creating index %s: %w", name, pluginError(err))
+	}
+	return name, nil
+}
+
+// CountDocuments 刷新索引后返回其中的文档数
+func (repo *esProductRepositoryImpl) CountDocuments(ctx context.Context, index string) (int, error) {
+	refresh, err := esapi.IndicesRefreshRequest{Index: []string{index}}.Do(ctx, repo.client)
+	if err != nil {
+		return 0, err
+	}
+	refresh.Body.Close()
+	if refresh.IsError() {
+		return 0, fmt.Errorf("Error refreshing index %s: %w", index, responseError(refresh))
+	}
+
+	res, err := esapi.CountRequest{Index: []string{index}}.Do(ctx, repo.client)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return 0, fmt.Errorf("Error counting documents in %s: %w", index, responseError(res))
+	}
+	var count struct {
+		Count int `json:"count"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&count); err != nil {
+		return 0, err
+	}
+	return count.Count, nil
+}
+
+// SwapAlias 在一次 _aliases 请求中把别名从当前索引移到 index 上，搜索不会看到中间状态。
+// 如果 pms 还是早期直接创建的真实索引（而不是别名），会在同一个请求中删除它
+func (repo *esProductRepositoryImpl) SwapAlias(ctx context.Context, index string) error {
+	current, err := repo.aliasTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	actions := []map[string]interface{}{}
+	concrete, err := repo.isConcreteIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if concrete {
+		log.Printf("Replacing concrete index %s with an alias to %s", repo.index, index)
+		actions = append(actions, map[string]interface{}{"remove_index": map[string]interface{}{"index": repo.index}})
+	}
+	for _, old := range current {
+		if old != index {
+			actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": old, "alias": repo.index}})
+		}
+	}
+	actions = append(actions, map[string]interface{}{"add": map[string]interface{}{"index": index, "alias": repo.index, "is_write_index": true}})
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"actions": actions}); err != nil {
+		return err
+	}
+	res, err := esapi.IndicesUpdateAliasesRequest{Body: &buf}.Do(ctx, repo.client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Error switching alias %s to %s: %w", repo.index, index, responseError(res))
+	}
+	log.Printf("Alias %s now points to %s", repo.index, index)
+	return nil
+}
+
+// Generations 按创建时间从新到旧列出所有代的索引
+func (repo *esProductRepositoryImpl) Generations(ctx context.Context) ([]model.IndexGeneration, error) {
+	res, err := esapi.CatIndicesRequest{
+		Index:  []string{repo.generationPattern()},
+		Format: "json",
+		H:      []string{"index", "docs.count", "creation.date.string"},
+	}.Do(ctx, repo.client)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("Error listing index generations: %w", responseError(res))
+	}
+
+	var rows []struct {
+		Index     string `json:"index"`
+		DocsCount string `json:"docs.count"`
+		CreatedAt string `json:"creation.date.string"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&rows); err != nil {
+		return nil, err
+	}
+
+	active, err := repo.aliasTargets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	generations := make([]model.IndexGeneration, 0, len(rows))
+	for _, row := range rows {
+		docs, _ := strconv.Atoi(row.DocsCount)
+		generations = append(generations, model.IndexGeneration{
+			Name:      row.Index,
+			DocsCount: docs,
+			CreatedAt: row.CreatedAt,
+			Active:    contains(active, row.Index),
+		})
+	}
+	//索引名中的时间戳是定长的，按名称倒序即按时间倒序。早期只到秒的时间戳是同一时刻毫秒时间戳的前缀，排序同样正确
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].Name > generations[j].Name
+	})
+	return generations, nil
+}
+
+// DeleteIndex 删除一代索引，拒绝删除别名当前指向的索引
+func (repo *esProductRepositoryImpl) DeleteIndex(ctx context.Context, index string) error {
+	if !strings.HasPrefix(index, repo.index+"_v") {
+		return fmt.Errorf("Error deleting index %s: not a generation of %s", index, repo.index)
+	}
+	active, err := repo.aliasTargets(ctx)
+	if err != nil {
+		return err
+	}
+	if contains(active, index) {
+		return fmt.Errorf("Error deleting index %s: it is the active generation", index)
+	}
+
+	res, err := esapi.IndicesDeleteRequest{Index: []string{index}}.Do(ctx, repo.client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Error deleting index %s: %w", index, responseError(res))
+	}
+	return nil
+}
+
+// aliasTargets 返回别名当前指向的索引，别名不存在时返回空
+func (repo *esProductRepositoryImpl) aliasTargets(ctx context.Context) ([]string, error) {
+	res, err := esapi.IndicesGetAliasRequest{Name: []string{repo.index}}.Do(ctx, repo.client)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("Error getting alias %s: %w", repo.index, responseError(res))
+	}
+
+	var aliases map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&aliases); err != nil {
+		return nil, err
+	}
+	targets := make([]string, 0, len(aliases))
+	for index := range aliases {
+		targets = append(targets, index)
+	}
+	sort.Strings(targets)
+	return targets, nil
+}
+
+// isConcreteIndex 判断 pms 是否是一个真实索引而不是别名
+func (repo *esProductRepositoryImpl) isConcreteIndex(ctx context.Context) (bool, error) {
+	res, err := esapi.IndicesExistsRequest{Index: []string{repo.index}}.Do(ctx, repo.client)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	aliases, err := repo.aliasTargets(ctx)
+	if err != nil {
+		return false, err
+	}
+	return len(aliases) == 0, nil
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"mall-search-go/model"
+)
+
+// IndexSchemaVersion 是索引模板的版本号，修改 mapping/pms.json 时需要同时加一，
+// 启动时发现 ES 中的模板版本不同会自动覆盖
+const IndexSchemaVersion = 5
+
+// productIndexDefinition 与 Java 版 EsProduct 上的注解保持一致：
+// keyword 字段、使用 ik_max_word 分词的 name/subTitle/keywords，以及 nested 类型的 attrValueList。
+// _class 是 Spring Data Elasticsearch 写入的类型提示，_meta.documentSchema 是 model.ProductSchemaVersion。
+// suggest 是 Go 版增加的 completion 字段，由 model.EncodeProduct 生成，按 category context 过滤分类。
+// name、brandName、productCategoryName 的 pinyin/initials 子字段用于全拼和首字母搜索，需要 ES 安装 analysis-pinyin 插件。
+// name/subTitle/keywords 搜索时使用 ik_synonym_search，其中的同义词和停用词由 ApplySynonyms 写入，模板中为空
+//
+//go:embed mapping/pms.json
+var productIndexDefinition []byte
+
+type indexDefinition struct {
+	Settings map[string]interface{} `json:"settings"`
+	Mappings map[string]interface{} `json:"mappings"`
+}
+
+func loadIndexDefinition() indexDefinition {
+	var def indexDefinition
+	if err := json.Unmarshal(productIndexDefinition, &def); err != nil {
+		panic(fmt.Sprintf("invalid embedded index definition: %s", err))
+	}
+	return def
+}
+
+// analysisPlugins 是 mapping/pms.json 中用到的插件提供的分词器和过滤器
+var analysisPlugins = map[string]string{
+	"ik_max_word": "analysis-ik",
+	"ik_smart":    "analysis-ik",
+	"pinyin":      "analysis-pinyin",
+}
+
+// missingAnalysisComponent 匹配 ES 找不到分词器或过滤器时的错误原因，例如
+// "Unknown filter type [pinyin] for [pinyin_full]"、"failed to find tokenizer under name [ik_max_word]"
+var missingAnalysisComponent = regexp.MustCompile(`(?:Unknown (?:filter|tokenizer) type|failed to find (?:tokenizer|filter|analyzer)(?: under name)?) \[(\w+)\]`)
+
+// MissingPluginError 表示 ES 节点没有安装索引需要的分析插件，模板和新一代索引都无法创建
+type MissingPluginError struct {
+	Plugin string
+	Err    error
+}
+
+func (e *MissingPluginError) Error() string {
+	return fmt.Sprintf("%s plugin missing: install the %s release matching the Elasticsearch version on every node (see document/docker/docker-compose-env.yml): %s", e.Plugin, e.Plugin, e.Err)
+}
+
+func (e *MissingPluginError) Unwrap() error {
+	return e.Err
+}
+
+// pluginError 在 ES 因为缺少分析插件拒绝请求时返回 *MissingPluginError，其余错误原样返回
+func pluginError(err error) error {
+	var esErr *ElasticsearchError
+	if !errors.As(err, &esErr) {
+		return err
+	}
+	for _, match := range missingAnalysisComponent.FindAllStringSubmatch(esErr.Reason, -1) {
+		if plugin, ok := analysisPlugins[match[1]]; ok {
+			return &MissingPluginError{Plugin: plugin, Err: err}
+		}
+	}
+	return err
+}
+
+// EnsureIndex 创建或更新索引模板，并在索引（或同名别名）不存在时创建第一代索引和别名
+func (repo *esProductRepositoryImpl) EnsureIndex(ctx context.Context) error {
+	if err := repo.ensureIndexTemplate(ctx); err != nil {
+		return err
+	}
+
+	res, err := esapi.IndicesExistsRequest{Index: []string{repo.index}}.Do(ctx, repo.client)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	if res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Error checking index %s: %s", repo.index, res.Status())
+	}
+
+	//首次启动时创建第一代索引并让别名指向它
+	index, err := repo.CreateGeneration(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Created index %s from template", index)
+	return repo.SwapAlias(ctx, index)
+}
+
+func (repo *esProductRepositoryImpl) ensureIndexTemplate(ctx context.Context) error {
+	res, err := esapi.IndicesGetIndexTemplateRequest{Name: repo.index}.Do(ctx, repo.client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+	case res.IsError():
+		return fmt.Errorf("Error getting index template %s: %w", repo.index, responseError(res))
+	default:
+		var existing struct {
+			IndexTemplates []struct {
+				IndexTemplate struct {
+					Version int `json:"version"`
+				} `json:"index_template"`
+			} `json:"index_templates"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&existing); err != nil {
+			return err
+		}
+		if len(existing.IndexTemplates) > 0 && existing.IndexTemplates[0].IndexTemplate.Version == IndexSchemaVersion {
+			return nil
+		}
+	}
+
+	def := loadIndexDefinition()
+	template := map[string]interface{}{
+		"index_patterns": []string{repo.index, repo.index + "_*"},
+		"priority":       100,
+		"version":        IndexSchemaVersion,
+		"_meta": map[string]interface{}{
+			"managed_by": "mall-search-go",
+		},
+		"template": map[string]interface{}{
+			"settings": def.Settings,
+			"mappings": def.Mappings,
+		},
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(template); err != nil {
+		return err
+	}
+
+	putRes, err := esapi.IndicesPutIndexTemplateRequest{Name: repo.index, Body: &buf}.Do(ctx, repo.client)
+	if err != nil {
+		return err
+	}
+	defer putRes.Body.Close()
+	if putRes.IsError() {
+		return fmt.Errorf("Error putting index template %s: %w", repo.index, pluginError(responseError(putRes)))
+	}
+	log.Printf("Installed index template %s version %d", repo.index, IndexSchemaVersion)
+	return nil
+}
+
+// MappingDrift 比较索引（或别名指向的所有索引）的实际 mapping 与模板中的期望 mapping
+func (repo *esProductRepositoryImpl) MappingDrift(ctx context.Context) ([]model.MappingDrift, error) {
+	res, err := esapi.IndicesGetMappingRequest{Index: []string{repo.index}}.Do(ctx, repo.client)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("Error getting mapping of %s: %w", repo.index, responseError(res))
+	}
+
+	var actual map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&actual); err != nil {
+		return nil, err
+	}
+
+	expected := flattenProperties(loadIndexDefinition().Mappings["properties"], "")
+	indices := make([]string, 0, len(actual))
+	for index := range actual {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+
+	drifts := []model.MappingDrift{}
+	for _, index := range indices {
+		drifts = append(drifts, diffMappings(index, expected, flattenProperties(actual[index].Mappings["properties"], ""))...)
+		if d, ok := schemaDrift(index, actual[index].Mappings); ok {
+			drifts = append(drifts, d)
+		}
+	}
+	return drifts, nil
+}
+
+// schemaDrift 检查索引的文档结构版本，Java 版创建的索引没有 _meta，文档结构与版本 1 相同
+func schemaDrift(index string, mappings map[string]interface{}) (model.MappingDrift, bool) {
+	meta, _ := mappings["_meta"].(map[string]interface{})
+	version, ok := meta["documentSchema"].(float64)
+	if !ok {
+		version = 1
+	}
+	if int(version) == model.ProductSchemaVersion {
+		return model.MappingDrift{}, false
+	}
+	return model.MappingDrift{
+		Index:    index,
+		Field:    "_meta.documentSchema",
+		Expected: strconv.Itoa(model.ProductSchemaVersion),
+		Actual:   strconv.Itoa(int(version)),
+	}, true
+}
+
+// flattenProperties 把嵌套的 properties/fields 展开为 "attrValueList.name" -> "keyword" 的形式
+func flattenProperties(properties interface{}, prefix string) map[string]string {
+	fields := make(map[string]string)
+	props, _ := properties.(map[string]interface{})
+	for name, raw := range props {
+		field, _ := raw.(map[string]interface{})
+		path := prefix + name
+		fields[path] = describeField(field)
+		for _, key := range []string{"properties", "fields"} {
+			for subPath, desc := range flattenProperties(field[key], path+".") {
+				fields[subPath] = desc
+			}
+		}
+	}
+	return fields
+}
+
+func describeField(field map[string]interface{}) string {
+	fieldType, _ := field["type"].(string)
+	if fieldType == "" {
+		fieldType = "object"
+	}
+	var attrs []string
+	for _, key := range []string{"analyzer", "search_analyzer", "index"} {
+		if value, ok := field[key]; ok {
+			attrs = append(attrs, fmt.Sprintf("%s=%v", key, value))
+		}
+	}
+	if len(attrs) == 0 {
+		return fieldType
+	}
+	return fieldType + "(" + strings.Join(attrs, ",") + ")"
+}
+
+func diffMappings(index string, expected, actual map[string]string) []model.MappingDrift {
+	var drifts []model.MappingDrift
+	for path, want := range expected {
+		if got := actual[path]; got != want {
+			drifts = append(drifts, model.MappingDrift{Index: index, Field: path, Expected: want, Actual: got})
+		}
+	}
+	for path, got := range actual {
+		if _, ok := expected[path]; !ok {
+			drifts = append(drifts, model.MappingDrift{Index: index, Field: path, Actual: got})
+		}
+	}
+	sort.Slice(drifts, func(i, j int) bool {
+		return drifts[i].Field < drifts[j].Field
+	})
+	return drifts
+}
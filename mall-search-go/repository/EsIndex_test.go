@@ -0,0 +1,219 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"mall-search-go/model"
+)
+
+func TestMappingDriftDetectsDynamicMapping(t *testing.T) {
+	// 没有模板时 ES 动态推断出的 mapping：brandName 变成了 text+keyword，attrValueList 不是 nested
+	var dynamic map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"brandName": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+		"attrValueList": {"properties": {"value": {"type": "text"}}}
+	}`), &dynamic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := flattenProperties(loadIndexDefinition().Mappings["properties"], "")
+	drifts := diffMappings("pms", expected, flattenProperties(dynamic, ""))
+
+	byField := make(map[string]model.MappingDrift)
+	for _, d := range drifts {
+		byField[d.Field] = d
+	}
+	checks := map[string][2]string{
+		"brandName":                        {"keyword", "text"},
+		"brandName.keyword":                {"", "keyword"},
+		"attrValueList":                    {"nested", "object"},
+		"attrValueList.value":              {"keyword", "text"},
+		"attrValueList.name":               {"keyword", ""},
+		"name":                             {"text(analyzer=ik_max_word,search_analyzer=ik_synonym_search)", ""},
+		"attrValueList.productAttributeId": {"long", ""},
+	}
+	for field, want := range checks {
+		d, ok := byField[field]
+		if !ok {
+			t.Errorf("no drift reported for %s", field)
+			continue
+		}
+		if d.Expected != want[0] || d.Actual != want[1] {
+			t.Errorf("%s: drift = %q -> %q, want %q -> %q", field, d.Expected, d.Actual, want[0], want[1])
+		}
+	}
+
+	if drifts := diffMappings("pms", expected, expected); len(drifts) != 0 {
+		t.Errorf("identical mappings reported drift: %+v", drifts)
+	}
+}
+
+// 写入的每个字段都要在 mapping 中（dynamic=false 时不在 mapping 中的字段无法搜索），mapping 中的字段也都要写入
+func TestEncodedDocumentMatchesMapping(t *testing.T) {
+	def := loadIndexDefinition()
+	if meta, _ := def.Mappings["_meta"].(map[string]interface{}); meta["documentSchema"] != float64(model.ProductSchemaVersion) {
+		t.Fatalf("mapping _meta = %v, want documentSchema %d", def.Mappings["_meta"], model.ProductSchemaVersion)
+	}
+
+	source, err := model.EncodeProduct(model.EsProduct{
+		ID:            26,
+		Name:          "华为 HUAWEI P20",
+		Price:         "3788.00",
+		AttrValueList: []model.EsProductAttributeValue{{ID: 185, ProductAttributeID: 26, Value: "中国大陆", Type: 1, Name: "商品产地"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(source, &doc); err != nil {
+		t.Fatal(err)
+	}
+	written := flattenProperties(documentProperties(doc), "")
+	expected := flattenProperties(def.Mappings["properties"], "")
+	//completion 字段写入的是 input/weight/contexts，不是子字段
+	for completion, desc := range expected {
+		if !strings.HasPrefix(desc, "completion") {
+			continue
+		}
+		for field := range written {
+			if strings.HasPrefix(field, completion+".") {
+				delete(written, field)
+			}
+		}
+	}
+	for field := range written {
+		if _, ok := expected[field]; !ok {
+			t.Errorf("field %s is written but not mapped", field)
+		}
+	}
+	for field, desc := range expected {
+		//name.pinyin 这样的子字段由 ES 从父字段生成，不单独写入
+		if i := strings.LastIndex(field, "."); i > 0 && !strings.HasPrefix(expected[field[:i]], "object") && !strings.HasPrefix(expected[field[:i]], "nested") {
+			continue
+		}
+		if _, ok := written[field]; !ok {
+			t.Errorf("mapped field %s (%s) is never written", field, desc)
+		}
+	}
+}
+
+// documentProperties 把一个文档转换成 properties 的形状，以便复用 flattenProperties
+func documentProperties(doc map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{}, len(doc))
+	for name, value := range doc {
+		field := map[string]interface{}{}
+		if list, ok := value.([]interface{}); ok && len(list) > 0 {
+			value = list[0]
+		}
+		if object, ok := value.(map[string]interface{}); ok {
+			field["properties"] = documentProperties(object)
+		}
+		properties[name] = field
+	}
+	return properties
+}
+
+func TestSchemaDrift(t *testing.T) {
+	//Java 版创建的索引没有 _meta，是版本 1 的结构，没有 suggest 字段
+	if d, ok := schemaDrift("pms_java", map[string]interface{}{}); !ok || d.Actual != "1" {
+		t.Errorf("drift of an index created by the Java service = %+v, %v", d, ok)
+	}
+	if _, ok := schemaDrift("pms_v2", map[string]interface{}{"_meta": map[string]interface{}{"documentSchema": float64(model.ProductSchemaVersion)}}); ok {
+		t.Error("an index with the current schema reported drift")
+	}
+	d, ok := schemaDrift("pms_v1", map[string]interface{}{"_meta": map[string]interface{}{"documentSchema": float64(model.ProductSchemaVersion + 1)}})
+	if !ok || d.Field != "_meta.documentSchema" || d.Actual == d.Expected {
+		t.Errorf("drift = %+v, %v", d, ok)
+	}
+}
+
+// 同一秒内开始的两次导入要得到不同的索引名，按名称排序仍然是按时间排序
+func TestGenerationNamesAreUniqueWithinASecond(t *testing.T) {
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {})
+	at := time.Date(2024, 1, 1, 8, 0, 0, 0, time.Local)
+	first, second := repo.generationName(at), repo.generationName(at.Add(time.Millisecond))
+	if first != "pms_v20240101080000000" || second != "pms_v20240101080000001" {
+		t.Fatalf("generation names = %s, %s", first, second)
+	}
+	//早期只到秒的索引名排在同一秒之后创建的索引前面
+	if !("pms_v20240101080000" < first && first < second && second < repo.generationName(at.Add(time.Second))) {
+		t.Fatal("generation names do not sort by creation time")
+	}
+}
+
+// 索引名被另一次导入占用时返回 ErrGenerationExists，而不是写入别人的索引
+func TestCreateGenerationReportsExistingIndex(t *testing.T) {
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/_alias/"):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"alias [pms] missing","status":404}`)
+		case r.Method == http.MethodPut:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":{"type":"resource_already_exists_exception","reason":"index [%s] already exists"},"status":400}`, strings.TrimPrefix(r.URL.Path, "/"))
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	})
+	if _, err := repo.CreateGeneration(context.Background()); !errors.Is(err, model.ErrGenerationExists) {
+		t.Fatalf("CreateGeneration error = %v, want ErrGenerationExists", err)
+	}
+}
+
+// ES 没有安装 pinyin 或 ik 插件时启动就失败，错误要指明缺少哪个插件
+func TestEnsureIndexReportsMissingPlugin(t *testing.T) {
+	reasons := map[string]string{
+		"analysis-pinyin": `{"error":{"root_cause":[{"type":"illegal_argument_exception","reason":"Unknown filter type [pinyin] for [pinyin_full]"}],"type":"illegal_argument_exception","reason":"Unknown filter type [pinyin] for [pinyin_full]"},"status":400}`,
+		"analysis-ik":     `{"error":{"root_cause":[{"type":"illegal_argument_exception","reason":"Custom Analyzer [pinyin_full] failed to find tokenizer under name [ik_max_word]"}],"type":"illegal_argument_exception","reason":"Custom Analyzer [pinyin_full] failed to find tokenizer under name [ik_max_word]"},"status":400}`,
+	}
+	for plugin, reason := range reasons {
+		repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+			switch {
+			case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/_index_template/"):
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"index_templates":[]}`)
+			case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_index_template/"):
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, reason)
+			default:
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+		})
+		err := repo.EnsureIndex(context.Background())
+		var missing *MissingPluginError
+		if !errors.As(err, &missing) || missing.Plugin != plugin {
+			t.Errorf("EnsureIndex error = %v, want %s missing", err, plugin)
+			continue
+		}
+		if !strings.Contains(err.Error(), plugin+" plugin missing") {
+			t.Errorf("error message %q", err)
+		}
+	}
+}
+
+// 其他原因创建失败时不误报缺少插件
+func TestCreateGenerationReportsOtherErrorsUnchanged(t *testing.T) {
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/_alias/"):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"alias [pms] missing","status":404}`)
+		case r.Method == http.MethodPut:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"type":"illegal_argument_exception","reason":"failed to build synonyms"},"status":400}`)
+		}
+	})
+	_, err := repo.CreateGeneration(context.Background())
+	var missing *MissingPluginError
+	if err == nil || errors.As(err, &missing) {
+		t.Fatalf("CreateGeneration error = %v", err)
+	}
+}
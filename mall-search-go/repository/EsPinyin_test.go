@@ -0,0 +1,211 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"mall-search-go/config"
+	"mall-search-go/model"
+)
+
+// liveRepository 连接 MALL_SEARCH_TEST_ES 指定的 ES（需要安装 analysis-ik 和 analysis-pinyin 插件），
+// 按托管的模板创建一个临时索引，测试结束后删除。没有设置时跳过，分词器的效果只能在真实的 ES 上验证
+func liveRepository(t *testing.T) *esProductRepositoryImpl {
+	t.Helper()
+	url := os.Getenv("MALL_SEARCH_TEST_ES")
+	if url == "" {
+		t.Skip("MALL_SEARCH_TEST_ES is not set")
+	}
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{url}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default().Search
+	cfg.Index = fmt.Sprintf("pms_test_%d", time.Now().UnixNano())
+	repo := NewEsProductRepository(client, cfg).(*esProductRepositoryImpl)
+	t.Cleanup(func() {
+		ctx := context.Background()
+		if res, err := (esapi.IndicesDeleteRequest{Index: []string{cfg.Index + "_*"}}).Do(ctx, client); err == nil {
+			res.Body.Close()
+		}
+		if res, err := (esapi.IndicesDeleteIndexTemplateRequest{Name: cfg.Index}).Do(ctx, client); err == nil {
+			res.Body.Close()
+		}
+	})
+	if err := repo.EnsureIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func productIds(products []model.EsProduct) []int64 {
+	ids := make([]int64, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+var pinyinProducts = []model.EsProduct{
+	{ID: 1, Name: "小米8 全面屏", BrandName: "小米", ProductCategoryName: "手机通讯", Price: "2699"},
+	{ID: 2, Name: "华为 HUAWEI P20", BrandName: "华为", ProductCategoryName: "手机通讯", Price: "3788"},
+	{ID: 3, Name: "Apple iPad 平板电脑", BrandName: "苹果", ProductCategoryName: "平板电脑", Price: "2999"},
+}
+
+// pinyinCases 中全拼命中名称或品牌的拼音，首字母命中名称、品牌或分类首字母的前缀
+var pinyinCases = []struct {
+	hanzi  string
+	pinyin []string
+	want   string
+	// criteria 是条件搜索用拼音时的结果，没有列出的为空：条件搜索中拼音只参与排序，
+	// 只有拼音命中的商品达不到 min_score（/esProduct/search 的接口文档中有说明）
+	criteria map[string]string
+}{
+	{"小米", []string{"xiaomi", "xm"}, "[1]", nil},
+	//名称中有 HUAWEI，条件搜索用全拼也能按名称命中
+	{"华为", []string{"huawei", "hw"}, "[2]", map[string]string{"huawei": "[2]"}},
+	{"平板电脑", []string{"pingbandiannao", "pbdn"}, "[3]", nil},
+}
+
+func TestPinyinAndHanziFindTheSameProducts(t *testing.T) {
+	repo := liveRepository(t)
+	if _, err := repo.SaveAll(pinyinProducts); err != nil {
+		t.Fatal(err)
+	}
+	checkPinyinCases(t, repo)
+}
+
+// checkPinyinCases 用汉字和拼音分别搜索，两者应该命中相同的商品
+func checkPinyinCases(t *testing.T, repo *esProductRepositoryImpl) {
+	t.Helper()
+	for _, tc := range pinyinCases {
+		for _, keyword := range append([]string{tc.hanzi}, tc.pinyin...) {
+			page, err := repo.Search(keyword, 1, 10, "", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(productIds(page.Content)); got != tc.want {
+				t.Errorf("Search(%q) = %s, want %s like %q", keyword, got, tc.want, tc.hanzi)
+			}
+			want := tc.want
+			if keyword != tc.hanzi {
+				if want = tc.criteria[keyword]; want == "" {
+					want = "[]"
+				}
+			}
+			page, err = repo.SearchByCriteria(model.SearchCriteria{Keyword: keyword, PageNum: 1, PageSize: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(productIds(page.Content)); got != want {
+				t.Errorf("SearchByCriteria(%q) = %s, want %s", keyword, got, want)
+			}
+		}
+	}
+}
+
+// 不连接 ES 时检查发给 ES 的查询：两种搜索都在 pinyinFields 中搜索，拼音的权重低于汉字的匹配，
+// 条件搜索中拼音的 weight 低于 min_score；这些子字段在托管的 mapping 中用拼音分析器建索引。
+// 分析器的效果只能在真实的 ES 上验证，见 TestPinyinAndHanziFindTheSameProducts
+func TestSearchQueriesIncludePinyinFields(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []map[string]interface{}
+	)
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		var parsed map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+			t.Errorf("query %s: %s", body, err)
+		}
+		mu.Lock()
+		bodies = append(bodies, parsed)
+		mu.Unlock()
+		fmt.Fprint(w, `{"hits":{"total":{"value":0,"relation":"eq"},"hits":[]}}`)
+	})
+	if _, err := repo.Search("hwsj", 1, 10, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.SearchByCriteria(model.SearchCriteria{Keyword: "hwsj", PageNum: 1, PageSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("%d searches sent", len(bodies))
+	}
+
+	//简单搜索：拼音是 bool.should 中 boost 为 0.5 的 multi_match，汉字的 match 是默认的 1
+	var pinyin map[string]interface{}
+	should, _ := object(bodies[0], "query", "bool")["should"].([]interface{})
+	for _, clause := range should {
+		clause, _ := clause.(map[string]interface{})
+		if m := object(clause, "multi_match"); m != nil {
+			pinyin = m
+		} else if _, ok := clause["match"]; !ok {
+			t.Errorf("unexpected clause %v", clause)
+		}
+	}
+	if pinyin == nil || pinyin["query"] != "hwsj" || fmt.Sprint(pinyin["fields"]) != fmt.Sprint(pinyinFields) {
+		t.Fatalf("Search has no pinyin clause: %v", should)
+	}
+	if boost, _ := pinyin["boost"].(float64); boost <= 0 || boost >= 1 {
+		t.Errorf("pinyin boost %v, want below the boost of the hanzi matches", pinyin["boost"])
+	}
+
+	//条件搜索：拼音的 weight 低于汉字各字段，也低于 min_score
+	score := object(bodies[1], "query", "function_score")
+	minScore, _ := score["min_score"].(float64)
+	var pinyinWeight float64
+	var hanziWeights []float64
+	functions, _ := score["functions"].([]interface{})
+	for _, f := range functions {
+		f, _ := f.(map[string]interface{})
+		weight, _ := f["weight"].(float64)
+		if m := object(f, "filter", "multi_match"); m != nil {
+			if fmt.Sprint(m["fields"]) != fmt.Sprint(pinyinFields) {
+				t.Errorf("criteria pinyin fields %v", m["fields"])
+			}
+			pinyinWeight = weight
+		} else {
+			hanziWeights = append(hanziWeights, weight)
+		}
+	}
+	if pinyinWeight <= 0 || pinyinWeight >= minScore {
+		t.Errorf("criteria pinyin weight %v, want positive and below min_score %v", pinyinWeight, minScore)
+	}
+	for _, w := range hanziWeights {
+		if w <= pinyinWeight {
+			t.Errorf("hanzi weight %v is not above the pinyin weight %v", w, pinyinWeight)
+		}
+	}
+
+	//查询用到的拼音子字段都在 mapping 中，索引时用拼音分析器，搜索时不再转换拼音
+	properties := loadIndexDefinition().Mappings["properties"].(map[string]interface{})
+	for _, field := range pinyinFields {
+		parts := strings.SplitN(field, ".", 2)
+		sub := object(properties, parts[0], "fields", parts[1])
+		analyzer, _ := sub["analyzer"].(string)
+		searchAnalyzer, _ := sub["search_analyzer"].(string)
+		if !strings.HasPrefix(analyzer, "pinyin_") || searchAnalyzer != analyzer+"_search" {
+			t.Errorf("%s is mapped as %v", field, sub)
+		}
+	}
+}
+
+// object 按 keys 依次取出嵌套的 JSON 对象，不存在时返回 nil
+func object(v interface{}, keys ...string) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	for _, key := range keys {
+		m, _ = m[key].(map[string]interface{})
+	}
+	return m
+}
@@ -0,0 +1,300 @@
+package repository
+
+import (
+	"strconv"
+
+	"mall-search-go/config"
+	"mall-search-go/model"
+	"mall-search-go/repository/query"
+)
+
+// 这里的函数只负责组装查询，不访问 ES，查询的结构由 testdata/queries 下的 golden 文件校验
+
+// pinyinFields 是名称、品牌和分类的全拼和首字母子字段，用户输入 xiaomi 或 hwsj 时也能搜到小米、华为手机
+var pinyinFields = []string{
+	"name.pinyin", "name.initials",
+	"brandName.pinyin", "brandName.initials",
+	"productCategoryName.pinyin", "productCategoryName.initials",
+}
+
+// pinyinQuery 在拼音子字段中搜索，权重低于汉字的匹配，汉字搜索词的排序基本不受影响
+func pinyinQuery(keyword string) query.Query {
+	return query.MultiMatch(keyword, pinyinFields...).Boost(0.5)
+}
+
+// searchQuery 在名称、副标题、关键词以及名称、品牌和分类的拼音中搜索
+func searchQuery(keyword string, pageNum, pageSize int) *query.Search {
+	return query.NewSearch().
+		Query(query.Bool().Should(
+			query.Match("name", keyword),
+			query.Match("subTitle", keyword),
+			query.Match("keywords", keyword),
+			pinyinQuery(keyword),
+		)).
+		From(pageOffset(pageNum, pageSize)).
+		Size(pageSize).
+		Sort(query.Desc("_score")).
+		TrackTotalHits(true)
+}
+
+// pageOffset 返回第 pageNum 页第一条结果的偏移，页码从 1 开始，小于 1 时按第一页处理
+func pageOffset(pageNum, pageSize int) int {
+	if pageNum < 1 {
+		return 0
+	}
+	return (pageNum - 1) * pageSize
+}
+
+// criteriaQuery 与 Java 版 EsProductServiceImpl.search 一致：
+// 关键词按名称、副标题、关键词分别匹配加权求和，总分低于 2 的不返回；其他条件只过滤不打分。
+// 请求分面时筛选条件改放在 post_filter 中，聚合只受关键词和各自维度以外的条件影响
+func criteriaQuery(c model.SearchCriteria, facets config.FacetsConfig) *query.Search {
+	//没有提供关键字时使用match_all查询
+	var scoring query.Query = query.MatchAll()
+	if c.Keyword != "" {
+		//名称命中得10分，副标题5分，关键词2分，只有关键词命中也能达到min_score；
+		//名称、品牌、分类的拼音命中只加1分，用来给汉字命中排序，只有拼音命中时达不到min_score。
+		//所以条件搜索不能只用拼音搜到商品（与简单搜索不同），接口文档 /esProduct/search 中写明了这一点
+		scoring = query.FunctionScore(nil).
+			Weight(query.Match("name", c.Keyword), 10).
+			Weight(query.Match("subTitle", c.Keyword), 5).
+			Weight(query.Match("keywords", c.Keyword), 2).
+			Weight(query.MultiMatch(c.Keyword, pinyinFields...), 1).
+			ScoreMode("sum").
+			MinScore(2)
+	}
+
+	search := query.NewSearch()
+	filters := criteriaFilters(c)
+	filter := filters.except("")
+	switch {
+	case c.Facets:
+		search.Query(scoring)
+		if !filter.IsEmpty() {
+			search.PostFilter(filter)
+		}
+		facetAggregations(search, c, filters, facets)
+	case !filter.IsEmpty():
+		search.Query(filter.Must(scoring))
+	default:
+		search.Query(scoring)
+	}
+
+	search.From(pageOffset(c.PageNum, c.PageSize)).Size(c.PageSize).TrackTotalHits(true)
+	//按字段排序时相同的值再按相关度排序
+	if s := productSort(c.Sort); s.Field != "_score" {
+		search.Sort(s)
+	}
+	return search.Sort(query.Desc("_score"))
+}
+
+// filterClause 是一个筛选条件，facet 是它所属的分面维度，计算这个维度的分面时不应用它
+type filterClause struct {
+	facet string
+	query query.Query
+}
+
+type filterClauses []filterClause
+
+// except 返回除 facet 维度以外的所有条件，facet 为空时返回全部条件
+func (fs filterClauses) except(facet string) *query.BoolQuery {
+	filter := query.Bool()
+	for _, f := range fs {
+		if facet == "" || f.facet != facet {
+			filter.Filter(f.query)
+		}
+	}
+	return filter
+}
+
+// attrFacet 是属性 attrId 的分面维度名
+func attrFacet(attrId int64) string {
+	return "attr_" + strconv.FormatInt(attrId, 10)
+}
+
+// criteriaFilters 把关键词以外的条件转换为 filter 子句
+func criteriaFilters(c model.SearchCriteria) filterClauses {
+	var filters filterClauses
+	for _, term := range []struct {
+		facet string
+		field string
+		value *int64
+	}{
+		{"brands", "brandId", c.BrandId},
+		{"categories", "productCategoryId", c.ProductCategoryId},
+		{"", "newStatus", c.NewStatus},
+		{"", "recommandStatus", c.RecommandStatus},
+		{"", "promotionType", c.PromotionType},
+	} {
+		if term.value != nil {
+			filters = append(filters, filterClause{term.facet, query.Term(term.field, *term.value)})
+		}
+	}
+	if c.MinPrice != "" || c.MaxPrice != "" {
+		price := query.Range("price")
+		if c.MinPrice != "" {
+			price.Gte(c.MinPrice)
+		}
+		if c.MaxPrice != "" {
+			price.Lte(c.MaxPrice)
+		}
+		filters = append(filters, filterClause{"prices", price})
+	}
+	if c.InStock {
+		filters = append(filters, filterClause{"", query.Range("stock").Gt(0)})
+	}
+	//每个属性单独一个nested查询，属性id和值必须在同一个属性值上匹配
+	for _, attr := range c.Attrs {
+		values := make([]interface{}, len(attr.Values))
+		for i, v := range attr.Values {
+			values[i] = v
+		}
+		filters = append(filters, filterClause{attrFacet(attr.AttrId), query.Nested("attrValueList", query.Bool().Filter(
+			query.Term("attrValueList.productAttributeId", attr.AttrId),
+			query.Terms("attrValueList.value", values...),
+		)).ScoreMode("none")})
+	}
+	return filters
+}
+
+// facetAggregations 为每个分面维度添加一个 filter 聚合，应用这个维度以外的筛选条件。
+// 已选的属性各自单独聚合，其他属性的取值在 attrs 中按全部条件统计
+func facetAggregations(search *query.Search, c model.SearchCriteria, filters filterClauses, cfg config.FacetsConfig) {
+	named := func(field, nameField string) query.Aggregation {
+		return query.TermsAgg(field).Size(cfg.Size).SubAgg("names", query.TermsAgg(nameField).Size(1))
+	}
+	search.Aggregation("brands", query.FilterAgg(filters.except("brands")).SubAgg("ids", named("brandId", "brandName")))
+	search.Aggregation("categories", query.FilterAgg(filters.except("categories")).SubAgg("ids", named("productCategoryId", "productCategoryName")))
+
+	prices := query.RangeAgg("price")
+	var from interface{}
+	for _, bound := range cfg.PriceRanges {
+		prices.AddRange(from, bound)
+		from = bound
+	}
+	prices.AddRange(from, nil)
+	search.Aggregation("prices", query.FilterAgg(filters.except("prices")).SubAgg("ranges", prices))
+
+	attrs := func(attrFilter query.Query) query.Aggregation {
+		return query.NestedAgg("attrValueList").SubAgg("attrs", query.FilterAgg(attrFilter).
+			SubAgg("ids", query.TermsAgg("attrValueList.productAttributeId").Size(cfg.Size).
+				SubAgg("names", query.TermsAgg("attrValueList.name").Size(1)).
+				SubAgg("values", query.TermsAgg("attrValueList.value").Size(cfg.Size).
+					SubAgg("products", query.ReverseNestedAgg()))))
+	}
+	//只统计参数（type=1），与商品详情页的筛选属性一致
+	search.Aggregation("attrs", query.FilterAgg(filters.except("")).SubAgg("values", attrs(query.Term("attrValueList.type", 1))))
+	for _, attr := range c.Attrs {
+		facet := attrFacet(attr.AttrId)
+		search.Aggregation(facet, query.FilterAgg(filters.except(facet)).SubAgg("values", attrs(query.Term("attrValueList.productAttributeId", attr.AttrId))))
+	}
+}
+
+// highlightFields 是高亮的字段，与关键词搜索的字段一致
+var highlightFields = []string{"name", "subTitle", "keywords"}
+
+// productHighlight 请求名称、副标题和关键词的高亮。搜索的查询可能是 function_score，
+// 它的 functions 不参与高亮，所以用关键词单独构造高亮查询
+func productHighlight(keyword string, cfg config.HighlightConfig) *query.Highlight {
+	h := query.NewHighlight(highlightFields...).Tags(cfg.PreTag, cfg.PostTag)
+	if keyword != "" {
+		h.Query(query.MultiMatch(keyword, highlightFields...))
+	}
+	return h
+}
+
+// productSort 对应接口的 sort 参数
+// 1: 根据id降序
+// 2: 根据sale降序
+// 3: 根据price升序
+// 4: 根据price降序
+// 其他: 按相关度
+func productSort(sort int) query.Sort {
+	switch sort {
+	case 1:
+		return query.Desc("id")
+	case 2:
+		return query.Desc("sale")
+	case 3:
+		return query.Asc("price")
+	case 4:
+		return query.Desc("price")
+	default:
+		return query.Desc("_score")
+	}
+}
+
+// recommendQuery 按名称、品牌、分类与指定商品的相似度推荐，排除商品本身
+func recommendQuery(id int64, product model.EsProduct, pageNum int, pageSize int) *query.Search {
+	return query.NewSearch().
+		Query(query.Bool().
+			MustNot(query.Term("id", id)).
+			Should(
+				query.Match("name", product.Name).Boost(8),
+				query.Match("subTitle", product.SubTitle).Boost(2),
+				query.Match("keywords", product.Keywords).Boost(2),
+				query.Match("brandId", product.BrandId).Boost(5),
+				query.Match("productCategoryId", product.ProductCategoryId).Boost(3),
+			)).
+		From(pageOffset(pageNum, pageSize)).
+		Size(pageSize).
+		Sort(query.Desc("_score")).
+		TrackTotalHits(true)
+}
+
+// relatedQuery 与 Java 版 EsProductServiceImpl.searchRelatedInfo 一致，聚合搜索结果中的品牌、分类和可筛选的属性。
+// 属性只统计参数（type=1）中 attrIds 列出的属性，按属性id分组，每组取属性名和所有取值
+func relatedQuery(keyword string, attrIds []int64) *query.Search {
+	var q query.Query = query.MatchAll()
+	if keyword != "" {
+		q = query.MultiMatch(keyword, "name", "subTitle", "keywords")
+	}
+	search := query.NewSearch().
+		Query(q).
+		Size(0).
+		Aggregation("brandNames", query.TermsAgg("brandName")).
+		Aggregation("productCategoryNames", query.TermsAgg("productCategoryName"))
+	if len(attrIds) == 0 {
+		return search
+	}
+	ids := make([]interface{}, len(attrIds))
+	for i, id := range attrIds {
+		ids[i] = id
+	}
+	return search.Aggregation("allAttrValues", query.NestedAgg("attrValueList").
+		SubAgg("productAttrs", query.FilterAgg(query.Bool().Filter(
+			query.Term("attrValueList.type", 1),
+			query.Terms("attrValueList.productAttributeId", ids...),
+		)).
+			SubAgg("attrIds", query.TermsAgg("attrValueList.productAttributeId").Size(len(attrIds)).
+				SubAgg("attrValues", query.TermsAgg("attrValueList.value")).
+				SubAgg("attrNames", query.TermsAgg("attrValueList.name").Size(1)))))
+}
+
+// suggestQuery 在 suggest 字段上按前缀查找输入提示，categoryId 不为 nil 时只提示这个分类的商品。
+// 不需要命中结果，_source 只取判断提示类型用到的字段
+func suggestQuery(prefix string, categoryId *int64, size int) *query.Search {
+	completion := query.Completion("suggest", prefix).Size(size).SkipDuplicates(true)
+	if categoryId != nil {
+		completion.Context(model.SuggestContextCategory, strconv.FormatInt(*categoryId, 10))
+	}
+	return query.NewSearch().
+		Size(0).
+		SourceFields("id", "name", "brandName", "productCategoryName").
+		Suggest("products", completion)
+}
+
+// spellingQuery 用商品名称和关键词作为词典纠正搜索词，只返回至少能搜到一个商品的纠正结果
+func spellingQuery(keyword string, maxErrors float64) *query.Search {
+	return query.NewSearch().
+		Size(0).
+		Suggest("spelling", query.Phrase("name", keyword).
+			Analyzer("ik_smart").
+			Size(1).
+			MaxErrors(maxErrors).
+			DirectGenerator(
+				query.Generator("name").MinWordLength(2),
+				query.Generator("keywords").MinWordLength(2),
+			).
+			Collate(query.MultiMatch("{{suggestion}}", "name", "subTitle", "keywords")))
+}
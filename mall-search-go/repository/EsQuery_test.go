@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"mall-search-go/config"
+	"mall-search-go/model"
+	"mall-search-go/repository/query"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/queries with the current queries")
+
+// checkGolden 比对查询和 testdata/queries/<name>.json，修改查询后用 go test ./repository -update 重新生成并审阅差异
+func checkGolden(t *testing.T, name string, search *query.Search) {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(search.Source()); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.Bytes()
+	path := filepath.Join("testdata", "queries", name+".json")
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from %s:\n%s", name, path, got)
+	}
+}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func TestQueryShapes(t *testing.T) {
+	product := model.EsProduct{ID: 26, Name: "华为 HUAWEI P20", SubTitle: "AI智慧全面屏", Keywords: "手机", BrandId: 3, ProductCategoryId: 19}
+	facets := config.FacetsConfig{Size: 10, PriceRanges: []float64{1000, 3000}}
+	for name, search := range map[string]*query.Search{
+		"search":                  searchQuery("手机", 1, 5),
+		"search_highlight":        searchQuery("手机", 1, 5).Highlight(productHighlight("手机", config.Default().Search.Highlight)),
+		"criteria_keyword":        criteriaQuery(model.SearchCriteria{Keyword: "手机", PageNum: 1, PageSize: 5}, facets),
+		"criteria_no_keyword":     criteriaQuery(model.SearchCriteria{PageNum: 2, PageSize: 10, Sort: 3}, facets),
+		"criteria_brand_category": criteriaQuery(model.SearchCriteria{Keyword: "手机", BrandId: int64Ptr(3), ProductCategoryId: int64Ptr(19), PageNum: 1, PageSize: 5, Sort: 2}, facets),
+		"criteria_all_filters": criteriaQuery(model.SearchCriteria{
+			Keyword: "手机", BrandId: int64Ptr(3), ProductCategoryId: int64Ptr(19),
+			MinPrice: "1999.00", MaxPrice: "4999", NewStatus: int64Ptr(1), RecommandStatus: int64Ptr(1), PromotionType: int64Ptr(0), InStock: true,
+			PageNum: 1, PageSize: 5,
+		}, facets),
+		"criteria_attrs": criteriaQuery(model.SearchCriteria{
+			Keyword: "手机",
+			Attrs:   []model.AttrFilter{{AttrId: 43, Values: []string{"5.8"}}, {AttrId: 44, Values: []string{"黑色", "金色"}}},
+			PageNum: 1, PageSize: 5,
+		}, facets),
+		"criteria_facets": criteriaQuery(model.SearchCriteria{
+			Keyword: "手机", BrandId: int64Ptr(3), MaxPrice: "4999", InStock: true,
+			Attrs:  []model.AttrFilter{{AttrId: 44, Values: []string{"黑色"}}},
+			Facets: true, PageNum: 1, PageSize: 5,
+		}, facets),
+		"criteria_min_price_only": criteriaQuery(model.SearchCriteria{MinPrice: "100", PageNum: 1, PageSize: 5}, facets),
+		"recommend":               recommendQuery(26, product, 1, 5),
+		"search_page_zero":        searchQuery("手机", 0, 5),
+		"search_pinyin":           searchQuery("shouji", 1, 5),
+		"criteria_cursor": pageCursor{PIT: "pit-1", After: []json.RawMessage{json.RawMessage("2699.0"), json.RawMessage("4294967298")}, Page: 3, Size: 5}.
+			apply(criteriaQuery(model.SearchCriteria{Keyword: "手机", Sort: 3}, facets), "pit-1", "60s"),
+		"related":            relatedQuery("手机", []int64{43, 44}),
+		"related_no_keyword": relatedQuery("", []int64{43}),
+		"related_no_attrs":   relatedQuery("手机", nil),
+		"suggest":            suggestQuery("华为", nil, 10),
+		"suggest_category":   suggestQuery("hua", int64Ptr(19), 5),
+		"spelling":           spellingQuery("华伟手机", 2),
+	} {
+		checkGolden(t, name, search)
+	}
+}
@@ -8,91 +8,103 @@ import (
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
-	"github.com/elastic/go-elasticsearch/v8/esutil"
-	"github.com/mitchellh/mapstructure"
-	"log"
+	"mall-search-go/config"
 	"mall-search-go/model"
+	"mall-search-go/repository/query"
+	"net/http"
 	"strconv"
+	"sync"
 )
 
 type EsProductRepository interface {
 	SaveAll([]model.EsProduct) (int, error)
+	// NewBulkWriter 创建流式写入指定索引的 BulkWriter，全量导入时用于写入新一代索引
+	NewBulkWriter(index string) (BulkWriter, error)
 	Save(*model.EsProduct) (*model.EsProduct, error)
 	Delete(int64) error
 	DeletaBatch([]int64) error
-	Search(keyword string, pageNum, pageSize int) (model.Page, error)
-	SearchById(keyword string, brandId *int64, productCategoryId *int64, pageNum int, pageSize int, sort int) (model.Page, error)
-	Recommend(id int64, product model.EsProduct, pageNum int, pageSize int) (model.Page, error)
-	SearchRelated(keyword string) (model.EsProductRelatedInfo, error)
+	// Search 在名称、副标题和关键词中搜索，highlight 为 true 时返回匹配词的高亮片段。
+	// cursor 不为空时忽略 pageNum 和 pageSize，返回游标对应的那一页
+	Search(keyword string, pageNum, pageSize int, cursor string, highlight bool) (model.Page, error)
+	// SearchByCriteria 按关键词打分，按 criteria 中的条件过滤
+	SearchByCriteria(criteria model.SearchCriteria) (model.Page, error)
+	Recommend(id int64, product model.EsProduct, pageNum int, pageSize int, cursor string) (model.Page, error)
+	// Export 分批取出 criteria 匹配的所有商品交给 fn，忽略分页、分面和高亮
+	Export(ctx context.Context, criteria model.SearchCriteria, fn func([]model.EsProduct) error) error
+	// SearchRelated 聚合搜索结果中的品牌、分类和属性，只统计 attrIds 中的属性，attrIds 为空时不返回属性
+	SearchRelated(keyword string, attrIds []int64) (model.EsProductRelatedInfo, error)
+	// Correct 按商品名称和关键词纠正搜索词的拼写，没有更好的写法时返回 ""
+	Correct(keyword string) (string, error)
+	// Suggest 返回以 prefix 开头的商品名称、品牌、分类和关键词，categoryId 不为 nil 时只提示这个分类的商品
+	Suggest(ctx context.Context, prefix string, categoryId *int64, size int) ([]model.Suggestion, error)
+	// EnsureIndex 创建或更新索引模板，索引不存在时按模板创建
+	EnsureIndex(ctx context.Context) error
+	// MappingDrift 返回实际 mapping 与索引模板不一致的字段
+	MappingDrift(ctx context.Context) ([]model.MappingDrift, error)
+	// CreateGeneration 创建新一代索引 pms_v<毫秒时间戳>，名称已被占用时返回 model.ErrGenerationExists
+	CreateGeneration(ctx context.Context) (string, error)
+	// CountDocuments 刷新并统计指定索引中的文档数
+	CountDocuments(ctx context.Context, index string) (int, error)
+	// SwapAlias 原子地把别名 pms 切换到指定索引
+	SwapAlias(ctx context.Context, index string) error
+	// Generations 按从新到旧列出所有代的索引
+	Generations(ctx context.Context) ([]model.IndexGeneration, error)
+	// ApplySynonyms 创建使用新的同义词规则和停用词的一代索引，复制当前索引的文档后切换别名，线上索引不会关闭，
+	// 被替换的一代与导入替换的一样保留下来
+	ApplySynonyms(ctx context.Context, synonyms, stopWords []string) error
+	// CopySynonyms 把别名当前指向的索引的同义词和停用词写入 index，已经一致时什么都不做。
+	// index 不能是线上索引：修改时要关闭它
+	CopySynonyms(ctx context.Context, index string) error
+	// DeleteIndex 删除一代不再使用的索引
+	DeleteIndex(ctx context.Context, index string) error
+	// Close 等待进行中的索引写入完成，停机时调用
+	Close(ctx context.Context) error
 }
 
 type esProductRepositoryImpl struct {
 	client *elasticsearch.Client
 	index  string
-}
-
-func init() {
-	cfg := elasticsearch.Config{
-		Addresses: []string{
-			"http://localhost:9200",
-		},
-	}
 
-	es, err := elasticsearch.NewClient(cfg)
-	if err != nil {
-		log.Fatalf("Error creating the client: %s", err)
-	}
-
-	Repo = NewEsProductRepository(es, "pms")
+	mu        sync.RWMutex
+	bulk      config.BulkConfig
+	facets    config.FacetsConfig
+	highlight config.HighlightConfig
+	spelling  config.SpellingConfig
+	paging    config.PagingConfig
+	//进行中的写请求，Close时等待它们完成
+	writes sync.WaitGroup
 }
 
-var Repo EsProductRepository
+func NewEsProductRepository(client *elasticsearch.Client, cfg config.SearchConfig) EsProductRepository {
+	return &esProductRepositoryImpl{client: client, index: cfg.Index, bulk: cfg.Bulk, facets: cfg.Facets, highlight: cfg.Highlight, spelling: cfg.Spelling, paging: cfg.Paging}
+}
 
-func NewEsProductRepository(client *elasticsearch.Client, index string) EsProductRepository {
-	return &esProductRepositoryImpl{client: client, index: index}
+// UpdateConfig 替换 BulkIndexer、分面统计、高亮、拼写纠正和分页的参数，之后创建的 BulkWriter 和之后的搜索使用新值，索引名不能在运行中修改
+func (repo *esProductRepositoryImpl) UpdateConfig(cfg config.SearchConfig) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.bulk = cfg.Bulk
+	repo.facets = cfg.Facets
+	repo.highlight = cfg.Highlight
+	repo.spelling = cfg.Spelling
+	repo.paging = cfg.Paging
 }
 
 func (repo *esProductRepositoryImpl) SaveAll(products []model.EsProduct) (int, error) {
-
-	var buf bytes.Buffer
-	for _, product := range products {
-		meta := []byte(`{"index" : {"_id" : "` + strconv.FormatInt(product.ID, 10) + `" }} ` + "\n")
-		data, err := json.Marshal(product)
-		if err != nil {
-			return 0, err
-		}
-		data = append(data, "\n"...)
-		buf.Grow(len(meta) + len(data))
-		buf.Write(meta)
-		buf.Write(data)
-	}
-	req := esapi.BulkRequest{
-		Index:   repo.index,
-		Body:    &buf,
-		Refresh: "true",
-	}
-
-	res, err := req.Do(context.Background(), repo.client)
-	if err != nil {
-		return 0, err
-	}
-	defer res.Body.Close()
-
-	if res.IsError() {
-		var e map[string]interface{}
-		if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
-			return 0, err
-		}
-		return 0, fmt.Errorf("[%s] %s: %s", res.Status(), e["error"].(map[string]interface{})["type"], e["error"].(map[string]interface{})["reason"])
-	}
-	return len(products), nil
+	return repo.saveAll(repo.index, products)
 }
 
 func (repo *esProductRepositoryImpl) Save(product *model.EsProduct) (*model.EsProduct, error) {
+	repo.writes.Add(1)
+	defer repo.writes.Done()
+	source, err := model.EncodeProduct(*product)
+	if err != nil {
+		return nil, err
+	}
 	req := esapi.IndexRequest{
 		Index:      repo.index,
 		DocumentID: strconv.FormatInt(product.ID, 10),
-		Body:       esutil.NewJSONReader(product),
+		Body:       bytes.NewReader(source),
 		Refresh:    "true",
 	}
 
@@ -100,15 +112,18 @@ func (repo *esProductRepositoryImpl) Save(product *model.EsProduct) (*model.EsPr
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
 	if res.IsError() {
-		return nil, fmt.Errorf("Error indexing document ID=%d: %s", product.ID, res.Status())
+		return nil, fmt.Errorf("Error indexing document ID=%d: %w", product.ID, responseError(res))
 	}
 
 	return product, nil
 }
 
 func (repo *esProductRepositoryImpl) Delete(id int64) error {
+	repo.writes.Add(1)
+	defer repo.writes.Done()
 	req := esapi.DeleteRequest{
 		Index:      repo.index,
 		DocumentID: strconv.FormatInt(id, 10),
@@ -119,13 +134,16 @@ func (repo *esProductRepositoryImpl) Delete(id int64) error {
 	}
 	defer res.Body.Close()
 
-	if res.IsError() {
-		return fmt.Errorf("Error: %s", res.String())
+	//删除不存在的文档与 Java 版一样不算错误
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Error deleting document ID=%d: %w", id, responseError(res))
 	}
 	return nil
 }
 
 func (repo *esProductRepositoryImpl) DeletaBatch(ids []int64) error {
+	repo.writes.Add(1)
+	defer repo.writes.Done()
 	var buf bytes.Buffer
 	for _, id := range ids {
 		meta := []byte(`{"delete" : {"_id" : "` + strconv.FormatInt(id, 10) + `" }} ` + "\n")
@@ -143,422 +161,161 @@ func (repo *esProductRepositoryImpl) DeletaBatch(ids []int64) error {
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
-	if res.IsError() {
-		return fmt.Errorf("Error deleting documents: %s", res.Status())
+	var bulk bulkResponse
+	if err := decodeResponse(res, &bulk); err != nil {
+		return fmt.Errorf("Error deleting documents: %w", err)
+	}
+	if failed := bulk.failures(); len(failed) > 0 {
+		return fmt.Errorf("Error deleting %d of %d documents, first failure: document %s: %s: %s",
+			len(failed), len(ids), failed[0].ID, failed[0].Error.Type, failed[0].Error.Reason)
 	}
 	return nil
 }
 
-func (repo *esProductRepositoryImpl) Search(keyword string, pageNum, pageSize int) (model.Page, error) {
-	var result model.Page
-
-	query := map[string]interface{}{
-		"query": map[string]interface{}{
-			"bool": map[string]interface{}{
-				"should": []map[string]interface{}{
-					{"match": map[string]interface{}{"name": keyword}},
-					{"match": map[string]interface{}{"subTitle": keyword}},
-					{"match": map[string]interface{}{"keywords": keyword}},
-				},
-			},
-		},
-		"from": (pageNum - 1) * pageSize,
-		"size": pageSize,
-	}
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(query); err != nil {
-		return result, err
-	}
-
-	res, err := repo.client.Search(
-		repo.client.Search.WithContext(context.Background()),
-		repo.client.Search.WithIndex(repo.index),
-		repo.client.Search.WithBody(&buf),
-		repo.client.Search.WithTrackTotalHits(true),
-	)
-	if err != nil {
-		return result, err
-	}
-
-	var searchResult map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
-		return result, err
-	}
-
-	var products []model.EsProduct
-	for _, hit := range searchResult["hits"].(map[string]interface{})["hits"].([]interface{}) {
-		var product model.EsProduct
-		err := mapstructure.Decode(hit.(map[string]interface{})["_source"], &product)
-		if err != nil {
-			return result, err
-		}
-		products = append(products, product)
-	}
-
-	totalHits := int(searchResult["hits"].(map[string]interface{})["total"].(map[string]interface{})["value"].(float64))
-	totalPages := (totalHits + pageSize - 1) / pageSize
-
-	result.Content = products
-	result.PageInfo = model.PageInfo{
-		TotalElements: totalHits,
-		TotalPages:    totalPages,
-		Number:        pageNum,
-		Size:          pageSize,
+func (repo *esProductRepositoryImpl) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		repo.writes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Error waiting for pending writes: %s", ctx.Err())
 	}
-	return result, nil
 }
 
-func (repo *esProductRepositoryImpl) SearchById(keyword string, brandId *int64, productCategoryId *int64, pageNum int, pageSize int, sort int) (model.Page, error) {
-	var result model.Page
-	query := make(map[string]interface{})
-
-	//如果没有提供关键字（keyword为空），则使用match_all查询
-	if keyword != "" {
-		query["query"] = map[string]interface{}{
-			"match_all": map[string]interface{}{},
-		}
-	} else {
-		//使用multi_match查询搜索多个字段。这些字段的权重如下：
-		//name: 权重为10
-		//subTitle: 权重为5
-		//keywords: 权重为2
-		//所以，如果关键字在name字段中出现，它的重要性是在subTitle字段中出现的2倍，是在keywords字段中出现的5倍。
-		query["query"] = map[string]interface{}{
-			"function_score": map[string]interface{}{
-				"query": map[string]interface{}{
-					"multi_match": map[string]interface{}{
-						"query":  keyword,
-						"fields": []string{"name^10", "subTitle^5", "keywords"},
-					},
-				},
-				"score_mode": "sum",
-				"min_score":  2,
-			},
-		}
-	}
-
-	//如果提供了brandId或productCategoryId，则将它们添加为term查询来过滤结果
-	boolFilter := map[string]interface{}{
-		"filter": []map[string]interface{}{},
-	}
-
-	if brandId != nil {
-		boolFilter["filter"] = append(boolFilter["filter"].([]map[string]interface{}), map[string]interface{}{
-			"term": map[string]interface{}{
-				"brandId": brandId,
-			},
-		})
-	}
-
-	if productCategoryId != nil {
-		boolFilter["filter"] = append(boolFilter["filter"].([]map[string]interface{}), map[string]interface{}{
-			"term": map[string]interface{}{
-				"productCategoryId": productCategoryId,
-			},
-		})
-	}
-
-	query["query"] = map[string]interface{}{"bool": boolFilter}
-
-	//Sorting
-	//1: 根据id降序
-	//2: 根据sale降序
-	//3: 根据price升序
-	//4: 根据price降序
-	var sortField string
-	var sortOrder string
-	switch sort {
-	case 1:
-		sortField = "id"
-		sortOrder = "desc"
-	case 2:
-		sortField = "sale"
-		sortOrder = "desc"
-	case 3:
-		sortField = "price"
-		sortOrder = "asc"
-	case 4:
-		sortField = "price"
-		sortOrder = "desc"
-	default:
-		sortField = "_score"
-		sortOrder = "desc"
-	}
-
-	query["sort"] = []map[string]interface{}{
-		{
-			sortField: map[string]interface{}{
-				"order": sortOrder,
-			},
-		},
-	}
-
-	//Pagination
-	query["from"] = (pageNum - 1) * pageSize
-	query["size"] = pageSize
-
-	//Convert query to JSON and make the request
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(query); err != nil {
-		return result, fmt.Errorf("Error encoding query: %s", err)
+func (repo *esProductRepositoryImpl) Search(keyword string, pageNum, pageSize int, cursor string, highlight bool) (model.Page, error) {
+	search := searchQuery(keyword, pageNum, pageSize)
+	if highlight {
+		repo.mu.RLock()
+		search.Highlight(productHighlight(keyword, repo.highlight))
+		repo.mu.RUnlock()
 	}
+	_, page, err := repo.searchPage(context.Background(), search, queryDigest(search), pageNum, pageSize, cursor)
+	return page, err
+}
 
-	res, err := repo.client.Search(
-		repo.client.Search.WithContext(context.Background()),
-		repo.client.Search.WithIndex(repo.index),
-		repo.client.Search.WithBody(&buf),
-	)
+func (repo *esProductRepositoryImpl) SearchByCriteria(criteria model.SearchCriteria) (model.Page, error) {
+	repo.mu.RLock()
+	search := criteriaQuery(criteria, repo.facets)
+	if criteria.Highlight {
+		search.Highlight(productHighlight(criteria.Keyword, repo.highlight))
+	}
+	//请求分面时筛选条件移到 post_filter 中，结果不变，游标的摘要按不请求分面的查询计算，翻页时可以不再请求分面
+	plain := criteria
+	plain.Facets = false
+	digest := queryDigest(criteriaQuery(plain, repo.facets))
+	repo.mu.RUnlock()
+	res, page, err := repo.searchPage(context.Background(), search, digest, criteria.PageNum, criteria.PageSize, criteria.Cursor)
 	if err != nil {
-		return result, fmt.Errorf("Error getting response: %s", err)
+		return model.Page{}, err
 	}
-	defer res.Body.Close()
-
-	var searchResult map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
-		return result, fmt.Errorf("Error parsing the response body: %s", err)
-	}
-
-	var products []model.EsProduct
-	for _, hits := range searchResult["hits"].(map[string]interface{})["hits"].([]interface{}) {
-		var product model.EsProduct
-		err := mapstructure.Decode(hits.(map[string]interface{})["_source"], &product)
-		if err != nil {
-			return result, err
+	if criteria.Facets {
+		if page.Facets, err = convertFacets(res.Aggregations, criteria); err != nil {
+			return model.Page{}, err
 		}
-		products = append(products, product)
 	}
-
-	totalHits := int(searchResult["hits"].(map[string]interface{})["total"].(map[string]interface{})["value"].(float64))
-	totalPages := (totalHits + pageSize - 1) / pageSize
-
-	result.Content = products
-	result.PageInfo = model.PageInfo{
-		TotalElements: totalHits,
-		TotalPages:    totalPages,
-		Number:        pageNum,
-		Size:          pageSize,
-	}
-	return result, nil
-
+	return page, nil
 }
 
-func (repo *esProductRepositoryImpl) Recommend(id int64, product model.EsProduct, pageNum int, pageSize int) (model.Page, error) {
-	var result model.Page
-
-	query := map[string]interface{}{
-		//must_not 确保原始商品不会被包含在结果中。
-		"query": map[string]interface{}{
-			"bool": map[string]interface{}{
-				"must_not": map[string]interface{}{
-					"term": map[string]interface{}{
-						"id": id,
-					},
-				},
-				//构建了一个加权的查询
-				"should": []map[string]interface{}{
-					{"match": map[string]interface{}{"name": map[string]interface{}{"query": product.Name, "boost": 8}}},
-					{"match": map[string]interface{}{"subTitle": map[string]interface{}{"query": product.SubTitle, "boost": 2}}},
-					{"match": map[string]interface{}{"keywords": map[string]interface{}{"query": product.Keywords, "boost": 2}}},
-					{"match": map[string]interface{}{"brandId": map[string]interface{}{"query": product.BrandId, "boost": 5}}},
-					{"match": map[string]interface{}{"productCategoryId": map[string]interface{}{"query": product.ProductCategoryId, "boost": 3}}},
-				},
-			},
-		},
-		"from": (pageNum - 1) * pageSize,
-		"size": pageSize,
-	}
-
-	// Convert query to JSON and make the request
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(query); err != nil {
-		return result, err
-	}
+func (repo *esProductRepositoryImpl) Recommend(id int64, product model.EsProduct, pageNum int, pageSize int, cursor string) (model.Page, error) {
+	search := recommendQuery(id, product, pageNum, pageSize)
+	_, page, err := repo.searchPage(context.Background(), search, queryDigest(search), pageNum, pageSize, cursor)
+	return page, err
+}
 
-	res, err := repo.client.Search(
-		repo.client.Search.WithContext(context.Background()),
-		repo.client.Search.WithIndex(repo.index),
-		repo.client.Search.WithBody(&buf),
-	)
+func (repo *esProductRepositoryImpl) SearchRelated(keyword string, attrIds []int64) (model.EsProductRelatedInfo, error) {
+	res, err := repo.search(context.Background(), relatedQuery(keyword, attrIds))
 	if err != nil {
-		return result, err
+		return model.EsProductRelatedInfo{}, err
 	}
-	defer res.Body.Close()
+	return convertProductRelatedInfo(res.Aggregations)
+}
 
-	// Parse the response
-	var searchResult map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
-		return result, err
+func (repo *esProductRepositoryImpl) Correct(keyword string) (string, error) {
+	repo.mu.RLock()
+	search := spellingQuery(keyword, repo.spelling.MaxErrors)
+	repo.mu.RUnlock()
+	res, err := repo.search(context.Background(), search)
+	if err != nil {
+		return "", err
 	}
-
-	// Map the results
-	var products []model.EsProduct
-	for _, hit := range searchResult["hits"].(map[string]interface{})["hits"].([]interface{}) {
-		var product model.EsProduct
-		mapstructure.Decode(hit.(map[string]interface{})["_source"], &product)
-		products = append(products, product)
+	if correction := res.correction("spelling"); correction != keyword {
+		return correction, nil
 	}
+	return "", nil
+}
 
-	totalHits := int(searchResult["hits"].(map[string]interface{})["total"].(map[string]interface{})["value"].(float64))
-	totalPages := (totalHits + pageSize - 1) / pageSize
-
-	result.Content = products
-	result.PageInfo = model.PageInfo{
-		TotalElements: totalHits,
-		TotalPages:    totalPages,
-		Number:        pageNum,
-		Size:          pageSize,
+func (repo *esProductRepositoryImpl) Suggest(ctx context.Context, prefix string, categoryId *int64, size int) ([]model.Suggestion, error) {
+	res, err := repo.search(ctx, suggestQuery(prefix, categoryId, size))
+	if err != nil {
+		return nil, err
 	}
-	return result, nil
+	return res.suggestions("products"), nil
+}
 
+// relatedAggregations 是 SearchRelated 中聚合的结果
+type relatedAggregations struct {
+	BrandNames           termsAggregation `json:"brandNames"`
+	ProductCategoryNames termsAggregation `json:"productCategoryNames"`
+	AllAttrValues        struct {
+		ProductAttrs struct {
+			AttrIds struct {
+				Buckets []struct {
+					Key        int64            `json:"key"`
+					AttrValues termsAggregation `json:"attrValues"`
+					AttrNames  termsAggregation `json:"attrNames"`
+				} `json:"buckets"`
+			} `json:"attrIds"`
+		} `json:"productAttrs"`
+	} `json:"allAttrValues"`
 }
 
-func (repo *esProductRepositoryImpl) SearchRelated(keyword string) (model.EsProductRelatedInfo, error) {
+func convertProductRelatedInfo(aggregations json.RawMessage) (model.EsProductRelatedInfo, error) {
 	var info model.EsProductRelatedInfo
+	if len(aggregations) == 0 {
+		return info, errors.New("Error parsing aggregations: response has no aggregations")
+	}
+	var aggs relatedAggregations
+	if err := json.Unmarshal(aggregations, &aggs); err != nil {
+		return info, fmt.Errorf("Error parsing aggregations: %w", err)
+	}
 
-	query := make(map[string]interface{})
-	if keyword == "" {
-		query["query"] = map[string]interface{}{
-			"match_all": map[string]interface{}{},
-		}
-	} else {
-		query["query"] = map[string]interface{}{
-			"multi_match": map[string]interface{}{
-				"query":  keyword,
-				"fields": []string{"name", "subTitle", "keywords"},
-			},
+	info.BrandNames = aggs.BrandNames.keys()
+	info.ProductCategoryNames = aggs.ProductCategoryNames.keys()
+	for _, bucket := range aggs.AllAttrValues.ProductAttrs.AttrIds.Buckets {
+		attr := model.ProductAttr{AttrId: bucket.Key, AttrValues: bucket.AttrValues.keys()}
+		if names := bucket.AttrNames.keys(); len(names) > 0 {
+			attr.AttrName = names[0]
 		}
+		info.ProductAttrs = append(info.ProductAttrs, attr)
 	}
+	return info, nil
+}
 
-	//aggregations
-	query["aggs"] = map[string]interface{}{
-		"brandNames": map[string]interface{}{
-			"terms": map[string]interface{}{
-				"field": "brandName",
-			},
-		},
-		"productCategoryNames": map[string]interface{}{
-			"terms": map[string]interface{}{
-				"field": "productCategoryName",
-			},
-		},
-		"allAttrValues": map[string]interface{}{
-			"nested": map[string]interface{}{
-				"path": "attrValueList",
-			},
-			"aggs": map[string]interface{}{
-				"productAttrs": map[string]interface{}{
-					"terms": map[string]interface{}{
-						"attrValueList.type": 1,
-					},
-				},
-				"aggs": map[string]interface{}{
-					"attrIds": map[string]interface{}{
-						"terms": map[string]interface{}{
-							"field": "attrValueList.productAttributeId",
-						},
-						"aggs": map[string]interface{}{
-							"attrValues": map[string]interface{}{
-								"terms": map[string]interface{}{
-									"field": "attrValueList.value",
-								},
-							},
-							"attrNames": map[string]interface{}{
-								"terms": map[string]interface{}{
-									"field": "attrValueList.name",
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-	// Convert query to JSON and make the request
+// search 把查询编码后发给 ES，并把响应流式解码为 searchResponse
+func (repo *esProductRepositoryImpl) search(ctx context.Context, body *query.Search, opts ...func(*esapi.SearchRequest)) (searchResponse, error) {
+	var out searchResponse
 	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(query); err != nil {
-		return info, err
-	}
-
-	req := esapi.SearchRequest{
-		Index: []string{repo.index},
-		Body:  &buf,
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return out, fmt.Errorf("Error encoding query: %w", err)
 	}
-
-	res, err := req.Do(context.Background(), repo.client)
+	opts = append([]func(*esapi.SearchRequest){
+		repo.client.Search.WithContext(ctx),
+		repo.client.Search.WithIndex(repo.index),
+		repo.client.Search.WithBody(&buf),
+	}, opts...)
+	res, err := repo.client.Search(opts...)
 	if err != nil {
-		return info, err
+		return out, fmt.Errorf("Error getting response: %w", err)
 	}
 	defer res.Body.Close()
-
-	// Parse the response
-	var searchResult map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
-		return info, err
-	}
-
-	return convertProductRelatedInfo(searchResult)
-
-}
-
-func convertProductRelatedInfo(response map[string]interface{}) (model.EsProductRelatedInfo, error) {
-	var info model.EsProductRelatedInfo
-
-	// Extract aggregations
-	aggs, ok := response["aggregations"].(map[string]interface{})
-	if !ok {
-		return info, errors.New("Error parsing aggregations")
-	}
-
-	// Extract brand names
-	if brandNamesAgg, exists := aggs["brandNames"].(map[string]interface{}); exists {
-		for _, bucket := range brandNamesAgg["buckets"].([]interface{}) {
-			brand := bucket.(map[string]interface{})
-			brandName := brand["key"].(string)
-			info.BrandNames = append(info.BrandNames, brandName)
-		}
-	}
-
-	// Extract product category names
-	if productCategoryNamesAgg, exists := aggs["productCategoryNames"].(map[string]interface{}); exists {
-		for _, bucket := range productCategoryNamesAgg["buckets"].([]interface{}) {
-			category := bucket.(map[string]interface{})
-			categoryName := category["key"].(string)
-			info.ProductCategoryNames = append(info.ProductCategoryNames, categoryName)
-		}
-	}
-
-	// Extract product attributes
-	if allAttrValuesAgg, exists := aggs["allAttrValues"].(map[string]interface{}); exists {
-		productAttrsAgg := allAttrValuesAgg["productAttrs"].(map[string]interface{})
-		attrIdsAgg := productAttrsAgg["attrIds"].(map[string]interface{})
-		for _, bucket := range attrIdsAgg["buckets"].([]interface{}) {
-			attr := model.ProductAttr{}
-			attrBucket := bucket.(map[string]interface{})
-			attr.AttrId = int64(attrBucket["key"].(float64))
-
-			// Extract attribute values and names
-			attrValuesAgg := attrBucket["attrValues"].(map[string]interface{})
-			for _, valueBucket := range attrValuesAgg["buckets"].([]interface{}) {
-				value := valueBucket.(map[string]interface{})["key"].(string)
-				attr.AttrValues = append(attr.AttrValues, value)
-			}
-
-			attrNamesAgg := attrBucket["attrNames"].(map[string]interface{})
-			if len(attrNamesAgg["buckets"].([]interface{})) > 0 {
-				attr.AttrName = attrNamesAgg["buckets"].([]interface{})[0].(map[string]interface{})["key"].(string)
-			}
-
-			info.ProductAttrs = append(info.ProductAttrs, attr)
-		}
+	if err := decodeResponse(res, &out); err != nil {
+		return out, err
 	}
-
-	return info, nil
+	return out, nil
 }
-
-//func (repo *esProductRepositoryImpl) Recommend(id int64, pageNum, pageSize int) (model.Page, error) {
-//	var result model.Page
-//
-//
-//
-//}
@@ -0,0 +1,249 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"mall-search-go/model"
+)
+
+// ElasticsearchError 是 ES 返回的错误响应，例如索引不存在、查询语法错误或集群拒绝执行
+type ElasticsearchError struct {
+	Status int
+	Type   string
+	Reason string
+}
+
+func (e *ElasticsearchError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("elasticsearch: %d %s", e.Status, e.Reason)
+	}
+	return fmt.Sprintf("elasticsearch: %d %s: %s", e.Status, e.Type, e.Reason)
+}
+
+// errorCause 是错误响应中的 error 字段，root_cause 中通常有更具体的原因
+type errorCause struct {
+	Type      string       `json:"type"`
+	Reason    string       `json:"reason"`
+	RootCause []errorCause `json:"root_cause"`
+}
+
+// responseError 把非 2xx 响应转换为 *ElasticsearchError，响应体不是 ES 的错误格式时原样作为原因
+func responseError(res *esapi.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	var parsed struct {
+		Error json.RawMessage `json:"error"`
+	}
+	e := &ElasticsearchError{Status: res.StatusCode}
+	if json.Unmarshal(body, &parsed) == nil && len(parsed.Error) > 0 {
+		var cause errorCause
+		if json.Unmarshal(parsed.Error, &cause) == nil && cause.Type != "" {
+			if len(cause.RootCause) > 0 && cause.RootCause[0].Reason != cause.Reason {
+				cause.Reason += " (" + cause.RootCause[0].Type + ": " + cause.RootCause[0].Reason + ")"
+			}
+			e.Type, e.Reason = cause.Type, cause.Reason
+			return e
+		}
+		//部分接口的 error 是字符串
+		var reason string
+		if json.Unmarshal(parsed.Error, &reason) == nil {
+			e.Reason = reason
+			return e
+		}
+	}
+	e.Reason = strings.TrimSpace(string(body))
+	return e
+}
+
+// decodeResponse 检查状态码并把响应体流式解码到 v 中，调用方负责关闭 res.Body
+func decodeResponse(res *esapi.Response, v interface{}) error {
+	if res.IsError() {
+		return responseError(res)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode elasticsearch response: %w", err)
+	}
+	return nil
+}
+
+// searchResponse 是 _search 的响应，_source 直接解码为 model.EsProduct，不经过中间的 map
+type searchResponse struct {
+	Took     int  `json:"took"`
+	TimedOut bool `json:"timed_out"`
+	Shards   struct {
+		Total      int `json:"total"`
+		Successful int `json:"successful"`
+		Failed     int `json:"failed"`
+	} `json:"_shards"`
+	Hits struct {
+		Total    totalHits   `json:"total"`
+		MaxScore *float64    `json:"max_score"`
+		Hits     []searchHit `json:"hits"`
+	} `json:"hits"`
+	Aggregations json.RawMessage `json:"aggregations"`
+	// Suggest 的 key 是请求中 suggester 的名字，每个 entry 对应输入的一段文本
+	Suggest map[string][]suggestEntry `json:"suggest"`
+	// PitID 是在 PIT 上搜索时 ES 返回的最新 PIT id
+	PitID string `json:"pit_id"`
+}
+
+type suggestEntry struct {
+	Text    string `json:"text"`
+	Options []struct {
+		Text   string          `json:"text"`
+		ID     string          `json:"_id"`
+		Score  float64         `json:"_score"`
+		Source model.EsProduct `json:"_source"`
+	} `json:"options"`
+}
+
+type searchHit struct {
+	Index     string              `json:"_index"`
+	ID        string              `json:"_id"`
+	Score     *float64            `json:"_score"`
+	Source    model.EsProduct     `json:"_source"`
+	Sort      []json.RawMessage   `json:"sort"`
+	Highlight map[string][]string `json:"highlight"`
+}
+
+// totalHits 是 hits.total，ES 7 之前是一个数字，之后是 {"value":..,"relation":..}
+type totalHits struct {
+	Value    int    `json:"value"`
+	Relation string `json:"relation"`
+}
+
+func (t *totalHits) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] != '{' {
+		t.Relation = "eq"
+		return json.Unmarshal(data, &t.Value)
+	}
+	type plain totalHits
+	return json.Unmarshal(data, (*plain)(t))
+}
+
+func (r *searchResponse) products() []model.EsProduct {
+	products := make([]model.EsProduct, len(r.Hits.Hits))
+	for i, hit := range r.Hits.Hits {
+		products[i] = hit.Source
+	}
+	return products
+}
+
+// highlights 返回有高亮片段的命中，没有请求高亮时返回 nil
+func (r *searchResponse) highlights() map[int64]map[string][]string {
+	var highlights map[int64]map[string][]string
+	for _, hit := range r.Hits.Hits {
+		if len(hit.Highlight) == 0 {
+			continue
+		}
+		if highlights == nil {
+			highlights = make(map[int64]map[string][]string)
+		}
+		highlights[hit.Source.ID] = hit.Highlight
+	}
+	return highlights
+}
+
+// suggestions 返回 suggester name 的提示，ES 已经按权重排序并去掉了重复的文本
+func (r *searchResponse) suggestions(name string) []model.Suggestion {
+	suggestions := []model.Suggestion{}
+	for _, entry := range r.Suggest[name] {
+		for _, option := range entry.Options {
+			suggestions = append(suggestions, model.NewSuggestion(option.Text, option.Source))
+		}
+	}
+	return suggestions
+}
+
+// correction 返回 phrase suggester name 得分最高的纠正结果，没有时返回 ""
+func (r *searchResponse) correction(name string) string {
+	for _, entry := range r.Suggest[name] {
+		if len(entry.Options) > 0 {
+			return entry.Options[0].Text
+		}
+	}
+	return ""
+}
+
+// page 按 Java 版 CommonPage 的方式计算分页信息，小于 1 的页码按第一页返回
+func (r *searchResponse) page(pageNum, pageSize int) model.Page {
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	total := r.Hits.Total.Value
+	totalPages := 0
+	if pageSize > 0 {
+		totalPages = (total + pageSize - 1) / pageSize
+	}
+	return model.Page{
+		Content: r.products(),
+		PageInfo: model.PageInfo{
+			TotalElements: total,
+			TotalPages:    totalPages,
+			Number:        pageNum,
+			Size:          pageSize,
+		},
+		Highlights: r.highlights(),
+	}
+}
+
+// termsAggregation 是 terms 聚合的结果，Key 按字段类型可能是字符串或数字
+type termsAggregation struct {
+	Buckets []termsBucket `json:"buckets"`
+}
+
+type termsBucket struct {
+	Key      json.RawMessage `json:"key"`
+	DocCount int             `json:"doc_count"`
+}
+
+// KeyString 返回桶的 key，字符串去掉引号，数字保持原文
+func (b termsBucket) KeyString() string {
+	var s string
+	if json.Unmarshal(b.Key, &s) == nil {
+		return s
+	}
+	return string(b.Key)
+}
+
+func (a termsAggregation) keys() []string {
+	keys := make([]string, 0, len(a.Buckets))
+	for _, b := range a.Buckets {
+		keys = append(keys, b.KeyString())
+	}
+	return keys
+}
+
+// bulkResponse 是 _bulk 的响应，每个 item 的 key 是操作名（index/create/update/delete）
+type bulkResponse struct {
+	Took   int                           `json:"took"`
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	Index  string      `json:"_index"`
+	ID     string      `json:"_id"`
+	Status int         `json:"status"`
+	Result string      `json:"result"`
+	Error  *errorCause `json:"error"`
+}
+
+// failures 返回失败的 item，删除不存在的文档返回 404 但没有 error，不算失败
+func (r *bulkResponse) failures() []bulkResponseItem {
+	if !r.Errors {
+		return nil
+	}
+	var failed []bulkResponseItem
+	for _, item := range r.Items {
+		for _, result := range item {
+			if result.Error != nil {
+				failed = append(failed, result)
+			}
+		}
+	}
+	return failed
+}
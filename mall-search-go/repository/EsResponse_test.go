@@ -0,0 +1,200 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"mall-search-go/config"
+	"mall-search-go/model"
+)
+
+// newStubES 启动一个对每个请求都调用 handler 的假 ES
+func newStubES(t testing.TB, handler func(w http.ResponseWriter, r *http.Request, body string)) *esProductRepositoryImpl {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := ioutil.ReadAll(r.Body)
+		handler(w, r, string(body))
+	}))
+	t.Cleanup(server.Close)
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEsProductRepository(client, config.Default().Search).(*esProductRepositoryImpl)
+}
+
+const javaHits = `{"took":3,"timed_out":false,"_shards":{"total":1,"successful":1,"skipped":0,"failed":0},
+"hits":{"total":%s,"max_score":1.2,"hits":[
+{"_index":"pms","_id":"26","_score":1.2,"_source":{"_class":"com.macro.mall.search.domain.EsProduct","id":26,"brandId":3,"brandName":"华为","name":"华为 HUAWEI P20 ","price":3788.0,"recommandStatus":1,"attrValueList":[{"id":185,"productAttributeId":26,"value":"中国大陆","type":1,"name":"商品产地"}]}},
+{"_index":"pms","_id":"27","_score":0.8,"_source":{"id":27,"brandId":6,"brandName":"小米","name":"小米8","price":"2699.00"}}]}}`
+
+func TestSearchDecodesTypedHits(t *testing.T) {
+	for _, total := range []string{`{"value":12,"relation":"eq"}`, `12`} {
+		repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+			fmt.Fprintf(w, javaHits, total)
+		})
+		page, err := repo.Search("手机", 1, 5, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.PageInfo.TotalElements != 12 || page.PageInfo.TotalPages != 3 || len(page.Content) != 2 {
+			t.Fatalf("total %s: page info = %+v, %d products", total, page.PageInfo, len(page.Content))
+		}
+		p := page.Content[0]
+		if p.ID != 26 || p.Price != "3788.0" || p.RecommandStatus != 1 || len(p.AttrValueList) != 1 || p.AttrValueList[0].Value != "中国大陆" {
+			t.Fatalf("decoded %+v", p)
+		}
+		if page.Content[1].Price != "2699.00" {
+			t.Fatalf("string price decoded as %q", page.Content[1].Price)
+		}
+	}
+}
+
+// 以前这些响应会在类型断言时 panic
+func TestSearchReturnsElasticsearchErrors(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+		want   ElasticsearchError
+	}{
+		{404, `{"error":{"root_cause":[{"type":"index_not_found_exception","reason":"no such index [pms]"}],"type":"index_not_found_exception","reason":"no such index [pms]"},"status":404}`,
+			ElasticsearchError{Status: 404, Type: "index_not_found_exception", Reason: "no such index [pms]"}},
+		{400, `{"error":{"root_cause":[{"type":"parsing_exception","reason":"unknown query [mach]"}],"type":"search_phase_execution_exception","reason":"all shards failed"},"status":400}`,
+			ElasticsearchError{Status: 400, Type: "search_phase_execution_exception", Reason: "all shards failed (parsing_exception: unknown query [mach])"}},
+		{429, `{"error":"rejected execution of coordinating operation","status":429}`,
+			ElasticsearchError{Status: 429, Reason: "rejected execution of coordinating operation"}},
+		{502, `Bad Gateway`, ElasticsearchError{Status: 502, Reason: "Bad Gateway"}},
+	}
+	for _, tc := range cases {
+		repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+			w.WriteHeader(tc.status)
+			fmt.Fprint(w, tc.body)
+		})
+		for name, call := range map[string]func() error{
+			"Search": func() error { _, err := repo.Search("手机", 1, 5, "", false); return err },
+			"SearchByCriteria": func() error {
+				_, err := repo.SearchByCriteria(model.SearchCriteria{PageNum: 1, PageSize: 5})
+				return err
+			},
+			"SearchRelated": func() error { _, err := repo.SearchRelated("手机", []int64{26}); return err },
+		} {
+			err := call()
+			var esErr *ElasticsearchError
+			if !errors.As(err, &esErr) || *esErr != tc.want {
+				t.Errorf("%s with %d: err = %v, want %+v", name, tc.status, err, tc.want)
+			}
+		}
+	}
+
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		fmt.Fprint(w, `{"hits":{"total":{"value":1},"hits":[{"_source":{"id":"twenty-six"}}]}}`)
+	})
+	if _, err := repo.Recommend(26, model.EsProduct{ID: 26, Name: "华为"}, 1, 5, ""); err == nil || !strings.Contains(err.Error(), "decode elasticsearch response") {
+		t.Errorf("Recommend ignored a malformed document: %v", err)
+	}
+}
+
+func TestDeleteBatchReportsItemFailures(t *testing.T) {
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		fmt.Fprint(w, `{"took":2,"errors":true,"items":[
+{"delete":{"_index":"pms_v1","_id":"26","status":200,"result":"deleted"}},
+{"delete":{"_index":"pms_v1","_id":"27","status":404,"result":"not_found"}},
+{"delete":{"_index":"pms_v1","_id":"28","status":429,"error":{"type":"es_rejected_execution_exception","reason":"rejected execution"}}}]}`)
+	})
+	err := repo.DeletaBatch([]int64{26, 27, 28})
+	if err == nil || !strings.Contains(err.Error(), "1 of 3") || !strings.Contains(err.Error(), "document 28: es_rejected_execution_exception") {
+		t.Fatalf("err = %v", err)
+	}
+
+	repo = newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		fmt.Fprint(w, `{"took":2,"errors":false,"items":[{"delete":{"_id":"27","status":404,"result":"not_found"}}]}`)
+	})
+	if err := repo.DeletaBatch([]int64{27}); err != nil {
+		t.Fatalf("deleting a missing document: %v", err)
+	}
+}
+
+func TestSearchRelatedDecodesAggregations(t *testing.T) {
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		fmt.Fprint(w, `{"hits":{"total":{"value":2},"hits":[]},"aggregations":{
+"brandNames":{"buckets":[{"key":"华为","doc_count":1},{"key":"小米","doc_count":1}]},
+"productCategoryNames":{"buckets":[{"key":"手机通讯","doc_count":2}]},
+"allAttrValues":{"doc_count":6,"productAttrs":{"doc_count":4,"attrIds":{"buckets":[
+{"key":26,"doc_count":2,"attrValues":{"buckets":[{"key":"中国大陆","doc_count":2}]},"attrNames":{"buckets":[{"key":"商品产地","doc_count":2}]}}]}}}}}`)
+	})
+	info, err := repo.SearchRelated("手机", []int64{26})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(info.BrandNames, ",") != "华为,小米" || len(info.ProductCategoryNames) != 1 || len(info.ProductAttrs) != 1 {
+		t.Fatalf("info = %+v", info)
+	}
+	if attr := info.ProductAttrs[0]; attr.AttrId != 26 || attr.AttrName != "商品产地" || attr.AttrValues[0] != "中国大陆" {
+		t.Fatalf("attr = %+v", attr)
+	}
+}
+
+func BenchmarkSearchDecode(b *testing.B) {
+	response := fmt.Sprintf(javaHits, `{"value":2,"relation":"eq"}`)
+	repo := newStubES(b, func(w http.ResponseWriter, r *http.Request, body string) {
+		fmt.Fprint(w, response)
+	})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := repo.Search("手机", 1, 5, "", false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSearchByCriteriaReturnsFacets(t *testing.T) {
+	var body string
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, b string) {
+		body = b
+		fmt.Fprint(w, `{"hits":{"total":{"value":1},"hits":[{"_id":"26","_source":{"id":26}}]},"aggregations":{
+"brands":{"doc_count":3,"ids":{"buckets":[{"key":3,"doc_count":2,"names":{"buckets":[{"key":"华为","doc_count":2}]}},{"key":6,"doc_count":1,"names":{"buckets":[{"key":"小米","doc_count":1}]}}]}},
+"categories":{"doc_count":1,"ids":{"buckets":[{"key":19,"doc_count":1,"names":{"buckets":[{"key":"手机通讯","doc_count":1}]}}]}},
+"prices":{"doc_count":1,"ranges":{"buckets":[{"key":"*-1000.0","to":1000.0,"doc_count":0},{"key":"1000.0-3000.0","from":1000.0,"to":3000.0,"doc_count":0},{"key":"3000.0-*","from":3000.0,"doc_count":1}]}},
+"attrs":{"doc_count":1,"values":{"doc_count":4,"attrs":{"doc_count":2,"ids":{"buckets":[
+{"key":43,"doc_count":1,"names":{"buckets":[{"key":"屏幕尺寸","doc_count":1}]},"values":{"buckets":[{"key":"5.8","doc_count":1,"products":{"doc_count":1}}]}},
+{"key":44,"doc_count":1,"names":{"buckets":[{"key":"颜色","doc_count":1}]},"values":{"buckets":[{"key":"黑色","doc_count":1,"products":{"doc_count":1}}]}}]}}}},
+"attr_44":{"doc_count":2,"values":{"doc_count":6,"attrs":{"doc_count":3,"ids":{"buckets":[
+{"key":44,"doc_count":3,"names":{"buckets":[{"key":"颜色","doc_count":3}]},"values":{"buckets":[{"key":"黑色","doc_count":2,"products":{"doc_count":1}},{"key":"金色","doc_count":1,"products":{"doc_count":1}}]}}]}}}}}}`)
+	})
+	page, err := repo.SearchByCriteria(model.SearchCriteria{
+		BrandId: int64Ptr(3),
+		Attrs:   []model.AttrFilter{{AttrId: 44, Values: []string{"黑色"}}},
+		Facets:  true, PageNum: 1, PageSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, `"post_filter"`) || len(page.Content) != 1 {
+		t.Fatalf("page = %+v, query %s", page, body)
+	}
+	f := page.Facets
+	if f == nil || len(f.Brands) != 2 || f.Brands[1] != (model.FacetBucket{Id: 6, Name: "小米", Count: 1}) || f.Categories[0].Name != "手机通讯" {
+		t.Fatalf("facets = %+v", f)
+	}
+	if len(f.Prices) != 3 || f.Prices[0] != (model.PriceFacet{To: "1000"}) || f.Prices[2] != (model.PriceFacet{From: "3000", Count: 1}) {
+		t.Fatalf("prices = %+v", f.Prices)
+	}
+	// 已选的颜色用单独的聚合统计，没选中的金色也在分面中；数量是商品数而不是属性值个数
+	if len(f.Attrs) != 2 || f.Attrs[0].AttrName != "屏幕尺寸" || f.Attrs[1].AttrId != 44 ||
+		len(f.Attrs[1].Values) != 2 || f.Attrs[1].Values[0] != (model.FacetValue{Value: "黑色", Count: 1}) {
+		t.Fatalf("attrs = %+v", f.Attrs)
+	}
+
+	//不请求分面时不返回
+	page, err = repo.SearchByCriteria(model.SearchCriteria{PageNum: 1, PageSize: 5})
+	if err != nil || page.Facets != nil || strings.Contains(body, `"aggs"`) {
+		t.Fatalf("facets = %+v, err = %v, query %s", page.Facets, err, body)
+	}
+}
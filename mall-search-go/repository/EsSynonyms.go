@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// 同义词和停用词是索引 analysis 设置中的两个过滤器，只有 name/subTitle/keywords 的搜索分词器 ik_synonym_search 使用它们。
+// analysis 设置只能在索引关闭时修改，关闭线上索引会让搜索和写入失败，所以 ApplySynonyms 不修改线上索引，
+// 而是按新的过滤器创建新一代索引，用 _reindex 从线上索引复制文档后切换别名，与全量导入一样搜索不会看到中间状态
+
+const (
+	synonymFilter  = "product_synonyms"
+	stopWordFilter = "product_stopwords"
+)
+
+// discardTimeout 是复制失败或请求被取消后删除新建索引可以使用的时间
+const discardTimeout = 30 * time.Second
+
+func synonymSettings(filters map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"index": map[string]interface{}{"analysis": map[string]interface{}{"filter": filters}}}
+}
+
+func synonymFilters(synonyms, stopWords []string) map[string]interface{} {
+	//nil 会编码为 null，ES 要求空数组
+	synonyms = append([]string{}, synonyms...)
+	stopWords = append([]string{}, stopWords...)
+	return map[string]interface{}{
+		synonymFilter:  map[string]interface{}{"type": "synonym_graph", "synonyms": synonyms},
+		stopWordFilter: map[string]interface{}{"type": "stop", "stopwords": stopWords},
+	}
+}
+
+// ApplySynonyms 创建使用新的同义词和停用词的一代索引，复制线上索引的文档后切换别名。
+// 被替换的一代留给调用方按 search.reindex.retain 清理，回滚时 CopySynonyms 会把当前的同义词带过去。
+// ES 拒绝规则时创建索引就会失败，线上索引不受影响。复制期间写入旧索引的变更需要调用方让增量同步重放
+func (repo *esProductRepositoryImpl) ApplySynonyms(ctx context.Context, synonyms, stopWords []string) error {
+	index, err := repo.createGeneration(ctx, synonymFilters(synonyms, stopWords))
+	if err != nil {
+		return err
+	}
+	if err := repo.copyDocuments(ctx, index); err != nil {
+		return repo.discardIndex(ctx, index, err)
+	}
+	if err := repo.SwapAlias(ctx, index); err != nil {
+		return repo.discardIndex(ctx, index, err)
+	}
+	log.Printf("Applied %d synonym rules and %d stop words to %s", len(synonyms), len(stopWords), index)
+	return nil
+}
+
+// copyDocuments 用 _reindex 把别名指向的索引中的所有文档复制到 index，完成后刷新 index
+func (repo *esProductRepositoryImpl) copyDocuments(ctx context.Context, index string) error {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(map[string]interface{}{
+		"source": map[string]interface{}{"index": repo.index},
+		"dest":   map[string]interface{}{"index": index},
+	})
+	if err != nil {
+		return err
+	}
+	res, err := esapi.ReindexRequest{
+		Body:              &buf,
+		Refresh:           esapi.BoolPtr(true),
+		WaitForCompletion: esapi.BoolPtr(true),
+	}.Do(ctx, repo.client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var out struct {
+		Total    int               `json:"total"`
+		Failures []json.RawMessage `json:"failures"`
+	}
+	if err := decodeResponse(res, &out); err != nil {
+		return fmt.Errorf("Error copying %s to %s: %w", repo.index, index, err)
+	}
+	if len(out.Failures) > 0 {
+		return fmt.Errorf("Error copying %s to %s: %d documents failed, first failure %s", repo.index, index, len(out.Failures), out.Failures[0])
+	}
+	return nil
+}
+
+// discardIndex 删除没有切换上线的新索引并返回 cause，ctx 已经被取消时换成一个新的限时 context
+func (repo *esProductRepositoryImpl) discardIndex(ctx context.Context, index string, cause error) error {
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), discardTimeout)
+		defer cancel()
+	}
+	if err := repo.DeleteIndex(ctx, index); err != nil {
+		log.Printf("Error deleting index %s: %s", index, err)
+	}
+	return cause
+}
+
+// CopySynonyms 把线上索引的同义词和停用词写入不在线上的 index：回滚到的一代可能是修改同义词之前建的，
+// 回滚只撤销导入，同义词保持数据库中的最新版本。analysis 设置只能在索引关闭时修改，index 没有流量，可以关闭
+func (repo *esProductRepositoryImpl) CopySynonyms(ctx context.Context, index string) error {
+	active, err := repo.activeSynonymFilters(ctx)
+	if err != nil {
+		return err
+	}
+	if active == nil {
+		active = synonymFilters(nil, nil)
+	}
+	current, err := repo.synonymFiltersOf(ctx, index)
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(active, current) {
+		return nil
+	}
+
+	closeRes, err := esapi.IndicesCloseRequest{Index: []string{index}}.Do(ctx, repo.client)
+	if err != nil {
+		return err
+	}
+	defer closeRes.Body.Close()
+	if closeRes.IsError() {
+		return fmt.Errorf("Error closing index %s: %w", index, responseError(closeRes))
+	}
+	//无论修改是否成功都要重新打开，否则这一代既不能回滚也不能被搜索
+	updateErr := repo.putSynonymFilters(ctx, index, active)
+	openRes, err := esapi.IndicesOpenRequest{Index: []string{index}, WaitForActiveShards: "1"}.Do(ctx, repo.client)
+	if err != nil {
+		return err
+	}
+	defer openRes.Body.Close()
+	if openRes.IsError() {
+		return fmt.Errorf("Error opening index %s: %w", index, responseError(openRes))
+	}
+	if updateErr != nil {
+		return updateErr
+	}
+	log.Printf("Copied the active synonyms to %s", index)
+	return nil
+}
+
+func (repo *esProductRepositoryImpl) putSynonymFilters(ctx context.Context, index string, filters map[string]interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(synonymSettings(filters)); err != nil {
+		return err
+	}
+	res, err := esapi.IndicesPutSettingsRequest{Index: []string{index}, Body: &buf}.Do(ctx, repo.client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Error updating synonyms of %s: %w", index, responseError(res))
+	}
+	return nil
+}
+
+// activeSynonymFilters 返回别名当前指向的索引中的同义词和停用词过滤器，新一代索引从它复制，
+// 别名还不存在或者索引中没有这两个过滤器时返回 nil
+func (repo *esProductRepositoryImpl) activeSynonymFilters(ctx context.Context) (map[string]interface{}, error) {
+	return repo.synonymFiltersOf(ctx, repo.index)
+}
+
+// synonymFiltersOf 返回 index（索引或别名）中的同义词和停用词过滤器，不存在时返回 nil
+func (repo *esProductRepositoryImpl) synonymFiltersOf(ctx context.Context, index string) (map[string]interface{}, error) {
+	res, err := esapi.IndicesGetSettingsRequest{
+		Index: []string{index},
+		Name:  []string{"index.analysis.filter." + synonymFilter, "index.analysis.filter." + stopWordFilter},
+	}.Do(ctx, repo.client)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	var indices map[string]struct {
+		Settings struct {
+			Index struct {
+				Analysis struct {
+					Filter map[string]interface{} `json:"filter"`
+				} `json:"analysis"`
+			} `json:"index"`
+		} `json:"settings"`
+	}
+	if err := decodeResponse(res, &indices); err != nil {
+		return nil, fmt.Errorf("Error getting synonyms of %s: %w", index, err)
+	}
+	names := make([]string, 0, len(indices))
+	for name := range indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if filters := indices[name].Settings.Index.Analysis.Filter; len(filters) > 0 {
+			return filters, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// generationPath 把请求路径中新建的一代索引名替换为 pms_vNEW，旧的 pms_v20240101000000 保持不变
+var generationPath = regexp.MustCompile(`pms_v\d{17}`)
+
+// synonymES 模拟别名指向 pms_v20240101000000 的集群，记录收到的请求，reject 为 true 时拒绝新索引中的同义词
+func synonymES(t *testing.T, reject bool) (*esProductRepositoryImpl, func() string) {
+	var (
+		mu      sync.Mutex
+		calls   []string
+		created string
+	)
+	repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+		mu.Lock()
+		calls = append(calls, r.Method+" "+generationPath.ReplaceAllString(r.URL.Path, "pms_vNEW"))
+		mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/_close"):
+			t.Errorf("closed index %s", r.URL.Path)
+		case strings.HasPrefix(r.URL.Path, "/_alias/"):
+			mu.Lock()
+			active := "pms_v20240101000000"
+			if created != "" {
+				active = created
+			}
+			mu.Unlock()
+			fmt.Fprintf(w, `{%q:{"aliases":{"pms":{}}}}`, active)
+		case r.Method == http.MethodPut && generationPath.MatchString(r.URL.Path):
+			if !strings.Contains(body, `"synonyms":["的, 地"]`) || !strings.Contains(body, `"stopwords":[]`) {
+				t.Errorf("create index body %s", body)
+			}
+			if reject {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":{"type":"illegal_argument_exception","reason":"failed to build synonyms"},"status":400}`)
+				return
+			}
+			fmt.Fprint(w, `{"acknowledged":true}`)
+		case r.URL.Path == "/_reindex":
+			if !strings.Contains(body, `"source":{"index":"pms"}`) || !generationPath.MatchString(body) {
+				t.Errorf("reindex body %s", body)
+			}
+			fmt.Fprint(w, `{"total":2,"created":2,"failures":[]}`)
+		case r.URL.Path == "/_aliases":
+			mu.Lock()
+			created = generationPath.FindString(body)
+			mu.Unlock()
+			fmt.Fprint(w, `{"acknowledged":true}`)
+		default:
+			fmt.Fprint(w, `{"acknowledged":true}`)
+		}
+	})
+	return repo, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return fmt.Sprint(calls)
+	}
+}
+
+// 修改同义词时不关闭线上索引：新建一代索引，复制文档后切换别名，被替换的索引留给调用方按保留代数清理
+func TestApplySynonymsRebuildsIndexWithoutClosingIt(t *testing.T) {
+	repo, calls := synonymES(t, false)
+	if err := repo.ApplySynonyms(context.Background(), []string{"的, 地"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := "[PUT /pms_vNEW POST /_reindex GET /_alias/pms HEAD /pms GET /_alias/pms POST /_aliases]"
+	if got := calls(); got != want {
+		t.Fatalf("requests = %s, want %s", got, want)
+	}
+}
+
+// ES 拒绝同义词规则时在创建新索引时就失败，线上索引不受影响，错误要带上 400 让接口返回参数错误
+func TestApplySynonymsLeavesIndexWhenRejected(t *testing.T) {
+	repo, calls := synonymES(t, true)
+	err := repo.ApplySynonyms(context.Background(), []string{"的, 地"}, nil)
+	var esErr *ElasticsearchError
+	if !errors.As(err, &esErr) || esErr.Status != http.StatusBadRequest {
+		t.Fatalf("ApplySynonyms error = %v, want a 400 from ES", err)
+	}
+	want := "[PUT /pms_vNEW]"
+	if got := calls(); got != want {
+		t.Fatalf("requests = %s, want %s", got, want)
+	}
+}
+
+// 回滚到的一代同义词与线上不同时关闭它、写入线上的同义词后再打开，一致时不做任何修改
+func TestCopySynonymsToRolledBackGeneration(t *testing.T) {
+	settings := func(index, synonyms string) string {
+		return fmt.Sprintf(`{%q:{"settings":{"index":{"analysis":{"filter":{"product_synonyms":{"type":"synonym_graph","synonyms":[%s]},"product_stopwords":{"type":"stop","stopwords":[]}}}}}}}`, index, synonyms)
+	}
+	for _, c := range []struct {
+		old  string
+		want string
+	}{
+		{`"的, 地"`, "[GET /pms/_settings GET /pms_v20240101000000/_settings]"},
+		{``, "[GET /pms/_settings GET /pms_v20240101000000/_settings POST /pms_v20240101000000/_close PUT /pms_v20240101000000/_settings POST /pms_v20240101000000/_open]"},
+	} {
+		var calls []string
+		repo := newStubES(t, func(w http.ResponseWriter, r *http.Request, body string) {
+			path := strings.Split(r.URL.Path, "/")
+			calls = append(calls, r.Method+" /"+path[1]+"/"+path[2])
+			switch {
+			case r.Method == http.MethodGet && path[1] == "pms":
+				fmt.Fprint(w, settings("pms_v20240102000000", `"的, 地"`))
+			case r.Method == http.MethodGet:
+				fmt.Fprint(w, settings(path[1], c.old))
+			case r.Method == http.MethodPut:
+				if !strings.Contains(body, `"synonyms":["的, 地"]`) {
+					t.Errorf("settings body %s", body)
+				}
+				fmt.Fprint(w, `{"acknowledged":true}`)
+			default:
+				fmt.Fprint(w, `{"acknowledged":true}`)
+			}
+		})
+		if err := repo.CopySynonyms(context.Background(), "pms_v20240101000000"); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(calls); got != c.want {
+			t.Errorf("requests = %s, want %s", got, c.want)
+		}
+	}
+}
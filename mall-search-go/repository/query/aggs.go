@@ -0,0 +1,133 @@
+package query
+
+// Aggregation 是一个聚合，可以带子聚合
+type Aggregation interface {
+	Source() map[string]interface{}
+}
+
+// subAggregations 是各种聚合共用的子聚合列表
+type subAggregations map[string]Aggregation
+
+func (s subAggregations) source(agg map[string]interface{}) map[string]interface{} {
+	if len(s) == 0 {
+		return agg
+	}
+	aggs := make(map[string]interface{}, len(s))
+	for name, sub := range s {
+		aggs[name] = sub.Source()
+	}
+	agg["aggs"] = aggs
+	return agg
+}
+
+// TermsAggregation 按字段的取值分桶
+type TermsAggregation struct {
+	field string
+	size  int
+	subs  subAggregations
+}
+
+func TermsAgg(field string) *TermsAggregation {
+	return &TermsAggregation{field: field, subs: make(subAggregations)}
+}
+
+// Size 是返回的桶数，不设置时 ES 默认返回 10 个
+func (a *TermsAggregation) Size(size int) *TermsAggregation {
+	a.size = size
+	return a
+}
+
+func (a *TermsAggregation) SubAgg(name string, sub Aggregation) *TermsAggregation {
+	a.subs[name] = sub
+	return a
+}
+
+func (a *TermsAggregation) Source() map[string]interface{} {
+	terms := map[string]interface{}{"field": a.field}
+	if a.size > 0 {
+		terms["size"] = a.size
+	}
+	return a.subs.source(map[string]interface{}{"terms": terms})
+}
+
+// NestedAggregation 进入 nested 字段，子聚合在子文档上计算
+type NestedAggregation struct {
+	path string
+	subs subAggregations
+}
+
+func NestedAgg(path string) *NestedAggregation {
+	return &NestedAggregation{path: path, subs: make(subAggregations)}
+}
+
+func (a *NestedAggregation) SubAgg(name string, sub Aggregation) *NestedAggregation {
+	a.subs[name] = sub
+	return a
+}
+
+func (a *NestedAggregation) Source() map[string]interface{} {
+	return a.subs.source(map[string]interface{}{"nested": map[string]interface{}{"path": a.path}})
+}
+
+// FilterAggregation 只统计满足条件的文档
+type FilterAggregation struct {
+	filter Query
+	subs   subAggregations
+}
+
+func FilterAgg(filter Query) *FilterAggregation {
+	return &FilterAggregation{filter: filter, subs: make(subAggregations)}
+}
+
+func (a *FilterAggregation) SubAgg(name string, sub Aggregation) *FilterAggregation {
+	a.subs[name] = sub
+	return a
+}
+
+func (a *FilterAggregation) Source() map[string]interface{} {
+	return a.subs.source(map[string]interface{}{"filter": a.filter.Source()})
+}
+
+// RangeAggregation 按数值区间分桶，区间包含 from 不包含 to
+type RangeAggregation struct {
+	field  string
+	ranges []map[string]interface{}
+	subs   subAggregations
+}
+
+func RangeAgg(field string) *RangeAggregation {
+	return &RangeAggregation{field: field, subs: make(subAggregations)}
+}
+
+// AddRange 添加一个区间，from 或 to 为 nil 表示没有下界或上界
+func (a *RangeAggregation) AddRange(from, to interface{}) *RangeAggregation {
+	r := make(map[string]interface{})
+	if from != nil {
+		r["from"] = from
+	}
+	if to != nil {
+		r["to"] = to
+	}
+	a.ranges = append(a.ranges, r)
+	return a
+}
+
+func (a *RangeAggregation) SubAgg(name string, sub Aggregation) *RangeAggregation {
+	a.subs[name] = sub
+	return a
+}
+
+func (a *RangeAggregation) Source() map[string]interface{} {
+	return a.subs.source(map[string]interface{}{"range": map[string]interface{}{"field": a.field, "ranges": a.ranges}})
+}
+
+// ReverseNestedAggregation 在 nested 聚合内部回到父文档，用于统计商品数而不是属性值的个数
+type ReverseNestedAggregation struct{}
+
+func ReverseNestedAgg() ReverseNestedAggregation {
+	return ReverseNestedAggregation{}
+}
+
+func (ReverseNestedAggregation) Source() map[string]interface{} {
+	return map[string]interface{}{"reverse_nested": map[string]interface{}{}}
+}
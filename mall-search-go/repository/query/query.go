@@ -0,0 +1,324 @@
+// Package query 是组装 Elasticsearch 查询 DSL 的类型化构造器，只覆盖商品搜索用到的子集。
+// 每个构造器的 Source 返回可以直接编码为 JSON 的 map，编码时键按字母序输出，便于用 golden 文件比对
+package query
+
+// Query 是一个查询子句
+type Query interface {
+	Source() map[string]interface{}
+}
+
+func sources(queries []Query) []interface{} {
+	out := make([]interface{}, len(queries))
+	for i, q := range queries {
+		out[i] = q.Source()
+	}
+	return out
+}
+
+// BoolQuery 组合多个子句，must/should 参与打分，filter/must_not 只过滤
+type BoolQuery struct {
+	must, filter, should, mustNot []Query
+	minimumShouldMatch            interface{}
+}
+
+func Bool() *BoolQuery {
+	return &BoolQuery{}
+}
+
+func (q *BoolQuery) Must(queries ...Query) *BoolQuery {
+	q.must = append(q.must, queries...)
+	return q
+}
+
+func (q *BoolQuery) Filter(queries ...Query) *BoolQuery {
+	q.filter = append(q.filter, queries...)
+	return q
+}
+
+func (q *BoolQuery) Should(queries ...Query) *BoolQuery {
+	q.should = append(q.should, queries...)
+	return q
+}
+
+func (q *BoolQuery) MustNot(queries ...Query) *BoolQuery {
+	q.mustNot = append(q.mustNot, queries...)
+	return q
+}
+
+// MinimumShouldMatch 可以是数字或 "75%" 这样的字符串
+func (q *BoolQuery) MinimumShouldMatch(v interface{}) *BoolQuery {
+	q.minimumShouldMatch = v
+	return q
+}
+
+// IsEmpty 表示没有任何子句，调用方据此决定是否省略这个 bool
+func (q *BoolQuery) IsEmpty() bool {
+	return len(q.must)+len(q.filter)+len(q.should)+len(q.mustNot) == 0
+}
+
+func (q *BoolQuery) Source() map[string]interface{} {
+	body := make(map[string]interface{})
+	if len(q.must) > 0 {
+		body["must"] = sources(q.must)
+	}
+	if len(q.filter) > 0 {
+		body["filter"] = sources(q.filter)
+	}
+	if len(q.should) > 0 {
+		body["should"] = sources(q.should)
+	}
+	if len(q.mustNot) > 0 {
+		body["must_not"] = sources(q.mustNot)
+	}
+	if q.minimumShouldMatch != nil {
+		body["minimum_should_match"] = q.minimumShouldMatch
+	}
+	return map[string]interface{}{"bool": body}
+}
+
+type matchAllQuery struct{}
+
+func MatchAll() Query {
+	return matchAllQuery{}
+}
+
+func (matchAllQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"match_all": map[string]interface{}{}}
+}
+
+// MatchQuery 是单字段的全文查询
+type MatchQuery struct {
+	field    string
+	text     interface{}
+	boost    float64
+	operator string
+}
+
+func Match(field string, text interface{}) *MatchQuery {
+	return &MatchQuery{field: field, text: text}
+}
+
+func (q *MatchQuery) Boost(boost float64) *MatchQuery {
+	q.boost = boost
+	return q
+}
+
+// Operator 是 "or"（默认）或 "and"
+func (q *MatchQuery) Operator(operator string) *MatchQuery {
+	q.operator = operator
+	return q
+}
+
+func (q *MatchQuery) Source() map[string]interface{} {
+	if q.boost == 0 && q.operator == "" {
+		return map[string]interface{}{"match": map[string]interface{}{q.field: q.text}}
+	}
+	body := map[string]interface{}{"query": q.text}
+	if q.boost != 0 {
+		body["boost"] = q.boost
+	}
+	if q.operator != "" {
+		body["operator"] = q.operator
+	}
+	return map[string]interface{}{"match": map[string]interface{}{q.field: body}}
+}
+
+// MultiMatchQuery 在多个字段上执行同一个全文查询，字段可以写成 "name^10" 指定权重
+type MultiMatchQuery struct {
+	text     interface{}
+	fields   []string
+	typ      string
+	operator string
+	boost    float64
+}
+
+func MultiMatch(text interface{}, fields ...string) *MultiMatchQuery {
+	return &MultiMatchQuery{text: text, fields: fields}
+}
+
+// Type 是 best_fields（默认）、most_fields、cross_fields 等
+func (q *MultiMatchQuery) Type(typ string) *MultiMatchQuery {
+	q.typ = typ
+	return q
+}
+
+func (q *MultiMatchQuery) Operator(operator string) *MultiMatchQuery {
+	q.operator = operator
+	return q
+}
+
+func (q *MultiMatchQuery) Boost(boost float64) *MultiMatchQuery {
+	q.boost = boost
+	return q
+}
+
+func (q *MultiMatchQuery) Source() map[string]interface{} {
+	body := map[string]interface{}{"query": q.text, "fields": q.fields}
+	if q.typ != "" {
+		body["type"] = q.typ
+	}
+	if q.operator != "" {
+		body["operator"] = q.operator
+	}
+	if q.boost != 0 {
+		body["boost"] = q.boost
+	}
+	return map[string]interface{}{"multi_match": body}
+}
+
+// TermQuery 精确匹配 keyword、数字等未分词的字段
+type TermQuery struct {
+	field string
+	value interface{}
+	boost float64
+}
+
+func Term(field string, value interface{}) *TermQuery {
+	return &TermQuery{field: field, value: value}
+}
+
+func (q *TermQuery) Boost(boost float64) *TermQuery {
+	q.boost = boost
+	return q
+}
+
+func (q *TermQuery) Source() map[string]interface{} {
+	if q.boost == 0 {
+		return map[string]interface{}{"term": map[string]interface{}{q.field: q.value}}
+	}
+	return map[string]interface{}{"term": map[string]interface{}{q.field: map[string]interface{}{"value": q.value, "boost": q.boost}}}
+}
+
+type termsQuery struct {
+	field  string
+	values []interface{}
+}
+
+// Terms 匹配字段等于任意一个值的文档
+func Terms(field string, values ...interface{}) Query {
+	return termsQuery{field: field, values: values}
+}
+
+func (q termsQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"terms": map[string]interface{}{q.field: q.values}}
+}
+
+// RangeQuery 是数值或日期范围，未设置的边界不输出
+type RangeQuery struct {
+	field  string
+	bounds map[string]interface{}
+}
+
+func Range(field string) *RangeQuery {
+	return &RangeQuery{field: field, bounds: make(map[string]interface{})}
+}
+
+func (q *RangeQuery) Gt(v interface{}) *RangeQuery {
+	q.bounds["gt"] = v
+	return q
+}
+
+func (q *RangeQuery) Gte(v interface{}) *RangeQuery {
+	q.bounds["gte"] = v
+	return q
+}
+
+func (q *RangeQuery) Lt(v interface{}) *RangeQuery {
+	q.bounds["lt"] = v
+	return q
+}
+
+func (q *RangeQuery) Lte(v interface{}) *RangeQuery {
+	q.bounds["lte"] = v
+	return q
+}
+
+func (q *RangeQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"range": map[string]interface{}{q.field: q.bounds}}
+}
+
+// NestedQuery 在 nested 类型的字段（如 attrValueList）的每个子文档上单独匹配
+type NestedQuery struct {
+	path      string
+	query     Query
+	scoreMode string
+}
+
+func Nested(path string, query Query) *NestedQuery {
+	return &NestedQuery{path: path, query: query}
+}
+
+// ScoreMode 是 avg（默认）、max、min、sum 或 none
+func (q *NestedQuery) ScoreMode(mode string) *NestedQuery {
+	q.scoreMode = mode
+	return q
+}
+
+func (q *NestedQuery) Source() map[string]interface{} {
+	body := map[string]interface{}{"path": q.path, "query": q.query.Source()}
+	if q.scoreMode != "" {
+		body["score_mode"] = q.scoreMode
+	}
+	return map[string]interface{}{"nested": body}
+}
+
+// FunctionScoreQuery 对应 Java 版的 QueryBuilders.functionScoreQuery，
+// 每个函数在文档满足 filter 时贡献 weight 分
+type FunctionScoreQuery struct {
+	query     Query
+	functions []map[string]interface{}
+	scoreMode string
+	boostMode string
+	minScore  *float64
+}
+
+func FunctionScore(query Query) *FunctionScoreQuery {
+	return &FunctionScoreQuery{query: query}
+}
+
+// Weight 添加一个权重函数，filter 为 nil 时对所有文档生效
+func (q *FunctionScoreQuery) Weight(filter Query, weight float64) *FunctionScoreQuery {
+	fn := map[string]interface{}{"weight": weight}
+	if filter != nil {
+		fn["filter"] = filter.Source()
+	}
+	q.functions = append(q.functions, fn)
+	return q
+}
+
+// ScoreMode 决定多个函数的分数如何合并：multiply（默认）、sum、avg、first、max、min
+func (q *FunctionScoreQuery) ScoreMode(mode string) *FunctionScoreQuery {
+	q.scoreMode = mode
+	return q
+}
+
+// BoostMode 决定函数分数和查询分数如何合并：multiply（默认）、replace、sum、avg、max、min
+func (q *FunctionScoreQuery) BoostMode(mode string) *FunctionScoreQuery {
+	q.boostMode = mode
+	return q
+}
+
+func (q *FunctionScoreQuery) MinScore(score float64) *FunctionScoreQuery {
+	q.minScore = &score
+	return q
+}
+
+func (q *FunctionScoreQuery) Source() map[string]interface{} {
+	body := make(map[string]interface{})
+	if q.query != nil {
+		body["query"] = q.query.Source()
+	}
+	if len(q.functions) > 0 {
+		body["functions"] = q.functions
+	}
+	if q.scoreMode != "" {
+		body["score_mode"] = q.scoreMode
+	}
+	if q.boostMode != "" {
+		body["boost_mode"] = q.boostMode
+	}
+	if q.minScore != nil {
+		body["min_score"] = *q.minScore
+	}
+	return map[string]interface{}{"function_score": body}
+}
@@ -0,0 +1,53 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSource(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		q    interface{}
+		want string
+	}{
+		{"empty bool", Bool(), `{"bool":{}}`},
+		{"bool", Bool().Must(MatchAll()).Filter(Term("brandId", 3), Terms("id", 1, 2)).MustNot(Term("id", 26)).MinimumShouldMatch(1),
+			`{"bool":{"filter":[{"term":{"brandId":3}},{"terms":{"id":[1,2]}}],"minimum_should_match":1,"must":[{"match_all":{}}],"must_not":[{"term":{"id":26}}]}}`},
+		{"match", Match("name", "手机"), `{"match":{"name":"手机"}}`},
+		{"match with boost", Match("name", "手机").Boost(8).Operator("and"), `{"match":{"name":{"boost":8,"operator":"and","query":"手机"}}}`},
+		{"term with boost", Term("brandId", 3).Boost(5), `{"term":{"brandId":{"boost":5,"value":3}}}`},
+		{"range", Range("price").Gte("100").Lt(200), `{"range":{"price":{"gte":"100","lt":200}}}`},
+		{"nested", Nested("attrValueList", Term("attrValueList.value", "黑色")).ScoreMode("none"),
+			`{"nested":{"path":"attrValueList","query":{"term":{"attrValueList.value":"黑色"}},"score_mode":"none"}}`},
+		{"function score", FunctionScore(nil).Weight(Match("name", "手机"), 10).Weight(nil, 1).ScoreMode("sum").BoostMode("replace").MinScore(2),
+			`{"function_score":{"boost_mode":"replace","functions":[{"filter":{"match":{"name":"手机"}},"weight":10},{"weight":1}],"min_score":2,"score_mode":"sum"}}`},
+		{"aggs", NestedAgg("attrValueList").SubAgg("ids", TermsAgg("attrValueList.productAttributeId").Size(20).SubAgg("f", FilterAgg(MatchAll()))),
+			`{"aggs":{"ids":{"aggs":{"f":{"filter":{"match_all":{}}}},"terms":{"field":"attrValueList.productAttributeId","size":20}}},"nested":{"path":"attrValueList"}}`},
+		{"range agg", RangeAgg("price").AddRange(nil, 500).AddRange(500, nil).SubAgg("products", ReverseNestedAgg()),
+			`{"aggs":{"products":{"reverse_nested":{}}},"range":{"field":"price","ranges":[{"to":500},{"from":500}]}}`},
+		{"search", NewSearch().Query(MatchAll()).PostFilter(Term("brandId", 3)).From(0).Size(0).Sort(Desc("sale"), Asc("id")).
+			Highlight(NewHighlight("name").Tags("【", "】").Query(Match("name", "手机"))).TrackTotalHits(true),
+			`{"from":0,"highlight":{"fields":{"name":{}},"highlight_query":{"match":{"name":"手机"}},"post_tags":["】"],"pre_tags":["【"]},"post_filter":{"term":{"brandId":3}},"query":{"match_all":{}},"size":0,"sort":[{"sale":{"order":"desc"}},{"id":{"order":"asc"}}],"track_total_hits":true}`},
+		{"suggest", NewSearch().Size(0).SourceFields("id", "name").Suggest("s", Completion("suggest", "华为").Size(5).SkipDuplicates(true).Context("category", "19")),
+			`{"_source":["id","name"],"size":0,"suggest":{"s":{"completion":{"contexts":{"category":["19"]},"field":"suggest","size":5,"skip_duplicates":true},"prefix":"华为"}}}`},
+		{"phrase", Phrase("name", "华伟手机").Analyzer("ik_smart").Size(1).MaxErrors(2).Confidence(0).
+			DirectGenerator(Generator("name").SuggestMode("missing").MinWordLength(2)).Collate(Match("name", "{{suggestion}}")),
+			`{"phrase":{"analyzer":"ik_smart","collate":{"query":{"source":{"match":{"name":"{{suggestion}}"}}}},"confidence":0,"direct_generator":[{"field":"name","min_word_length":2,"suggest_mode":"missing"}],"field":"name","max_errors":2,"size":1},"text":"华伟手机"}`},
+		{"search after", NewSearch().Size(5).Sort(Desc("_score")).SearchAfter(1.5, json.RawMessage("4294967298")).PointInTime("pit-1", "1m"),
+			`{"pit":{"id":"pit-1","keep_alive":"1m"},"search_after":[1.5,4294967298],"size":5,"sort":[{"_score":{"order":"desc"}}]}`},
+		{"empty search", NewSearch(), `{}`},
+	} {
+		var source interface{} = tc.q
+		if s, ok := tc.q.(interface{ Source() map[string]interface{} }); ok {
+			source = s.Source()
+		}
+		got, err := json.Marshal(source)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+}
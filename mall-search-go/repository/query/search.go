@@ -0,0 +1,204 @@
+package query
+
+import "encoding/json"
+
+// Sort 是一个排序字段
+type Sort struct {
+	Field string
+	Order string
+}
+
+func Asc(field string) Sort {
+	return Sort{Field: field, Order: "asc"}
+}
+
+func Desc(field string) Sort {
+	return Sort{Field: field, Order: "desc"}
+}
+
+func (s Sort) Source() map[string]interface{} {
+	return map[string]interface{}{s.Field: map[string]interface{}{"order": s.Order}}
+}
+
+// Highlight 请求指定字段的高亮片段
+type Highlight struct {
+	fields   []string
+	preTags  []string
+	postTags []string
+	query    Query
+}
+
+func NewHighlight(fields ...string) *Highlight {
+	return &Highlight{fields: fields}
+}
+
+// Tags 设置包裹匹配词的标签，不设置时 ES 使用 <em></em>
+func (h *Highlight) Tags(pre, post string) *Highlight {
+	h.preTags, h.postTags = []string{pre}, []string{post}
+	return h
+}
+
+// Query 设置用来提取高亮词的查询，不设置时使用搜索的查询。
+// function_score 中 functions 的 filter 不参与高亮，这时需要单独指定
+func (h *Highlight) Query(q Query) *Highlight {
+	h.query = q
+	return h
+}
+
+func (h *Highlight) Source() map[string]interface{} {
+	fields := make(map[string]interface{}, len(h.fields))
+	for _, f := range h.fields {
+		fields[f] = map[string]interface{}{}
+	}
+	body := map[string]interface{}{"fields": fields}
+	if len(h.preTags) > 0 {
+		body["pre_tags"], body["post_tags"] = h.preTags, h.postTags
+	}
+	if h.query != nil {
+		body["highlight_query"] = h.query.Source()
+	}
+	return body
+}
+
+// Search 是 _search 的请求体
+type Search struct {
+	query          Query
+	postFilter     Query
+	from, size     *int
+	sorts          []Sort
+	aggs           subAggregations
+	highlight      *Highlight
+	trackTotalHits *bool
+	suggesters     map[string]Suggester
+	sourceFields   []string
+	searchAfter    []interface{}
+	pit            *PointInTime
+}
+
+// PointInTime 让多次搜索看到索引同一时刻的数据，KeepAlive 是每次搜索后 PIT 继续保留的时间，如 "1m"
+type PointInTime struct {
+	ID        string
+	KeepAlive string
+}
+
+func NewSearch() *Search {
+	return &Search{aggs: make(subAggregations), suggesters: make(map[string]Suggester)}
+}
+
+func (s *Search) Query(q Query) *Search {
+	s.query = q
+	return s
+}
+
+// PostFilter 在聚合之后过滤命中结果，聚合不受它影响
+func (s *Search) PostFilter(q Query) *Search {
+	s.postFilter = q
+	return s
+}
+
+func (s *Search) From(from int) *Search {
+	s.from = &from
+	return s
+}
+
+func (s *Search) Size(size int) *Search {
+	s.size = &size
+	return s
+}
+
+func (s *Search) Sort(sorts ...Sort) *Search {
+	s.sorts = append(s.sorts, sorts...)
+	return s
+}
+
+func (s *Search) Aggregation(name string, agg Aggregation) *Search {
+	s.aggs[name] = agg
+	return s
+}
+
+func (s *Search) Highlight(h *Highlight) *Search {
+	s.highlight = h
+	return s
+}
+
+func (s *Search) Suggest(name string, suggester Suggester) *Search {
+	s.suggesters[name] = suggester
+	return s
+}
+
+// SourceFields 只返回 _source 中的这些字段
+func (s *Search) SourceFields(fields ...string) *Search {
+	s.sourceFields = append(s.sourceFields, fields...)
+	return s
+}
+
+// SearchAfter 从上一页最后一条命中的排序值之后开始返回，需要同时指定排序
+func (s *Search) SearchAfter(values ...interface{}) *Search {
+	s.searchAfter = values
+	return s
+}
+
+// PointInTime 在 PIT 上搜索，这时请求路径中不能再指定索引
+func (s *Search) PointInTime(id, keepAlive string) *Search {
+	s.pit = &PointInTime{ID: id, KeepAlive: keepAlive}
+	return s
+}
+
+// TrackTotalHits 为 true 时统计精确的总数，否则超过 10000 条时只返回下界
+func (s *Search) TrackTotalHits(track bool) *Search {
+	s.trackTotalHits = &track
+	return s
+}
+
+func (s *Search) Source() map[string]interface{} {
+	body := make(map[string]interface{})
+	if s.query != nil {
+		body["query"] = s.query.Source()
+	}
+	if s.postFilter != nil {
+		body["post_filter"] = s.postFilter.Source()
+	}
+	if s.from != nil {
+		body["from"] = *s.from
+	}
+	if s.size != nil {
+		body["size"] = *s.size
+	}
+	if len(s.sorts) > 0 {
+		sorts := make([]interface{}, len(s.sorts))
+		for i, sort := range s.sorts {
+			sorts[i] = sort.Source()
+		}
+		body["sort"] = sorts
+	}
+	if len(s.aggs) > 0 {
+		s.aggs.source(body)
+	}
+	if s.highlight != nil {
+		body["highlight"] = s.highlight.Source()
+	}
+	if s.trackTotalHits != nil {
+		body["track_total_hits"] = *s.trackTotalHits
+	}
+	if len(s.suggesters) > 0 {
+		suggest := make(map[string]interface{}, len(s.suggesters))
+		for name, suggester := range s.suggesters {
+			suggest[name] = suggester.Source()
+		}
+		body["suggest"] = suggest
+	}
+	if len(s.sourceFields) > 0 {
+		body["_source"] = s.sourceFields
+	}
+	if len(s.searchAfter) > 0 {
+		body["search_after"] = s.searchAfter
+	}
+	if s.pit != nil {
+		body["pit"] = map[string]interface{}{"id": s.pit.ID, "keep_alive": s.pit.KeepAlive}
+	}
+	return body
+}
+
+func (s *Search) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Source())
+}
@@ -0,0 +1,165 @@
+package query
+
+// Suggester 是 suggest 中的一个建议器
+type Suggester interface {
+	Source() map[string]interface{}
+}
+
+// CompletionSuggester 在 completion 类型的字段上按前缀查找输入提示
+type CompletionSuggester struct {
+	field          string
+	prefix         string
+	size           int
+	skipDuplicates bool
+	contexts       map[string][]interface{}
+}
+
+func Completion(field, prefix string) *CompletionSuggester {
+	return &CompletionSuggester{field: field, prefix: prefix}
+}
+
+// Size 是返回的提示数，不设置时 ES 默认返回 5 个
+func (s *CompletionSuggester) Size(size int) *CompletionSuggester {
+	s.size = size
+	return s
+}
+
+// SkipDuplicates 为 true 时文本相同的提示只返回一次，例如多个商品的同一个品牌
+func (s *CompletionSuggester) SkipDuplicates(skip bool) *CompletionSuggester {
+	s.skipDuplicates = skip
+	return s
+}
+
+// Context 只返回 context name 的取值为 values 之一的提示，不设置时不按 context 过滤
+func (s *CompletionSuggester) Context(name string, values ...interface{}) *CompletionSuggester {
+	if s.contexts == nil {
+		s.contexts = make(map[string][]interface{})
+	}
+	s.contexts[name] = append(s.contexts[name], values...)
+	return s
+}
+
+func (s *CompletionSuggester) Source() map[string]interface{} {
+	completion := map[string]interface{}{"field": s.field}
+	if s.size > 0 {
+		completion["size"] = s.size
+	}
+	if s.skipDuplicates {
+		completion["skip_duplicates"] = true
+	}
+	if len(s.contexts) > 0 {
+		completion["contexts"] = s.contexts
+	}
+	return map[string]interface{}{"prefix": s.prefix, "completion": completion}
+}
+
+// PhraseSuggester 对整段文本纠错，先由 DirectGenerator 为每个词生成候选，再按 field 上的词频选出最可能的组合
+type PhraseSuggester struct {
+	field      string
+	text       string
+	analyzer   string
+	size       int
+	maxErrors  float64
+	confidence *float64
+	generators []*DirectGenerator
+	collate    Query
+}
+
+func Phrase(field, text string) *PhraseSuggester {
+	return &PhraseSuggester{field: field, text: text}
+}
+
+// Analyzer 是切分 text 用的分词器，不设置时使用 field 的 search analyzer
+func (s *PhraseSuggester) Analyzer(analyzer string) *PhraseSuggester {
+	s.analyzer = analyzer
+	return s
+}
+
+func (s *PhraseSuggester) Size(size int) *PhraseSuggester {
+	s.size = size
+	return s
+}
+
+// MaxErrors 是最多修正的词数，小于 1 时表示占词数的比例
+func (s *PhraseSuggester) MaxErrors(maxErrors float64) *PhraseSuggester {
+	s.maxErrors = maxErrors
+	return s
+}
+
+// Confidence 是候选的得分至少要达到原文得分的倍数，0 表示总是返回得分最高的候选
+func (s *PhraseSuggester) Confidence(confidence float64) *PhraseSuggester {
+	s.confidence = &confidence
+	return s
+}
+
+func (s *PhraseSuggester) DirectGenerator(generators ...*DirectGenerator) *PhraseSuggester {
+	s.generators = append(s.generators, generators...)
+	return s
+}
+
+// Collate 只返回能搜到文档的候选，q 中的 {{suggestion}} 会替换为候选文本
+func (s *PhraseSuggester) Collate(q Query) *PhraseSuggester {
+	s.collate = q
+	return s
+}
+
+func (s *PhraseSuggester) Source() map[string]interface{} {
+	phrase := map[string]interface{}{"field": s.field}
+	if s.analyzer != "" {
+		phrase["analyzer"] = s.analyzer
+	}
+	if s.size > 0 {
+		phrase["size"] = s.size
+	}
+	if s.maxErrors > 0 {
+		phrase["max_errors"] = s.maxErrors
+	}
+	if s.confidence != nil {
+		phrase["confidence"] = *s.confidence
+	}
+	if len(s.generators) > 0 {
+		generators := make([]interface{}, len(s.generators))
+		for i, g := range s.generators {
+			generators[i] = g.Source()
+		}
+		phrase["direct_generator"] = generators
+	}
+	if s.collate != nil {
+		phrase["collate"] = map[string]interface{}{"query": map[string]interface{}{"source": s.collate.Source()}}
+	}
+	return map[string]interface{}{"text": s.text, "phrase": phrase}
+}
+
+// DirectGenerator 从 field 的词典中为每个词找编辑距离内的候选
+type DirectGenerator struct {
+	field         string
+	suggestMode   string
+	minWordLength int
+}
+
+func Generator(field string) *DirectGenerator {
+	return &DirectGenerator{field: field}
+}
+
+// SuggestMode 是 missing（默认，只纠正词典中没有的词）、popular 或 always
+func (g *DirectGenerator) SuggestMode(mode string) *DirectGenerator {
+	g.suggestMode = mode
+	return g
+}
+
+// MinWordLength 是需要纠正的词的最小长度，ES 默认是 4，中文的词通常只有两三个字
+func (g *DirectGenerator) MinWordLength(length int) *DirectGenerator {
+	g.minWordLength = length
+	return g
+}
+
+func (g *DirectGenerator) Source() map[string]interface{} {
+	body := map[string]interface{}{"field": g.field}
+	if g.suggestMode != "" {
+		body["suggest_mode"] = g.suggestMode
+	}
+	if g.minWordLength > 0 {
+		body["min_word_length"] = g.minWordLength
+	}
+	return body
+}
@@ -1,13 +1,15 @@
 package service
 
 import (
-	//"mall-search-go/model"
+	"context"
+
 	"mall-search-go/model"
 )
 
 type EsProductService interface {
-	// Import all products from the database to ES
-	ImportAll() (int, error)
+	// Import all products from the database into a new index generation and switch the alias to it,
+	// calling progress (if not nil) on every phase change and batch
+	ImportAll(ctx context.Context, progress func(model.ImportProgress)) (model.ImportReport, error)
 
 	// Delete a product from ES
 	Delete(id int64) error
@@ -18,13 +20,38 @@ type EsProductService interface {
 	// Search for products in ES
 	DeleteBatch(ids []int64) error
 
-	SearchByNameOrSubTitleOrKeywords(keyword string, pageNum, pageSize int) (model.Page, error)
+	// SearchByNameOrSubTitleOrKeywords searches the name, subtitle and keywords, returning highlighted fragments if highlight is true.
+	// When there are fewer than search.spelling.min-hits results it suggests a corrected keyword,
+	// and if autoCorrect is true returns the results of the corrected keyword instead.
+	// A non-empty cursor from a previous page replaces pageNum and pageSize
+	SearchByNameOrSubTitleOrKeywords(keyword string, pageNum, pageSize int, cursor string, highlight, autoCorrect bool) (model.Page, error)
 
-	SearchByProductCategoryId(keyword string, brandId *int64, productCategoryId *int64, pageNum int, pageSize int, sort int) (model.Page, error)
+	// SearchByCriteria searches by keyword and filters by the other criteria
+	SearchByCriteria(criteria model.SearchCriteria) (model.Page, error)
 
 	// recommend products based on product id
-	Recommend(id int64, pageNum int, pageSize int) (model.Page, error)
+	Recommend(id int64, pageNum int, pageSize int, cursor string) (model.Page, error)
+
+	// Export passes every product matching the criteria to fn in batches, ignoring paging, facets and highlight
+	Export(ctx context.Context, criteria model.SearchCriteria, fn func([]model.EsProduct) error) error
 
 	// SearchRelated products based on keyword
 	SearchRelated(keyword string) (model.EsProductRelatedInfo, error)
+
+	// Suggest returns completions for prefix, limited to one category if categoryId is not nil.
+	// It returns no suggestions instead of an error when Elasticsearch does not answer within search.suggest.timeout
+	Suggest(prefix string, categoryId *int64, size int) ([]model.Suggestion, error)
+
+	// Generations lists the index generations behind the alias, newest first
+	Generations(ctx context.Context) ([]model.IndexGeneration, error)
+
+	// Rollback switches the alias back to the previous index generation, keeping the active synonyms.
+	// Synonym changes also create generations, so rolling back an import made before one takes two steps
+	Rollback(ctx context.Context) (string, error)
+
+	// PruneGenerations deletes the generations older than the active one beyond search.reindex.retain
+	PruneGenerations(ctx context.Context)
+
+	// MappingDrift reports fields whose mapping differs from the managed index template
+	MappingDrift(ctx context.Context) ([]model.MappingDrift, error)
 }
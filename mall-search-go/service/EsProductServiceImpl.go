@@ -1,50 +1,229 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"gorm.io/driver/mysql"
-	"gorm.io/gorm"
+	"log"
+	"sync"
+	"time"
+
 	"mall-search-go/config"
 	"mall-search-go/model"
 	"mall-search-go/repository"
 	"mall-search-go/store"
 )
 
+// ErrProductNotFound 表示数据库中没有这个商品，或者商品已删除、未上架
+var ErrProductNotFound = errors.New("product not found")
+
+// ChangeLog 是增量同步的进度，cdc.Syncer 满足这个接口。增量同步写入的是别名，
+// 全量导入期间的变更只进入旧索引，切换别名后需要从导入开始时的位置重放
+type ChangeLog interface {
+	Mark() model.BinlogPosition
+	Replay(from model.BinlogPosition)
+}
+
 type EsProductServiceImpl struct {
 	prouductDao store.EsproductDao
 	elasticRepo repository.EsProductRepository
+	// changes 在没有开启增量同步时为 nil
+	changes ChangeLog
+
+	mu     sync.RWMutex
+	config config.SearchConfig
+}
+
+// NewEsProductServiceImpl 创建 service，changes 可以为 nil
+func NewEsProductServiceImpl(productDao store.EsproductDao, elasticRepo repository.EsProductRepository, changes ChangeLog, cfg config.SearchConfig) EsProductService {
+	return &EsProductServiceImpl{prouductDao: productDao, elasticRepo: elasticRepo, changes: changes, config: cfg}
+}
+
+// UpdateConfig 替换导入使用的配置，配置中心推送新配置时调用，对进行中的导入不生效
+func (s *EsProductServiceImpl) UpdateConfig(cfg config.SearchConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = cfg
 }
 
-func NewEsProductServiceImpl() EsProductService {
-	//dsn := "root:root@tcp(localhost:3306)/dbname?charset=utf8mb4&parseTime=True&loc=Local"
-	db, err := gorm.Open(mysql.Open(config.Dsn), &gorm.Config{})
+func (s *EsProductServiceImpl) settings() config.SearchConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// cleanupTimeout 是导入被取消后删除半成品索引、等待剩余批次可以使用的时间
+const cleanupTimeout = 30 * time.Second
+
+// ImportAll 按主键分页读取商品并流式写入新一代索引，全部写入成功且文档数与读到的商品数一致后再切换别名，
+// 导入失败或被取消时线上索引不受影响，新建的索引会被删除。切换别名后让增量同步重放导入期间的变更。progress 可以为 nil
+func (s *EsProductServiceImpl) ImportAll(ctx context.Context, progress func(model.ImportProgress)) (model.ImportReport, error) {
+	if progress == nil {
+		progress = func(model.ImportProgress) {}
+	}
+	state := model.ImportProgress{Phase: model.JobPreparing}
+	progress(state)
+
+	//总数只用于展示进度，统计失败不影响导入
+	if total, err := s.prouductDao.CountProducts(); err == nil {
+		state.Total = total
+	}
+	//在读取数据库之前记下增量同步的位置，这之后的变更可能没有被导入读到
+	var mark model.BinlogPosition
+	if s.changes != nil {
+		mark = s.changes.Mark()
+	}
+	index, err := s.elasticRepo.CreateGeneration(ctx)
+	if errors.Is(err, model.ErrGenerationExists) {
+		//另一个实例的导入在同一毫秒创建了同名索引，不能写入别人正在导入的索引
+		return model.ImportReport{}, fmt.Errorf("%w: %v", ErrImportRunning, err)
+	}
+	if err != nil {
+		return model.ImportReport{}, err
+	}
+	writer, err := s.elasticRepo.NewBulkWriter(index)
 	if err != nil {
-		fmt.Println(err.Error())
+		return model.ImportReport{Index: index}, s.discardGeneration(ctx, index, err)
+	}
+	state.Phase = model.JobIndexing
+	state.Index = index
+	progress(state)
+
+	err = s.prouductDao.IterateProducts(ctx, s.settings().Bulk.BatchSize, func(products []model.EsProduct) error {
+		for _, product := range products {
+			if err := writer.Add(ctx, product); err != nil {
+				return err
+			}
+		}
+		state.Processed += len(products)
+		progress(state)
 		return nil
+	})
+	closeCtx, cancel := cleanupContext(ctx)
+	report, closeErr := writer.Close(closeCtx)
+	cancel()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return report, s.discardGeneration(ctx, index, err)
+	}
+	if report.Failed > 0 {
+		return report, s.discardGeneration(ctx, index, fmt.Errorf("%d products failed to index", report.Failed))
+	}
+
+	state.Phase = model.JobVerifying
+	progress(state)
+	//与导入实际读到的商品数比较，而不是重新统计数据库：导入期间上架或删除的商品会让两者不同，
+	//这些变更由切换别名后的重放补上
+	indexed, err := s.elasticRepo.CountDocuments(ctx, index)
+	if err != nil {
+		return report, s.discardGeneration(ctx, index, err)
 	}
+	if indexed != state.Processed {
+		return report, s.discardGeneration(ctx, index, fmt.Errorf("index %s has %d documents but the import read %d products", index, indexed, state.Processed))
+	}
+
+	state.Phase = model.JobSwitching
+	progress(state)
+	if err := s.elasticRepo.SwapAlias(ctx, index); err != nil {
+		return report, s.discardGeneration(ctx, index, err)
+	}
+	if s.changes != nil {
+		s.changes.Replay(mark)
+	}
+	s.PruneGenerations(ctx)
+	return report, nil
+}
 
-	return &EsProductServiceImpl{prouductDao: store.NewEsProductDao(db), elasticRepo: repository.Repo}
+func (s *EsProductServiceImpl) discardGeneration(ctx context.Context, index string, cause error) error {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	if err := s.elasticRepo.DeleteIndex(ctx, index); err != nil {
+		log.Printf("Error deleting failed generation %s: %s", index, err)
+	}
+	return cause
+}
+
+// cleanupContext 在 ctx 已经被取消时换成一个新的限时 context，保证收尾工作仍然能完成
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Err() == nil {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(context.Background(), cleanupTimeout)
 }
 
-func (s *EsProductServiceImpl) ImportAll() (int, error) {
-	esProductList, err := s.prouductDao.GetAllProductList(nil)
+// PruneGenerations 删除比当前索引更旧、且超出保留代数的索引，全量导入和修改同义词切换别名后调用
+func (s *EsProductServiceImpl) PruneGenerations(ctx context.Context) {
+	generations, err := s.elasticRepo.Generations(ctx)
 	if err != nil {
-		return 0, err
+		log.Printf("Error listing index generations: %s", err)
+		return
 	}
-	num, err := s.elasticRepo.SaveAll(esProductList)
+	older := 0
+	activeSeen := false
+	for _, g := range generations {
+		if g.Active {
+			activeSeen = true
+			continue
+		}
+		if !activeSeen {
+			continue
+		}
+		older++
+		if older > s.settings().Reindex.Retain {
+			if err := s.elasticRepo.DeleteIndex(ctx, g.Name); err != nil {
+				log.Printf("Error deleting old generation %s: %s", g.Name, err)
+			}
+		}
+	}
+}
+
+func (s *EsProductServiceImpl) Generations(ctx context.Context) ([]model.IndexGeneration, error) {
+	return s.elasticRepo.Generations(ctx)
+}
+
+// Rollback 把别名切回当前索引之前的一代。回滚只撤销导入，同义词保持线上的版本：
+// 之前的一代可能是修改同义词之前建的，切换前先把线上的同义词写入它
+func (s *EsProductServiceImpl) Rollback(ctx context.Context) (string, error) {
+	generations, err := s.elasticRepo.Generations(ctx)
 	if err != nil {
-		return 0, err
+		return "", err
 	}
-	return num, nil
+	for i, g := range generations {
+		if !g.Active {
+			continue
+		}
+		if i+1 >= len(generations) {
+			break
+		}
+		previous := generations[i+1].Name
+		if err := s.elasticRepo.CopySynonyms(ctx, previous); err != nil {
+			return previous, err
+		}
+		return previous, s.elasticRepo.SwapAlias(ctx, previous)
+	}
+	return "", errors.New("no previous index generation to roll back to")
 }
 
 func (s *EsProductServiceImpl) Create(id int64) (*model.EsProduct, error) {
-	product, err := s.prouductDao.GetAllProductList(&id)
+	product, err := s.product(id)
 	if err != nil {
 		return nil, err
 	}
+	return s.elasticRepo.Save(&product)
+}
 
-	return s.elasticRepo.Save(&product[0])
+// product 返回可以搜索的商品，不存在、已删除或未上架时返回 ErrProductNotFound
+func (s *EsProductServiceImpl) product(id int64) (model.EsProduct, error) {
+	products, err := s.prouductDao.GetAllProductList(&id)
+	if err != nil {
+		return model.EsProduct{}, err
+	}
+	if len(products) == 0 {
+		return model.EsProduct{}, fmt.Errorf("%w: %d", ErrProductNotFound, id)
+	}
+	return products[0], nil
 }
 
 func (s *EsProductServiceImpl) Delete(id int64) error {
@@ -58,25 +237,105 @@ func (s *EsProductServiceImpl) DeleteBatch(ids []int64) error {
 	return s.elasticRepo.DeletaBatch(ids)
 }
 
-func (s *EsProductServiceImpl) SearchByNameOrSubTitleOrKeywords(keyword string, pageNum, pageSize int) (model.Page, error) {
-	return s.elasticRepo.Search(keyword, pageNum, pageSize)
+func (s *EsProductServiceImpl) SearchByNameOrSubTitleOrKeywords(keyword string, pageNum, pageSize int, cursor string, highlight, autoCorrect bool) (model.Page, error) {
+	page, err := s.elasticRepo.Search(keyword, pageNum, pageSize, cursor, highlight)
+	//翻到后面的页时已经在第一页提示过纠正后的搜索词
+	if err != nil || keyword == "" || cursor != "" || page.PageInfo.TotalElements >= s.settings().Spelling.MinHits {
+		return page, err
+	}
+	//纠错失败不影响已经得到的结果
+	suggestion, err := s.elasticRepo.Correct(keyword)
+	if err != nil {
+		log.Printf("Error correcting keyword %q: %s", keyword, err)
+		return page, nil
+	}
+	if suggestion == "" {
+		return page, nil
+	}
+	page.Suggestion = suggestion
+	if !autoCorrect {
+		return page, nil
+	}
+	corrected, err := s.elasticRepo.Search(suggestion, pageNum, pageSize, "", highlight)
+	if err != nil {
+		return model.Page{}, err
+	}
+	//纠正后的结果不比原来多时保留原来的结果，只提示纠正后的搜索词
+	if corrected.PageInfo.TotalElements <= page.PageInfo.TotalElements {
+		return page, nil
+	}
+	corrected.Suggestion, corrected.Corrected = suggestion, true
+	return corrected, nil
 }
 
-func (s *EsProductServiceImpl) SearchByProductCategoryId(keyword string, brandId *int64, productCategoryId *int64, pageNum int, pageSize int, sort int) (model.Page, error) {
-	return s.elasticRepo.SearchById(keyword, brandId, productCategoryId, pageNum, pageSize, sort)
+func (s *EsProductServiceImpl) SearchByCriteria(criteria model.SearchCriteria) (model.Page, error) {
+	if err := criteria.Validate(); err != nil {
+		return model.Page{}, err
+	}
+	return s.elasticRepo.SearchByCriteria(criteria)
 }
 
-func (s *EsProductServiceImpl) Recommend(id int64, pageNum int, pageSize int) (model.Page, error) {
-	var result model.Page
-
-	product, err := s.prouductDao.GetAllProductList(&id)
+func (s *EsProductServiceImpl) Recommend(id int64, pageNum int, pageSize int, cursor string) (model.Page, error) {
+	product, err := s.product(id)
 	if err != nil {
-		return result, err
+		return model.Page{}, err
 	}
+	return s.elasticRepo.Recommend(id, product, pageNum, pageSize, cursor)
+}
 
-	return s.elasticRepo.Recommend(id, product[0], pageNum, pageSize)
+func (s *EsProductServiceImpl) Export(ctx context.Context, criteria model.SearchCriteria, fn func([]model.EsProduct) error) error {
+	if err := criteria.Validate(); err != nil {
+		return err
+	}
+	return s.elasticRepo.Export(ctx, criteria, fn)
 }
 
+// SearchRelated 只返回可以用来筛选的属性，属性名和展示样式以 pms_product_attribute 为准
 func (s *EsProductServiceImpl) SearchRelated(keyword string) (model.EsProductRelatedInfo, error) {
-	return s.elasticRepo.SearchRelated(keyword)
+	attrs, err := s.prouductDao.GetFilterableAttributes(context.Background())
+	if err != nil {
+		return model.EsProductRelatedInfo{}, err
+	}
+	byId := make(map[int64]model.ProductAttribute, len(attrs))
+	ids := make([]int64, len(attrs))
+	for i, attr := range attrs {
+		byId[attr.ID] = attr
+		ids[i] = attr.ID
+	}
+
+	info, err := s.elasticRepo.SearchRelated(keyword, ids)
+	if err != nil {
+		return info, err
+	}
+	filterable := info.ProductAttrs[:0]
+	for _, attr := range info.ProductAttrs {
+		a, ok := byId[attr.AttrId]
+		if !ok {
+			continue
+		}
+		attr.AttrName, attr.FilterType = a.Name, a.FilterType
+		filterable = append(filterable, attr)
+	}
+	info.ProductAttrs = filterable
+	return info, nil
+}
+
+// Suggest 限制提示数和等待时间，输入提示随用户每次按键发出，慢的结果已经没有用了
+func (s *EsProductServiceImpl) Suggest(prefix string, categoryId *int64, size int) ([]model.Suggestion, error) {
+	cfg := s.settings().Suggest
+	if size <= 0 || size > cfg.Size {
+		size = cfg.Size
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	suggestions, err := s.elasticRepo.Suggest(ctx, prefix, categoryId, size)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Suggest %q timed out after %s", prefix, cfg.Timeout)
+		return []model.Suggestion{}, nil
+	}
+	return suggestions, err
+}
+
+func (s *EsProductServiceImpl) MappingDrift(ctx context.Context) ([]model.MappingDrift, error) {
+	return s.elasticRepo.MappingDrift(ctx)
 }
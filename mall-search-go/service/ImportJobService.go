@@ -0,0 +1,308 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"mall-search-go/model"
+	"mall-search-go/store"
+)
+
+// ErrImportRunning 表示已经有一个全量导入在运行，同一时间只允许一个
+var ErrImportRunning = errors.New("a full import is already running")
+
+// ErrJobFinished 表示要取消的任务已经结束
+var ErrJobFinished = errors.New("import job has already finished")
+
+// progressSaveInterval 限制运行中的任务把进度写回数据库的频率，阶段变化时总是立即写入
+const progressSaveInterval = time.Second
+
+// lockCheckInterval 是运行中的任务确认导入锁仍然有效的间隔，锁随连接断开而失效时任务失败，
+// 避免和之后在其他实例上开始的导入同时写入
+const lockCheckInterval = 10 * time.Second
+
+type ImportJobService interface {
+	// Start 在后台开始一次全量导入并立即返回任务，这个或其他实例上已有导入在运行时返回 ErrImportRunning 和那个任务
+	Start() (model.ImportJob, error)
+
+	// Get returns the job, with live progress if it is the running one
+	Get(id int64) (model.ImportJob, error)
+
+	// List returns the most recent jobs, newest first
+	List(limit int) ([]model.ImportJob, error)
+
+	// Cancel cancels the running job through its context; the job becomes CANCELLED once the import has cleaned up
+	Cancel(id int64) (model.ImportJob, error)
+
+	// Shutdown interrupts the running job, if any, and waits for it to finish or for ctx to end
+	Shutdown(ctx context.Context) error
+}
+
+type ImportJobServiceImpl struct {
+	products EsProductService
+	jobs     store.ImportJobDao
+	// lock 保证所有实例中同一时间只有一个导入，任务运行期间一直持有
+	lock store.DbLock
+
+	mu      sync.Mutex
+	running *runningJob
+}
+
+type runningJob struct {
+	job       model.ImportJob
+	cancel    context.CancelFunc
+	done      chan struct{}
+	cancelled bool
+	stopping  bool
+	lockLost  bool
+	savedAt   time.Time
+}
+
+// NewImportJobServiceImpl 创建导入任务服务，lock 为 nil 时只在这个实例内保证同一时间只有一个导入
+func NewImportJobServiceImpl(products EsProductService, jobs store.ImportJobDao, lock store.DbLock) ImportJobService {
+	return &ImportJobServiceImpl{products: products, jobs: jobs, lock: lock}
+}
+
+func (s *ImportJobServiceImpl) Start() (model.ImportJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running != nil {
+		return s.running.job, ErrImportRunning
+	}
+	if err := s.acquire(); err != nil {
+		return s.unfinished(err)
+	}
+
+	job := model.ImportJob{Phase: model.JobPreparing, Failures: []model.ImportFailure{}}
+	if err := s.jobs.Create(&job); err != nil {
+		s.release()
+		return job, err
+	}
+	//任务不属于发起它的 HTTP 请求，请求结束后继续运行，只能通过 Cancel/Shutdown 取消
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runningJob{job: job, cancel: cancel, done: make(chan struct{}), savedAt: time.Now()}
+	s.running = r
+	go s.run(ctx, r)
+	log.Printf("Started import job %d", job.ID)
+	return job, nil
+}
+
+// acquire 获取导入锁，其他实例正在导入时返回 ErrImportRunning。
+// 拿到锁说明没有实例在导入，之前没有结束的任务属于已经退出的实例，把它们标记为 INTERRUPTED
+func (s *ImportJobServiceImpl) acquire() error {
+	if s.lock == nil {
+		return nil
+	}
+	ok, err := s.lock.TryLock(context.Background())
+	if err != nil {
+		return fmt.Errorf("acquire import lock: %w", err)
+	}
+	if !ok {
+		return ErrImportRunning
+	}
+	interrupted, err := s.jobs.InterruptUnfinished()
+	if err != nil {
+		s.release()
+		return err
+	}
+	if interrupted > 0 {
+		log.Printf("Marked %d import jobs left by stopped instances as interrupted", interrupted)
+	}
+	return nil
+}
+
+// unfinished 在 err 是 ErrImportRunning 时带上其他实例正在运行的任务，没有任务时锁被同义词修改占用
+func (s *ImportJobServiceImpl) unfinished(err error) (model.ImportJob, error) {
+	if !errors.Is(err, ErrImportRunning) {
+		return model.ImportJob{}, err
+	}
+	job, getErr := s.jobs.Unfinished()
+	if errors.Is(getErr, store.ErrJobNotFound) {
+		return job, fmt.Errorf("%w: the index is being rebuilt for a synonym change", err)
+	}
+	if getErr != nil {
+		return job, getErr
+	}
+	return job, err
+}
+
+func (s *ImportJobServiceImpl) release() {
+	if s.lock == nil {
+		return
+	}
+	if err := s.lock.Unlock(); err != nil {
+		log.Printf("Error releasing import lock: %s", err)
+	}
+}
+
+// watchLock 每隔 lockCheckInterval 确认导入锁仍然有效，失效时取消任务
+func (s *ImportJobServiceImpl) watchLock(ctx context.Context, r *runningJob) {
+	ticker := time.NewTicker(lockCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		held, err := s.lock.Held(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && held {
+			continue
+		}
+		log.Printf("Import lock is no longer held (%v), stopping import job %d", err, r.job.ID)
+		s.mu.Lock()
+		r.lockLost = true
+		s.mu.Unlock()
+		r.cancel()
+		return
+	}
+}
+
+func (s *ImportJobServiceImpl) run(ctx context.Context, r *runningJob) {
+	defer close(r.done)
+	defer r.cancel()
+	if s.lock != nil {
+		go s.watchLock(ctx, r)
+	}
+
+	report, err := s.products.ImportAll(ctx, func(p model.ImportProgress) {
+		s.mu.Lock()
+		phaseChanged := r.job.Phase != p.Phase
+		r.job.Phase = p.Phase
+		r.job.Index = p.Index
+		r.job.Processed = p.Processed
+		r.job.Total = p.Total
+		save := phaseChanged || time.Since(r.savedAt) >= progressSaveInterval
+		if save {
+			r.savedAt = time.Now()
+		}
+		job := r.job
+		s.mu.Unlock()
+
+		if save {
+			s.save(&job)
+		}
+	})
+
+	s.mu.Lock()
+	now := time.Now()
+	r.job.Indexed = report.Indexed
+	r.job.Failed = report.Failed
+	if report.Failures != nil {
+		r.job.Failures = report.Failures
+	}
+	if report.Index != "" {
+		r.job.Index = report.Index
+	}
+	r.job.FinishedAt = &now
+	switch {
+	case err == nil:
+		r.job.Phase = model.JobSucceeded
+	case r.stopping:
+		r.job.Phase = model.JobInterrupted
+		r.job.Error = err.Error()
+	case r.lockLost:
+		r.job.Phase = model.JobFailed
+		r.job.Error = "lost the import lock: " + err.Error()
+	case r.cancelled:
+		r.job.Phase = model.JobCancelled
+		r.job.Error = err.Error()
+	default:
+		r.job.Phase = model.JobFailed
+		r.job.Error = err.Error()
+	}
+	job := r.job
+	s.mu.Unlock()
+
+	//保存结果之后才释放锁，下一个拿到锁的实例不会把这个任务当作没有结束
+	s.save(&job)
+	s.release()
+	s.mu.Lock()
+	s.running = nil
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Import job %d %s: %s", job.ID, job.Phase, err)
+	} else {
+		log.Printf("Import job %d finished: %d products indexed into %s", job.ID, job.Indexed, job.Index)
+	}
+}
+
+// save 写入任务状态，数据库暂时不可用时只记录日志，内存中的进度仍然可以查询
+func (s *ImportJobServiceImpl) save(job *model.ImportJob) {
+	if err := s.jobs.Save(job); err != nil {
+		log.Printf("Error saving import job %d: %s", job.ID, err)
+	}
+}
+
+func (s *ImportJobServiceImpl) Get(id int64) (model.ImportJob, error) {
+	s.mu.Lock()
+	if s.running != nil && s.running.job.ID == id {
+		job := s.running.job
+		s.mu.Unlock()
+		return job, nil
+	}
+	s.mu.Unlock()
+	return s.jobs.Get(id)
+}
+
+func (s *ImportJobServiceImpl) List(limit int) ([]model.ImportJob, error) {
+	jobs, err := s.jobs.List(limit)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range jobs {
+		if s.running != nil && jobs[i].ID == s.running.job.ID {
+			jobs[i] = s.running.job
+		}
+	}
+	return jobs, nil
+}
+
+func (s *ImportJobServiceImpl) Cancel(id int64) (model.ImportJob, error) {
+	s.mu.Lock()
+	if s.running != nil && s.running.job.ID == id {
+		s.running.cancelled = true
+		s.running.cancel()
+		job := s.running.job
+		s.mu.Unlock()
+		log.Printf("Cancelling import job %d", id)
+		return job, nil
+	}
+	s.mu.Unlock()
+
+	job, err := s.jobs.Get(id)
+	if err != nil {
+		return job, err
+	}
+	return job, fmt.Errorf("%w: job %d is %s", ErrJobFinished, id, job.Phase)
+}
+
+func (s *ImportJobServiceImpl) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	r := s.running
+	if r != nil {
+		r.stopping = true
+		r.cancel()
+	}
+	s.mu.Unlock()
+	if r == nil {
+		return nil
+	}
+
+	log.Printf("Interrupting import job %d", r.job.ID)
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"mall-search-go/model"
+	"mall-search-go/repository"
+	"mall-search-go/store"
+)
+
+// ErrSynonymRuleNotFound 表示当前版本中没有这条同义词规则或停用词
+var ErrSynonymRuleNotFound = errors.New("synonym rule not found")
+
+// ErrSynonymConflict 表示修改期间另一个请求（可能来自另一个实例）已经保存了新版本，需要基于最新版本重新修改
+var ErrSynonymConflict = errors.New("synonyms were changed by another request, reload and try again")
+
+// ErrSynonymBusy 表示某个实例正在全量导入或修改同义词，两者都会新建一代索引并切换别名，不能同时进行
+var ErrSynonymBusy = errors.New("a full import or another synonym change is running, try again later")
+
+type SynonymService interface {
+	// Current returns the latest version, which is the one applied to the index
+	// once the change that saved it has finished
+	Current() (model.SynonymVersion, error)
+
+	// Versions returns the most recent versions, newest first
+	Versions(limit int) ([]model.SynonymVersion, error)
+
+	// AddRule, UpdateRule and DeleteRule change one synonym rule, AddStopWord and DeleteStopWord one stop word.
+	// Each change is saved as a new version first and then applied to the index
+	AddRule(ctx context.Context, rule string) (model.SynonymVersion, error)
+	UpdateRule(ctx context.Context, id int64, rule string) (model.SynonymVersion, error)
+	DeleteRule(ctx context.Context, id int64) (model.SynonymVersion, error)
+	AddStopWord(ctx context.Context, word string) (model.SynonymVersion, error)
+	DeleteStopWord(ctx context.Context, word string) (model.SynonymVersion, error)
+
+	// Rollback applies the rules and stop words of an earlier version and saves them as a new version
+	Rollback(ctx context.Context, version int64) (model.SynonymVersion, error)
+}
+
+type SynonymServiceImpl struct {
+	dao         store.SynonymDao
+	products    EsProductService
+	elasticRepo repository.EsProductRepository
+	// changes 为 nil 表示没有开启增量同步
+	changes ChangeLog
+	// lock 是全量导入使用的锁。修改同义词和导入都从线上索引出发新建一代索引再切换别名，
+	// 同时进行时后切换的一方会覆盖另一方：导入复制的是开始时的同义词，修改同义词复制的是导入之前的文档
+	lock store.DbLock
+
+	//同一进程内的修改排队执行；多个实例之间由数据库中版本号的唯一性保证不会丢失修改，见 change
+	mu sync.Mutex
+}
+
+// NewSynonymServiceImpl 创建同义词服务，products 用来按保留代数清理被替换的索引。
+// lock 应该与 ImportJobService 使用同一个，为 nil 时不与导入互斥
+func NewSynonymServiceImpl(dao store.SynonymDao, products EsProductService, elasticRepo repository.EsProductRepository, changes ChangeLog, lock store.DbLock) SynonymService {
+	return &SynonymServiceImpl{dao: dao, products: products, elasticRepo: elasticRepo, changes: changes, lock: lock}
+}
+
+func (s *SynonymServiceImpl) Current() (model.SynonymVersion, error) {
+	return s.dao.Latest()
+}
+
+func (s *SynonymServiceImpl) Versions(limit int) ([]model.SynonymVersion, error) {
+	return s.dao.List(limit)
+}
+
+func (s *SynonymServiceImpl) AddRule(ctx context.Context, rule string) (model.SynonymVersion, error) {
+	rule, err := model.NormalizeSynonymRule(rule)
+	if err != nil {
+		return model.SynonymVersion{}, err
+	}
+	return s.change(ctx, func(v *model.SynonymVersion) error {
+		id := v.NextRuleID()
+		v.Rules = append(v.Rules, model.SynonymRule{ID: id, Rule: rule})
+		v.Comment = fmt.Sprintf("add rule %d: %s", id, rule)
+		return nil
+	})
+}
+
+func (s *SynonymServiceImpl) UpdateRule(ctx context.Context, id int64, rule string) (model.SynonymVersion, error) {
+	rule, err := model.NormalizeSynonymRule(rule)
+	if err != nil {
+		return model.SynonymVersion{}, err
+	}
+	return s.change(ctx, func(v *model.SynonymVersion) error {
+		for i := range v.Rules {
+			if v.Rules[i].ID == id {
+				v.Rules[i].Rule = rule
+				v.Comment = fmt.Sprintf("update rule %d: %s", id, rule)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %d", ErrSynonymRuleNotFound, id)
+	})
+}
+
+func (s *SynonymServiceImpl) DeleteRule(ctx context.Context, id int64) (model.SynonymVersion, error) {
+	return s.change(ctx, func(v *model.SynonymVersion) error {
+		for i, r := range v.Rules {
+			if r.ID == id {
+				v.Rules = append(v.Rules[:i], v.Rules[i+1:]...)
+				v.Comment = fmt.Sprintf("delete rule %d: %s", id, r.Rule)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %d", ErrSynonymRuleNotFound, id)
+	})
+}
+
+func (s *SynonymServiceImpl) AddStopWord(ctx context.Context, word string) (model.SynonymVersion, error) {
+	word, err := model.NormalizeStopWord(word)
+	if err != nil {
+		return model.SynonymVersion{}, err
+	}
+	return s.change(ctx, func(v *model.SynonymVersion) error {
+		for _, w := range v.StopWords {
+			if w == word {
+				return fmt.Errorf("%w: stop word %q already exists", model.ErrInvalidSynonym, word)
+			}
+		}
+		v.StopWords = append(v.StopWords, word)
+		v.Comment = "add stop word " + word
+		return nil
+	})
+}
+
+func (s *SynonymServiceImpl) DeleteStopWord(ctx context.Context, word string) (model.SynonymVersion, error) {
+	return s.change(ctx, func(v *model.SynonymVersion) error {
+		for i, w := range v.StopWords {
+			if w == word {
+				v.StopWords = append(v.StopWords[:i], v.StopWords[i+1:]...)
+				v.Comment = "delete stop word " + word
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: stop word %q", ErrSynonymRuleNotFound, word)
+	})
+}
+
+func (s *SynonymServiceImpl) Rollback(ctx context.Context, version int64) (model.SynonymVersion, error) {
+	target, err := s.dao.Get(version)
+	if err != nil {
+		return model.SynonymVersion{}, err
+	}
+	return s.change(ctx, func(v *model.SynonymVersion) error {
+		v.Rules, v.StopWords = target.Rules, target.StopWords
+		v.Comment = fmt.Sprintf("roll back to version %d", version)
+		return nil
+	})
+}
+
+// change 在最新版本的副本上执行 edit，先把它保存为新版本占住版本号，再写入索引。新版本号固定为最新版本号加一，
+// 另一个实例已经保存了这个版本号时返回 ErrSynonymConflict，索引不会被修改；写入索引失败时删除这个版本。
+//
+// 每次修改都整体重建一代索引而不是修改线上索引的设置：分析器设置只能在索引关闭时修改，关闭线上索引期间搜索和增量同步都会失败；
+// ES 的 updateable 同义词只能从节点上的文件读取，不能用保存在数据库中的规则；_clone 要求源索引只读，同样会让增量写入失败
+func (s *SynonymServiceImpl) change(ctx context.Context, edit func(*model.SynonymVersion) error) (model.SynonymVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lock != nil {
+		ok, err := s.lock.TryLock(ctx)
+		if err != nil {
+			return model.SynonymVersion{}, fmt.Errorf("acquire import lock: %w", err)
+		}
+		if !ok {
+			return model.SynonymVersion{}, ErrSynonymBusy
+		}
+		defer func() {
+			if err := s.lock.Unlock(); err != nil {
+				log.Printf("Error releasing import lock: %s", err)
+			}
+		}()
+	}
+
+	current, err := s.dao.Latest()
+	if err != nil {
+		return model.SynonymVersion{}, err
+	}
+	next := model.SynonymVersion{
+		ID:        current.ID + 1,
+		Rules:     append([]model.SynonymRule{}, current.Rules...),
+		StopWords: append([]string{}, current.StopWords...),
+	}
+	if err := edit(&next); err != nil {
+		return current, err
+	}
+
+	if err := s.dao.Create(&next); err != nil {
+		if errors.Is(err, store.ErrSynonymVersionExists) {
+			return current, fmt.Errorf("%w: version %d was saved by another request", ErrSynonymConflict, next.ID)
+		}
+		return current, err
+	}
+	//规则无法解析（例如某个词被分词器完全去掉）时 ES 拒绝修改，不保留这个版本
+	if err := s.apply(ctx, next); err != nil {
+		if err := s.dao.Delete(next.ID); err != nil {
+			log.Printf("Error deleting synonym version %d that was not applied: %s", next.ID, err)
+		}
+		return current, err
+	}
+	log.Printf("Synonym version %d: %s", next.ID, next.Comment)
+	return next, nil
+}
+
+// apply 用版本 v 的规则和停用词重建索引。重建时从线上索引复制文档，复制期间的变更写入了被替换的索引，
+// 切换后让增量同步从重建前的位置重放。被替换的一代与导入一样按 search.reindex.retain 保留
+func (s *SynonymServiceImpl) apply(ctx context.Context, v model.SynonymVersion) error {
+	var mark model.BinlogPosition
+	if s.changes != nil {
+		mark = s.changes.Mark()
+	}
+	if err := s.elasticRepo.ApplySynonyms(ctx, v.Synonyms(), v.StopWords); err != nil {
+		return err
+	}
+	if s.changes != nil {
+		s.changes.Replay(mark)
+	}
+	s.products.PruneGenerations(ctx)
+	return nil
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"mall-search-go/model"
+)
+
+type CdcCheckpointDao interface {
+	// Load 返回 name 的检查点，从未保存过时返回 nil
+	Load(name string) (*model.BinlogPosition, error)
+	Save(name string, pos model.BinlogPosition) error
+	// Rewind 把 name 的位置回退到 pos，从未保存过时保存 pos，已经在 pos 之前时不变
+	Rewind(name string, pos model.BinlogPosition) error
+	// Take 返回并删除 name 的位置，从未保存过时返回 nil
+	Take(name string) (*model.BinlogPosition, error)
+}
+
+type CdcCheckpointDaoImpl struct {
+	db *gorm.DB
+}
+
+func NewCdcCheckpointDao(db *gorm.DB) CdcCheckpointDao {
+	return &CdcCheckpointDaoImpl{db: db}
+}
+
+func (d *CdcCheckpointDaoImpl) Load(name string) (*model.BinlogPosition, error) {
+	var checkpoint model.CdcCheckpoint
+	err := d.db.Where("name = ?", name).First(&checkpoint).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &model.BinlogPosition{File: checkpoint.File, Pos: checkpoint.Pos}, nil
+}
+
+func (d *CdcCheckpointDaoImpl) Save(name string, pos model.BinlogPosition) error {
+	checkpoint := model.CdcCheckpoint{Name: name, File: pos.File, Pos: pos.Pos}
+	return d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&checkpoint).Error
+}
+
+func (d *CdcCheckpointDaoImpl) Rewind(name string, pos model.BinlogPosition) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		var checkpoint model.CdcCheckpoint
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", name).First(&checkpoint).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Create(&model.CdcCheckpoint{Name: name, File: pos.File, Pos: pos.Pos}).Error
+		}
+		if err != nil {
+			return err
+		}
+		if !pos.Before(model.BinlogPosition{File: checkpoint.File, Pos: checkpoint.Pos}) {
+			return nil
+		}
+		return tx.Model(&checkpoint).Updates(map[string]interface{}{"file": pos.File, "pos": pos.Pos}).Error
+	})
+}
+
+func (d *CdcCheckpointDaoImpl) Take(name string) (*model.BinlogPosition, error) {
+	var taken *model.BinlogPosition
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		var checkpoint model.CdcCheckpoint
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", name).First(&checkpoint).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&checkpoint).Error; err != nil {
+			return err
+		}
+		taken = &model.BinlogPosition{File: checkpoint.File, Pos: checkpoint.Pos}
+		return nil
+	})
+	return taken, err
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// DbLock 是 MySQL 的命名锁（GET_LOCK），在多个服务实例之间选出唯一的执行者。
+// 锁属于一个单独占用的连接，实例退出或连接断开时由 MySQL 释放，不会因为实例崩溃一直被占用。
+// 锁名前面加上当前库名，同一个 MySQL 上的不同环境互不影响
+type DbLock interface {
+	// TryLock 不等待地获取锁，已经被其他连接（或这个 DbLock 自己）持有时返回 false
+	TryLock(ctx context.Context) (bool, error)
+	// Held 确认锁仍然属于这个 DbLock，连接断开后返回错误
+	Held(ctx context.Context) (bool, error)
+	// Unlock 释放锁并归还连接，没有持有锁时什么都不做
+	Unlock() error
+}
+
+type DbLockImpl struct {
+	db   *gorm.DB
+	name string
+
+	mu   sync.Mutex
+	conn *sql.Conn
+}
+
+func NewDbLock(db *gorm.DB, name string) DbLock {
+	return &DbLockImpl{db: db, name: name}
+}
+
+func (l *DbLockImpl) TryLock(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		return false, nil
+	}
+	sqlDB, err := l.db.DB()
+	if err != nil {
+		return false, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(CONCAT(DATABASE(), '.', ?), 0)", l.name).Scan(&got); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if got.Int64 != 1 {
+		conn.Close()
+		return false, nil
+	}
+	l.conn = conn
+	return true, nil
+}
+
+func (l *DbLockImpl) Held(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return false, nil
+	}
+	var held sql.NullBool
+	err := l.conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(CONCAT(DATABASE(), '.', ?)) = CONNECTION_ID()", l.name).Scan(&held)
+	return held.Bool, err
+}
+
+func (l *DbLockImpl) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	conn := l.conn
+	l.conn = nil
+	if _, err := conn.ExecContext(context.Background(), "DO RELEASE_LOCK(CONCAT(DATABASE(), '.', ?))", l.name); err != nil {
+		//释放失败时丢弃这个连接，连接关闭后 MySQL 会释放锁，不能把持有锁的连接还给连接池
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		conn.Close()
+		return err
+	}
+	return conn.Close()
+}
@@ -1,32 +1,145 @@
 package store
 
 import (
+	"context"
+
 	"gorm.io/gorm"
 	"mall-search-go/model"
 )
 
 type EsproductDao interface {
 	GetAllProductList(id *int64) ([]model.EsProduct, error)
+	// CountProducts 统计可以被搜索的商品数（未删除且已上架）
+	CountProducts() (int, error)
+	// IterateProducts 按主键分页读取可以被搜索的商品，每页调用一次 fn，内存占用与 batchSize 成正比
+	IterateProducts(ctx context.Context, batchSize int, fn func([]model.EsProduct) error) error
+	// GetProducts 返回 ids 中可以被搜索的商品，已删除、已下架或不存在的商品不在结果中
+	GetProducts(ctx context.Context, ids []int64) ([]model.EsProduct, error)
+	// GetFilterableAttributes 返回可以用来筛选商品的属性，即需要检索（search_type 不为 0）的参数
+	GetFilterableAttributes(ctx context.Context) ([]model.ProductAttribute, error)
 }
 
 type EsProductDaoImpl struct {
 	db *gorm.DB
 }
 
+// 与 Java 版 EsProductDao.xml 中 getAllEsProductList 查询的字段一致
+const productColumns = "id, product_sn, brand_id, brand_name, product_category_id, product_category_name, pic, name, sub_title, " +
+	"price, sale, new_status, recommand_status, stock, promotion_type, keywords, sort"
+
+func (e *EsProductDaoImpl) searchable(db *gorm.DB) *gorm.DB {
+	return db.Table("pms_product").Where("delete_status = ? AND publish_status = ?", 0, 1)
+}
+
 func (e *EsProductDaoImpl) GetAllProductList(id *int64) ([]model.EsProduct, error) {
 	var esProducts []model.EsProduct
-	query := e.db.Preload("AttrValueList").Where("delete_status = ? AND publish_status = ?", 0, 1)
+	query := e.searchable(e.db).Select(productColumns)
 
 	if id != nil {
 		query = query.Where("id = ?", *id)
 	}
 
-	err := e.db.Find(&esProducts).Error
+	err := query.Order("id").Find(&esProducts).Error
 	if err != nil {
 		return nil, err
 	}
 
-	return esProducts, err
+	return esProducts, e.attachAttrValues(e.db, esProducts)
+}
+
+func (e *EsProductDaoImpl) CountProducts() (int, error) {
+	var count int64
+	err := e.searchable(e.db).Count(&count).Error
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func (e *EsProductDaoImpl) IterateProducts(ctx context.Context, batchSize int, fn func([]model.EsProduct) error) error {
+	db := e.db.WithContext(ctx)
+	var lastID int64
+	for {
+		var batch []model.EsProduct
+		err := e.searchable(db).Select(productColumns).
+			Where("id > ?", lastID).
+			Order("id").
+			Limit(batchSize).
+			Find(&batch).Error
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := e.attachAttrValues(db, batch); err != nil {
+			return err
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+		lastID = batch[len(batch)-1].ID
+	}
+}
+
+func (e *EsProductDaoImpl) GetProducts(ctx context.Context, ids []int64) ([]model.EsProduct, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	db := e.db.WithContext(ctx)
+	var products []model.EsProduct
+	err := e.searchable(db).Select(productColumns).
+		Where("id IN ?", ids).
+		Order("id").
+		Find(&products).Error
+	if err != nil {
+		return nil, err
+	}
+	return products, e.attachAttrValues(db, products)
+}
+
+// attachAttrValues 一次查询出这批商品的属性值，并关联上属性的名称和类型
+func (e *EsProductDaoImpl) attachAttrValues(db *gorm.DB, products []model.EsProduct) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+
+	var values []model.EsProductAttributeValue
+	err := db.Table("pms_product_attribute_value pav").
+		Select("pav.id, pav.value, pav.product_attribute_id, pav.product_id, pa.type, pa.name").
+		Joins("LEFT JOIN pms_product_attribute pa ON pav.product_attribute_id = pa.id").
+		Where("pav.product_id IN ?", ids).
+		Order("pav.id").
+		Find(&values).Error
+	if err != nil {
+		return err
+	}
+
+	byProduct := make(map[int64][]model.EsProductAttributeValue, len(products))
+	for _, v := range values {
+		byProduct[v.ProductID] = append(byProduct[v.ProductID], v)
+	}
+	for i := range products {
+		products[i].AttrValueList = byProduct[products[i].ID]
+	}
+	return nil
+}
+
+func (e *EsProductDaoImpl) GetFilterableAttributes(ctx context.Context) ([]model.ProductAttribute, error) {
+	var attrs []model.ProductAttribute
+	err := e.db.WithContext(ctx).Table("pms_product_attribute").
+		Select("id, name, type, search_type, filter_type").
+		Where("type = ? AND search_type <> ?", 1, 0).
+		Order("id").
+		Find(&attrs).Error
+	return attrs, err
 }
 
 func NewEsProductDao(db *gorm.DB) EsproductDao {
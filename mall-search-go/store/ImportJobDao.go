@@ -0,0 +1,79 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"mall-search-go/model"
+)
+
+// ErrJobNotFound 表示 es_import_job 中没有这个任务
+var ErrJobNotFound = errors.New("import job not found")
+
+type ImportJobDao interface {
+	Create(job *model.ImportJob) error
+	Save(job *model.ImportJob) error
+	Get(id int64) (model.ImportJob, error)
+	// List 按创建时间从新到旧返回最近的 limit 个任务
+	List(limit int) ([]model.ImportJob, error)
+	// Unfinished 返回最近一个还没有结束的任务，没有时返回 ErrJobNotFound
+	Unfinished() (model.ImportJob, error)
+	// InterruptUnfinished 把运行它的进程已经退出的任务标记为 INTERRUPTED，返回标记的个数。
+	// 调用方必须持有导入锁，否则会把其他实例正在运行的任务也标记掉
+	InterruptUnfinished() (int64, error)
+}
+
+// unfinishedPhases 是任务运行中的阶段
+var unfinishedPhases = []string{model.JobPreparing, model.JobIndexing, model.JobVerifying, model.JobSwitching}
+
+type ImportJobDaoImpl struct {
+	db *gorm.DB
+}
+
+func NewImportJobDao(db *gorm.DB) ImportJobDao {
+	return &ImportJobDaoImpl{db: db}
+}
+
+func (d *ImportJobDaoImpl) Create(job *model.ImportJob) error {
+	return d.db.Create(job).Error
+}
+
+func (d *ImportJobDaoImpl) Save(job *model.ImportJob) error {
+	return d.db.Save(job).Error
+}
+
+func (d *ImportJobDaoImpl) Get(id int64) (model.ImportJob, error) {
+	var job model.ImportJob
+	err := d.db.First(&job, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return job, ErrJobNotFound
+	}
+	return job, err
+}
+
+func (d *ImportJobDaoImpl) List(limit int) ([]model.ImportJob, error) {
+	jobs := []model.ImportJob{}
+	err := d.db.Order("id DESC").Limit(limit).Find(&jobs).Error
+	return jobs, err
+}
+
+func (d *ImportJobDaoImpl) Unfinished() (model.ImportJob, error) {
+	var job model.ImportJob
+	err := d.db.Where("phase IN ?", unfinishedPhases).Order("id DESC").First(&job).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return job, ErrJobNotFound
+	}
+	return job, err
+}
+
+func (d *ImportJobDaoImpl) InterruptUnfinished() (int64, error) {
+	res := d.db.Model(&model.ImportJob{}).
+		Where("phase IN ?", unfinishedPhases).
+		Updates(map[string]interface{}{
+			"phase":       model.JobInterrupted,
+			"error":       "the service stopped while the job was running",
+			"finished_at": time.Now(),
+		})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+	"mall-search-go/model"
+)
+
+// ErrSynonymVersionNotFound 表示 es_synonym_version 中没有这个版本
+var ErrSynonymVersionNotFound = errors.New("synonym version not found")
+
+// ErrSynonymVersionExists 表示要写入的版本号已经被另一个修改占用
+var ErrSynonymVersionExists = errors.New("synonym version already exists")
+
+// mysqlDuplicateEntry 是主键或唯一索引冲突的错误码 ER_DUP_ENTRY
+const mysqlDuplicateEntry = 1062
+
+type SynonymDao interface {
+	// Latest 返回最新的版本，还没有任何版本时返回版本号为 0 的空版本
+	Latest() (model.SynonymVersion, error)
+	Get(version int64) (model.SynonymVersion, error)
+	// List 按版本号从新到旧返回最近的 limit 个版本
+	List(limit int) ([]model.SynonymVersion, error)
+	// Create 写入一个新版本，版本号由调用方指定为基于的版本号加一。版本号是主键，
+	// 两个修改基于同一个版本时只有一个能写入，另一个返回 ErrSynonymVersionExists
+	Create(version *model.SynonymVersion) error
+	// Delete 删除写入索引失败的版本
+	Delete(version int64) error
+}
+
+type SynonymDaoImpl struct {
+	db *gorm.DB
+}
+
+func NewSynonymDao(db *gorm.DB) SynonymDao {
+	return &SynonymDaoImpl{db: db}
+}
+
+func (d *SynonymDaoImpl) Latest() (model.SynonymVersion, error) {
+	var version model.SynonymVersion
+	err := d.db.Order("id DESC").First(&version).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return model.SynonymVersion{}, nil
+	}
+	return version, err
+}
+
+func (d *SynonymDaoImpl) Get(id int64) (model.SynonymVersion, error) {
+	var version model.SynonymVersion
+	err := d.db.First(&version, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return version, ErrSynonymVersionNotFound
+	}
+	return version, err
+}
+
+func (d *SynonymDaoImpl) List(limit int) ([]model.SynonymVersion, error) {
+	versions := []model.SynonymVersion{}
+	err := d.db.Order("id DESC").Limit(limit).Find(&versions).Error
+	return versions, err
+}
+
+func (d *SynonymDaoImpl) Create(version *model.SynonymVersion) error {
+	err := d.db.Create(version).Error
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+		return ErrSynonymVersionExists
+	}
+	return err
+}
+
+func (d *SynonymDaoImpl) Delete(id int64) error {
+	return d.db.Delete(&model.SynonymVersion{}, id).Error
+}
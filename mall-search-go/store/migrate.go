@@ -0,0 +1,20 @@
+package store
+
+import (
+	"gorm.io/gorm"
+	"mall-search-go/model"
+)
+
+// Migrate 创建 Go 版 mall-search 自己的表（es_import_job、es_cdc_checkpoint、es_synonym_version）中不存在的那些。
+// 已经存在的表不会被修改，生产环境的只读账号可以由 DBA 预先执行 document/sql/mall-search.sql 建表
+func Migrate(db *gorm.DB) error {
+	for _, table := range []interface{}{&model.ImportJob{}, &model.CdcCheckpoint{}, &model.SynonymVersion{}} {
+		if db.Migrator().HasTable(table) {
+			continue
+		}
+		if err := db.Migrator().CreateTable(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}